@@ -11,10 +11,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/tx"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
 	"github.com/getmeemaw/meemaw/utils/types"
 	"github.com/getmeemaw/meemaw/utils/ws"
 	"github.com/google/uuid"
@@ -30,9 +33,51 @@ func Identify(host, authData string) (string, error) {
 	return getDataFromServer(host, authData, "", "/identify")
 }
 
-// Dkg performs the full dkg process on the client side
+// DkgOptions defines the wallet created by DkgWithOptions
+type DkgOptions struct {
+	Threshold int    // number of peers required to sign, server included (default 2)
+	Devices   int    // number of devices taking part in the dkg, this device included (default 1)
+	Scheme    string // signature scheme, see tss.Scheme (default ECDSA on secp256k1)
+}
+
+// Dkg performs the full dkg process on the client side, creating an ECDSA wallet with the server and this device only (2-of-2)
 // Requires authData (to confirm authorization and identify user) and host
 func Dkg(host, authData string) (*tss.DkgResult, string, error) {
+	return DkgWithOptions(host, authData, DkgOptions{})
+}
+
+// DkgWithOptions performs the full dkg process on the client side, creating a wallet of the given scheme shared by the server and the given number of devices, requiring threshold of them (server included) to sign.
+// Except for this device, the devices need to join the dkg through JoinDkg
+// Requires authData (to confirm authorization and identify user) and host
+func DkgWithOptions(host, authData string, options DkgOptions) (*tss.DkgResult, string, error) {
+	if options.Threshold == 0 {
+		options.Threshold = 2
+	}
+	if options.Devices == 0 {
+		options.Devices = 1
+	}
+
+	if options.Threshold < 2 || options.Devices < 1 || options.Threshold > options.Devices+1 {
+		log.Println("Dkg - invalid threshold:", options.Threshold, "for", options.Devices, "devices")
+		return nil, "", &types.ErrBadRequest{}
+	}
+
+	scheme, err := tss.ParseScheme(options.Scheme)
+	if err != nil {
+		log.Println("Dkg - invalid scheme:", err)
+		return nil, "", &types.ErrBadRequest{}
+	}
+
+	return runDkg(host, authData, "&threshold="+strconv.Itoa(options.Threshold)+"&devices="+strconv.Itoa(options.Devices)+"&scheme="+string(scheme), false)
+}
+
+// JoinDkg takes part, as an additional device, in the dkg process started by another device of the user with DkgWithOptions
+// Requires authData (to confirm authorization and identify user) and host
+func JoinDkg(host, authData string) (*tss.DkgResult, string, error) {
+	return runDkg(host, authData, "&join=true", true)
+}
+
+func runDkg(host, authData, parameters string, join bool) (*tss.DkgResult, string, error) {
 	// Get temporary access token from server based on auth data
 	token, err := getAccessToken(host, "", authData)
 	if err != nil {
@@ -41,7 +86,7 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 	}
 
 	// Prepare DKG process
-	path := "/dkg?token=" + token
+	path := "/dkg?token=" + token + parameters
 
 	_hostHttp, err := urlToHttp(host)
 	if err != nil {
@@ -49,29 +94,24 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 		return nil, "", err
 	}
 
-	// Check if wallet already exists
+	// Check if wallet already exists (or, when joining, if a dkg is in progress)
 	resp, err := http.Get(_hostHttp + path)
 	if err != nil {
 		log.Println("Dkg - error dialing server /dkg (first call):", err)
 		return nil, "", err
 	}
 
-	if resp.StatusCode == 401 {
-		return nil, "", &types.ErrUnauthorized{}
-	} else if resp.StatusCode == 400 {
-		return nil, "", &types.ErrBadRequest{}
-	} else if resp.StatusCode == 404 {
-		return nil, "", &types.ErrNotFound{}
-	} else if resp.StatusCode == 409 {
-		log.Println("Dkg - error: existing wallet")
-		return nil, "", &types.ErrConflict{}
-	} else if resp.StatusCode == 426 {
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 426 {
 		log.Println("Dkg - no existing wallet")
 	} else {
-		log.Println("Dkg - unknown behavior")
-		return nil, "", errors.New("Dkg - unknown behavior")
+		err = errorFromResponse(resp)
+		if errors.Is(err, &types.ErrConflict{}) {
+			log.Println("Dkg - error: existing wallet")
+		}
+		return nil, "", err
 	}
-	defer resp.Body.Close()
 
 	_host, err := urlToWs(host)
 	if err != nil {
@@ -81,15 +121,11 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 
 	// Init DKG
 	peerID := uuid.New().String()
-	if strings.HasSuffix(os.Args[0], ".test") {
+	if strings.HasSuffix(os.Args[0], ".test") && !join {
 		peerID = "client"
 	}
 
-	dkg, err := tss.NewClientDkg(peerID)
-	if err != nil {
-		log.Println("Dkg - error creating new client dkg:", err)
-		return nil, "", err
-	}
+	var dkg *tss.ClientDkg
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -102,6 +138,7 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
 	serverDone := make(chan struct{})
+	startTss := make(chan struct{}) // the dkg can only start once the server shared all the peers taking part in it
 	errs := make(chan error, 2)
 
 	var stage uint32 = 0
@@ -149,6 +186,31 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 			// log.Println("received message in Dkg:", msg)
 
 			switch msg.Type {
+			case ws.PeersMessage:
+				if stage > msg.Type.MsgStage {
+					// discard
+					log.Println("Dkg - error: received peers message but we're at later stage; stage:", stage)
+					continue
+				}
+
+				peers, err := ws.DecodePeers(msg.Msg)
+				if err != nil {
+					log.Println("Dkg - could not decode peers:", err)
+					errs <- err
+					return
+				}
+
+				dkg, err = tss.NewClientDkg(peerID, peers.PeerIDs, peers.Threshold, peers.Scheme)
+				if err != nil {
+					log.Println("Dkg - error creating new client dkg:", err)
+					errs <- err
+					return
+				}
+
+				stage = msg.Type.MsgStage
+
+				close(startTss)
+
 			case ws.TssMessage:
 				// verify stage : if tss message but we're at storage stage or further, discard
 				if stage > msg.Type.MsgStage {
@@ -157,6 +219,12 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 					continue
 				}
 
+				if dkg == nil {
+					log.Println("Dkg - error: received TSS message before peers message")
+					errs <- errors.New("tss message before peers message")
+					return
+				}
+
 				// log.Println("Dkg - received tss message:", msg)
 
 				// Decode TSS msg
@@ -224,10 +292,22 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 		}
 	}()
 
+	// Wait for all peers to be known
+	select {
+	case <-startTss:
+	case err = <-errs:
+		log.Println("Dkg - error before dkg start:", err)
+		c.Close(websocket.StatusInternalError, "dkg process failed")
+		return nil, "", &types.ErrTssProcessFailed{}
+	case <-ctx.Done():
+		log.Println("Dkg - timeout before dkg start")
+		return nil, "", &types.ErrTimeOut{}
+	}
+
 	// TSS sending and listening for finish signal
 	go ws.TssSend(dkg.GetNextMessageToSend, serverDone, errs, ctx, c, "Dkg")
 
-	// Start adder
+	// Start dkg
 	dkgResult, err := dkg.Process()
 	if err != nil {
 		log.Println("Dkg - error processing adder:", err)
@@ -262,24 +342,326 @@ func Dkg(host, authData string) (*tss.DkgResult, string, error) {
 	return dkgResult, metadata, nil
 }
 
-// Sign performs the full signing process on the client side
+// SignOptions defines the optional parameters of SignWithOptions
+type SignOptions struct {
+	PeerIDs []string // other signing devices (this device excluded), required when the threshold of the wallet is above 2
+	Path    string   // non-hardened derivation path of the signing key (e.g. m/0/1), see DeriveAddress (default: key of the wallet)
+}
+
+// Sign performs the full signing process on the client side, with the server and this device only
 // Requires the message to be signed, the dkgResult (i.e. client-side of wallet), authData (to confirm authorization and identify user) and host
 func Sign(host string, message []byte, dkgResultStr string, metadata string, authData string) (*tss.Signature, error) {
+	return SignWithOptions(host, message, dkgResultStr, metadata, authData, SignOptions{})
+}
 
-	// Get temporary access token from server based on auth data
-	token, err := getAccessToken(host, metadata, authData)
+// SignWithPeers performs the full signing process on the client side, with the server and the given devices (peerIDs, this device excluded)
+// It is required when the threshold of the wallet is above 2: the other devices need to join the signing process through JoinSign
+func SignWithPeers(host string, message []byte, dkgResultStr string, metadata string, authData string, peerIDs []string) (*tss.Signature, error) {
+	return SignWithOptions(host, message, dkgResultStr, metadata, authData, SignOptions{PeerIDs: peerIDs})
+}
+
+// SignWithOptions performs the full signing process on the client side, with the server and the given devices, with the key of the wallet or one of its child keys (derivation path)
+func SignWithOptions(host string, message []byte, dkgResultStr string, metadata string, authData string, options SignOptions) (*tss.Signature, error) {
+	return signWithOptions(host, message, "", dkgResultStr, metadata, authData, options)
+}
+
+// SignSchnorr performs the full signing process of a BIP-340 Schnorr signature on the client side, with the server and this device only
+// Requires an ECDSA wallet and a 32 bytes message. With taproot, the signature is valid for the taproot output key of the wallet (BIP-86, key-path spends) instead of its public key
+func SignSchnorr(host string, message []byte, dkgResultStr string, metadata string, authData string, taproot bool) (*tss.Signature, error) {
+	signatureType := tss.SignatureSchnorr
+	if taproot {
+		signatureType = tss.SignatureTaproot
+	}
+
+	return signWithOptions(host, message, signatureType, dkgResultStr, metadata, authData, SignOptions{})
+}
+
+func signWithOptions(host string, message []byte, signatureType string, dkgResultStr string, metadata string, authData string, options SignOptions) (*tss.Signature, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
 	if err != nil {
-		log.Println("Sign - error getting access token:", err)
-		return nil, &types.ErrUnauthorized{}
+		log.Println("Sign - error unmarshaling signingParameters:", err)
+		return nil, &types.ErrBadRequest{}
+	}
+
+	signers := []string{dkgResult.PeerID}
+	for _, peerID := range options.PeerIDs {
+		if peerID != dkgResult.PeerID {
+			signers = append(signers, peerID)
+		}
+	}
+
+	if len(signers)+1 < int(dkgResult.GetThreshold()) {
+		log.Println("Sign - not enough signers for threshold", dkgResult.GetThreshold())
+		return nil, &types.ErrBadRequest{}
 	}
 
+	signingWallet, pathParameter, err := derivedWallet(&dkgResult, options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return runSign(host, "/sign?msg="+hex.EncodeToString(message), message, signatureType, signingWallet, metadata, authData, "&peers="+url.QueryEscape(strings.Join(signers, ","))+pathParameter)
+}
+
+// JoinSign takes part, as an additional device, in the signing process started by another device of the user with SignWithPeers
+// Requires the same message as the device starting the signing process
+func JoinSign(host string, message []byte, dkgResultStr string, metadata string, authData string) (*tss.Signature, error) {
+	return JoinSignWithOptions(host, message, dkgResultStr, metadata, authData, SignOptions{})
+}
+
+// JoinSignWithOptions takes part in the signing process started by another device with SignWithOptions, with the same derivation path (the peers are set by the device starting the signing process)
+func JoinSignWithOptions(host string, message []byte, dkgResultStr string, metadata string, authData string, options SignOptions) (*tss.Signature, error) {
 	var dkgResult tss.DkgResult
-	err = json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
 	if err != nil {
 		log.Println("Sign - error unmarshaling signingParameters:", err)
 		return nil, &types.ErrBadRequest{}
 	}
 
+	signingWallet, pathParameter, err := derivedWallet(&dkgResult, options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return runSign(host, "/sign?msg="+hex.EncodeToString(message), message, "", signingWallet, metadata, authData, "&join=true"+pathParameter)
+}
+
+// DeriveAddress returns the address of the child key of the wallet at the non-hardened derivation path (e.g. m/0/1), signed for with SignWithOptions
+// Child keys are derived from the public key of the wallet: no dkg is required, client and server adjust their shares when signing
+func DeriveAddress(dkgResultStr string, path string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("DeriveAddress - error unmarshaling dkgResult:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	address, err := tss.DeriveAddress(dkgResult.Pubkey, dkgResult.GetScheme(), path)
+	if err != nil {
+		log.Println("DeriveAddress - error deriving address:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	return address, nil
+}
+
+// derivedWallet returns the wallet of the child key at path (the wallet itself without path), and the URL parameter sharing the path with the server
+func derivedWallet(dkgResult *tss.DkgResult, path string) (*tss.DkgResult, string, error) {
+	if len(path) == 0 {
+		return dkgResult, "", nil
+	}
+
+	derived, err := tss.DeriveDkgResult(dkgResult, path)
+	if err != nil {
+		log.Println("Sign - error deriving key:", err)
+		return nil, "", &types.ErrBadRequest{}
+	}
+
+	return derived, "&path=" + url.QueryEscape(path), nil
+}
+
+// SignEthTransaction signs an Ethereum transaction (json-encoded transaction parameters) with the server and this device, and returns the hex-encoded signed raw transaction
+// The transaction itself is sent to the server, which decodes it and computes the hash to be signed on its side
+func SignEthTransaction(host string, jsonEncodedTx string, chainId string, dkgResultStr string, metadata string, authData string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("SignEthTransaction - error unmarshaling signingParameters:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	_tx, err := tx.NewEthereumTxWithJson(jsonEncodedTx, chainId)
+	if err != nil {
+		log.Println("SignEthTransaction - error while initialising tx:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	message := _tx.GenerateMessage()
+
+	endpoint := "/sign-tx?tx=" + url.QueryEscape(jsonEncodedTx) + "&chainId=" + url.QueryEscape(chainId)
+
+	signature, err := runSign(host, endpoint, message, "", &dkgResult, metadata, authData, "")
+	if err != nil {
+		log.Println("SignEthTransaction - error while signing:", err)
+		return "", err
+	}
+
+	return _tx.Sign(signature.Signature)
+}
+
+// SignEthMessage signs an Ethereum message (EIP-191, as personal_sign) with the server and this device, and returns the hex-encoded signature (v being 27 or 28)
+func SignEthMessage(host string, message []byte, dkgResultStr string, metadata string, authData string) (string, error) {
+	signature, err := Sign(host, tx.HashPersonalMessage(message), dkgResultStr, metadata, authData)
+	if err != nil {
+		log.Println("SignEthMessage - error while signing:", err)
+		return "", err
+	}
+
+	ethSignature, err := tx.MessageSignature(signature.Signature)
+	if err != nil {
+		log.Println("SignEthMessage - error converting signature:", err)
+		return "", err
+	}
+
+	return hex.EncodeToString(ethSignature), nil
+}
+
+// SignTypedData signs EIP-712 typed data (json-encoded, as eth_signTypedData_v4) with the server and this device, and returns the hex-encoded signature (v being 27 or 28)
+func SignTypedData(host string, jsonTypedData string, dkgResultStr string, metadata string, authData string) (string, error) {
+	hash, err := tx.HashTypedData(jsonTypedData)
+	if err != nil {
+		log.Println("SignTypedData - error hashing typed data:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	signature, err := Sign(host, hash, dkgResultStr, metadata, authData)
+	if err != nil {
+		log.Println("SignTypedData - error while signing:", err)
+		return "", err
+	}
+
+	ethSignature, err := tx.MessageSignature(signature.Signature)
+	if err != nil {
+		log.Println("SignTypedData - error converting signature:", err)
+		return "", err
+	}
+
+	return hex.EncodeToString(ethSignature), nil
+}
+
+// BitcoinAddress returns the native segwit address (P2WPKH) of the wallet on the Bitcoin network (mainnet, testnet, signet or regtest)
+func BitcoinAddress(dkgResultStr string, network string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("BitcoinAddress - error unmarshaling dkgResult:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	params, err := bitcoin.NetworkParams(network)
+	if err != nil {
+		log.Println("BitcoinAddress - error getting network:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	return bitcoin.P2WPKHAddress(dkgResult.Pubkey, params)
+}
+
+// BitcoinTaprootAddress returns the taproot address (P2TR, BIP-86) of the wallet on the Bitcoin network (mainnet, testnet, signet or regtest)
+func BitcoinTaprootAddress(dkgResultStr string, network string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("BitcoinTaprootAddress - error unmarshaling dkgResult:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	params, err := bitcoin.NetworkParams(network)
+	if err != nil {
+		log.Println("BitcoinTaprootAddress - error getting network:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	return bitcoin.P2TRAddress(dkgResult.Pubkey, params)
+}
+
+// SignPsbt signs the inputs of the wallet in the PSBT (base64 or hex encoded) for network (mainnet, testnet, signet or regtest) with the server and this device, one signing process per input (Schnorr signature for taproot inputs)
+// The PSBT itself is sent to the server, which decodes it and computes the sighash of each input on its side (its policy applies to the outputs)
+// Returns the hex-encoded raw transaction, or the base64-encoded PSBT when inputs of other signers remain to be signed
+func SignPsbt(host string, encodedPsbt string, network string, dkgResultStr string, metadata string, authData string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("SignPsbt - error unmarshaling dkgResult:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	if dkgResult.GetScheme() != tss.SchemeECDSA {
+		log.Println("SignPsbt - bitcoin transactions require an ecdsa wallet")
+		return "", &types.ErrBadRequest{}
+	}
+
+	if 2 < int(dkgResult.GetThreshold()) {
+		log.Println("SignPsbt - not enough signers for threshold", dkgResult.GetThreshold())
+		return "", &types.ErrBadRequest{}
+	}
+
+	_psbt, err := bitcoin.NewPsbt(encodedPsbt, dkgResult.Pubkey)
+	if err != nil {
+		log.Println("SignPsbt - error parsing psbt:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	sighashes, err := _psbt.Sighashes()
+	if err != nil {
+		log.Println("SignPsbt - error computing sighashes:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	_, err = bitcoin.NetworkParams(network)
+	if err != nil {
+		log.Println("SignPsbt - error getting network:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	// the PSBT as signed so far is sent, the server computes the same sighashes from it
+	endpoint := "/sign-psbt?psbt=" + url.QueryEscape(encodedPsbt) + "&network=" + url.QueryEscape(network)
+
+	for _, sighash := range sighashes {
+		inputEndpoint := endpoint + "&input=" + strconv.Itoa(sighash.Index)
+
+		if sighash.Taproot {
+			signature, err := runSign(host, inputEndpoint, sighash.Message, tss.SignatureTaproot, &dkgResult, metadata, authData, "")
+			if err != nil {
+				log.Println("SignPsbt - error while signing input", sighash.Index, ":", err)
+				return "", err
+			}
+
+			err = _psbt.AddTaprootSignature(sighash.Index, signature.Signature)
+			if err != nil {
+				log.Println("SignPsbt - error adding signature of input", sighash.Index, ":", err)
+				return "", err
+			}
+			continue
+		}
+
+		signature, err := runSign(host, inputEndpoint, sighash.Message, "", &dkgResult, metadata, authData, "")
+		if err != nil {
+			log.Println("SignPsbt - error while signing input", sighash.Index, ":", err)
+			return "", err
+		}
+
+		err = _psbt.AddSignature(sighash.Index, signature.Signature)
+		if err != nil {
+			log.Println("SignPsbt - error adding signature of input", sighash.Index, ":", err)
+			return "", err
+		}
+	}
+
+	rawTx, err := _psbt.Finalize()
+	if errors.Is(err, bitcoin.ErrIncompletePsbt) {
+		return _psbt.Base64()
+	}
+	if err != nil {
+		log.Println("SignPsbt - error finalizing psbt:", err)
+		return "", err
+	}
+
+	return rawTx, nil
+}
+
+// runSign runs the signing process of message through endpoint (/sign with the message, or /sign-tx with the transaction it is the hash of)
+// signatureType is the signature type (tss.SignatureSchnorr or tss.SignatureTaproot), empty for the signature of the scheme of the wallet
+func runSign(host string, endpoint string, message []byte, signatureType string, dkgResult *tss.DkgResult, metadata string, authData string, parameters string) (*tss.Signature, error) {
+
+	// Get temporary access token from server based on auth data
+	token, err := getAccessToken(host, metadata, authData)
+	if err != nil {
+		log.Println("Sign - error getting access token:", err)
+		return nil, &types.ErrUnauthorized{}
+	}
+
 	// Prepare signing process
 
 	pubkeyStr := dkgResult.Pubkey
@@ -287,7 +669,10 @@ func Sign(host string, message []byte, dkgResultStr string, metadata string, aut
 	share := dkgResult.Share
 	clientPeerID := dkgResult.PeerID
 
-	path := "/sign?msg=" + hex.EncodeToString(message) + "&token=" + token + "&peer=" + clientPeerID
+	path := endpoint + "&token=" + token + "&peer=" + url.QueryEscape(clientPeerID) + parameters
+	if signatureType != "" {
+		path += "&signature=" + signatureType
+	}
 
 	_host, err := urlToWs(host)
 	if err != nil {
@@ -305,34 +690,99 @@ func Sign(host string, message []byte, dkgResultStr string, metadata string, aut
 			return nil, err
 		}
 
-		if resp.StatusCode == 401 {
-			return nil, &types.ErrUnauthorized{}
-		} else if resp.StatusCode == 400 {
-			return nil, &types.ErrBadRequest{}
-		} else if resp.StatusCode == 404 {
-			return nil, &types.ErrNotFound{}
-		} else if resp.StatusCode == 409 {
-			return nil, &types.ErrConflict{}
-		} else {
-			log.Println("Sign - error dialing websocket:", err)
-			return nil, err
-		}
+		return nil, errorFromResponse(resp)
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
-	signer, err := tss.NewClientSigner(clientPeerID, pubkeyStr, share, BKs, message)
-	if err != nil {
-		log.Println("Sign - error when getting new client signer:", err)
-		return nil, &types.ErrBadRequest{}
-	}
+	var signer *tss.ClientSigner
 
+	signingDone := make(chan struct{})
+	startTss := make(chan struct{}) // the signing can only start once the server shared all the signing peers
 	errs := make(chan error, 2)
 
-	go tss.Send(signer, ctx, errs, c)
-	go tss.Receive(signer, ctx, errs, c)
+	go func() {
+		for {
+			var msg ws.Message
+			err := wsjson.Read(ctx, c, &msg)
+			if err != nil {
+				errs <- err // includes the normal closure from server at the end of the signing process
+				return
+			}
+
+			switch msg.Type {
+			case ws.PeersMessage:
+				peers, err := ws.DecodePeers(msg.Msg)
+				if err != nil {
+					log.Println("Sign - could not decode peers:", err)
+					errs <- err
+					return
+				}
+
+				if peers.Scheme != dkgResult.GetScheme() {
+					log.Println("Sign - error: scheme of server wallet is different:", peers.Scheme)
+					errs <- &types.ErrBadRequest{}
+					return
+				}
+
+				if signatureType == "" {
+					signer, err = tss.NewClientSigner(clientPeerID, peers.PeerIDs, pubkeyStr, share, BKs, dkgResult.PublicShares, dkgResult.GetThreshold(), dkgResult.GetScheme(), message)
+				} else {
+					signer, err = tss.NewClientSignerSchnorr(clientPeerID, peers.PeerIDs, pubkeyStr, share, BKs, dkgResult.PublicShares, dkgResult.GetThreshold(), dkgResult.GetScheme(), signatureType == tss.SignatureTaproot, message)
+				}
+				if err != nil {
+					log.Println("Sign - error when getting new client signer:", err)
+					errs <- &types.ErrBadRequest{}
+					return
+				}
+
+				close(startTss)
+
+			case ws.TssMessage:
+				if signer == nil {
+					log.Println("Sign - error: received TSS message before peers message")
+					errs <- errors.New("tss message before peers message")
+					return
+				}
+
+				tssMsg, err := ws.DecodeTssMessage(msg.Msg)
+				if err != nil {
+					log.Println("Sign - could not decode tss msg:", err)
+					errs <- err
+					return
+				}
+
+				err = signer.HandleMessage(tssMsg)
+				if err != nil {
+					log.Println("Sign - could not handle tss msg:", err)
+					errs <- err
+					return
+				}
+
+			default:
+				log.Println("Sign - Unexpected message type:", msg.Type)
+			}
+		}
+	}()
+
+	// Wait for all signing peers to be known
+	select {
+	case <-startTss:
+	case processErr := <-errs:
+		log.Println("Sign - error before signing start:", processErr)
+		var badRequestErr *types.ErrBadRequest
+		if errors.As(processErr, &badRequestErr) {
+			return nil, processErr
+		}
+		return nil, &types.ErrTssProcessFailed{}
+	case <-ctx.Done():
+		return nil, &types.ErrTimeOut{}
+	}
+
+	go ws.TssSend(signer.GetNextMessageToSend, signingDone, errs, ctx, c, "Sign")
 
 	// Start signing process
 	signature, err := signer.Process()
+	close(signingDone)
 	if err != nil {
 		log.Println("Sign - error processing signing:", err)
 		return nil, &types.ErrTssProcessFailed{}
@@ -361,6 +811,12 @@ func Sign(host string, message []byte, dkgResultStr string, metadata string, aut
 // Export exports the private key from the server and client shares
 // Requires the dkgResult (i.e. client-side of wallet), authData (to confirm authorization and identify user) and host
 func Export(host string, dkgResultStr string, metadata string, authData string) (string, error) {
+	return ExportWithDevices(host, []string{dkgResultStr}, metadata, authData)
+}
+
+// ExportWithDevices exports the private key from the server share and the shares of several devices
+// It is required when the threshold of the wallet is above 2: threshold-1 devices need to provide their dkgResult
+func ExportWithDevices(host string, dkgResultStrs []string, metadata string, authData string) (string, error) {
 
 	// Get temporary access token from server based on auth data
 	token, err := getAccessToken(host, metadata, authData)
@@ -369,17 +825,32 @@ func Export(host string, dkgResultStr string, metadata string, authData string)
 		return "", &types.ErrUnauthorized{}
 	}
 
-	// Get client share
-	var dkgResult tss.DkgResult
-	err = json.Unmarshal([]byte(dkgResultStr), &dkgResult)
-	if err != nil {
-		log.Println("Export - error unmarshaling client dkgResults:", err)
+	// Get client shares
+	if len(dkgResultStrs) == 0 {
+		log.Println("Export - error: no client dkgResult")
 		return "", &types.ErrBadRequest{}
 	}
 
-	clientShare := dkgResult.Share
-	clientPeerID := dkgResult.PeerID
-	publicKey := dkgResult.Pubkey
+	clientShares := make(map[string]string)
+	var publicKey tss.PubkeyStr
+
+	for i, dkgResultStr := range dkgResultStrs {
+		var dkgResult tss.DkgResult
+		err = json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+		if err != nil {
+			log.Println("Export - error unmarshaling client dkgResults:", err)
+			return "", &types.ErrBadRequest{}
+		}
+
+		if i == 0 {
+			publicKey = dkgResult.Pubkey
+		} else if publicKey != dkgResult.Pubkey {
+			log.Println("Export - error: client public keys do not match")
+			return "", &types.ErrBadRequest{}
+		}
+
+		clientShares[dkgResult.PeerID] = dkgResult.Share
+	}
 
 	// Get server share
 	path := "/export?token=" + token
@@ -410,10 +881,10 @@ func Export(host string, dkgResultStr string, metadata string, authData string)
 
 	// Export private key
 	// Note: BKs need to come from the server, as they are the only ones that are fully complete in the case of multi-device
-	privateKey, err := tss.RecoverPrivateKeyWrapper(clientPeerID, publicKey, serverDkgResult.Share, clientShare, serverDkgResult.BKs)
+	privateKey, err := tss.RecoverPrivateKeyWrapper(publicKey, serverDkgResult.Share, clientShares, serverDkgResult.BKs, serverDkgResult.GetThreshold(), serverDkgResult.GetScheme())
 	if err != nil {
 		log.Println("Export - error recovering private key:", err)
-		if strings.Contains(err.Error(), "invalid point") {
+		if strings.Contains(err.Error(), "invalid point") || errors.Is(err, tss.ErrNotEnoughSigners) || errors.Is(err, tss.ErrUnknownPeer) {
 			return "", &types.ErrBadRequest{}
 		} else {
 			return "", &types.ErrServerError{}
@@ -459,13 +930,13 @@ func getDataFromServer(host, authData, metadata, endpoint string) (string, error
 		return "", err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		log.Println("getDataFromServer - error while", endpoint, ", status not 200")
-		log.Printf("getDataFromServer - resp:%+v\n", resp)
-		return "", fmt.Errorf(endpoint, " status not 200")
+		return "", errorFromResponse(resp)
 	}
 
-	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Println("getDataFromServer - error while reading response body of", endpoint, ":", err)
@@ -476,6 +947,29 @@ func getDataFromServer(host, authData, metadata, endpoint string) (string, error
 	return retValue, nil
 }
 
+// errorFromResponse returns the error described by the error response of the server (see types.ErrorResponse)
+// Falls back on the status code for responses which are not JSON (e.g. older servers)
+func errorFromResponse(resp *http.Response) error {
+	var errorResponse types.ErrorResponse
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err == nil && json.Unmarshal(body, &errorResponse) == nil && len(errorResponse.Code) > 0 {
+		log.Printf("server error %s: %s (request id: %s)\n", errorResponse.Code, errorResponse.Message, errorResponse.RequestID)
+		if knownErr := types.ErrorFromCode(errorResponse.Code); knownErr != nil {
+			if errors.Is(knownErr, &types.ErrPolicyRejected{}) {
+				return &types.ErrPolicyRejected{Reason: errorResponse.Message}
+			}
+			return knownErr
+		}
+		return fmt.Errorf("server error %s: %s", errorResponse.Code, errorResponse.Message)
+	}
+
+	if knownErr := types.ErrorFromStatus(resp.StatusCode); knownErr != nil {
+		return knownErr
+	}
+
+	return fmt.Errorf("server responded with status %d", resp.StatusCode)
+}
+
 func urlToHttp(_url string) (string, error) {
 	parsedURL, err := url.Parse(_url)
 	if err != nil {
@@ -102,6 +102,105 @@ func Sign(host string, message []byte, dkgResultStr string, authData string) *Sw
 	return swiftResultSignature(signature, nil)
 }
 
+// SignWithPath signs with the child key of the wallet at the non-hardened derivation path (e.g. m/0/1, see DeriveAddress)
+func SignWithPath(host string, message []byte, dkgResultStr string, path string, authData string) *SwiftResultBytes {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultSignature(nil, err)
+	}
+
+	signature, err := client.SignWithOptions(host, message, upgradedDkgResult.DkgResultStr, upgradedDkgResult.Metadata, authData, client.SignOptions{Path: path})
+	if err != nil {
+		return swiftResultSignature(nil, err)
+	}
+	return swiftResultSignature(signature, nil)
+}
+
+func SignEthTransaction(host string, jsonEncodedTx string, chainId string, dkgResultStr string, authData string) *SwiftResultString {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+
+	signedTx, err := client.SignEthTransaction(host, jsonEncodedTx, chainId, upgradedDkgResult.DkgResultStr, upgradedDkgResult.Metadata, authData)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+	return swiftResultString(signedTx, nil)
+}
+
+func SignEthMessage(host string, message []byte, dkgResultStr string, authData string) *SwiftResultString {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+
+	signature, err := client.SignEthMessage(host, message, upgradedDkgResult.DkgResultStr, upgradedDkgResult.Metadata, authData)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+	return swiftResultString(signature, nil)
+}
+
+func SignTypedData(host string, jsonTypedData string, dkgResultStr string, authData string) *SwiftResultString {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+
+	signature, err := client.SignTypedData(host, jsonTypedData, upgradedDkgResult.DkgResultStr, upgradedDkgResult.Metadata, authData)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+	return swiftResultString(signature, nil)
+}
+
+func SignPsbt(host string, encodedPsbt string, network string, dkgResultStr string, authData string) *SwiftResultString {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+
+	signed, err := client.SignPsbt(host, encodedPsbt, network, upgradedDkgResult.DkgResultStr, upgradedDkgResult.Metadata, authData)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+	return swiftResultString(signed, nil)
+}
+
+func BitcoinAddress(dkgResultStr string, network string) *SwiftResultString {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+
+	address, err := client.BitcoinAddress(upgradedDkgResult.DkgResultStr, network)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+	return swiftResultString(address, nil)
+}
+
+func DeriveAddress(dkgResultStr string, path string) *SwiftResultString {
+	var upgradedDkgResult upgradedDkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+
+	address, err := client.DeriveAddress(upgradedDkgResult.DkgResultStr, path)
+	if err != nil {
+		return swiftResultString("", err)
+	}
+	return swiftResultString(address, nil)
+}
+
 func Export(host string, dkgResultStr string, authData string) *SwiftResultString {
 	var upgradedDkgResult upgradedDkgResult
 	err := json.Unmarshal([]byte(dkgResultStr), &upgradedDkgResult)
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+// RotateMetadata replaces the metadata of the wallet (i.e. the client key encrypting the server share) and returns the new one
+// Use it when the metadata of a device might have leaked. The previous metadata becomes useless: the other devices of the wallet get the new one with UpdateMetadata.
+// Requires the dkgResult (to identify the device), the current metadata, authData (to confirm authorization and identify user) and host
+func RotateMetadata(host string, dkgResultStr string, metadata string, authData string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("RotateMetadata - error unmarshaling dkgResult:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	// Get temporary access token from server based on auth data
+	token, err := getAccessToken(host, metadata, authData)
+	if err != nil {
+		log.Println("RotateMetadata - error getting access token:", err)
+		return "", &types.ErrUnauthorized{}
+	}
+
+	newMetadata, err := getDataFromServer(host, "", "", "/rotate-metadata?token="+token+"&peer="+url.QueryEscape(dkgResult.PeerID))
+	if err != nil {
+		log.Println("RotateMetadata - error rotating metadata:", err)
+		return "", err
+	}
+
+	return newMetadata, nil
+}
+
+// UpdateMetadata returns the latest metadata of the wallet: the new one if another device rotated it (RotateMetadata), the given one otherwise
+// The server seals the new metadata for each device with its public share: it is opened with the share of the dkgResult, the previous metadata alone does not give it
+// Requires the dkgResult (to identify the device and open the new metadata), the metadata of the device, authData (to confirm authorization and identify user) and host
+func UpdateMetadata(host string, dkgResultStr string, metadata string, authData string) (string, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("UpdateMetadata - error unmarshaling dkgResult:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	// Get temporary access token from server based on auth data
+	token, err := getAccessToken(host, metadata, authData)
+	if err != nil {
+		log.Println("UpdateMetadata - error getting access token:", err)
+		return "", &types.ErrUnauthorized{}
+	}
+
+	sealedMetadata, err := getDataFromServer(host, "", "", "/metadata?token="+token+"&peer="+url.QueryEscape(dkgResult.PeerID))
+	if err != nil {
+		log.Println("UpdateMetadata - error getting metadata:", err)
+		return "", err
+	}
+
+	// Not rotated
+	if len(sealedMetadata) == 0 {
+		return metadata, nil
+	}
+
+	sealed, err := hex.DecodeString(sealedMetadata)
+	if err != nil {
+		log.Println("UpdateMetadata - error decoding sealed metadata:", err)
+		return "", &types.ErrServerError{}
+	}
+
+	latestMetadata, err := dkgResult.OpenSealed(sealed)
+	if err != nil {
+		log.Println("UpdateMetadata - error opening sealed metadata:", err)
+		return "", err
+	}
+
+	return hex.EncodeToString(latestMetadata), nil
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/getmeemaw/meemaw/server"
 	"github.com/getmeemaw/meemaw/utils/tss"
-	"github.com/getmeemaw/meemaw/utils/types"
 	"github.com/getmeemaw/meemaw/utils/ws"
 	"github.com/google/uuid"
 	"nhooyr.io/websocket"
@@ -24,6 +26,8 @@ import (
 //
 // client/tss_add.go also manages backups, as it uses the two multi-device functions as building blocks: the combination of RegisterDevice & AcceptDevice can be used to create backups or recover from backups.
 //
+// Only ECDSA wallets support adding devices: for EdDSA wallets, the server rejects RegisterDevice and AcceptDevice with ErrUnsupportedScheme.
+//
 /////////
 
 // UPDATE DESCRIPTION
@@ -56,18 +60,7 @@ func RegisterDevice(host, authData, device string) (*tss.DkgResult, string, erro
 			return nil, "", err
 		}
 
-		if resp.StatusCode == 401 {
-			return nil, "", &types.ErrUnauthorized{}
-		} else if resp.StatusCode == 400 {
-			return nil, "", &types.ErrBadRequest{}
-		} else if resp.StatusCode == 404 {
-			return nil, "", &types.ErrNotFound{}
-		} else if resp.StatusCode == 409 {
-			return nil, "", &types.ErrConflict{}
-		} else {
-			log.Println("RegisterDevice - error dialing websocket:", err)
-			return nil, "", err
-		}
+		return nil, "", errorFromResponse(resp)
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
@@ -80,7 +73,7 @@ func RegisterDevice(host, authData, device string) (*tss.DkgResult, string, erro
 	var metadata string
 
 	peerID := uuid.New().String()
-	var acceptingDevicePeerID string
+	var acceptingDevicePeerIDs []string
 
 	// send peerID
 	peerIdMsg := ws.Message{
@@ -130,7 +123,7 @@ func RegisterDevice(host, authData, device string) (*tss.DkgResult, string, erro
 					continue
 				}
 
-				acceptingDevicePeerID = string(msg.Msg)
+				acceptingDevicePeerIDs = strings.Split(string(msg.Msg), ",")
 
 				// send DeviceMessage
 				deviceMsg := ws.Message{
@@ -168,7 +161,7 @@ func RegisterDevice(host, authData, device string) (*tss.DkgResult, string, erro
 				// log.Println("RegisterDevice - creating adder")
 
 				// Create adder
-				adder, err = tss.NewClientAdd(peerID, acceptingDevicePeerID, publicWallet.PublicKey, publicWallet.BKs)
+				adder, err = tss.NewClientAdd(peerID, acceptingDevicePeerIDs, publicWallet.PublicKey, publicWallet.BKs, publicWallet.Threshold, publicWallet.Scheme)
 				if err != nil {
 					log.Println("RegisterDevice - error creating newClientAdd():", err)
 					errs <- err
@@ -331,12 +324,20 @@ func RegisterDevice(host, authData, device string) (*tss.DkgResult, string, erro
 
 // UPDATE DESCRIPTION
 func AcceptDevice(host string, dkgResultStr string, metadata string, authData string) error {
+	_, err := AcceptDeviceWithPeers(host, dkgResultStr, metadata, authData, nil)
+	return err
+}
+
+// AcceptDeviceWithPeers accepts the new device with the server and the given existing devices (peerIDs, this device excluded)
+// It is required when the threshold of the wallet is above 2: the other devices need to join the process through JoinAcceptDevice
+// It returns the dkg result of this device including the new device, which is required to sign with it when the threshold is above 2
+func AcceptDeviceWithPeers(host string, dkgResultStr string, metadata string, authData string, peerIDs []string) (*tss.DkgResult, error) {
 
 	// Get temporary access token from server based on auth data
 	token, err := getAccessToken(host, metadata, authData)
 	if err != nil {
 		log.Println("AcceptDevice - error getting access token:", err)
-		return err
+		return nil, err
 	}
 
 	// Unmarshal dkg results
@@ -344,16 +345,24 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	err = json.Unmarshal([]byte(dkgResultStr), &dkgResult)
 	if err != nil {
 		log.Println("AcceptDevice - error unmarshaling dkgResult:", err)
-		return err
+		return nil, err
+	}
+
+	// Accepting devices, this device first
+	acceptingPeerIDs := []string{dkgResult.PeerID}
+	for _, peerID := range peerIDs {
+		if peerID != dkgResult.PeerID {
+			acceptingPeerIDs = append(acceptingPeerIDs, peerID)
+		}
 	}
 
 	// Prepare DKG process
-	path := "/accept?token=" + token
+	path := "/accept?token=" + token + "&peers=" + url.QueryEscape(strings.Join(acceptingPeerIDs, ","))
 
 	_host, err := urlToWs(host)
 	if err != nil {
 		log.Println("AcceptDevice - error getting ws host:", err)
-		return err
+		return nil, err
 	}
 
 	var adder *tss.ExistingClientAdd
@@ -365,20 +374,10 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	if err != nil {
 		if resp == nil {
 			log.Println("AcceptDevice - error dialing websocket:", err)
-			return err
+			return nil, err
 		}
 
-		if resp.StatusCode == 401 {
-			return &types.ErrUnauthorized{}
-		} else if resp.StatusCode == 400 {
-			return &types.ErrBadRequest{}
-		} else if resp.StatusCode == 404 {
-			return &types.ErrNotFound{}
-		} else if resp.StatusCode == 409 {
-			return &types.ErrConflict{}
-		} else {
-			return err
-		}
+		return nil, errorFromResponse(resp)
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
@@ -401,7 +400,7 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	err = wsjson.Write(ctx, c, peerIdMsg)
 	if err != nil {
 		log.Println("AcceptDevice - peerIdMsg - error writing json through websocket:", err)
-		return err
+		return nil, err
 	}
 
 	// log.Println("AcceptDevice - metadata sent from acceptDevice")
@@ -461,7 +460,7 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 
 				// log.Println("AcceptDevice - creating adder")
 
-				adder, err = tss.NewExistingClientAdd(newClientPeerID, peerID, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs)
+				adder, err = tss.NewExistingClientAdd(newClientPeerID, peerID, acceptingPeerIDs, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs, dkgResult.GetThreshold(), dkgResult.GetScheme())
 				if err != nil {
 					log.Println("AcceptDevice - error creating newClientAdd():", err)
 					errs <- err
@@ -556,12 +555,10 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	// log.Println("AcceptDevice - start process")
 
 	// Start adder
-	// newDkgResult, err := adder.Process() // UPDATE RETURN
-	_, err = adder.Process() // UPDATE RETURN
+	newDkgResult, err := adder.Process()
 	if err != nil {
 		log.Println("AcceptDevice - error processing adder:", err)
-		errs <- err
-		return nil
+		return nil, err
 	}
 
 	// log.Println("AcceptDevice - process done")
@@ -575,7 +572,7 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	err = ws.ProcessErrors(errs, ctx, c, "AcceptDevice")
 	if err != nil {
 		c.Close(websocket.StatusInternalError, "AcceptDevice process failed")
-		return err
+		return nil, err
 	}
 
 	stage = 40 // only move to next stage after tss process is done
@@ -590,7 +587,7 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	err = wsjson.Write(ctx, c, existingDeviceDoneMsg)
 	if err != nil {
 		log.Println("AcceptDevice - error writing json through websocket:", err)
-		return err
+		return nil, err
 	}
 
 	<-serverDone
@@ -609,7 +606,172 @@ func AcceptDevice(host string, dkgResultStr string, metadata string, authData st
 	// CLOSE WEBSOCKET
 	c.Close(websocket.StatusNormalClosure, "dkg process finished successfully")
 
-	return nil // UPDATE
+	return mergeAddResult(&dkgResult, newDkgResult)
+}
+
+// JoinAcceptDevice takes part in the acceptance of a new device started by another device with AcceptDeviceWithPeers (the peers are set by the device starting the process)
+// It returns the dkg result of this device including the new device
+func JoinAcceptDevice(host string, dkgResultStr string, metadata string, authData string) (*tss.DkgResult, error) {
+
+	// Get temporary access token from server based on auth data
+	token, err := getAccessToken(host, metadata, authData)
+	if err != nil {
+		log.Println("JoinAcceptDevice - error getting access token:", err)
+		return nil, err
+	}
+
+	// Unmarshal dkg results
+	var dkgResult tss.DkgResult
+	err = json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("JoinAcceptDevice - error unmarshaling dkgResult:", err)
+		return nil, err
+	}
+
+	peerID := dkgResult.PeerID
+
+	path := "/accept?token=" + token + "&join=true&peer=" + url.QueryEscape(peerID)
+
+	_host, err := urlToWs(host)
+	if err != nil {
+		log.Println("JoinAcceptDevice - error getting ws host:", err)
+		return nil, err
+	}
+
+	var adder *tss.ExistingClientAdd
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, _host+path, nil)
+	if err != nil {
+		if resp == nil {
+			log.Println("JoinAcceptDevice - error dialing websocket:", err)
+			return nil, err
+		}
+
+		return nil, errorFromResponse(resp)
+	}
+	defer c.Close(websocket.StatusInternalError, "the sky is falling")
+
+	serverDone := make(chan struct{})
+	startTss := make(chan struct{}) // the process can only start once the server shared the new device and all the accepting devices
+	errs := make(chan error, 2)
+
+	var newClientPeerID string
+
+	go func() {
+		for {
+			var msg ws.Message
+			err := wsjson.Read(ctx, c, &msg)
+			if err != nil {
+				if ctx.Err() == context.Canceled {
+					return
+				}
+
+				closeStatus := websocket.CloseStatus(err)
+				if closeStatus == websocket.StatusNormalClosure || closeStatus == websocket.StatusGoingAway {
+					return
+				}
+
+				log.Println("JoinAcceptDevice - error reading message from websocket:", err)
+				errs <- err
+				return
+			}
+
+			switch msg.Type {
+			case ws.PeerIdBroadcastMessage:
+				newClientPeerID = string(msg.Msg)
+
+			case ws.PeersMessage:
+				peers, err := ws.DecodePeers(msg.Msg)
+				if err != nil {
+					log.Println("JoinAcceptDevice - could not decode peers:", err)
+					errs <- err
+					return
+				}
+
+				adder, err = tss.NewExistingClientAdd(newClientPeerID, peerID, peers.PeerIDs, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs, dkgResult.GetThreshold(), dkgResult.GetScheme())
+				if err != nil {
+					log.Println("JoinAcceptDevice - error creating existingClientAdd():", err)
+					errs <- err
+					return
+				}
+
+				close(startTss)
+
+			case ws.TssMessage:
+				if adder == nil {
+					log.Println("JoinAcceptDevice - error: received TSS message before peers message")
+					errs <- errors.New("tss message before peers message")
+					return
+				}
+
+				tssMsg, err := ws.DecodeTssMessage(msg.Msg)
+				if err != nil {
+					log.Println("JoinAcceptDevice - could not decode tss msg:", err)
+					errs <- err
+					return
+				}
+
+				err = adder.HandleMessage(tssMsg)
+				if err != nil {
+					log.Println("JoinAcceptDevice - could not handle tss msg:", err)
+					errs <- err
+					return
+				}
+
+			case ws.NewDeviceDoneMessage:
+				close(serverDone)
+
+			default:
+				log.Println("JoinAcceptDevice - Unexpected message type:", msg.Type)
+			}
+		}
+	}()
+
+	// Wait for all accepting peers to be known
+	select {
+	case <-startTss:
+	case err = <-errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// TSS sending and listening for finish signal
+	go ws.TssSend(adder.GetNextMessageToSendAll, serverDone, errs, ctx, c, "JoinAcceptDevice")
+
+	newDkgResult, err := adder.Process()
+	if err != nil {
+		log.Println("JoinAcceptDevice - error processing adder:", err)
+		return nil, err
+	}
+
+	// Wait for the new device to be stored
+	select {
+	case <-serverDone:
+	case err = <-errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	cancel()
+
+	c.Close(websocket.StatusNormalClosure, "dkg process finished successfully")
+
+	return mergeAddResult(&dkgResult, newDkgResult)
+}
+
+// mergeAddResult adds the new device (and the peers which took part in the process) to the dkg result of an existing device
+func mergeAddResult(original, added *tss.DkgResult) (*tss.DkgResult, error) {
+	merged, ok := tss.MergeDkgResults(original, added)
+	if !ok {
+		log.Println("error merging dkg results after adding device")
+		return nil, errors.New("could not merge dkg results")
+	}
+	return merged, nil
 }
 
 //////////////////////////
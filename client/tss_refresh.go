@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/getmeemaw/meemaw/utils/ws"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Refresh re-randomises the shares of the wallet (server and devices), keeping the same public key and address
+// Every device of the wallet needs to take part: this device starts the refresh, the other devices join it through JoinRefresh
+// Returns the refreshed dkgResult, which replaces the previous one (the metadata does not change). The previous share becomes useless once the refresh succeeded.
+// Returns ErrDevicesMissing if some devices of the wallet did not join: lost devices need to be revoked first (RevokeDevice)
+// Returns ErrUnsupportedScheme for EdDSA wallets: only ECDSA wallets can be refreshed
+// Requires the dkgResult (i.e. client-side of wallet), authData (to confirm authorization and identify user) and host
+func Refresh(host string, dkgResultStr string, metadata string, authData string) (*tss.DkgResult, error) {
+	return runRefresh(host, dkgResultStr, metadata, authData, "")
+}
+
+// JoinRefresh takes part, as an additional device, in the refresh started by another device of the user with Refresh
+func JoinRefresh(host string, dkgResultStr string, metadata string, authData string) (*tss.DkgResult, error) {
+	return runRefresh(host, dkgResultStr, metadata, authData, "&join=true")
+}
+
+func runRefresh(host string, dkgResultStr string, metadata string, authData string, parameters string) (*tss.DkgResult, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("Refresh - error unmarshaling dkgResult:", err)
+		return nil, &types.ErrBadRequest{}
+	}
+
+	// Get temporary access token from server based on auth data
+	token, err := getAccessToken(host, metadata, authData)
+	if err != nil {
+		log.Println("Refresh - error getting access token:", err)
+		return nil, &types.ErrUnauthorized{}
+	}
+
+	path := "/refresh?token=" + token + "&peer=" + url.QueryEscape(dkgResult.PeerID) + parameters
+
+	_host, err := urlToWs(host)
+	if err != nil {
+		log.Println("Refresh - error getting ws host:", err)
+		return nil, &types.ErrBadRequest{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, _host+path, nil)
+	if err != nil {
+		if resp == nil {
+			log.Println("Refresh - error dialing websocket:", err)
+			return nil, err
+		}
+
+		return nil, errorFromResponse(resp)
+	}
+	defer c.Close(websocket.StatusInternalError, "the sky is falling")
+
+	var refresher *tss.ClientRefresh
+
+	refreshDone := make(chan struct{})
+	startTss := make(chan struct{}) // the refresh can only start once the server shared all the peers
+	errs := make(chan error, 2)
+
+	go func() {
+		for {
+			var msg ws.Message
+			err := wsjson.Read(ctx, c, &msg)
+			if err != nil {
+				errs <- err // includes the normal closure from server at the end of the refresh process
+				return
+			}
+
+			switch msg.Type {
+			case ws.PeersMessage:
+				peers, err := ws.DecodePeers(msg.Msg)
+				if err != nil {
+					log.Println("Refresh - could not decode peers:", err)
+					errs <- err
+					return
+				}
+
+				if peers.Scheme != dkgResult.GetScheme() || peers.Threshold != dkgResult.GetThreshold() {
+					log.Println("Refresh - error: server wallet is different:", peers.Scheme, peers.Threshold)
+					errs <- &types.ErrBadRequest{}
+					return
+				}
+
+				refresher, err = tss.NewClientRefresh(&dkgResult, peers.PeerIDs)
+				if err != nil {
+					log.Println("Refresh - error when getting new client refresh:", err)
+					errs <- &types.ErrBadRequest{}
+					return
+				}
+
+				close(startTss)
+
+			case ws.TssMessage:
+				if refresher == nil {
+					log.Println("Refresh - error: received TSS message before peers message")
+					errs <- errors.New("tss message before peers message")
+					return
+				}
+
+				tssMsg, err := ws.DecodeTssMessage(msg.Msg)
+				if err != nil {
+					log.Println("Refresh - could not decode tss msg:", err)
+					errs <- err
+					return
+				}
+
+				err = refresher.HandleMessage(tssMsg)
+				if err != nil {
+					log.Println("Refresh - could not handle tss msg:", err)
+					errs <- err
+					return
+				}
+
+			default:
+				log.Println("Refresh - Unexpected message type:", msg.Type)
+			}
+		}
+	}()
+
+	// Wait for all peers to be known
+	select {
+	case <-startTss:
+	case processErr := <-errs:
+		log.Println("Refresh - error before refresh start:", processErr)
+		var badRequestErr *types.ErrBadRequest
+		if errors.As(processErr, &badRequestErr) {
+			return nil, processErr
+		}
+		if websocket.CloseStatus(processErr) == websocket.StatusTryAgainLater {
+			// the close reason is the error code, e.g. when some devices did not join and need to be revoked
+			var closeErr websocket.CloseError
+			if errors.As(processErr, &closeErr) {
+				if knownErr := types.ErrorFromCode(closeErr.Reason); knownErr != nil {
+					return nil, knownErr
+				}
+			}
+		}
+		return nil, &types.ErrTssProcessFailed{}
+	case <-ctx.Done():
+		return nil, &types.ErrTimeOut{}
+	}
+
+	go ws.TssSend(refresher.GetNextMessageToSend, refreshDone, errs, ctx, c, "Refresh")
+
+	// Start refresh process
+	refreshedDkgResult, err := refresher.Process()
+	close(refreshDone)
+	if err != nil {
+		log.Println("Refresh - error processing refresh:", err)
+		return nil, &types.ErrTssProcessFailed{}
+	}
+
+	// Unlike signing, the refreshed share is only valid if the server stored its own: it waits for every device to acknowledge the refresh,
+	// then confirms it by closing the websocket normally
+	err = wsjson.Write(ctx, c, ws.Message{Type: ws.RefreshAckMessage})
+	if err != nil {
+		log.Println("Refresh - error acknowledging refresh:", err)
+		return nil, &types.ErrTssProcessFailed{}
+	}
+
+	processErr := <-errs
+	if websocket.CloseStatus(processErr) != websocket.StatusNormalClosure {
+		log.Println("Refresh - server did not confirm the refresh:", processErr)
+		return nil, &types.ErrTssProcessFailed{}
+	}
+
+	return refreshedDkgResult, nil
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+// RevokeDevice removes the device peerID from the wallet: the server will not take part in any TSS process with it anymore
+// If refresh is true, the shares are then refreshed so that the share of the revoked device becomes useless (the other remaining devices need to join the refresh through JoinRefresh)
+// Returns the updated dkgResult of this device (refreshed if required), which replaces the previous one. A device revoking itself gets a nil dkgResult.
+// If the refresh fails, the device is revoked nonetheless: the refresh can be retried with Refresh
+// Requires the dkgResult (i.e. client-side of wallet), authData (to confirm authorization and identify user) and host
+func RevokeDevice(host string, dkgResultStr string, metadata string, authData string, peerID string, refresh bool) (*tss.DkgResult, error) {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		log.Println("RevokeDevice - error unmarshaling dkgResult:", err)
+		return nil, &types.ErrBadRequest{}
+	}
+
+	// Get temporary access token from server based on auth data
+	token, err := getAccessToken(host, metadata, authData)
+	if err != nil {
+		log.Println("RevokeDevice - error getting access token:", err)
+		return nil, &types.ErrUnauthorized{}
+	}
+
+	path := "/revoke?token=" + token + "&peer=" + url.QueryEscape(dkgResult.PeerID) + "&device=" + url.QueryEscape(peerID)
+
+	_, err = getDataFromServer(host, "", "", path)
+	if err != nil {
+		log.Println("RevokeDevice - error revoking device:", err)
+		return nil, err
+	}
+
+	if peerID == dkgResult.PeerID {
+		return nil, nil
+	}
+
+	updatedDkgResult, err := tss.RemovePeer(&dkgResult, peerID)
+	if err != nil {
+		// the server has the complete list of devices, the local one can be outdated: the device is revoked anyway
+		log.Println("RevokeDevice - could not remove device from local dkgResult:", err)
+		updatedDkgResult = &dkgResult
+	}
+
+	if !refresh {
+		return updatedDkgResult, nil
+	}
+
+	updatedDkgResultBytes, err := json.Marshal(updatedDkgResult)
+	if err != nil {
+		log.Println("RevokeDevice - error marshaling dkgResult:", err)
+		return nil, err
+	}
+
+	return Refresh(host, string(updatedDkgResultBytes), metadata, authData)
+}
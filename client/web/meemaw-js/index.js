@@ -35,8 +35,8 @@ export class Wallet {
         return "0x"+signedTx;
     }
 
-    // SignBytes signs hex encoded bytes using TSS
-    async SignBytes(raw) {
+    // SignBytes signs hex encoded bytes using TSS, with the key of the wallet or its child key at path (e.g. m/0/1, see DeriveAddress)
+    async SignBytes(raw, path = "") {
 
         if (!(/^0x[0-9a-fA-F]+$/i.test(raw))) {
             throw new Error("Incorrect format. Requires hex encoded data.");
@@ -45,7 +45,7 @@ export class Wallet {
         let signature = ""
 
         try {
-            signature = await window.SignBytes(this.host, raw, this.dkgResult, this.metadata, this.authData);
+            signature = await window.SignBytes(this.host, raw, this.dkgResult, this.metadata, this.authData, path);
         } catch (error) {
             console.error("SignBytes - error:", error)
             throw error;
@@ -54,6 +54,94 @@ export class Wallet {
         return "0x"+signature;
     }
 
+    // SignEthMessage signs an Ethereum message (EIP-191, as personal_sign) using TSS
+    // The message is either a string (utf-8 encoded) or hex encoded bytes (0x...)
+    async SignEthMessage(message) {
+
+        let hexMessage = "";
+        if (/^0x[0-9a-fA-F]*$/i.test(message) && message.length % 2 == 0) {
+            hexMessage = message;
+        } else {
+            hexMessage = "0x" + Array.from(new TextEncoder().encode(message), (b) => b.toString(16).padStart(2, "0")).join("");
+        }
+
+        let signature = ""
+
+        try {
+            signature = await window.SignEthMessage(this.host, hexMessage, this.dkgResult, this.metadata, this.authData);
+        } catch (error) {
+            console.error("SignEthMessage - error:", error)
+            throw error;
+        }
+
+        return "0x"+signature;
+    }
+
+    // SignTypedData signs EIP-712 typed data (object or json, as eth_signTypedData_v4) using TSS
+    async SignTypedData(typedData) {
+
+        if (typeof typedData !== "string") {
+            typedData = JSON.stringify(typedData, (key, value) => typeof value === "bigint" ? value.toString() : value);
+        }
+
+        let signature = ""
+
+        try {
+            signature = await window.SignTypedData(this.host, typedData, this.dkgResult, this.metadata, this.authData);
+        } catch (error) {
+            console.error("SignTypedData - error:", error)
+            throw error;
+        }
+
+        return "0x"+signature;
+    }
+
+    // SignPsbt signs the inputs of the wallet in a Bitcoin PSBT (base64 or hex encoded) using TSS (network: mainnet, testnet, signet or regtest)
+    // Returns the hex encoded signed transaction, or the base64 encoded PSBT if inputs of other signers remain
+    async SignPsbt(psbt, network = "mainnet") {
+
+        let signed = ""
+
+        try {
+            signed = await window.SignPsbt(this.host, psbt, network, this.dkgResult, this.metadata, this.authData);
+        } catch (error) {
+            console.error("SignPsbt - error:", error)
+            throw error;
+        }
+
+        return signed;
+    }
+
+    // DeriveAddress returns the address of the child key of the wallet at the non-hardened derivation path (e.g. m/0/1)
+    async DeriveAddress(path) {
+        try {
+            return await window.DeriveAddress(this.dkgResult, path);
+        } catch (error) {
+            console.error("DeriveAddress - error:", error)
+            throw error;
+        }
+    }
+
+    // BitcoinAddress returns the native segwit address of the wallet (network: mainnet, testnet, signet or regtest)
+    async BitcoinAddress(network = "mainnet") {
+        try {
+            return await window.BitcoinAddress(this.dkgResult, network);
+        } catch (error) {
+            console.error("BitcoinAddress - error:", error)
+            throw error;
+        }
+    }
+
+    // BitcoinTaprootAddress returns the taproot address of the wallet (network: mainnet, testnet, signet or regtest)
+    async BitcoinTaprootAddress(network = "mainnet") {
+        try {
+            return await window.BitcoinTaprootAddress(this.dkgResult, network);
+        } catch (error) {
+            console.error("BitcoinTaprootAddress - error:", error)
+            throw error;
+        }
+    }
+
     // Export exports the private key based on client and server shares
     async Export() {
 
@@ -12,7 +12,6 @@ import (
 
 	"github.com/getmeemaw/meemaw/client"
 	"github.com/getmeemaw/meemaw/utils/tss"
-	"github.com/getmeemaw/meemaw/utils/tx"
 )
 
 /////////
@@ -37,8 +36,13 @@ func main() {
 	js.Global().Set("Backup", asyncFunc(Backup))
 	js.Global().Set("FromBackup", asyncFunc(FromBackup))
 	js.Global().Set("SignBytes", asyncFunc(SignBytes))
-	// js.Global().Set("SignEthMessage", asyncFunc(SignEthMessage))
+	js.Global().Set("SignEthMessage", asyncFunc(SignEthMessage))
+	js.Global().Set("SignTypedData", asyncFunc(SignTypedData))
 	js.Global().Set("SignEthTransaction", asyncFunc(SignEthTransaction))
+	js.Global().Set("SignPsbt", asyncFunc(SignPsbt))
+	js.Global().Set("BitcoinAddress", asyncFunc(BitcoinAddress))
+	js.Global().Set("BitcoinTaprootAddress", asyncFunc(BitcoinTaprootAddress))
+	js.Global().Set("DeriveAddress", asyncFunc(DeriveAddress))
 	js.Global().Set("Export", asyncFunc(Export))
 
 	select {}
@@ -177,7 +181,7 @@ func FromBackup(this js.Value, args []js.Value) (any, error) {
 	return string(respJSON), err
 }
 
-// input : host, message (hex encoded bytes), dkgResultStr, authData
+// input : host, message (hex encoded bytes), dkgResultStr, authData, derivation path (optional)
 // output : signed message, error
 func SignBytes(this js.Value, args []js.Value) (any, error) {
 	host := args[0].String()
@@ -185,6 +189,11 @@ func SignBytes(this js.Value, args []js.Value) (any, error) {
 	metadata := args[3].String()
 	authData := args[4].String()
 
+	path := ""
+	if len(args) > 5 && args[5].Type() == js.TypeString {
+		path = args[5].String()
+	}
+
 	hexEncodedMsg := args[1].String()
 	trimmedHexEncodedMsg := strings.TrimPrefix(strings.TrimSuffix(strings.ReplaceAll(hexEncodedMsg, "\"", ""), "\n"), "0x")
 	message, err := hex.DecodeString(trimmedHexEncodedMsg)
@@ -193,7 +202,7 @@ func SignBytes(this js.Value, args []js.Value) (any, error) {
 		return nil, err
 	}
 
-	signature, err := client.Sign(host, message, dkgResultStr, metadata, authData)
+	signature, err := client.SignWithOptions(host, message, dkgResultStr, metadata, authData, client.SignOptions{Path: path})
 	if err != nil {
 		log.Println("SignBytes - error while signing:", err)
 		return nil, err
@@ -204,6 +213,112 @@ func SignBytes(this js.Value, args []js.Value) (any, error) {
 	return ret, nil
 }
 
+// input : host, message (hex encoded bytes), dkgResultStr, authData
+// output : signature (EIP-191), error
+func SignEthMessage(this js.Value, args []js.Value) (any, error) {
+	host := args[0].String()
+	dkgResultStr := args[2].String()
+	metadata := args[3].String()
+	authData := args[4].String()
+
+	hexEncodedMsg := args[1].String()
+	message, err := hex.DecodeString(strings.TrimPrefix(hexEncodedMsg, "0x"))
+	if err != nil {
+		log.Println("SignEthMessage - error while hex decoding message:", err)
+		return nil, err
+	}
+
+	signature, err := client.SignEthMessage(host, message, dkgResultStr, metadata, authData)
+	if err != nil {
+		log.Println("SignEthMessage - error while signing:", err)
+		return nil, err
+	}
+
+	return signature, nil
+}
+
+// input : host, json encoded typed data, dkgResultStr, authData
+// output : signature (EIP-712), error
+func SignTypedData(this js.Value, args []js.Value) (any, error) {
+	host := args[0].String()
+	jsonTypedData := args[1].String()
+	dkgResultStr := args[2].String()
+	metadata := args[3].String()
+	authData := args[4].String()
+
+	signature, err := client.SignTypedData(host, jsonTypedData, dkgResultStr, metadata, authData)
+	if err != nil {
+		log.Println("SignTypedData - error while signing:", err)
+		return nil, err
+	}
+
+	return signature, nil
+}
+
+// input : host, psbt (base64 or hex encoded), network (mainnet, testnet, signet or regtest), dkgResultStr, authData
+// output : signed transaction (hex encoded), or signed psbt (base64 encoded) if inputs of other signers remain, error
+func SignPsbt(this js.Value, args []js.Value) (any, error) {
+	host := args[0].String()
+	encodedPsbt := args[1].String()
+	network := args[2].String()
+	dkgResultStr := args[3].String()
+	metadata := args[4].String()
+	authData := args[5].String()
+
+	signed, err := client.SignPsbt(host, encodedPsbt, network, dkgResultStr, metadata, authData)
+	if err != nil {
+		log.Println("SignPsbt - error while signing:", err)
+		return nil, err
+	}
+
+	return signed, nil
+}
+
+// input : dkgResultStr, network (mainnet, testnet, signet or regtest)
+// output : bitcoin address (P2WPKH), error
+func BitcoinAddress(this js.Value, args []js.Value) (any, error) {
+	dkgResultStr := args[0].String()
+	network := args[1].String()
+
+	address, err := client.BitcoinAddress(dkgResultStr, network)
+	if err != nil {
+		log.Println("BitcoinAddress - error while getting address:", err)
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// input : dkgResultStr, network (mainnet, testnet, signet or regtest)
+// output : bitcoin address (P2TR), error
+func BitcoinTaprootAddress(this js.Value, args []js.Value) (any, error) {
+	dkgResultStr := args[0].String()
+	network := args[1].String()
+
+	address, err := client.BitcoinTaprootAddress(dkgResultStr, network)
+	if err != nil {
+		log.Println("BitcoinTaprootAddress - error while getting address:", err)
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// input : dkgResultStr, derivation path (e.g. m/0/1)
+// output : address of the child key, error
+func DeriveAddress(this js.Value, args []js.Value) (any, error) {
+	dkgResultStr := args[0].String()
+	path := args[1].String()
+
+	address, err := client.DeriveAddress(dkgResultStr, path)
+	if err != nil {
+		log.Println("DeriveAddress - error while deriving address:", err)
+		return nil, err
+	}
+
+	return address, nil
+}
+
 // input : host, dkgResultStr, authData
 // output : privateKey, error
 func Export(this js.Value, args []js.Value) (any, error) {
@@ -237,22 +352,12 @@ func SignEthTransaction(this js.Value, args []js.Value) (any, error) {
 
 	jsonEncodedTx := args[1].String()
 
-	_tx, err := tx.NewEthereumTxWithJson(jsonEncodedTx, chainId)
-	if err != nil {
-		log.Println("SignEthTransaction - error while initialising tx:", err)
-		return nil, err
-	}
-
-	message := _tx.GenerateMessage()
-
-	signature, err := client.Sign(host, message, dkgResultStr, metadata, authData)
+	signedTx, err := client.SignEthTransaction(host, jsonEncodedTx, chainId, dkgResultStr, metadata, authData)
 	if err != nil {
 		log.Println("SignEthTransaction - error while signing:", err)
 		return nil, err
 	}
 
-	signedTx, err := _tx.Sign(signature.Signature)
-
 	return signedTx, nil
 }
 
@@ -0,0 +1,493 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/tx"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+/////////
+//
+// Some signatures need a human or a risk engine in the loop: the policy decides which ones (ApprovalAboveValue, ApprovalAboveBitcoinValue, ApprovalForMessages).
+// Before co-signing those, the server calls the approval webhook (if configured) with the decoded request and waits for its decision, at most ApprovalTimeout.
+// Undecided requests stay pending (approvalTtl) and can be approved or denied later through the admin endpoints: the device then signs again, and the approval is used once.
+// An approval is only used up by a successful signature: if the signing fails, the device can sign again with it.
+// An approval is bound to what is signed (user, message, signature type and derivation path), and the admin api key of a tenant only reaches the requests of its users.
+// The inputs of a bitcoin transaction are signed one by one: its approval is bound to the transaction and covers all of them.
+// Pending approvals are kept in memory by each server instance.
+//
+/////////
+
+const approvalTtl = 24 * time.Hour
+
+// approval statuses
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+)
+
+// ApprovalRequest is the signing request sent to the approval webhook and listed by the admin endpoint
+type ApprovalRequest struct {
+	ID            string               `json:"id"`
+	Tenant        string               `json:"tenant,omitempty"` // empty without tenants
+	UserId        string               `json:"userId"`
+	PeerID        string               `json:"peerId"`
+	Message       string               `json:"message"`                 // hex-encoded message (hash of the transaction, if any)
+	SignatureType string               `json:"signatureType,omitempty"` // schnorr or taproot, empty for the signature of the scheme of the wallet
+	Path          string               `json:"path,omitempty"`          // derivation path of the signing key, empty for the key of the wallet
+	Transaction   *ApprovalTransaction `json:"transaction,omitempty"`   // nil for raw messages
+	Psbt          *bitcoin.Spend       `json:"psbt,omitempty"`          // bitcoin transaction, message being the sighash of its first input to sign
+	Status        string               `json:"status"`
+	Reason        string               `json:"reason,omitempty"` // of the denial
+	CreatedAt     time.Time            `json:"createdAt"`
+}
+
+// ApprovalTransaction holds the decoded fields of the transaction to be signed
+type ApprovalTransaction struct {
+	ChainId  string `json:"chainId"`
+	To       string `json:"to"`
+	Value    string `json:"value"` // wei
+	Data     string `json:"data"`  // hex-encoded
+	Nonce    uint64 `json:"nonce"`
+	Gas      uint64 `json:"gas"`
+	GasPrice string `json:"gasPrice"` // wei, max fee per gas for EIP-1559 transactions
+
+	TokenCall *ApprovalTokenCall `json:"tokenCall,omitempty"` // decoded ERC-20 call, if any
+}
+
+// ApprovalTokenCall holds the decoded ERC-20 call of the transaction (see tx.TokenCall)
+type ApprovalTokenCall struct {
+	Method    string `json:"method"` // transfer, transferFrom or approve
+	Token     string `json:"token"`
+	Recipient string `json:"recipient"` // spender for approve
+	Amount    string `json:"amount"`    // in the smallest unit of the token
+}
+
+// approvalDecision is the response of the approval webhook
+type approvalDecision struct {
+	Decision string `json:"decision"` // approve, deny or pending
+	Reason   string `json:"reason"`
+}
+
+type pendingApproval struct {
+	request ApprovalRequest
+	decided chan struct{} // closed once approved or denied
+	inUse   bool          // a signing process is using the approval (see use)
+}
+
+// approvalQueue keeps the approval requests by signing session (see sign)
+type approvalQueue struct {
+	mu       sync.Mutex
+	requests map[string]*pendingApproval // by session key
+}
+
+func newApprovalQueue() *approvalQueue {
+	return &approvalQueue{requests: make(map[string]*pendingApproval)}
+}
+
+// requiresApproval returns whether the policy requires an approval before co-signing
+func (policy *Policy) requiresApproval(ethTx *tx.EthereumTx) bool {
+	if ethTx == nil {
+		return policy.ApprovalForMessages
+	}
+
+	if policy.ApprovalAboveValue != nil && ethTx.Tx().Value().Cmp(policy.ApprovalAboveValue) > 0 {
+		return true
+	}
+
+	tokenCall, _ := ethTx.TokenCall() // already checked by Check
+	if tokenCall == nil || len(policy.ApprovalAboveTokenValue) == 0 {
+		return false
+	}
+
+	threshold := tokenValue(policy.ApprovalAboveTokenValue, tokenCall.Token.Hex())
+	return threshold == nil || tokenCall.Amount.Cmp(threshold) > 0
+}
+
+// requiresPsbtApproval returns whether the policy requires an approval before co-signing the inputs of the bitcoin transaction
+func (policy *Policy) requiresPsbtApproval(spend *bitcoin.Spend) bool {
+	return policy.ApprovalAboveBitcoinValue != nil && big.NewInt(spend.Value).Cmp(policy.ApprovalAboveBitcoinValue) > 0
+}
+
+// waitApproval blocks until the signing request is approved (nil), denied (types.ErrPolicyRejected) or still pending after ApprovalTimeout (types.ErrApprovalPending)
+// sessionKey identifies what is signed (user, message, signature type and derivation path, see sign): an approval only allows signing the same thing again
+// spend is the bitcoin transaction message is the sighash of an input of (nil otherwise): its approval allows signing all its inputs, until it expires
+// settle must be called once the message is signed or not: the approval is only used up by a successful signature
+func (server *Server) waitApproval(ctx context.Context, sessionKey string, userId string, peerID string, message []byte, signatureType string, path string, ethTx *tx.EthereumTx, spend *bitcoin.Spend) (settle func(signed bool), err error) {
+	settle = func(bool) {}
+
+	policy, err := server._getPolicy(ctx, server)
+	if err != nil {
+		return settle, err
+	}
+
+	if policy == nil {
+		return settle, nil
+	}
+
+	reusable := false
+	if spend != nil {
+		if !policy.requiresPsbtApproval(spend) {
+			return settle, nil
+		}
+		// signing the transaction again cannot spend more: the approval is bound to it rather than to the input
+		sessionKey = userId + "-psbt-" + spend.Network + "-" + spend.TxID
+		reusable = true
+	} else if !policy.requiresApproval(ethTx) {
+		return settle, nil
+	}
+
+	request := ApprovalRequest{
+		Tenant:        server.tenant(ctx).ID,
+		UserId:        userId,
+		PeerID:        peerID,
+		Message:       hex.EncodeToString(message),
+		SignatureType: signatureType,
+		Path:          path,
+		Transaction:   approvalTransaction(ethTx),
+		Psbt:          spend,
+	}
+
+	approval, created := server._approvals.getOrCreate(sessionKey, request)
+
+	if created && len(server._config.ApprovalWebhookUrl) > 0 {
+		go server.callApprovalWebhook(approval.request)
+	}
+
+	timeout := time.NewTimer(time.Duration(server._config.ApprovalTimeout) * time.Second)
+	defer timeout.Stop()
+
+	select {
+	case <-approval.decided:
+	case <-timeout.C:
+	case <-ctx.Done():
+	}
+
+	err = server._approvals.use(sessionKey, approval, reusable)
+	if err != nil {
+		return settle, err
+	}
+
+	if reusable {
+		return settle, nil
+	}
+
+	return func(signed bool) { server._approvals.settle(sessionKey, approval, signed) }, nil
+}
+
+// approvalTransaction returns the decoded fields of the transaction, nil for raw messages
+func approvalTransaction(ethTx *tx.EthereumTx) *ApprovalTransaction {
+	if ethTx == nil {
+		return nil
+	}
+
+	transaction := ethTx.Tx()
+	approvalTx := &ApprovalTransaction{
+		ChainId:  ethTx.ChainId().String(),
+		Value:    transaction.Value().String(),
+		Data:     hex.EncodeToString(transaction.Data()),
+		Nonce:    transaction.Nonce(),
+		Gas:      transaction.Gas(),
+		GasPrice: transaction.GasFeeCap().String(),
+	}
+	if transaction.To() != nil {
+		approvalTx.To = transaction.To().Hex()
+	}
+
+	if tokenCall, err := ethTx.TokenCall(); err == nil && tokenCall != nil {
+		approvalTx.TokenCall = &ApprovalTokenCall{
+			Method:    tokenCall.Method,
+			Token:     tokenCall.Token.Hex(),
+			Recipient: tokenCall.Recipient.Hex(),
+			Amount:    tokenCall.Amount.String(),
+		}
+	}
+
+	return approvalTx
+}
+
+// callApprovalWebhook sends the request to the approval webhook and applies its decision, if any
+func (server *Server) callApprovalWebhook(request ApprovalRequest) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Println("Error encoding approval request:", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", server._config.ApprovalWebhookUrl, bytes.NewReader(body))
+	if err != nil {
+		log.Println("Error creating approval webhook request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// allows the webhook to verify that the request comes from the server
+	if len(server._config.ApprovalWebhookSecret) > 0 {
+		mac := hmac.New(sha256.New, []byte(server._config.ApprovalWebhookSecret))
+		mac.Write(body)
+		req.Header.Set("M-SIGNATURE", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: time.Duration(server._config.ApprovalTimeout)*time.Second + 5*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Error calling approval webhook, request stays pending:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		log.Println("Approval webhook responded with status", resp.StatusCode, ", request stays pending")
+		return
+	}
+
+	var decision approvalDecision
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&decision)
+	if err != nil {
+		log.Println("Error decoding approval webhook response, request stays pending:", err)
+		return
+	}
+
+	switch decision.Decision {
+	case "approve":
+		err = server._approvals.decide(request.Tenant, request.ID, true, "")
+	case "deny":
+		err = server._approvals.decide(request.Tenant, request.ID, false, decision.Reason)
+	case "pending":
+	default:
+		log.Println("Unknown decision from approval webhook, request stays pending:", decision.Decision)
+	}
+	if err != nil {
+		log.Println("Error applying decision of approval webhook:", err)
+	}
+}
+
+// getOrCreate returns the approval request of the signing session, creating it from request if there is none
+func (queue *approvalQueue) getOrCreate(key string, request ApprovalRequest) (*pendingApproval, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.expire()
+
+	if approval, ok := queue.requests[key]; ok {
+		return approval, false
+	}
+
+	request.ID = uuid.New().String()
+	request.Status = approvalPending
+	request.CreatedAt = time.Now()
+
+	approval := &pendingApproval{request: request, decided: make(chan struct{})}
+	queue.requests[key] = approval
+
+	log.Println("Approval required for signing request", request.ID)
+
+	return approval, true
+}
+
+// use returns the outcome of the approval request of the signing session. An approval which is not reusable is used by one signing process at a time, until settle
+func (queue *approvalQueue) use(key string, approval *pendingApproval, reusable bool) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.requests[key] != approval {
+		return &types.ErrApprovalPending{} // expired, or used up meanwhile
+	}
+
+	switch approval.request.Status {
+	case approvalApproved:
+		if !reusable {
+			if approval.inUse {
+				return &types.ErrApprovalPending{}
+			}
+			approval.inUse = true
+		}
+		return nil
+	case approvalDenied:
+		delete(queue.requests, key)
+		reason := "denied by approver"
+		if len(approval.request.Reason) > 0 {
+			reason += ": " + approval.request.Reason
+		}
+		return &types.ErrPolicyRejected{Reason: reason}
+	default:
+		return &types.ErrApprovalPending{}
+	}
+}
+
+// settle ends the use of the approval by a signing process: used up if the message was signed, usable again otherwise
+func (queue *approvalQueue) settle(key string, approval *pendingApproval, signed bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.requests[key] != approval {
+		return
+	}
+
+	if signed {
+		delete(queue.requests, key)
+	} else {
+		approval.inUse = false
+	}
+}
+
+// decide approves or denies the pending approval request of the tenant
+func (queue *approvalQueue) decide(tenantID string, id string, approve bool, reason string) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for _, approval := range queue.requests {
+		if approval.request.ID != id || approval.request.Tenant != tenantID {
+			continue
+		}
+
+		if approval.request.Status != approvalPending {
+			return &types.ErrConflict{}
+		}
+
+		if approve {
+			approval.request.Status = approvalApproved
+		} else {
+			approval.request.Status = approvalDenied
+			approval.request.Reason = reason
+		}
+		close(approval.decided)
+
+		log.Println("Signing request", id, approval.request.Status)
+		return nil
+	}
+
+	return &types.ErrNotFound{}
+}
+
+// list returns the approval requests of the tenant, oldest first
+func (queue *approvalQueue) list(tenantID string) []ApprovalRequest {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.expire()
+
+	requests := make([]ApprovalRequest, 0, len(queue.requests))
+	for _, approval := range queue.requests {
+		if approval.request.Tenant == tenantID {
+			requests = append(requests, approval.request)
+		}
+	}
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt.Before(requests[j].CreatedAt) })
+
+	return requests
+}
+
+// expire removes the requests older than approvalTtl. Requires the lock.
+func (queue *approvalQueue) expire() {
+	for key, approval := range queue.requests {
+		if time.Since(approval.request.CreatedAt) > approvalTtl {
+			delete(queue.requests, key)
+		}
+	}
+}
+
+///////
+/// Admin endpoints
+
+// adminMiddleware verifies the admin api key (Authorization: Bearer <AdminApiKey of a tenant>) and adds the tenant it belongs to in the context
+// admin endpoints do not exist without admin api keys
+func (server *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants := server._config.Tenants
+		if !server.multiTenant() {
+			tenants = []*Tenant{server.tenant(r.Context())}
+		}
+
+		apiKey := getBearerTokenFromHeader(r.Header.Get("Authorization"))
+		enabled := false
+		for _, tenant := range tenants {
+			if len(tenant.AdminApiKey) == 0 {
+				continue
+			}
+			enabled = true
+
+			if subtle.ConstantTimeCompare([]byte(apiKey), []byte(tenant.AdminApiKey)) == 1 {
+				ctx := context.WithValue(r.Context(), types.ContextKey("adminTenant"), tenant.ID)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		if !enabled {
+			httpError(w, r, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		log.Println("Wrong admin api key")
+		httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// adminTenant returns the id of the tenant of the admin api key (see adminMiddleware)
+func adminTenant(ctx context.Context) string {
+	tenantID, _ := ctx.Value(types.ContextKey("adminTenant")).(string)
+	return tenantID
+}
+
+// ApprovalsHandler lists the approval requests of the tenant (pending, or decided but not used yet)
+func (server *Server) ApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, server._approvals.list(adminTenant(r.Context())))
+}
+
+// ApproveHandler approves the approval request
+func (server *Server) ApproveHandler(w http.ResponseWriter, r *http.Request) {
+	server.decideApproval(w, r, true)
+}
+
+// DenyHandler denies the approval request, with an optional reason (JSON body {"reason": "..."})
+func (server *Server) DenyHandler(w http.ResponseWriter, r *http.Request) {
+	server.decideApproval(w, r, false)
+}
+
+func (server *Server) decideApproval(w http.ResponseWriter, r *http.Request, approve bool) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength > 0 {
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body)
+		if err != nil {
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := server._approvals.decide(adminTenant(r.Context()), chi.URLParam(r, "id"), approve, body.Reason)
+	if err != nil {
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Approval request not found", http.StatusNotFound)
+		} else if errors.Is(err, &types.ErrConflict{}) {
+			httpError(w, r, "Approval request already decided", http.StatusConflict)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getmeemaw/meemaw/utils/tx"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+func TestApproval(t *testing.T) {
+	transfer, err := tx.NewEthereumTxWithJson(`{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"1000","nonce":1,"gasLimit":21000,"gasPrice":"1000000000"}`, 1)
+	if err != nil {
+		t.Fatalf("could not create tx: %s", err)
+	}
+	// transfer of 1000 USDC units
+	tokenTransfer, err := tx.NewEthereumTxWithJson(`{"to":"0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48","value":"1000","nonce":1,"gasLimit":60000,"gasPrice":"1000000000","data":"0xa9059cbb000000000000000000000000809ccc37d2dd55a8e8fa58fc51d101c6b22425a800000000000000000000000000000000000000000000000000000000000003e8"}`, 1)
+	if err != nil {
+		t.Fatalf("could not create tx: %s", err)
+	}
+	usdc := "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"
+	message := []byte("message")
+	ctx := context.Background()
+
+	///////////////////
+	/// TEST 1 : which requests need an approval
+
+	for i, test := range []struct {
+		policy   Policy
+		ethTx    *tx.EthereumTx
+		required bool
+	}{
+		{Policy{}, transfer, false},
+		{Policy{}, nil, false},
+		{Policy{ApprovalAboveValue: big.NewInt(1000)}, transfer, false},
+		{Policy{ApprovalAboveValue: big.NewInt(999)}, transfer, true},
+		{Policy{ApprovalAboveValue: big.NewInt(999)}, nil, false},
+		{Policy{ApprovalForMessages: true}, nil, true},
+		{Policy{ApprovalAboveValue: big.NewInt(1000)}, tokenTransfer, false},
+		{Policy{ApprovalAboveTokenValue: map[string]*big.Int{usdc: big.NewInt(1000)}}, tokenTransfer, false},
+		{Policy{ApprovalAboveTokenValue: map[string]*big.Int{usdc: big.NewInt(999)}}, tokenTransfer, true},
+		{Policy{ApprovalAboveTokenValue: map[string]*big.Int{"0xdAC17F958D2ee523a2206206994597C13D831ec7": big.NewInt(1000)}}, tokenTransfer, true}, // token not listed
+		{Policy{ApprovalAboveTokenValue: map[string]*big.Int{usdc: big.NewInt(999)}}, transfer, false},
+	} {
+		if required := test.policy.requiresApproval(test.ethTx); required != test.required {
+			t.Errorf("Failed test 1.%d: expected approval required to be %t", i, test.required)
+		}
+	}
+
+	///////////////////
+	/// TEST 2 : approved by the webhook, with a signed body
+
+	secret := "webhook-secret"
+	decision := "approve"
+	var received ApprovalRequest
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if r.Header.Get("M-SIGNATURE") != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.Unmarshal(body, &received)
+		json.NewEncoder(w).Encode(map[string]string{"decision": decision, "reason": "above the limit of the compliance team"})
+	}))
+	defer webhook.Close()
+
+	policy := &Policy{ApprovalAboveValue: big.NewInt(500), ApprovalForMessages: true}
+	_server := NewServer(nil, &Config{Policy: policy, ApprovalWebhookUrl: webhook.URL, ApprovalWebhookSecret: secret, ApprovalTimeout: 5}, nil, false)
+
+	_, err = _server.waitApproval(ctx, "alice-session", "alice", "client", message, "", "", transfer, nil)
+	if err != nil {
+		t.Errorf("Failed test 2: expected approval, got %s", err)
+	}
+
+	if received.UserId != "alice" || received.PeerID != "client" || received.Transaction == nil || received.Transaction.Value != "1000" || received.Transaction.ChainId != "1" || received.Transaction.TokenCall != nil {
+		t.Errorf("Failed test 2: unexpected request received by the webhook %+v", received)
+	}
+
+	// ERC-20 calls are decoded for the webhook
+	_, err = _server.waitApproval(ctx, "alice-token-session", "alice", "client", tokenTransfer.GenerateMessage(), "", "", tokenTransfer, nil)
+	if err != nil {
+		t.Errorf("Failed test 2: expected approval of the token transfer, got %s", err)
+	}
+
+	if tokenCall := received.Transaction.TokenCall; tokenCall == nil || tokenCall.Method != "transfer" || tokenCall.Amount != "1000" || !strings.EqualFold(tokenCall.Recipient, "0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8") {
+		t.Errorf("Failed test 2: expected the decoded token call in the webhook request, got %+v", received.Transaction)
+	}
+
+	///////////////////
+	/// TEST 3 : denied by the webhook
+
+	decision = "deny"
+
+	_, err = _server.waitApproval(ctx, "alice-message-session", "alice", "client", message, "", "", nil, nil)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) || !strings.Contains(err.Error(), "compliance team") {
+		t.Errorf("Failed test 3: expected denial with reason, got %v", err)
+	}
+
+	///////////////////
+	/// TEST 4 : pending, then approved through the admin endpoints
+
+	_server = NewServer(nil, &Config{Policy: policy, AdminApiKey: "admin-key"}, nil, false)
+
+	_, err = _server.waitApproval(ctx, "bob-session", "bob", "client", message, "", "", transfer, nil)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Fatalf("Failed test 4: expected approval pending, got %v", err)
+	}
+
+	testServer := httptest.NewServer(_server.Router())
+	defer testServer.Close()
+
+	admin := func(method, path, apiKey string) (int, string) {
+		req, _ := http.NewRequest(method, testServer.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not request %s: %s", path, err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	statusCode, _ := admin("GET", "/admin/approvals", "wrong-key")
+	if statusCode != 401 {
+		t.Errorf("Failed test 4: expected 401 with wrong admin api key, got %d", statusCode)
+	}
+
+	statusCode, body := admin("GET", "/admin/approvals", "admin-key")
+	var approvals []ApprovalRequest
+	json.Unmarshal([]byte(body), &approvals)
+	if statusCode != 200 || len(approvals) != 1 || approvals[0].UserId != "bob" || approvals[0].Status != "pending" {
+		t.Fatalf("Failed test 4: expected the pending request, got %d %s", statusCode, body)
+	}
+
+	statusCode, _ = admin("POST", "/admin/approvals/"+approvals[0].ID+"/approve", "admin-key")
+	if statusCode != 204 {
+		t.Errorf("Failed test 4: expected approval to succeed, got %d", statusCode)
+	}
+
+	statusCode, body = admin("POST", "/admin/approvals/"+approvals[0].ID+"/deny", "admin-key")
+	if statusCode != 409 || errorResponseCode(body) != "conflict" {
+		t.Errorf("Failed test 4: expected decided request to conflict, got %d %s", statusCode, body)
+	}
+
+	statusCode, _ = admin("POST", "/admin/approvals/unknown/approve", "admin-key")
+	if statusCode != 404 {
+		t.Errorf("Failed test 4: expected 404 for unknown request, got %d", statusCode)
+	}
+
+	// the approval does not allow signing the message with another key
+	_, err = _server.waitApproval(ctx, "bob-session-path[0]", "bob", "client", message, "", "m/0", transfer, nil)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Errorf("Failed test 4: expected the approval to be bound to the derivation path, got %v", err)
+	}
+
+	settle, err := _server.waitApproval(ctx, "bob-session", "bob", "client", message, "", "", transfer, nil)
+	if err != nil {
+		t.Fatalf("Failed test 4: expected approved request to be signed, got %s", err)
+	}
+
+	// one signing process at a time
+	_, err = _server.waitApproval(ctx, "bob-session", "bob", "client", message, "", "", transfer, nil)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Errorf("Failed test 4: expected the approval in use to be pending, got %v", err)
+	}
+
+	// a failed signing does not use up the approval
+	settle(false)
+
+	settle, err = _server.waitApproval(ctx, "bob-session", "bob", "client", message, "", "", transfer, nil)
+	if err != nil {
+		t.Fatalf("Failed test 4: expected the approval to be usable after a failed signing, got %s", err)
+	}
+	settle(true)
+
+	// approvals are used once
+	_, err = _server.waitApproval(ctx, "bob-session", "bob", "client", message, "", "", transfer, nil)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Errorf("Failed test 4: expected a new approval to be required, got %v", err)
+	}
+
+	///////////////////
+	/// TEST 5 : admin endpoints disabled without admin api key
+
+	_server = NewServer(nil, &Config{Policy: policy}, nil, false)
+
+	noAdminServer := httptest.NewServer(_server.Router())
+	defer noAdminServer.Close()
+
+	resp, err := http.Get(noAdminServer.URL + "/admin/approvals")
+	if err != nil {
+		t.Fatalf("could not request /admin/approvals: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 404 {
+		t.Errorf("Failed test 5: expected 404 without admin api key, got %d", resp.StatusCode)
+	}
+
+	///////////////////
+	/// TEST 6 : admin api keys scoped by tenant
+
+	app1 := &Tenant{ID: "app1", Policy: policy, AdminApiKey: "admin-key-1"}
+	app2 := &Tenant{ID: "app2", Policy: policy, AdminApiKey: "admin-key-2"}
+	_server = NewServer(nil, &Config{Policy: policy, Tenants: []*Tenant{app1, app2}}, nil, false)
+
+	app1Ctx := context.WithValue(ctx, types.ContextKey("tenantConfig"), app1)
+	_, err = _server.waitApproval(app1Ctx, "app1:carol-session", "app1:carol", "client", message, "", "", transfer, nil)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Fatalf("Failed test 6: expected approval pending, got %v", err)
+	}
+
+	tenantsServer := httptest.NewServer(_server.Router())
+	defer tenantsServer.Close()
+	testServer = tenantsServer
+
+	statusCode, body = admin("GET", "/admin/approvals", "admin-key-2")
+	approvals = nil
+	json.Unmarshal([]byte(body), &approvals)
+	if statusCode != 200 || len(approvals) != 0 {
+		t.Errorf("Failed test 6: expected no request for another tenant, got %d %s", statusCode, body)
+	}
+
+	statusCode, body = admin("GET", "/admin/approvals", "admin-key-1")
+	json.Unmarshal([]byte(body), &approvals)
+	if statusCode != 200 || len(approvals) != 1 || approvals[0].Tenant != "app1" {
+		t.Fatalf("Failed test 6: expected the request of the tenant, got %d %s", statusCode, body)
+	}
+
+	statusCode, _ = admin("POST", "/admin/approvals/"+approvals[0].ID+"/approve", "admin-key-2")
+	if statusCode != 404 {
+		t.Errorf("Failed test 6: expected 404 when approving the request of another tenant, got %d", statusCode)
+	}
+
+	statusCode, _ = admin("POST", "/admin/approvals/"+approvals[0].ID+"/approve", "admin-key-1")
+	if statusCode != 204 {
+		t.Errorf("Failed test 6: expected approval to succeed, got %d", statusCode)
+	}
+
+	///////////////////
+	/// TEST 7 : bitcoin transaction approved once for all its inputs
+
+	spend := &bitcoin.Spend{Network: "regtest", TxID: "tx1", Outputs: []bitcoin.SpendOutput{{Address: "bcrt1q77zw6x35srwfl3grt26yc46fyphmwj4s9kyq8e", Value: 1000}}, Value: 1000}
+
+	bitcoinPolicy := &Policy{ApprovalAboveBitcoinValue: big.NewInt(1000)}
+	if bitcoinPolicy.requiresPsbtApproval(spend) {
+		t.Errorf("Failed test 7: expected no approval required up to the value")
+	}
+	bitcoinPolicy.ApprovalAboveBitcoinValue = big.NewInt(999)
+
+	_server = NewServer(nil, &Config{Policy: bitcoinPolicy, AdminApiKey: "admin-key"}, nil, false)
+
+	_, err = _server.waitApproval(ctx, "dave-input0", "dave", "client", []byte("sighash0"), "", "", nil, spend)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Fatalf("Failed test 7: expected approval pending, got %v", err)
+	}
+
+	bitcoinServer := httptest.NewServer(_server.Router())
+	defer bitcoinServer.Close()
+	testServer = bitcoinServer
+
+	statusCode, body = admin("GET", "/admin/approvals", "admin-key")
+	approvals = nil
+	json.Unmarshal([]byte(body), &approvals)
+	if statusCode != 200 || len(approvals) != 1 || approvals[0].Psbt == nil || approvals[0].Psbt.TxID != "tx1" || approvals[0].Psbt.Value != 1000 {
+		t.Fatalf("Failed test 7: expected the pending bitcoin transaction, got %d %s", statusCode, body)
+	}
+
+	statusCode, _ = admin("POST", "/admin/approvals/"+approvals[0].ID+"/approve", "admin-key")
+	if statusCode != 204 {
+		t.Errorf("Failed test 7: expected approval to succeed, got %d", statusCode)
+	}
+
+	for i, sighash := range []string{"sighash0", "sighash1"} {
+		_, err = _server.waitApproval(ctx, "dave-input"+fmt.Sprint(i), "dave", "client", []byte(sighash), "", "", nil, spend)
+		if err != nil {
+			t.Errorf("Failed test 7: expected input %d to be approved, got %s", i, err)
+		}
+	}
+
+	spend.TxID = "tx2"
+	_, err = _server.waitApproval(ctx, "dave-input0", "dave", "client", []byte("sighash0"), "", "", nil, spend)
+	if !errors.Is(err, &types.ErrApprovalPending{}) {
+		t.Errorf("Failed test 7: expected another transaction to need its own approval, got %v", err)
+	}
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+/////////
+//
+// The jwt auth type verifies bearer tokens locally, without calling the auth provider on every request.
+// Verification keys come from the JWKS of the auth provider (cached, see jwksCache) or from a static public key.
+//
+/////////
+
+const jwtLeeway = time.Minute // tolerated clock skew for exp and nbf
+
+// JWTConfig is how JWTs are verified: expected claims and verification keys
+type JWTConfig struct {
+	Issuer      string // expected iss claim, not verified if empty
+	Audience    string // expected aud claim, not verified if empty
+	JwksUrl     string // JWKS of the auth provider
+	PublicKey   string // PEM public key, instead of JwksUrl
+	UserIdClaim string // claim holding the userId, "sub" if empty
+}
+
+// JWT verifies the JWT provided (signature, expiration, issuer, audience) and returns the userId found in the configured claim ("sub" by default)
+func (server *Server) JWT(jwtConfig *JWTConfig, token string) (string, error) {
+
+	// Verify jwt is not empty
+	if len(token) == 0 {
+		return "", &types.ErrBadRequest{}
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", &types.ErrBadRequest{}
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		log.Println("JWT - could not decode header:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		log.Println("JWT - could not decode signature:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	// Get verification key
+	var key crypto.PublicKey
+	if len(jwtConfig.PublicKey) > 0 {
+		key, err = parsePublicKeyPEM(jwtConfig.PublicKey)
+	} else {
+		key, err = server.getJWKSCache(jwtConfig.JwksUrl).getKey(header.Kid)
+	}
+	if err != nil {
+		log.Println("JWT - could not get verification key:", err)
+		return "", err
+	}
+
+	// Verify signature
+	err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		log.Println("JWT - invalid signature:", err)
+		return "", &types.ErrUnauthorized{}
+	}
+
+	// Verify claims
+	var claims map[string]any
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		log.Println("JWT - could not decode claims:", err)
+		return "", &types.ErrBadRequest{}
+	}
+
+	err = verifyJWTClaims(claims, jwtConfig.Issuer, jwtConfig.Audience, time.Now())
+	if err != nil {
+		log.Println("JWT - invalid claims:", err)
+		return "", &types.ErrUnauthorized{}
+	}
+
+	// Get userId
+	userIdClaim := jwtConfig.UserIdClaim
+	if len(userIdClaim) == 0 {
+		userIdClaim = "sub"
+	}
+
+	var userId string
+	switch value := claims[userIdClaim].(type) {
+	case string:
+		userId = value
+	case json.Number:
+		userId = value.String()
+	}
+
+	if len(userId) == 0 {
+		log.Println("JWT - no user id in claim", userIdClaim)
+		return "", &types.ErrBadRequest{}
+	}
+
+	return userId, nil
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// ecdsaCurveSizes is the curve required by each ECDSA algorithm (RFC 7518)
+var ecdsaCurveSizes = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// verifyJWTSignature verifies the signature of the JWT, for asymmetric algorithms only (no "none" nor HMAC)
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm " + alg)
+		}
+		if !ed25519.Verify(edKey, signingInput, signature) {
+			return errors.New("wrong signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported algorithm: " + alg)
+	}
+
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	digest := hasher.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm " + alg)
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature)
+	case "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm " + alg)
+		}
+		return rsa.VerifyPSS(rsaKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	default: // ES
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve.Params().BitSize != ecdsaCurveSizes[alg] {
+			return errors.New("key does not match algorithm " + alg)
+		}
+
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("wrong signature size")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("wrong signature")
+		}
+		return nil
+	}
+}
+
+// verifyJWTClaims verifies the registered claims: exp (required), nbf, iss and aud (if configured)
+func verifyJWTClaims(claims map[string]any, issuer, audience string, now time.Time) error {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return errors.New("missing exp")
+	}
+	if now.After(time.Unix(exp, 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Before(time.Unix(nbf, 0).Add(-jwtLeeway)) {
+		return errors.New("token not valid yet")
+	}
+
+	if len(issuer) > 0 && claims["iss"] != issuer {
+		return fmt.Errorf("wrong issuer: %v", claims["iss"])
+	}
+
+	if len(audience) > 0 {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == audience
+		case []any:
+			for _, value := range aud {
+				if value == audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("wrong audience: %v", claims["aud"])
+		}
+	}
+
+	return nil
+}
+
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+
+	value, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(value), true
+}
+
+// parsePublicKeyPEM parses a PEM encoded public key (PKIX) or certificate
+func parsePublicKeyPEM(publicKeyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM block in jwt public key")
+	}
+
+	if block.Type == "CERTIFICATE" {
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return certificate.PublicKey, nil
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+///////
+/// JWKS
+///////
+
+const jwksRefreshInterval = 10 * time.Minute    // keys are refreshed in the background after that
+const jwksMinRefreshInterval = 30 * time.Second // unknown key ids trigger at most one refresh per interval (key rotation)
+
+// jwksCache caches the keys of a JWKS url
+// If the JWKS cannot be fetched, the cached keys keep being used
+type jwksCache struct {
+	url         string
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // by key id
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	refreshing  bool
+}
+
+// getJWKSCache returns the cache of the JWKS url, created on first use
+func (server *Server) getJWKSCache(url string) *jwksCache {
+	cache, _ := server._jwks.LoadOrStore(url, &jwksCache{url: url})
+	return cache.(*jwksCache)
+}
+
+// getKey returns the key kid (or the only key if kid is empty), fetching the JWKS if required
+func (cache *jwksCache) getKey(kid string) (crypto.PublicKey, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key, ok := cache.findKey(kid)
+
+	if ok {
+		// known key: refresh stale keys in the background, without delaying the request
+		if time.Since(cache.fetchedAt) > jwksRefreshInterval && !cache.refreshing {
+			cache.refreshing = true
+			go func() {
+				cache.mu.Lock()
+				defer cache.mu.Unlock()
+				cache.refresh()
+				cache.refreshing = false
+			}()
+		}
+		return key, nil
+	}
+
+	// unknown key: the keys might have been rotated
+	if time.Since(cache.attemptedAt) >= jwksMinRefreshInterval {
+		err := cache.refresh()
+		if err != nil && len(cache.keys) == 0 {
+			return nil, err
+		}
+	}
+
+	key, ok = cache.findKey(kid)
+	if !ok {
+		return nil, &types.ErrUnauthorized{}
+	}
+
+	return key, nil
+}
+
+func (cache *jwksCache) findKey(kid string) (crypto.PublicKey, bool) {
+	if len(kid) == 0 && len(cache.keys) == 1 {
+		for _, key := range cache.keys {
+			return key, true
+		}
+	}
+
+	key, ok := cache.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the JWKS, keeping the previous keys if it fails. Requires the lock.
+func (cache *jwksCache) refresh() error {
+	cache.attemptedAt = time.Now()
+
+	keys, err := fetchJWKS(cache.url)
+	if err != nil {
+		log.Println("jwksCache - could not fetch JWKS:", err)
+		return err
+	}
+
+	cache.keys = keys
+	cache.fetchedAt = time.Now()
+
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS gets the signing keys of the JWKS url, ignoring the keys it does not support
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	if len(url) == 0 {
+		return nil, errors.New("missing JWKS url")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("JWKS response status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(body, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Println("fetchJWKS - ignoring key", jwk.Kid, ":", err)
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key in JWKS")
+	}
+
+	return keys, nil
+}
+
+// publicKey parses RSA, EC (P-256, P-384, P-521) and OKP (Ed25519) keys
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, errors.New("unsupported curve: " + jwk.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC coordinates")
+		}
+
+		// verifies that the point is on the curve
+		_, err = ecdhCurve.NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve: " + jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, errors.New("unsupported key type: " + jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: %s", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate ec key: %s", err)
+	}
+
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate ed25519 key: %s", err)
+	}
+
+	jwks := newTestJWKS(map[string]crypto.PublicKey{"rsa-1": &rsaKey.PublicKey, "ec-1": &ecKey.PublicKey, "ed-1": edPublicKey})
+	defer jwks.server.Close()
+
+	jwtConfig := &JWTConfig{
+		Issuer:   "https://auth.example",
+		Audience: "meemaw",
+		JwksUrl:  jwks.server.URL,
+	}
+
+	authConfig := &AuthConfig{
+		Provider: "jwt",
+		Settings: map[string]string{"jwtIssuer": "https://auth.example", "jwtAudience": "meemaw", "jwksUrl": jwks.server.URL},
+	}
+
+	_server := NewServer(nil, &Config{}, nil, false)
+
+	claims := func() map[string]any {
+		return map[string]any{
+			"iss": "https://auth.example",
+			"aud": "meemaw",
+			"sub": "user-1",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	///////////////////
+	/// TEST 1 : happy path, with RSA, EC and Ed25519 keys
+
+	for _, test := range []struct {
+		alg string
+		kid string
+		key crypto.Signer
+	}{{"RS256", "rsa-1", rsaKey}, {"PS256", "rsa-1", rsaKey}, {"ES256", "ec-1", ecKey}, {"EdDSA", "ed-1", edKey}} {
+		userId, err := _server.authProviders(context.Background(), authConfig, signTestJWT(t, test.alg, test.kid, test.key, claims()))
+		if err != nil || userId != "user-1" {
+			t.Errorf("Failed test 1 (%s): expected user-1, got %s (%v)", test.alg, userId, err)
+		}
+	}
+
+	///////////////////
+	/// TEST 2 : audience in an array
+
+	c := claims()
+	c["aud"] = []string{"other", "meemaw"}
+
+	userId, err := _server.JWT(jwtConfig, signTestJWT(t, "RS256", "rsa-1", rsaKey, c))
+	if err != nil || userId != "user-1" {
+		t.Errorf("Failed test 2: expected user-1, got %s (%v)", userId, err)
+	}
+
+	///////////////////
+	/// TEST 3 : invalid tokens
+
+	expired := claims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	notYetValid := claims()
+	notYetValid["nbf"] = time.Now().Add(time.Hour).Unix()
+
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://evil.example"
+
+	wrongAudience := claims()
+	wrongAudience["aud"] = "other"
+
+	noExpiration := claims()
+	delete(noExpiration, "exp")
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: %s", err)
+	}
+
+	for description, token := range map[string]string{
+		"expired":         signTestJWT(t, "RS256", "rsa-1", rsaKey, expired),
+		"not yet valid":   signTestJWT(t, "RS256", "rsa-1", rsaKey, notYetValid),
+		"wrong issuer":    signTestJWT(t, "RS256", "rsa-1", rsaKey, wrongIssuer),
+		"wrong audience":  signTestJWT(t, "RS256", "rsa-1", rsaKey, wrongAudience),
+		"no expiration":   signTestJWT(t, "RS256", "rsa-1", rsaKey, noExpiration),
+		"wrong signature": signTestJWT(t, "RS256", "rsa-1", otherKey, claims()),
+		"alg mismatch":    signTestJWT(t, "ES256", "rsa-1", ecKey, claims()),
+		"alg none":        signTestJWT(t, "none", "rsa-1", nil, claims()),
+	} {
+		_, err := _server.JWT(jwtConfig, token)
+		if !errors.Is(err, &types.ErrUnauthorized{}) {
+			t.Errorf("Failed test 3 (%s): expected ErrUnauthorized, got %v", description, err)
+		}
+	}
+
+	for _, token := range []string{"", "not-a-jwt", "a.b.c"} {
+		_, err := _server.JWT(jwtConfig, token)
+		if !errors.Is(err, &types.ErrBadRequest{}) {
+			t.Errorf("Failed test 3 (%q): expected ErrBadRequest, got %v", token, err)
+		}
+	}
+
+	///////////////////
+	/// TEST 4 : JWKS is cached
+
+	fetches := jwks.fetches()
+	_, err = _server.JWT(jwtConfig, signTestJWT(t, "RS256", "rsa-1", rsaKey, claims()))
+	if err != nil || jwks.fetches() != fetches {
+		t.Errorf("Failed test 4: expected cached JWKS to be used, got %d fetches (%v)", jwks.fetches()-fetches, err)
+	}
+
+	///////////////////
+	/// TEST 5 : key rotation, unknown kid triggers a refresh
+
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: %s", err)
+	}
+
+	jwks.setKeys(map[string]crypto.PublicKey{"rsa-2": &rotatedKey.PublicKey})
+	_server.getJWKSCache(jwtConfig.JwksUrl).attemptedAt = time.Time{} // as if the last refresh was long ago
+
+	userId, err = _server.JWT(jwtConfig, signTestJWT(t, "RS256", "rsa-2", rotatedKey, claims()))
+	if err != nil || userId != "user-1" {
+		t.Errorf("Failed test 5: expected user-1 with rotated key, got %s (%v)", userId, err)
+	}
+
+	// refreshes are rate limited
+	fetches = jwks.fetches()
+	_, err = _server.JWT(jwtConfig, signTestJWT(t, "RS256", "unknown", rotatedKey, claims()))
+	if !errors.Is(err, &types.ErrUnauthorized{}) || jwks.fetches() != fetches {
+		t.Errorf("Failed test 5: expected ErrUnauthorized without refresh, got %v (%d fetches)", err, jwks.fetches()-fetches)
+	}
+
+	///////////////////
+	/// TEST 6 : cached keys keep being used when the JWKS is unavailable
+
+	jwks.server.Close()
+	_server.getJWKSCache(jwtConfig.JwksUrl).fetchedAt = time.Time{} // stale keys, refreshed in the background
+
+	userId, err = _server.JWT(jwtConfig, signTestJWT(t, "RS256", "rsa-2", rotatedKey, claims()))
+	if err != nil || userId != "user-1" {
+		t.Errorf("Failed test 6: expected user-1 with cached key, got %s (%v)", userId, err)
+	}
+
+	///////////////////
+	/// TEST 7 : static public key and custom user id claim
+
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatalf("could not marshal public key: %s", err)
+	}
+
+	staticConfig := &AuthConfig{
+		Provider: "jwt",
+		Settings: map[string]string{
+			"jwtIssuer":      "https://auth.example",
+			"jwtAudience":    "meemaw",
+			"jwtPublicKey":   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDer})),
+			"jwtUserIdClaim": "user_id",
+		},
+	}
+
+	c = claims()
+	c["user_id"] = "custom-user"
+
+	userId, err = _server.authProviders(context.Background(), staticConfig, signTestJWT(t, "ES256", "", ecKey, c))
+	if err != nil || userId != "custom-user" {
+		t.Errorf("Failed test 7: expected custom-user, got %s (%v)", userId, err)
+	}
+
+	delete(c, "user_id")
+
+	_, err = _server.JWT(&JWTConfig{PublicKey: staticConfig.Settings["jwtPublicKey"], UserIdClaim: "user_id"}, signTestJWT(t, "ES256", "", ecKey, c))
+	if !errors.Is(err, &types.ErrBadRequest{}) {
+		t.Errorf("Failed test 7: expected ErrBadRequest without user id claim, got %v", err)
+	}
+
+	///////////////////
+	/// TEST 8 : missing verification key
+
+	_, err = _server.authProviders(context.Background(), &AuthConfig{Provider: "jwt"}, "token")
+	if err == nil {
+		t.Errorf("Failed test 8: expected error without JWKS url nor public key")
+	}
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+// testJWKS serves a JWKS which keys can be changed during the test
+type testJWKS struct {
+	server     *httptest.Server
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	fetchCount int
+}
+
+func newTestJWKS(keys map[string]crypto.PublicKey) *testJWKS {
+	jwks := &testJWKS{keys: keys}
+	jwks.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwks.mu.Lock()
+		defer jwks.mu.Unlock()
+
+		jwks.fetchCount++
+
+		var set struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		for kid, key := range jwks.keys {
+			set.Keys = append(set.Keys, marshalTestJWK(kid, key))
+		}
+
+		json.NewEncoder(w).Encode(set)
+	}))
+	return jwks
+}
+
+func (jwks *testJWKS) setKeys(keys map[string]crypto.PublicKey) {
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+	jwks.keys = keys
+}
+
+func (jwks *testJWKS) fetches() int {
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+	return jwks.fetchCount
+}
+
+func marshalTestJWK(kid string, key crypto.PublicKey) map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": encode(key.X.FillBytes(make([]byte, 32))), "y": encode(key.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": encode(key)}
+	}
+	return nil
+}
+
+// signTestJWT signs the claims with key, using alg (ES256 signatures are converted to r||s as in JWS)
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatalf("could not marshal header: %s", err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("could not marshal claims: %s", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case "none":
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signingInput))
+	default:
+		t.Fatalf("unsupported test algorithm %s", alg)
+	}
+	if err != nil {
+		t.Fatalf("could not sign jwt: %s", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
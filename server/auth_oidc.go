@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/////////
+//
+// The oidc auth type verifies the ID or access tokens of an OpenID Connect provider (Auth0, Keycloak, Cognito, Firebase Auth...).
+// The JWKS of the provider is found through discovery (/.well-known/openid-configuration), then tokens are verified locally like the jwt auth type.
+//
+/////////
+
+const oidcDiscoveryRefreshInterval = time.Hour
+
+// OIDC verifies the token issued by the OpenID Connect provider and returns the userId found in the configured claim ("sub" by default)
+func (server *Server) OIDC(issuerUrl, audience, userIdClaim, token string) (string, error) {
+	jwksUrl, err := server.getOIDCDiscovery(issuerUrl).getJwksUrl()
+	if err != nil {
+		log.Println("OIDC - discovery failed:", err)
+		return "", err
+	}
+
+	return server.JWT(&JWTConfig{
+		Issuer:      issuerUrl,
+		Audience:    audience,
+		JwksUrl:     jwksUrl,
+		UserIdClaim: userIdClaim,
+	}, token)
+}
+
+// oidcDiscovery caches the discovery document of an issuer
+// If the discovery document cannot be fetched, the cached one keeps being used
+type oidcDiscovery struct {
+	issuer    string
+	mu        sync.Mutex
+	jwksUrl   string
+	fetchedAt time.Time
+}
+
+// getOIDCDiscovery returns the discovery cache of the issuer, created on first use
+func (server *Server) getOIDCDiscovery(issuer string) *oidcDiscovery {
+	discovery, _ := server._oidc.LoadOrStore(issuer, &oidcDiscovery{issuer: issuer})
+	return discovery.(*oidcDiscovery)
+}
+
+// getJwksUrl returns the jwks_uri of the issuer, running discovery if required
+func (discovery *oidcDiscovery) getJwksUrl() (string, error) {
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+
+	if len(discovery.jwksUrl) > 0 && time.Since(discovery.fetchedAt) < oidcDiscoveryRefreshInterval {
+		return discovery.jwksUrl, nil
+	}
+
+	jwksUrl, err := fetchOIDCDiscovery(discovery.issuer)
+	if err != nil {
+		if len(discovery.jwksUrl) > 0 {
+			log.Println("oidcDiscovery - could not refresh discovery, using cached one:", err)
+			return discovery.jwksUrl, nil
+		}
+		return "", err
+	}
+
+	discovery.jwksUrl = jwksUrl
+	discovery.fetchedAt = time.Now()
+
+	return jwksUrl, nil
+}
+
+// fetchOIDCDiscovery gets the discovery document of the issuer and returns its jwks_uri
+func fetchOIDCDiscovery(issuer string) (string, error) {
+	if len(issuer) == 0 {
+		return "", errors.New("missing OIDC issuer url")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("discovery response status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	var configuration struct {
+		Issuer  string `json:"issuer"`
+		JwksUri string `json:"jwks_uri"`
+	}
+	err = json.Unmarshal(body, &configuration)
+	if err != nil {
+		return "", err
+	}
+
+	// The issuer of the discovery document must be exactly the configured one (OpenID Connect Discovery, section 4.3)
+	if configuration.Issuer != issuer {
+		return "", fmt.Errorf("discovery issuer %q does not match configured issuer %q", configuration.Issuer, issuer)
+	}
+
+	if len(configuration.JwksUri) == 0 {
+		return "", errors.New("no jwks_uri in discovery document")
+	}
+
+	return configuration.JwksUri, nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOIDC(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: %s", err)
+	}
+
+	jwks := newTestJWKS(map[string]crypto.PublicKey{"rsa-1": &rsaKey.PublicKey})
+	defer jwks.server.Close()
+
+	// stub issuer, serving the discovery document
+	var discoveryFetches atomic.Int32
+	var discoveredIssuer atomic.Value
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		discoveryFetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   discoveredIssuer.Load().(string),
+			"jwks_uri": jwks.server.URL,
+		})
+	}))
+	defer issuer.Close()
+	discoveredIssuer.Store(issuer.URL)
+
+	authConfig := &AuthConfig{
+		Provider: "oidc",
+		Settings: map[string]string{"oidcIssuerUrl": issuer.URL, "oidcAudience": "meemaw-client"},
+	}
+
+	_server := NewServer(nil, &Config{}, nil, false)
+
+	claims := func() map[string]any {
+		return map[string]any{
+			"iss":   issuer.URL,
+			"aud":   "meemaw-client",
+			"sub":   "oidc-user",
+			"email": "user@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	///////////////////
+	/// TEST 1 : happy path, through discovery
+
+	userId, err := _server.authProviders(context.Background(), authConfig, signTestJWT(t, "RS256", "rsa-1", rsaKey, claims()))
+	if err != nil || userId != "oidc-user" {
+		t.Errorf("Failed test 1: expected oidc-user, got %s (%v)", userId, err)
+	}
+
+	///////////////////
+	/// TEST 2 : discovery is cached
+
+	_, err = _server.OIDC(issuer.URL, "meemaw-client", "", signTestJWT(t, "RS256", "rsa-1", rsaKey, claims()))
+	if err != nil || discoveryFetches.Load() != 1 {
+		t.Errorf("Failed test 2: expected one discovery, got %d (%v)", discoveryFetches.Load(), err)
+	}
+
+	///////////////////
+	/// TEST 3 : custom user id claim
+
+	userId, err = _server.OIDC(issuer.URL, "meemaw-client", "email", signTestJWT(t, "RS256", "rsa-1", rsaKey, claims()))
+	if err != nil || userId != "user@example.com" {
+		t.Errorf("Failed test 3: expected user@example.com, got %s (%v)", userId, err)
+	}
+
+	///////////////////
+	/// TEST 4 : tokens of another issuer or audience are rejected
+
+	c := claims()
+	c["iss"] = "https://other-issuer.example"
+
+	_, err = _server.OIDC(issuer.URL, "meemaw-client", "", signTestJWT(t, "RS256", "rsa-1", rsaKey, c))
+	if err == nil {
+		t.Errorf("Failed test 4: expected error with wrong issuer")
+	}
+
+	c = claims()
+	c["aud"] = "other-client"
+
+	_, err = _server.OIDC(issuer.URL, "meemaw-client", "", signTestJWT(t, "RS256", "rsa-1", rsaKey, c))
+	if err == nil {
+		t.Errorf("Failed test 4: expected error with wrong audience")
+	}
+
+	///////////////////
+	/// TEST 5 : discovery document of another issuer is rejected
+
+	discoveredIssuer.Store("https://impostor.example")
+
+	otherServer := NewServer(nil, &Config{}, nil, false)
+	_, err = otherServer.OIDC(issuer.URL, "meemaw-client", "", signTestJWT(t, "RS256", "rsa-1", rsaKey, claims()))
+	if err == nil {
+		t.Errorf("Failed test 5: expected error with mismatching discovery issuer")
+	}
+
+	///////////////////
+	/// TEST 6 : unreachable issuer
+
+	unreachableConfig := &AuthConfig{
+		Provider: "oidc",
+		Settings: map[string]string{"oidcIssuerUrl": "http://127.0.0.1:1", "oidcAudience": "meemaw-client"},
+	}
+
+	_, err = _server.authProviders(context.Background(), unreachableConfig, signTestJWT(t, "RS256", "rsa-1", rsaKey, claims()))
+	if err == nil {
+		t.Errorf("Failed test 6: expected error with unreachable issuer")
+	}
+}
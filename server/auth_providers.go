@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,28 +15,101 @@ import (
 	"github.com/google/uuid"
 )
 
+// AuthConfig selects the auth provider used to identify users, and its settings
 type AuthConfig struct {
-	AuthType       string
-	AuthServerUrl  string
-	SupabaseUrl    string
-	SupabaseApiKey string
+	Provider string            // name of a registered auth provider: supabase, custom, jwt, oidc or any provider added with RegisterAuthProvider
+	Settings map[string]string // settings of the provider (e.g. supabaseUrl), available in the context of Identify, see AuthSettings
 }
 
-// authProviders calls the correct method based on the configured auth provider
-func (server *Server) authProviders(authConfig *AuthConfig, bearerToken string) (string, error) {
-	if authConfig.AuthType == "supabase" {
-		if len(authConfig.SupabaseApiKey) == 0 || len(authConfig.SupabaseUrl) == 0 {
+// AuthProvider gets the userId of the user identified by the token provided by the client
+// The userId is used as foreign key of the wallet, it should be immutable for a given user
+// Errors should be types.ErrBadRequest (malformed token), types.ErrUnauthorized (invalid or expired token) or types.ErrNotFound (unknown token)
+type AuthProvider interface {
+	Identify(ctx context.Context, token string) (string, error)
+}
+
+// AuthProviderFunc allows to use an ordinary function as AuthProvider
+type AuthProviderFunc func(ctx context.Context, token string) (string, error)
+
+// Identify calls f(ctx, token)
+func (f AuthProviderFunc) Identify(ctx context.Context, token string) (string, error) {
+	return f(ctx, token)
+}
+
+// AuthSettings returns the settings of the auth provider, from the context of Identify
+func AuthSettings(ctx context.Context) map[string]string {
+	settings, _ := ctx.Value(types.ContextKey("authSettings")).(map[string]string)
+	return settings
+}
+
+// RegisterAuthProvider adds an auth provider which can then be selected by name in AuthConfig. It replaces any provider with the same name, including the built-in ones.
+func (server *Server) RegisterAuthProvider(name string, provider AuthProvider) error {
+	if len(name) == 0 || provider == nil {
+		return errors.New("auth provider requires a name and an implementation")
+	}
+
+	server._authProvidersMu.Lock()
+	defer server._authProvidersMu.Unlock()
+
+	server._authProviders[name] = provider
+
+	return nil
+}
+
+// registerBuiltinAuthProviders registers the auth providers available out of the box
+func (server *Server) registerBuiltinAuthProviders() {
+	server.RegisterAuthProvider("supabase", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		settings := AuthSettings(ctx)
+		if len(settings["supabaseApiKey"]) == 0 || len(settings["supabaseUrl"]) == 0 {
 			return "", errors.New("missing Supabase config")
 		}
-		return server.Supabase(authConfig.SupabaseUrl, authConfig.SupabaseApiKey, bearerToken)
-	} else if authConfig.AuthType == "custom" {
-		if len(authConfig.AuthServerUrl) == 0 {
+		return server.Supabase(settings["supabaseUrl"], settings["supabaseApiKey"], token)
+	}))
+
+	server.RegisterAuthProvider("custom", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		settings := AuthSettings(ctx)
+		if len(settings["authServerUrl"]) == 0 {
 			return "", errors.New("missing custom auth url")
 		}
-		return server.CustomAuth(authConfig.AuthServerUrl, bearerToken)
-	} else {
+		return server.CustomAuth(settings["authServerUrl"], token)
+	}))
+
+	server.RegisterAuthProvider("jwt", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		settings := AuthSettings(ctx)
+		if len(settings["jwksUrl"]) == 0 && len(settings["jwtPublicKey"]) == 0 {
+			return "", errors.New("missing jwt verification key")
+		}
+		return server.JWT(&JWTConfig{
+			Issuer:      settings["jwtIssuer"],
+			Audience:    settings["jwtAudience"],
+			JwksUrl:     settings["jwksUrl"],
+			PublicKey:   settings["jwtPublicKey"],
+			UserIdClaim: settings["jwtUserIdClaim"],
+		}, token)
+	}))
+
+	server.RegisterAuthProvider("oidc", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		settings := AuthSettings(ctx)
+		if len(settings["oidcIssuerUrl"]) == 0 {
+			return "", errors.New("missing OIDC issuer url")
+		}
+		return server.OIDC(settings["oidcIssuerUrl"], settings["oidcAudience"], settings["oidcUserIdClaim"], token)
+	}))
+}
+
+// authProviders calls the auth provider selected by the auth config
+func (server *Server) authProviders(ctx context.Context, authConfig *AuthConfig, bearerToken string) (string, error) {
+	server._authProvidersMu.RLock()
+	provider, ok := server._authProviders[authConfig.Provider]
+	server._authProvidersMu.RUnlock()
+
+	if !ok {
 		return "", errors.New("wrong auth type")
 	}
+
+	ctx = context.WithValue(ctx, types.ContextKey("authSettings"), authConfig.Settings)
+
+	return provider.Identify(ctx, bearerToken)
 }
 
 type SupabaseUser struct {
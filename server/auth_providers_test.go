@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -188,6 +190,94 @@ func TestCustomAuth(t *testing.T) {
 	commonTests(fn, t)
 }
 
+func TestRegisterAuthProvider(t *testing.T) {
+	var config = Config{
+		AuthType: "custom",
+		DevMode:  true,
+	}
+
+	_server := NewServer(vault.NewMemoryVault(), &config, nil, false)
+
+	// provider defined by the embedder, using its own settings
+	err := _server.RegisterAuthProvider("static", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		if token != AuthSettings(ctx)["token"] {
+			return "", &types.ErrUnauthorized{}
+		}
+		return AuthSettings(ctx)["userId"], nil
+	}))
+	if err != nil {
+		t.Fatalf("could not register auth provider: %s", err)
+	}
+
+	_server.UpdateGetAuthConfig(func(ctx context.Context, server *Server) (*AuthConfig, error) {
+		return &AuthConfig{
+			Provider: "static",
+			Settings: map[string]string{"token": "my-token", "userId": "static-user"},
+		}, nil
+	})
+
+	identifyServer := httptest.NewServer(_server.Router())
+	defer identifyServer.Close()
+
+	identify := func(token string) (string, int) {
+		req, err := http.NewRequest("GET", identifyServer.URL+"/identify", nil)
+		if err != nil {
+			t.Fatalf("could not create request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %s", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.StatusCode
+	}
+
+	///////////////////
+	/// TEST 1 : happy path
+
+	userId, statusCode := identify("my-token")
+	if statusCode != 200 || userId != "static-user" {
+		t.Errorf("Failed test 1: expected static-user, got %d %s", statusCode, userId)
+	}
+
+	///////////////////
+	/// TEST 2 : provider rejects the token
+
+	_, statusCode = identify("other-token")
+	if statusCode != 401 {
+		t.Errorf("Failed test 2: expected 401, got %d", statusCode)
+	}
+
+	///////////////////
+	/// TEST 3 : unknown provider
+
+	_server.UpdateGetAuthConfig(func(ctx context.Context, server *Server) (*AuthConfig, error) {
+		return &AuthConfig{Provider: "unknown"}, nil
+	})
+
+	_, statusCode = identify("my-token")
+	if statusCode != 401 {
+		t.Errorf("Failed test 3: expected 401, got %d", statusCode)
+	}
+
+	///////////////////
+	/// TEST 4 : invalid registration
+
+	err = _server.RegisterAuthProvider("", AuthProviderFunc(func(ctx context.Context, token string) (string, error) { return "", nil }))
+	if err == nil {
+		t.Errorf("Failed test 4: expected error without name")
+	}
+
+	err = _server.RegisterAuthProvider("nil", nil)
+	if err == nil {
+		t.Errorf("Failed test 4: expected error without provider")
+	}
+}
+
 func commonTests(authFn func(string) (string, error), t *testing.T) {
 	var testDescription string
 	var userId string
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/joho/godotenv"
+)
+
+/////////
+//
+// The config of the server is loaded from the config file (config.toml by default, see --config), then overridden by environment variables (and .env, if any).
+//
+/////////
+
+const defaultConfigPath = "config.toml"
+
+// fileConfig is the content of the config file, pointers are nil when not provided (so that defaults apply)
+type fileConfig struct {
+	DevMode          *bool             `toml:"devMode"`
+	Export           *bool             `toml:"export"`
+	MultiDevice      *bool             `toml:"multiDevice"`
+	Port             *int              `toml:"port"`
+	VaultType        *string           `toml:"vaultType"`
+	KeyFile          *string           `toml:"keyFile"`
+	DbConnectionUrl  *string           `toml:"dbConnectionUrl"`
+	ClientOrigin     *string           `toml:"clientOrigin"`
+	AuthType         *string           `toml:"authType"`
+	AuthServerUrl    *string           `toml:"authServerUrl"`
+	SupabaseUrl      *string           `toml:"supabaseUrl"`
+	SupabaseApiKey   *string           `toml:"supabaseApiKey"`
+	JwtIssuer        *string           `toml:"jwtIssuer"`
+	JwtAudience      *string           `toml:"jwtAudience"`
+	JwksUrl          *string           `toml:"jwksUrl"`
+	JwtPublicKey     *string           `toml:"jwtPublicKey"`
+	JwtUserIdClaim   *string           `toml:"jwtUserIdClaim"`
+	OidcIssuerUrl    *string           `toml:"oidcIssuerUrl"`
+	OidcAudience     *string           `toml:"oidcAudience"`
+	OidcUserIdClaim  *string           `toml:"oidcUserIdClaim"`
+	IdentityCacheTtl *int              `toml:"identityCacheTtl"`
+	TenantResolution *string           `toml:"tenantResolution"`
+	Tenants          []fileTenant      `toml:"tenants"`
+	RpcUpstreams     map[string]string `toml:"rpcUpstreams"`
+	RpcMethods       []string          `toml:"rpcMethods"`
+	RpcRateLimit     *int              `toml:"rpcRateLimit"`
+	Policy           *filePolicy       `toml:"policy"`
+
+	ApprovalWebhookUrl    *string `toml:"approvalWebhookUrl"`
+	ApprovalWebhookSecret *string `toml:"approvalWebhookSecret"`
+	ApprovalTimeout       *int    `toml:"approvalTimeout"`
+	AdminApiKey           *string `toml:"adminApiKey"`
+}
+
+// fileTenant is a tenant of the config file ([[tenants]]), export, multiDevice, policy, rpcUpstreams and rpcMethods default to the values of the config file
+type fileTenant struct {
+	ID            string            `toml:"id"`
+	ApiKeys       []string          `toml:"apiKeys"`
+	ClientOrigins []string          `toml:"clientOrigins"`
+	Export        *bool             `toml:"export"`
+	MultiDevice   *bool             `toml:"multiDevice"`
+	AuthType      string            `toml:"authType"`
+	AuthSettings  map[string]string `toml:"authSettings"`
+	Policy        *filePolicy       `toml:"policy"`
+	RpcUpstreams  map[string]string `toml:"rpcUpstreams"`
+	RpcMethods    []string          `toml:"rpcMethods"`
+	AdminApiKey   string            `toml:"adminApiKey"` // not inherited: an admin api key only reaches the approvals of its tenant
+}
+
+// filePolicy is a policy of the config file ([policy] or [tenants.policy]), amounts are decimal strings in wei (sats for bitcoin)
+type filePolicy struct {
+	ChainIds          []uint64 `toml:"chainIds"`
+	AllowedRecipients []string `toml:"allowedRecipients"`
+	DeniedRecipients  []string `toml:"deniedRecipients"`
+	AllowedMethods    []string `toml:"allowedMethods"`
+	MaxGasPrice       string   `toml:"maxGasPrice"`
+	MaxDailyValue     string   `toml:"maxDailyValue"`
+	AllowMessages     bool     `toml:"allowMessages"`
+
+	MaxDailyTokenValue map[string]string `toml:"maxDailyTokenValue"` // by token contract address, in the smallest unit of the token
+
+	MaxDailyBitcoinValue string `toml:"maxDailyBitcoinValue"`
+
+	ApprovalAboveValue        string `toml:"approvalAboveValue"`
+	ApprovalAboveBitcoinValue string `toml:"approvalAboveBitcoinValue"`
+	ApprovalForMessages       bool   `toml:"approvalForMessages"`
+
+	ApprovalAboveTokenValue map[string]string `toml:"approvalAboveTokenValue"` // by token contract address, in the smallest unit of the token
+}
+
+// defaultConfig returns the config used when nothing is provided
+func defaultConfig() *server.Config {
+	return &server.Config{
+		DevMode:          false,
+		Export:           true,
+		MultiDevice:      true,
+		Port:             8421,
+		VaultType:        "postgres",
+		IdentityCacheTtl: 60,
+		ApprovalTimeout:  30,
+	}
+}
+
+// loadConfig loads the config file at path (if it exists, or if it is not the default path), then applies the environment overrides
+// The config is not validated, see validateConfig
+func loadConfig(path string) (*server.Config, error) {
+	config := defaultConfig()
+
+	if len(path) == 0 {
+		path = defaultConfigPath
+	}
+
+	_, err := os.Stat(path)
+	if err == nil {
+		err = loadConfigFromFile(path, config)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Config loaded from", path)
+	} else if errors.Is(err, os.ErrNotExist) && path == defaultConfigPath {
+		log.Println("No config file, using environment variables only")
+	} else {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	// Try to load from .env, if exists
+	err = godotenv.Load()
+	if err != nil {
+		log.Printf("No .env file found or error loading .env file: %v", err)
+	}
+
+	err = loadConfigFromEnvs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// loadConfigFromFile fills config with the values of the config file
+func loadConfigFromFile(path string, config *server.Config) error {
+	var file fileConfig
+	metadata, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+	}
+
+	setIfNotNil(&config.DevMode, file.DevMode)
+	setIfNotNil(&config.Export, file.Export)
+	setIfNotNil(&config.MultiDevice, file.MultiDevice)
+	setIfNotNil(&config.Port, file.Port)
+	setIfNotNil(&config.VaultType, file.VaultType)
+	setIfNotNil(&config.KeyFile, file.KeyFile)
+	setIfNotNil(&config.DbConnectionUrl, file.DbConnectionUrl)
+	setIfNotNil(&config.ClientOrigin, file.ClientOrigin)
+	setIfNotNil(&config.AuthType, file.AuthType)
+	setIfNotNil(&config.AuthServerUrl, file.AuthServerUrl)
+	setIfNotNil(&config.SupabaseUrl, file.SupabaseUrl)
+	setIfNotNil(&config.SupabaseApiKey, file.SupabaseApiKey)
+	setIfNotNil(&config.JwtIssuer, file.JwtIssuer)
+	setIfNotNil(&config.JwtAudience, file.JwtAudience)
+	setIfNotNil(&config.JwksUrl, file.JwksUrl)
+	setIfNotNil(&config.JwtPublicKey, file.JwtPublicKey)
+	setIfNotNil(&config.JwtUserIdClaim, file.JwtUserIdClaim)
+	setIfNotNil(&config.OidcIssuerUrl, file.OidcIssuerUrl)
+	setIfNotNil(&config.OidcAudience, file.OidcAudience)
+	setIfNotNil(&config.OidcUserIdClaim, file.OidcUserIdClaim)
+	setIfNotNil(&config.IdentityCacheTtl, file.IdentityCacheTtl)
+	setIfNotNil(&config.TenantResolution, file.TenantResolution)
+	setIfNotNil(&config.RpcRateLimit, file.RpcRateLimit)
+	setIfNotNil(&config.ApprovalWebhookUrl, file.ApprovalWebhookUrl)
+	setIfNotNil(&config.ApprovalWebhookSecret, file.ApprovalWebhookSecret)
+	setIfNotNil(&config.ApprovalTimeout, file.ApprovalTimeout)
+	setIfNotNil(&config.AdminApiKey, file.AdminApiKey)
+
+	if file.RpcUpstreams != nil {
+		config.RpcUpstreams = file.RpcUpstreams
+	}
+	if file.RpcMethods != nil {
+		config.RpcMethods = file.RpcMethods
+	}
+
+	if file.Policy != nil {
+		config.Policy, err = file.Policy.policy()
+		if err != nil {
+			return fmt.Errorf("config file %s: policy: %w", path, err)
+		}
+	}
+
+	for _, fileTenant := range file.Tenants {
+		tenant := &server.Tenant{
+			ID:            fileTenant.ID,
+			ApiKeys:       fileTenant.ApiKeys,
+			ClientOrigins: fileTenant.ClientOrigins,
+			AdminApiKey:   fileTenant.AdminApiKey,
+			Export:        config.Export,
+			MultiDevice:   config.MultiDevice,
+			Auth: &server.AuthConfig{
+				Provider: fileTenant.AuthType,
+				Settings: fileTenant.AuthSettings,
+			},
+		}
+		setIfNotNil(&tenant.Export, fileTenant.Export)
+		setIfNotNil(&tenant.MultiDevice, fileTenant.MultiDevice)
+
+		tenant.Policy = config.Policy
+		if fileTenant.Policy != nil {
+			tenant.Policy, err = fileTenant.Policy.policy()
+			if err != nil {
+				return fmt.Errorf("config file %s: tenant %s: policy: %w", path, fileTenant.ID, err)
+			}
+		}
+
+		tenant.RpcUpstreams = config.RpcUpstreams
+		if fileTenant.RpcUpstreams != nil {
+			tenant.RpcUpstreams = fileTenant.RpcUpstreams
+		}
+		tenant.RpcMethods = config.RpcMethods
+		if fileTenant.RpcMethods != nil {
+			tenant.RpcMethods = fileTenant.RpcMethods
+		}
+
+		config.Tenants = append(config.Tenants, tenant)
+	}
+
+	return nil
+}
+
+// policy converts the policy of the config file, verifying addresses, selectors and amounts
+func (file *filePolicy) policy() (*server.Policy, error) {
+	var errs []error
+
+	for _, address := range append(file.AllowedRecipients, file.DeniedRecipients...) {
+		if !common.IsHexAddress(address) {
+			errs = append(errs, fmt.Errorf("invalid address %q", address))
+		}
+	}
+
+	for _, selector := range file.AllowedMethods {
+		if _, err := hex.DecodeString(strings.TrimPrefix(selector, "0x")); err != nil || len(selector) != 10 || !strings.HasPrefix(selector, "0x") {
+			errs = append(errs, fmt.Errorf("invalid method selector %q, expected 0x followed by 4 bytes", selector))
+		}
+	}
+
+	parseAmount := func(name, value, unit string) *big.Int {
+		if len(value) == 0 {
+			return nil
+		}
+		amount, ok := new(big.Int).SetString(value, 10)
+		if !ok || amount.Sign() < 0 {
+			errs = append(errs, fmt.Errorf("%s should be a positive amount in %s, got %q", name, unit, value))
+			return nil
+		}
+		return amount
+	}
+
+	// parseTokenAmounts parses amounts by token contract address, in the smallest unit of each token
+	parseTokenAmounts := func(name string, values map[string]string) map[string]*big.Int {
+		if len(values) == 0 {
+			return nil
+		}
+		amounts := make(map[string]*big.Int)
+		for token, value := range values {
+			if !common.IsHexAddress(token) {
+				errs = append(errs, fmt.Errorf("invalid token address %q", token))
+				continue
+			}
+			amount, ok := new(big.Int).SetString(value, 10)
+			if !ok || amount.Sign() < 0 {
+				errs = append(errs, fmt.Errorf("%s of %s should be a positive amount in the smallest unit of the token, got %q", name, token, value))
+				continue
+			}
+			amounts[token] = amount
+		}
+		return amounts
+	}
+
+	policy := &server.Policy{
+		ChainIds:          file.ChainIds,
+		AllowedRecipients: file.AllowedRecipients,
+		DeniedRecipients:  file.DeniedRecipients,
+		AllowedMethods:    file.AllowedMethods,
+		MaxGasPrice:       parseAmount("maxGasPrice", file.MaxGasPrice, "wei"),
+		MaxDailyValue:     parseAmount("maxDailyValue", file.MaxDailyValue, "wei"),
+		AllowMessages:     file.AllowMessages,
+
+		MaxDailyTokenValue: parseTokenAmounts("maxDailyTokenValue", file.MaxDailyTokenValue),
+
+		MaxDailyBitcoinValue: parseAmount("maxDailyBitcoinValue", file.MaxDailyBitcoinValue, "sats"),
+
+		ApprovalAboveValue:        parseAmount("approvalAboveValue", file.ApprovalAboveValue, "wei"),
+		ApprovalAboveBitcoinValue: parseAmount("approvalAboveBitcoinValue", file.ApprovalAboveBitcoinValue, "sats"),
+		ApprovalForMessages:       file.ApprovalForMessages,
+
+		ApprovalAboveTokenValue: parseTokenAmounts("approvalAboveTokenValue", file.ApprovalAboveTokenValue),
+	}
+
+	return policy, errors.Join(errs...)
+}
+
+// loadConfigFromEnvs overrides config with the environment variables which are set
+func loadConfigFromEnvs(config *server.Config) error {
+	var errs []error
+
+	boolEnvs := map[string]*bool{
+		"DEV_MODE":     &config.DevMode,
+		"EXPORT":       &config.Export,
+		"MULTI_DEVICE": &config.MultiDevice,
+	}
+	for key, field := range boolEnvs {
+		if value, ok := os.LookupEnv(key); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s should be a boolean, got %q", key, value))
+				continue
+			}
+			*field = parsed
+		}
+	}
+
+	intEnvs := map[string]*int{
+		"PORT":               &config.Port,
+		"IDENTITY_CACHE_TTL": &config.IdentityCacheTtl,
+		"RPC_RATE_LIMIT":     &config.RpcRateLimit,
+		"APPROVAL_TIMEOUT":   &config.ApprovalTimeout,
+	}
+	for key, field := range intEnvs {
+		if value, ok := os.LookupEnv(key); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s should be an integer, got %q", key, value))
+				continue
+			}
+			*field = parsed
+		}
+	}
+
+	stringEnvs := map[string]*string{
+		"VAULT_TYPE":         &config.VaultType,
+		"KEY_FILE":           &config.KeyFile,
+		"DB_CONNECTION_URL":  &config.DbConnectionUrl,
+		"CLIENT_ORIGIN":      &config.ClientOrigin,
+		"AUTH_TYPE":          &config.AuthType,
+		"AUTH_SERVER_URL":    &config.AuthServerUrl,
+		"SUPABASE_URL":       &config.SupabaseUrl,
+		"SUPABASE_API_KEY":   &config.SupabaseApiKey,
+		"JWT_ISSUER":         &config.JwtIssuer,
+		"JWT_AUDIENCE":       &config.JwtAudience,
+		"JWKS_URL":           &config.JwksUrl,
+		"JWT_PUBLIC_KEY":     &config.JwtPublicKey,
+		"JWT_USER_ID_CLAIM":  &config.JwtUserIdClaim,
+		"OIDC_ISSUER_URL":    &config.OidcIssuerUrl,
+		"OIDC_AUDIENCE":      &config.OidcAudience,
+		"OIDC_USER_ID_CLAIM": &config.OidcUserIdClaim,
+
+		"APPROVAL_WEBHOOK_URL":    &config.ApprovalWebhookUrl,
+		"APPROVAL_WEBHOOK_SECRET": &config.ApprovalWebhookSecret,
+		"ADMIN_API_KEY":           &config.AdminApiKey,
+	}
+	for key, field := range stringEnvs {
+		if value, ok := os.LookupEnv(key); ok {
+			*field = value
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateConfig verifies that the config is complete and consistent, returning all the issues at once
+func validateConfig(config *server.Config) error {
+	var errs []error
+
+	if config.Port <= 0 || config.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port should be between 1 and 65535, got %d", config.Port))
+	}
+
+	if config.IdentityCacheTtl < 0 {
+		errs = append(errs, fmt.Errorf("identityCacheTtl should be positive (0 disables the cache), got %d", config.IdentityCacheTtl))
+	}
+
+	errs = append(errs, validateVaultConfig(config))
+	errs = append(errs, validateRpcConfig(config))
+
+	if config.ApprovalTimeout < 0 {
+		errs = append(errs, fmt.Errorf("approvalTimeout should be positive (0 replies approval_pending immediately), got %d", config.ApprovalTimeout))
+	}
+
+	// with tenants, origins and auth are configured by tenant
+	if len(config.Tenants) > 0 {
+		errs = append(errs, validateTenantsConfig(config))
+		return errors.Join(errs...)
+	}
+
+	if len(config.ClientOrigin) == 0 {
+		errs = append(errs, errors.New("clientOrigin (CLIENT_ORIGIN) is required"))
+	}
+
+	switch config.AuthType {
+	case "":
+		errs = append(errs, errors.New("authType (AUTH_TYPE) is required: custom, supabase, jwt or oidc"))
+	case "custom":
+		if len(config.AuthServerUrl) == 0 {
+			errs = append(errs, errors.New("authServerUrl (AUTH_SERVER_URL) is required when authType is custom"))
+		}
+	case "supabase":
+		if len(config.SupabaseUrl) == 0 {
+			errs = append(errs, errors.New("supabaseUrl (SUPABASE_URL) is required when authType is supabase"))
+		}
+		if len(config.SupabaseApiKey) == 0 {
+			errs = append(errs, errors.New("supabaseApiKey (SUPABASE_API_KEY) is required when authType is supabase"))
+		}
+	case "jwt":
+		if len(config.JwtIssuer) == 0 {
+			errs = append(errs, errors.New("jwtIssuer (JWT_ISSUER) is required when authType is jwt"))
+		}
+		if len(config.JwtAudience) == 0 {
+			errs = append(errs, errors.New("jwtAudience (JWT_AUDIENCE) is required when authType is jwt"))
+		}
+		if len(config.JwksUrl) == 0 && len(config.JwtPublicKey) == 0 {
+			errs = append(errs, errors.New("jwksUrl (JWKS_URL) or jwtPublicKey (JWT_PUBLIC_KEY) is required when authType is jwt"))
+		}
+	case "oidc":
+		if len(config.OidcIssuerUrl) == 0 {
+			errs = append(errs, errors.New("oidcIssuerUrl (OIDC_ISSUER_URL) is required when authType is oidc"))
+		}
+		if len(config.OidcAudience) == 0 {
+			errs = append(errs, errors.New("oidcAudience (OIDC_AUDIENCE) is required when authType is oidc"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("authType should be custom, supabase, jwt or oidc, got %q", config.AuthType))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTenantsConfig verifies the tenants and how they are resolved
+func validateTenantsConfig(config *server.Config) error {
+	var errs []error
+
+	switch config.TenantResolution {
+	case "", "header", "subdomain", "apiKey":
+	default:
+		errs = append(errs, fmt.Errorf("tenantResolution should be header, subdomain or apiKey, got %q", config.TenantResolution))
+	}
+
+	if len(config.AdminApiKey) > 0 {
+		errs = append(errs, errors.New("adminApiKey (ADMIN_API_KEY) is set by tenant (adminApiKey of [[tenants]]) when tenants are configured"))
+	}
+
+	ids := make(map[string]bool)
+	apiKeys := make(map[string]bool)
+	adminApiKeys := make(map[string]bool)
+	for i, tenant := range config.Tenants {
+		if len(tenant.ID) == 0 || strings.ContainsAny(tenant.ID, ":.") {
+			errs = append(errs, fmt.Errorf("tenant %d: id is required and cannot contain ':' nor '.', got %q", i, tenant.ID))
+		} else if ids[tenant.ID] {
+			errs = append(errs, fmt.Errorf("tenant %s: duplicate id", tenant.ID))
+		}
+		ids[tenant.ID] = true
+
+		if len(tenant.ClientOrigins) == 0 {
+			errs = append(errs, fmt.Errorf("tenant %s: clientOrigins is required", tenant.ID))
+		}
+
+		if tenant.Auth == nil || len(tenant.Auth.Provider) == 0 {
+			errs = append(errs, fmt.Errorf("tenant %s: authType is required", tenant.ID))
+		}
+
+		if config.TenantResolution == "apiKey" && len(tenant.ApiKeys) == 0 {
+			errs = append(errs, fmt.Errorf("tenant %s: apiKeys is required when tenantResolution is apiKey", tenant.ID))
+		}
+		for _, apiKey := range tenant.ApiKeys {
+			if apiKeys[apiKey] {
+				errs = append(errs, fmt.Errorf("tenant %s: api key already used by another tenant", tenant.ID))
+			}
+			apiKeys[apiKey] = true
+		}
+
+		if len(tenant.AdminApiKey) > 0 {
+			if adminApiKeys[tenant.AdminApiKey] {
+				errs = append(errs, fmt.Errorf("tenant %s: admin api key already used by another tenant", tenant.ID))
+			}
+			adminApiKeys[tenant.AdminApiKey] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateRpcConfig verifies the upstreams of the JSON-RPC gateway
+func validateRpcConfig(config *server.Config) error {
+	var errs []error
+
+	validateUpstreams := func(prefix string, upstreams map[string]string) {
+		for chainId, upstream := range upstreams {
+			if _, err := strconv.ParseUint(chainId, 10, 64); err != nil {
+				errs = append(errs, fmt.Errorf("%srpcUpstreams: chain id should be a decimal number, got %q", prefix, chainId))
+			}
+			if len(upstream) == 0 {
+				errs = append(errs, fmt.Errorf("%srpcUpstreams: url is required for chain %s", prefix, chainId))
+			}
+		}
+	}
+
+	validateUpstreams("", config.RpcUpstreams)
+	for _, tenant := range config.Tenants {
+		validateUpstreams("tenant "+tenant.ID+": ", tenant.RpcUpstreams)
+	}
+
+	if config.RpcRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("rpcRateLimit should be positive (0 disables the limit), got %d", config.RpcRateLimit))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateVaultConfig verifies the config required by the vault (also used by the migrate subcommand)
+func validateVaultConfig(config *server.Config) error {
+	switch config.VaultType {
+	case "postgres", "sqlite":
+		if len(config.DbConnectionUrl) == 0 {
+			return fmt.Errorf("dbConnectionUrl (DB_CONNECTION_URL) is required when vaultType is %s", config.VaultType)
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("vaultType should be postgres, sqlite or memory, got %q", config.VaultType)
+	}
+
+	return nil
+}
+
+func setIfNotNil[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	chdir(t, t.TempDir()) // no .env, no default config file
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(`
+devMode = true
+port = 9000
+dbConnectionUrl = 'postgresql://meemaw:meemaw@db:5432/meemaw'
+clientOrigin = 'http://localhost:3000'
+authType = 'supabase'
+supabaseUrl = 'https://supabase.example'
+supabaseApiKey = 'file-key'
+`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+
+	///////////////////
+	/// TEST 1 : config file, with defaults
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed test 1: could not load config: %s", err)
+	}
+
+	if !config.DevMode || config.Port != 9000 || config.SupabaseApiKey != "file-key" || !config.Export || !config.MultiDevice || config.VaultType != "postgres" {
+		t.Errorf("Failed test 1: unexpected config %+v", config)
+	}
+
+	if err := validateConfig(config); err != nil {
+		t.Errorf("Failed test 1: expected valid config, got %s", err)
+	}
+
+	///////////////////
+	/// TEST 2 : environment variables override the config file
+
+	t.Setenv("SUPABASE_API_KEY", "env-key")
+	t.Setenv("EXPORT", "false")
+
+	config, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed test 2: could not load config: %s", err)
+	}
+
+	if config.SupabaseApiKey != "env-key" || config.Export || config.Port != 9000 {
+		t.Errorf("Failed test 2: unexpected config %+v", config)
+	}
+
+	///////////////////
+	/// TEST 3 : invalid environment variable
+
+	t.Setenv("PORT", "not-a-port")
+
+	_, err = loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("Failed test 3: expected error about PORT, got %v", err)
+	}
+
+	///////////////////
+	/// TEST 4 : config file which does not exist (not the default one)
+
+	_, err = loadConfig(filepath.Join(t.TempDir(), "missing.toml"))
+	if err == nil {
+		t.Errorf("Failed test 4: expected error for missing config file")
+	}
+
+	///////////////////
+	/// TEST 5 : unknown key in config file
+
+	badPath := filepath.Join(t.TempDir(), "bad.toml")
+	err = os.WriteFile(badPath, []byte("clientOrign = 'typo'\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+
+	_, err = loadConfig(badPath)
+	if err == nil || !strings.Contains(err.Error(), "clientOrign") {
+		t.Errorf("Failed test 5: expected error about unknown key, got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := defaultConfig()
+	config.AuthType = "custom"
+
+	err := validateConfig(config)
+	if err == nil {
+		t.Fatalf("expected invalid config")
+	}
+
+	for _, expected := range []string{"dbConnectionUrl", "clientOrigin", "authServerUrl"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %s", expected, err)
+		}
+	}
+
+	config.VaultType = "memory"
+	config.ClientOrigin = "http://localhost:3000"
+	config.AuthServerUrl = "http://localhost:8080"
+
+	err = validateConfig(config)
+	if err != nil {
+		t.Errorf("expected valid config, got %s", err)
+	}
+
+	config.VaultType = "mongo"
+
+	err = validateConfig(config)
+	if err == nil || !strings.Contains(err.Error(), "vaultType") {
+		t.Errorf("expected error about vaultType, got %v", err)
+	}
+
+	config.VaultType = "memory"
+	config.AuthType = "jwt"
+
+	err = validateConfig(config)
+	if err == nil {
+		t.Fatalf("expected invalid jwt config")
+	}
+
+	for _, expected := range []string{"jwtIssuer", "jwtAudience", "jwksUrl"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %s", expected, err)
+		}
+	}
+
+	config.JwtIssuer = "https://auth.example"
+	config.JwtAudience = "meemaw"
+	config.JwksUrl = "https://auth.example/.well-known/jwks.json"
+
+	err = validateConfig(config)
+	if err != nil {
+		t.Errorf("expected valid jwt config, got %s", err)
+	}
+
+	config.RpcUpstreams = map[string]string{"mainnet": "https://eth.example", "10": ""}
+	config.RpcRateLimit = -1
+	config.ApprovalTimeout = -1
+
+	err = validateConfig(config)
+	if err == nil {
+		t.Fatalf("expected invalid rpc config")
+	}
+
+	for _, expected := range []string{"\"mainnet\"", "chain 10", "rpcRateLimit", "approvalTimeout"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %s", expected, err)
+		}
+	}
+}
+
+func TestLoadTenantsConfig(t *testing.T) {
+	chdir(t, t.TempDir())
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(`
+dbConnectionUrl = 'postgresql://meemaw:meemaw@db:5432/meemaw'
+export = false
+tenantResolution = 'subdomain'
+rpcUpstreams = { 1 = 'https://eth.example' }
+
+[[tenants]]
+id = 'app1'
+clientOrigins = ['https://app1.example']
+authType = 'supabase'
+authSettings = { supabaseUrl = 'https://app1.supabase.co', supabaseApiKey = 'key1' }
+adminApiKey = 'admin1'
+
+[[tenants]]
+id = 'app2'
+clientOrigins = ['https://app2.example', 'https://www.app2.example']
+export = true
+authType = 'oidc'
+authSettings = { oidcIssuerUrl = 'https://auth.app2.example/', oidcAudience = 'app2' }
+rpcUpstreams = { 8453 = 'https://base.app2.example' }
+rpcMethods = ['eth_chainId']
+`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("could not load config: %s", err)
+	}
+
+	if len(config.Tenants) != 2 || config.TenantResolution != "subdomain" {
+		t.Fatalf("unexpected tenants %+v", config.Tenants)
+	}
+
+	app1, app2 := config.Tenants[0], config.Tenants[1]
+	if app1.ID != "app1" || app1.Export || !app1.MultiDevice || app1.Auth.Provider != "supabase" || app1.Auth.Settings["supabaseApiKey"] != "key1" || app1.AdminApiKey != "admin1" {
+		t.Errorf("unexpected tenant app1 %+v", app1)
+	}
+	if app2.ID != "app2" || !app2.Export || len(app2.ClientOrigins) != 2 || app2.Auth.Settings["oidcAudience"] != "app2" || len(app2.AdminApiKey) != 0 {
+		t.Errorf("unexpected tenant app2 %+v", app2)
+	}
+
+	// tenants without upstreams get the global ones
+	if app1.RpcUpstreams["1"] != "https://eth.example" || len(app1.RpcMethods) != 0 {
+		t.Errorf("unexpected rpc config of tenant app1 %v %v", app1.RpcUpstreams, app1.RpcMethods)
+	}
+	if len(app2.RpcUpstreams) != 1 || app2.RpcUpstreams["8453"] != "https://base.app2.example" || len(app2.RpcMethods) != 1 {
+		t.Errorf("unexpected rpc config of tenant app2 %v %v", app2.RpcUpstreams, app2.RpcMethods)
+	}
+
+	// no global clientOrigin nor authType required with tenants
+	if err := validateConfig(config); err != nil {
+		t.Errorf("expected valid config, got %s", err)
+	}
+
+	config.TenantResolution = "apiKey"
+	app2.ID = "app1"
+	app2.RpcUpstreams["base"] = "https://base.app2.example"
+	app2.AdminApiKey = "admin1"
+	config.AdminApiKey = "admin"
+
+	err = validateConfig(config)
+	for _, expected := range []string{"duplicate id", "apiKeys", `"base"`, "admin api key already used", "adminApiKey (ADMIN_API_KEY) is set by tenant"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestLoadPolicyConfig(t *testing.T) {
+	chdir(t, t.TempDir())
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(`
+[policy]
+chainIds = [1, 8453]
+deniedRecipients = ['0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8']
+allowedMethods = ['0xa9059cbb']
+maxGasPrice = '100000000000'
+maxDailyValue = '1000000000000000000'
+approvalAboveValue = '100000000000000000'
+maxDailyTokenValue = { '0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48' = '1000000000' }
+maxDailyBitcoinValue = '1000000'
+approvalAboveBitcoinValue = '500000'
+approvalAboveTokenValue = { '0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48' = '100000000' }
+
+[[tenants]]
+id = 'app1'
+clientOrigins = ['https://app1.example']
+authType = 'custom'
+
+[[tenants]]
+id = 'app2'
+clientOrigins = ['https://app2.example']
+authType = 'custom'
+policy = { allowMessages = true }
+`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("could not load config: %s", err)
+	}
+
+	policy := config.Policy
+	if policy == nil || len(policy.ChainIds) != 2 || policy.MaxGasPrice.String() != "100000000000" || policy.MaxDailyValue.String() != "1000000000000000000" || policy.ApprovalAboveValue.String() != "100000000000000000" || policy.AllowMessages || policy.MaxDailyTokenValue["0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48"].String() != "1000000000" || policy.MaxDailyBitcoinValue.String() != "1000000" || policy.ApprovalAboveBitcoinValue.String() != "500000" || policy.ApprovalAboveTokenValue["0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48"].String() != "100000000" {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+
+	if config.Tenants[0].Policy != policy {
+		t.Errorf("expected tenant without policy to get the global policy")
+	}
+	if tenantPolicy := config.Tenants[1].Policy; tenantPolicy == nil || !tenantPolicy.AllowMessages || tenantPolicy.MaxDailyValue != nil {
+		t.Errorf("unexpected policy of tenant app2 %+v", tenantPolicy)
+	}
+
+	err = os.WriteFile(path, []byte(`
+[policy]
+deniedRecipients = ['0x1234']
+allowedMethods = ['transfer']
+maxDailyValue = '1 ether'
+maxDailyTokenValue = { 'usdc' = '1000' }
+maxDailyBitcoinValue = '0.01'
+approvalAboveTokenValue = { '0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48' = '100 USDC' }
+`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+
+	_, err = loadConfig(path)
+	for _, expected := range []string{"0x1234", "transfer", "maxDailyValue", "usdc", "maxDailyBitcoinValue", "approvalAboveTokenValue"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %v", expected, err)
+		}
+	}
+}
+
+// chdir changes the working directory for the duration of the test
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("could not get working directory: %s", err)
+	}
+
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatalf("could not change working directory: %s", err)
+	}
+
+	t.Cleanup(func() { os.Chdir(wd) })
+}
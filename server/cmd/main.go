@@ -3,15 +3,17 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/getmeemaw/meemaw/server"
 	"github.com/getmeemaw/meemaw/server/database"
 	"github.com/getmeemaw/meemaw/server/vault"
-	"github.com/getmeemaw/meemaw/utils/config"
-	"github.com/joho/godotenv"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
@@ -30,9 +32,32 @@ import (
 var wasmBinary []byte
 
 func main() {
+	// migrate subcommand
+	if len(os.Args[1:]) > 0 && os.Args[1] == "migrate" {
+		err := runMigrate(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Migration failed: %v\n", err)
+		}
+		return
+	}
+
+	// keygen subcommand
+	if len(os.Args[1:]) > 0 && os.Args[1] == "keygen" {
+		err := runKeygen(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Key generation failed: %v\n", err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", defaultConfigPath, "path of the config file (environment variables override it)")
+	silent := flag.Bool("s", false, "silence mode: discard logs")
+	flag.Bool("v", true, "verbose mode: log everything (default)")
+	flag.Parse()
+
 	// check if logging should be enabled or disabled
 	var logging bool
-	if len(os.Args[1:]) > 0 && os.Args[1] == "-s" {
+	if *silent {
 		log.Println("Silence mode: logging discarded")
 		log.SetOutput(io.Discard)
 	} else {
@@ -41,95 +66,195 @@ func main() {
 	}
 
 	// load config
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Unable to load config: %v\n", err)
+		os.Exit(1)
+	}
 
-	// config, err := loadConfigFromFile("config.toml")
-	// if err != nil {
-	// 	log.Fatalf("Unable to load config: %v\n", err)
-	// }
+	err = validateConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid config:\n%v\n", err)
+		os.Exit(1)
+	}
 
-	config, err := loadConfigFromEnvs()
+	// load vault, based on the configured backend
+	vault, closeVault, err := loadVault(config)
 	if err != nil {
-		log.Fatalf("Unable to load config: %v\n", err)
+		log.Fatalf("Unable to load vault: %v\n", err)
 		os.Exit(1)
 	}
+	defer closeVault()
 
+	// create server based on queries and config
+	server := server.NewServer(vault, config, wasmBinary, logging)
+
+	// start server
+	server.Start()
+}
+
+// loadVault creates the vault of the configured backend, with envelope encryption if a key file is configured
+func loadVault(config *server.Config) (server.Vault, func(), error) {
+	_vault, closeVault, err := openVault(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(config.KeyFile) == 0 {
+		log.Println("No key file: dkg results only encrypted with client keys")
+		return _vault, closeVault, nil
+	}
+
+	keyManager, err := vault.NewFileKeyManager(config.KeyFile)
+	if err != nil {
+		closeVault()
+		return nil, nil, fmt.Errorf("could not load key file: %w", err)
+	}
+
+	keyManagerVault, ok := _vault.(interface{ UpdateKeyManager(vault.KeyManager) })
+	if !ok {
+		closeVault()
+		return nil, nil, errors.New("vault does not support key managers")
+	}
+	keyManagerVault.UpdateKeyManager(keyManager)
+	log.Println("Envelope encryption enabled with key file:", config.KeyFile)
+
+	return _vault, closeVault, nil
+}
+
+// openVault creates the vault of the configured backend: postgres (default), sqlite or memory
+// DbConnectionUrl is the connection url for postgres and the path of the database file for sqlite
+func openVault(config *server.Config) (server.Vault, func(), error) {
+	switch config.VaultType {
+	case "postgres":
+		return loadPostgresVault(config.DbConnectionUrl)
+	case "sqlite":
+		sqliteVault, err := vault.OpenSQLiteVault(config.DbConnectionUrl)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Println("Using SQLite vault:", config.DbConnectionUrl)
+		return sqliteVault, func() { sqliteVault.Close() }, nil
+	case "memory":
+		log.Println("Using in-memory vault: wallets will be lost when the server stops")
+		return vault.NewMemoryVault(), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown vault type: %s", config.VaultType)
+	}
+}
+
+func loadPostgresVault(dbConnectionUrl string) (server.Vault, func(), error) {
 	// connect to DB
-	db, err := sql.Open("pgx", config.DbConnectionUrl)
+	db, err := sql.Open("pgx", dbConnectionUrl)
 	if err != nil {
-		log.Fatalf("Unable to connect to database: %v\n", err)
-		os.Exit(1)
+		return nil, nil, err
 	}
-	defer db.Close()
 
 	// load sqlc queries
 	queries := database.New(db)
 
-	// load vault
-	vault := vault.NewVault(queries)
-
 	// verify db connexion for good measure
 	_, err = queries.Status(context.Background())
 	if err != nil {
-		log.Fatalf("Error during db sttuse: %v\n", err)
-		os.Exit(1)
+		db.Close()
+		return nil, nil, err
 	}
 	log.Println("Connected to DB")
 
-	// verify db schema exists
-	_, err = queries.GetFirstUser(context.Background())
-	if err != nil && err != sql.ErrNoRows {
-		log.Println("Schema does not exist, creating...")
-		err = server.LoadSchema(db, "")
-		if err != nil {
-			log.Fatalf("Could not load schema: %s", err)
-			os.Exit(1)
-		} else {
-			log.Println("Schema loaded")
-		}
-	} else {
-		log.Println("Schema exists")
+	// apply pending migrations, if any
+	applied, err := server.MigrateUp(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("could not migrate schema: %w", err)
 	}
+	log.Println("Schema up to date,", len(applied), "migration(s) applied")
 
-	// create server based on queries and config
-	server := server.NewServer(vault, config, wasmBinary, logging)
+	return vault.NewVault(queries), func() { db.Close() }, nil
+}
 
-	// start server
-	server.Start()
+// runKeygen runs the keygen subcommand: it creates the key file of the config (keyFile) with a new key encryption key
+// The server never creates it by itself, a missing key file rather means that the key was lost or misconfigured
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file (environment variables override it)")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: meemaw keygen [--config config.toml]")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	if len(config.KeyFile) == 0 {
+		return errors.New("no keyFile in the config")
+	}
+
+	err = vault.CreateKeyFile(config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Key file created:", config.KeyFile)
+	return nil
 }
 
-func loadConfigFromEnvs() (*server.Config, error) {
-	// Try to load from .env, if exists
-	err := godotenv.Load()
+// runMigrate runs the migrate subcommand on the postgres database of the config:
+// "migrate status" lists the migrations and whether they are applied, "migrate up" applies the pending ones
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file (environment variables override it)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (flags.Arg(0) != "status" && flags.Arg(0) != "up") {
+		return errors.New("usage: meemaw migrate [--config config.toml] status|up")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	err = validateVaultConfig(config)
+	if err != nil {
+		return err
+	}
+
+	if config.VaultType != "postgres" {
+		return fmt.Errorf("migrations only apply to the postgres vault, vaultType is %s", config.VaultType)
+	}
+
+	db, err := sql.Open("pgx", config.DbConnectionUrl)
 	if err != nil {
-		log.Printf("No .env file found or error loading .env file: %v", err)
+		return err
 	}
+	defer db.Close()
+
+	ctx := context.Background()
 
-	requiredVars := []string{
-		"DEV_MODE",
-		"PORT",
-		"DB_CONNECTION_URL",
-		"CLIENT_ORIGIN",
-		"AUTH_TYPE",
-		"AUTH_SERVER_URL",
-		"SUPABASE_URL",
-		"SUPABASE_API_KEY",
+	if flags.Arg(0) == "up" {
+		applied, err := server.MigrateUp(ctx, db)
+		if err != nil {
+			return err
+		}
+		fmt.Println(len(applied), "migration(s) applied")
+		return nil
 	}
 
-	err = config.CheckRequiredEnvVars(requiredVars)
+	statuses, err := server.MigrationsStatus(ctx, db)
 	if err != nil {
-		return nil, err
-	}
-
-	return &server.Config{
-		DevMode:         config.GetEnvAsBool("DEV_MODE", false),
-		Export:          config.GetEnvAsBool("EXPORT", true),
-		MultiDevice:     config.GetEnvAsBool("MULTI_DEVICE", true),
-		Port:            config.GetEnvAsInt("PORT", 9421),
-		DbConnectionUrl: os.Getenv("DB_CONNECTION_URL"), // Required, checked previously
-		ClientOrigin:    os.Getenv("CLIENT_ORIGIN"),
-		AuthType:        os.Getenv("AUTH_TYPE"),
-		AuthServerUrl:   os.Getenv("AUTH_SERVER_URL"),
-		SupabaseUrl:     os.Getenv("SUPABASE_URL"),
-		SupabaseApiKey:  os.Getenv("SUPABASE_API_KEY"),
-	}, nil
+		return err
+	}
+
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			fmt.Printf("%04d_%s\tapplied %s\n", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+		} else {
+			fmt.Printf("%04d_%s\tpending\n", status.Version, status.Name)
+		}
+	}
+
+	return nil
 }
@@ -4,7 +4,9 @@
 
 package database
 
-import ()
+import (
+	"time"
+)
 
 type Device struct {
 	ID        int64
@@ -14,6 +16,21 @@ type Device struct {
 	UserAgent string
 }
 
+type MetadataDelivery struct {
+	WalletID       int64
+	SealedMetadata []byte
+	CreatedAt      time.Time
+}
+
+type Signature struct {
+	ID        int64
+	UserID    int64
+	WalletID  int64
+	PeerID    string
+	Message   []byte
+	CreatedAt time.Time
+}
+
 type User struct {
 	ID         int64
 	ForeignKey string
@@ -25,4 +42,5 @@ type Wallet struct {
 	PublicAddress       string
 	EncryptedDkgResults []byte
 	Nonce               []byte
+	Scheme              string
 }
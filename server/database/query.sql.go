@@ -89,6 +89,37 @@ func (q *Queries) AddPeer(ctx context.Context, arg AddPeerParams) (Device, error
 	return i, err
 }
 
+const addSignature = `-- name: AddSignature :one
+INSERT INTO signatures (user_id, wallet_id, peer_id, message)
+SELECT devices.user_id, devices.wallet_id, devices.peer_id, $1
+FROM devices
+INNER JOIN users ON devices.user_id = users.id
+WHERE users.foreign_key = $2
+    AND devices.peer_id = $3
+LIMIT 1
+RETURNING id, user_id, wallet_id, peer_id, message, created_at
+`
+
+type AddSignatureParams struct {
+	Message    []byte
+	ForeignKey string
+	PeerId     string
+}
+
+func (q *Queries) AddSignature(ctx context.Context, arg AddSignatureParams) (Signature, error) {
+	row := q.db.QueryRowContext(ctx, addSignature, arg.Message, arg.ForeignKey, arg.PeerId)
+	var i Signature
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.WalletID,
+		&i.PeerID,
+		&i.Message,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const addUser = `-- name: AddUser :one
 
 INSERT INTO users (foreign_key)
@@ -109,7 +140,7 @@ const addWallet = `-- name: AddWallet :one
 INSERT INTO wallets (user_id, public_address, encrypted_dkg_results, nonce)
 VALUES ($1, $2, $3, $4)
 ON CONFLICT DO NOTHING
-RETURNING id, user_id, public_address, encrypted_dkg_results, nonce
+RETURNING id, user_id, public_address, encrypted_dkg_results, nonce, scheme
 `
 
 type AddWalletParams struct {
@@ -133,6 +164,7 @@ func (q *Queries) AddWallet(ctx context.Context, arg AddWalletParams) (Wallet, e
 		&i.PublicAddress,
 		&i.EncryptedDkgResults,
 		&i.Nonce,
+		&i.Scheme,
 	)
 	return i, err
 }
@@ -145,8 +177,8 @@ WITH new_user AS (
     RETURNING id AS user_id
 ),
 new_wallet AS (
-    INSERT INTO wallets (user_id, public_address, encrypted_dkg_results, nonce)
-    SELECT user_id, $4, $5, $6
+    INSERT INTO wallets (user_id, public_address, encrypted_dkg_results, nonce, scheme)
+    SELECT user_id, $4, $5, $6, $7
     FROM new_user
     ON CONFLICT DO NOTHING
     RETURNING id AS wallet_id, user_id
@@ -165,6 +197,7 @@ type DkgParams struct {
 	PublicAddress       string
 	EncryptedDkgResults []byte
 	Nonce               []byte
+	Scheme              string
 }
 
 func (q *Queries) Dkg(ctx context.Context, arg DkgParams) (Device, error) {
@@ -175,6 +208,7 @@ func (q *Queries) Dkg(ctx context.Context, arg DkgParams) (Device, error) {
 		arg.PublicAddress,
 		arg.EncryptedDkgResults,
 		arg.Nonce,
+		arg.Scheme,
 	)
 	var i Device
 	err := row.Scan(
@@ -201,6 +235,22 @@ func (q *Queries) GetFirstUser(ctx context.Context) (User, error) {
 	return i, err
 }
 
+const getMetadataDelivery = `-- name: GetMetadataDelivery :one
+SELECT metadata_deliveries.wallet_id, metadata_deliveries.sealed_metadata, metadata_deliveries.created_at
+FROM metadata_deliveries
+INNER JOIN wallets ON metadata_deliveries.wallet_id = wallets.id
+INNER JOIN users ON wallets.user_id = users.id
+WHERE users.foreign_key = $1
+LIMIT 1
+`
+
+func (q *Queries) GetMetadataDelivery(ctx context.Context, foreignkey string) (MetadataDelivery, error) {
+	row := q.db.QueryRowContext(ctx, getMetadataDelivery, foreignkey)
+	var i MetadataDelivery
+	err := row.Scan(&i.WalletID, &i.SealedMetadata, &i.CreatedAt)
+	return i, err
+}
+
 const getUserByAddress = `-- name: GetUserByAddress :one
 SELECT users.id, users.foreign_key 
 FROM wallets
@@ -262,8 +312,44 @@ func (q *Queries) GetUserDevices(ctx context.Context, userid int64) ([]Device, e
 	return items, nil
 }
 
+const getUserSignatures = `-- name: GetUserSignatures :many
+SELECT id, user_id, wallet_id, peer_id, message, created_at FROM signatures
+WHERE user_id = $1
+ORDER BY id
+`
+
+func (q *Queries) GetUserSignatures(ctx context.Context, userid int64) ([]Signature, error) {
+	rows, err := q.db.QueryContext(ctx, getUserSignatures, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Signature
+	for rows.Next() {
+		var i Signature
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.WalletID,
+			&i.PeerID,
+			&i.Message,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getUserSigningParameters = `-- name: GetUserSigningParameters :one
-SELECT wallets.id, wallets.user_id, wallets.public_address, wallets.encrypted_dkg_results, wallets.nonce
+SELECT wallets.id, wallets.user_id, wallets.public_address, wallets.encrypted_dkg_results, wallets.nonce, wallets.scheme
 FROM users
 LEFT JOIN wallets ON users.id = wallets.user_id
 WHERE users.foreign_key = $1
@@ -275,6 +361,7 @@ type GetUserSigningParametersRow struct {
 	PublicAddress       sql.NullString
 	EncryptedDkgResults []byte
 	Nonce               []byte
+	Scheme              sql.NullString
 }
 
 func (q *Queries) GetUserSigningParameters(ctx context.Context, foreignkey string) (GetUserSigningParametersRow, error) {
@@ -286,12 +373,13 @@ func (q *Queries) GetUserSigningParameters(ctx context.Context, foreignkey strin
 		&i.PublicAddress,
 		&i.EncryptedDkgResults,
 		&i.Nonce,
+		&i.Scheme,
 	)
 	return i, err
 }
 
 const getUserWallets = `-- name: GetUserWallets :many
-SELECT id, user_id, public_address, encrypted_dkg_results, nonce FROM wallets
+SELECT id, user_id, public_address, encrypted_dkg_results, nonce, scheme FROM wallets
 WHERE user_id = $1
 `
 
@@ -310,6 +398,7 @@ func (q *Queries) GetUserWallets(ctx context.Context, userid int64) ([]Wallet, e
 			&i.PublicAddress,
 			&i.EncryptedDkgResults,
 			&i.Nonce,
+			&i.Scheme,
 		); err != nil {
 			return nil, err
 		}
@@ -325,7 +414,7 @@ func (q *Queries) GetUserWallets(ctx context.Context, userid int64) ([]Wallet, e
 }
 
 const getWalletByAddress = `-- name: GetWalletByAddress :one
-SELECT id, user_id, public_address, encrypted_dkg_results, nonce FROM wallets
+SELECT id, user_id, public_address, encrypted_dkg_results, nonce, scheme FROM wallets
 WHERE public_address = $1
 `
 
@@ -338,10 +427,99 @@ func (q *Queries) GetWalletByAddress(ctx context.Context, publicaddress string)
 		&i.PublicAddress,
 		&i.EncryptedDkgResults,
 		&i.Nonce,
+		&i.Scheme,
+	)
+	return i, err
+}
+
+const removeDevice = `-- name: RemoveDevice :one
+WITH existing_user AS (
+    SELECT id AS user_id
+    FROM users
+    WHERE foreign_key = $1
+),
+removed_device AS (
+    DELETE FROM devices
+    USING existing_user
+    WHERE devices.user_id = existing_user.user_id
+        AND devices.peer_id = $2
+    RETURNING devices.wallet_id
+)
+UPDATE wallets
+SET encrypted_dkg_results = $3,
+    nonce = $4
+FROM removed_device
+WHERE wallets.id = removed_device.wallet_id
+RETURNING wallets.id, wallets.user_id, wallets.public_address, wallets.encrypted_dkg_results, wallets.nonce, wallets.scheme
+`
+
+type RemoveDeviceParams struct {
+	ForeignKey          string
+	PeerId              string
+	EncryptedDkgResults []byte
+	Nonce               []byte
+}
+
+func (q *Queries) RemoveDevice(ctx context.Context, arg RemoveDeviceParams) (Wallet, error) {
+	row := q.db.QueryRowContext(ctx, removeDevice,
+		arg.ForeignKey,
+		arg.PeerId,
+		arg.EncryptedDkgResults,
+		arg.Nonce,
+	)
+	var i Wallet
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.PublicAddress,
+		&i.EncryptedDkgResults,
+		&i.Nonce,
+		&i.Scheme,
 	)
 	return i, err
 }
 
+const rotateWalletKey = `-- name: RotateWalletKey :one
+WITH rotated_wallet AS (
+    UPDATE wallets
+    SET encrypted_dkg_results = $1,
+        nonce = $2
+    WHERE id = $3
+        AND nonce = $4
+    RETURNING wallets.id
+),
+delivery AS (
+    INSERT INTO metadata_deliveries (wallet_id, sealed_metadata)
+    SELECT rotated_wallet.id, $5
+    FROM rotated_wallet
+    ON CONFLICT (wallet_id) DO UPDATE
+    SET sealed_metadata = excluded.sealed_metadata,
+        created_at = now()
+)
+SELECT id FROM rotated_wallet
+`
+
+type RotateWalletKeyParams struct {
+	EncryptedDkgResults []byte
+	Nonce               []byte
+	WalletId            int64
+	PreviousNonce       []byte
+	SealedMetadata      []byte
+}
+
+func (q *Queries) RotateWalletKey(ctx context.Context, arg RotateWalletKeyParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, rotateWalletKey,
+		arg.EncryptedDkgResults,
+		arg.Nonce,
+		arg.WalletId,
+		arg.PreviousNonce,
+		arg.SealedMetadata,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
 const status = `-- name: Status :one
 SELECT 1
 `
@@ -352,3 +530,45 @@ func (q *Queries) Status(ctx context.Context) (interface{}, error) {
 	err := row.Scan(&column_1)
 	return column_1, err
 }
+
+const updateWallet = `-- name: UpdateWallet :one
+WITH updated_wallet AS (
+    UPDATE wallets
+    SET encrypted_dkg_results = $1,
+        nonce = $2
+    FROM users
+    WHERE wallets.user_id = users.id
+        AND users.foreign_key = $3
+        AND wallets.public_address = $4
+    RETURNING wallets.id
+),
+resealed_delivery AS (
+    UPDATE metadata_deliveries
+    SET sealed_metadata = $5
+    FROM updated_wallet
+    WHERE metadata_deliveries.wallet_id = updated_wallet.id
+        AND octet_length($5) > 0
+)
+SELECT id FROM updated_wallet
+`
+
+type UpdateWalletParams struct {
+	EncryptedDkgResults []byte
+	Nonce               []byte
+	ForeignKey          string
+	PublicAddress       string
+	SealedMetadata      []byte
+}
+
+func (q *Queries) UpdateWallet(ctx context.Context, arg UpdateWalletParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, updateWallet,
+		arg.EncryptedDkgResults,
+		arg.Nonce,
+		arg.ForeignKey,
+		arg.PublicAddress,
+		arg.SealedMetadata,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
@@ -1,14 +1,14 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"io"
+	"encoding/json"
 	"log"
 	"net/http"
 	"strings"
 
 	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/go-chi/chi/middleware"
 	"github.com/google/uuid"
 	"github.com/patrickmn/go-cache"
 )
@@ -23,16 +23,32 @@ func (server *Server) identityMiddleware(next http.Handler) http.Handler {
 		if !server._config.DevMode {
 			if r.URL.Scheme != "https" {
 				log.Println("Unsecure connection in prod mode")
-				http.Error(w, "Secure connection required", http.StatusUnauthorized)
+				httpError(w, r, "Secure connection required", http.StatusUnauthorized)
 				return
 			}
 		}
 
+		// Tenant of the request
+		tenant, err := server.resolveTenant(r)
+		if err != nil {
+			log.Println("identityMiddleware - could not resolve tenant:", err)
+			httpError(w, r, "Unknown tenant", http.StatusUnauthorized)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); server.multiTenant() && len(origin) > 0 && !tenant.allowsOrigin(origin) {
+			log.Println("identityMiddleware - origin not allowed for tenant:", origin)
+			httpError(w, r, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		ctx = context.WithValue(ctx, types.ContextKey("tenantConfig"), tenant)
+
 		// Get Bearer token
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" || getBearerTokenFromHeader(authHeader) == "" {
 			log.Println("Empty auth header")
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			httpError(w, r, "Authorization header required", http.StatusUnauthorized)
 			return
 		}
 
@@ -40,22 +56,22 @@ func (server *Server) identityMiddleware(next http.Handler) http.Handler {
 		authConfig, err := server._getAuthConfig(ctx, server)
 		if err != nil {
 			log.Println("Problem getting auth config, err:", err)
-			http.Error(w, "Problem getting auth config", http.StatusBadRequest)
+			httpError(w, r, "Problem getting auth config", http.StatusBadRequest)
 			return
 		}
 
 		// Get userId from auth provider, based on Bearer token
-		userId, err := server.authProviders(authConfig, getBearerTokenFromHeader(authHeader))
+		userId, err := server.identify(ctx, authConfig, getBearerTokenFromHeader(authHeader))
 		if err != nil {
 			log.Println("Problem during the authorization, err:", err)
-			http.Error(w, "Invalid auth token", http.StatusUnauthorized)
+			httpError(w, r, "Invalid auth token", http.StatusUnauthorized)
 			// NOTE : we're loosing all error details (400 vs 401 vs 404). What do we really want?
 			return
 		}
 
-		// Store userId in context for next request in the stack
+		// Store userId in context for next request in the stack, namespaced by tenant
 
-		ctx = context.WithValue(ctx, types.ContextKey("userId"), userId)
+		ctx = context.WithValue(ctx, types.ContextKey("userId"), tenant.ForeignKey(userId))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -63,7 +79,7 @@ func (server *Server) identityMiddleware(next http.Handler) http.Handler {
 // ServeWasm is responsible for serving the wasm module
 func (server *Server) ServeWasm(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/wasm")
-	w.Header().Set("Access-Control-Allow-Origin", server._config.ClientOrigin)
+	w.Header().Set("Access-Control-Allow-Origin", server.allowedOrigin(r))
 	w.Write(server._wasm)
 }
 
@@ -74,7 +90,7 @@ func (server *Server) IdentifyHandler(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
 	if !ok {
 		log.Println("IdentifyHandler - userId not found in context")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
@@ -85,6 +101,7 @@ func (server *Server) IdentifyHandler(w http.ResponseWriter, r *http.Request) {
 type tokenParameters struct {
 	userId   string
 	metadata string
+	tenant   *Tenant
 }
 
 // AuthorizeHandler is responsible for creating an access token allowing for a tss request to be performed
@@ -95,7 +112,7 @@ func (server *Server) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
 	if !ok {
 		log.Println("AuthorizeHandler - userId not found in context")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
@@ -103,7 +120,7 @@ func (server *Server) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
 	metadata, ok := r.Context().Value(types.ContextKey("metadata")).(string)
 	if !ok {
 		log.Println("AuthorizeHandler - metadata not found in context")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
@@ -112,6 +129,7 @@ func (server *Server) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
 	params := tokenParameters{
 		userId:   userId,
 		metadata: metadata,
+		tenant:   server.tenant(r.Context()),
 	}
 
 	server._cache.Set(accessToken, params, cache.DefaultExpiration)
@@ -128,7 +146,7 @@ func (server *Server) authMiddleware(next http.Handler) http.Handler {
 		if !server._config.DevMode {
 			if r.URL.Scheme != "wss" {
 				log.Println("authMiddleware - secure connection required")
-				http.Error(w, "Secure connection required", http.StatusUnauthorized)
+				httpError(w, r, "Secure connection required", http.StatusUnauthorized)
 				return
 			}
 		}
@@ -138,7 +156,7 @@ func (server *Server) authMiddleware(next http.Handler) http.Handler {
 		tokenParam, ok := params["token"]
 		if !ok || len(tokenParam) == 0 {
 			log.Println("authMiddleware - you need to provide an access token")
-			http.Error(w, "You need to provide an access token", http.StatusUnauthorized)
+			httpError(w, r, "You need to provide an access token", http.StatusUnauthorized)
 			return
 		}
 
@@ -146,14 +164,14 @@ func (server *Server) authMiddleware(next http.Handler) http.Handler {
 		paramsInterface, found := server._cache.Get(tokenParam[0])
 		if !found {
 			log.Println("authMiddleware - access token does not exist")
-			http.Error(w, "The access token does not exist", http.StatusUnauthorized)
+			httpError(w, r, "The access token does not exist", http.StatusUnauthorized)
 			return
 		}
 
 		tokenParams, ok := paramsInterface.(tokenParameters)
 		if !ok {
 			log.Println("authMiddleware - could not infer tokenParameters type")
-			http.Error(w, "Issue during authorization", http.StatusBadRequest)
+			httpError(w, r, "Issue during authorization", http.StatusBadRequest)
 			return
 		}
 
@@ -162,66 +180,47 @@ func (server *Server) authMiddleware(next http.Handler) http.Handler {
 		ctx = context.WithValue(ctx, types.ContextKey("userId"), tokenParams.userId)
 		ctx = context.WithValue(ctx, types.ContextKey("metadata"), tokenParams.metadata)
 		ctx = context.WithValue(ctx, types.ContextKey("token"), tokenParam[0])
+		ctx = context.WithValue(ctx, types.ContextKey("tenantConfig"), tokenParams.tenant)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func getBearerTokenFromHeader(header string) string {
-	ret := strings.Replace(header, "Bearer", "", 1)
-	ret = strings.Replace(ret, " ", "", 1)
-	return ret
+// httpError replies to the request with a JSON error response (see types.ErrorResponse): the code matching the status, the message and the request id
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	httpTypedError(w, r, types.ErrorFromStatus(status), message, status)
 }
 
-// RpcHandler is used for debug operations : it logs every RPC-JSON requests and the return value
-func (server *Server) RpcHandler(w http.ResponseWriter, r *http.Request) {
-
-	// Log the incoming request details
-	log.Println("Received RPC request:", r.Method, r.URL.Path)
-
-	// Proxy the request to Alchemy
-	url := "https://eth-sepolia.g.alchemy.com/v2/6dMGxuEv2875AnJoXy2dy-5swIeK7WGG"
-	client := &http.Client{}
-	req, err := http.NewRequest(r.Method, url, r.Body)
-	if err != nil {
-		log.Println("error creating new request:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	response, err := client.Do(req)
+// httpTypedError replies with the code of err, for errors sharing their status with others (e.g. policy rejections)
+func httpTypedError(w http.ResponseWriter, r *http.Request, err error, message string, status int) {
+	code := "server_error"
 	if err != nil {
-		log.Println("error transmitting rpc call:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		code = types.ErrorCode(err)
 	}
 
-	defer response.Body.Close()
-
-	// Read the response body
-	bodyBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Println("error reading response body of rpc call:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+	requestID := middleware.GetReqID(r.Context())
 
-	// Print the response body
-	log.Println("Response body:", string(bodyBytes))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(status)
 
-	// Create a new reader with the body bytes for io.Copy
-	bodyReader := bytes.NewReader(bodyBytes)
+	json.NewEncoder(w).Encode(types.ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID,
+	})
+}
 
-	_, err = io.Copy(w, bodyReader)
-	if err != nil {
-		log.Println("error copying body:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+func getBearerTokenFromHeader(header string) string {
+	ret := strings.Replace(header, "Bearer", "", 1)
+	ret = strings.Replace(ret, " ", "", 1)
+	return ret
 }
 
 const headerPrefix = "M-"
 
 // headerMiddleware is a middleware used to transfer Meemaw headers to context
+// Their context keys are lowercase: the keys set by the server itself (e.g. tenantConfig, adminTenant) are not, so that a client cannot set them with a header
 func (server *Server) headerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a new context from the request context
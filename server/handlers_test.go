@@ -1,6 +1,8 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/getmeemaw/meemaw/server/database"
 	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/utils/types"
 	"github.com/google/uuid"
 )
 
@@ -119,6 +122,55 @@ func TestAuthorize(t *testing.T) {
 // tested through integration tests
 // func TestDkg(t *testing.T) {}
 
+func TestErrorResponse(t *testing.T) {
+	_server := NewServer(vault.NewMemoryVault(), &Config{DevMode: true, AuthType: "custom"}, nil, false)
+
+	errorServer := httptest.NewServer(_server.Router())
+	defer errorServer.Close()
+
+	for _, test := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/authorize", 401, "unauthorized"}, // no auth header
+		{"/sign?token=unknown", 401, "unauthorized"},
+		{"/rotate-metadata", 401, "unauthorized"}, // no access token
+	} {
+		resp, err := http.Get(errorServer.URL + test.path)
+		if err != nil {
+			t.Fatalf("could not request %s: %s", test.path, err)
+		}
+
+		var errorResponse types.ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&errorResponse)
+		resp.Body.Close()
+
+		if err != nil || resp.StatusCode != test.status || errorResponse.Code != test.code || len(errorResponse.Message) == 0 {
+			t.Errorf("%s: expected %d %s, got %d %+v (%v)", test.path, test.status, test.code, resp.StatusCode, errorResponse, err)
+		}
+
+		if len(errorResponse.RequestID) == 0 || resp.Header.Get("X-Request-Id") != errorResponse.RequestID {
+			t.Errorf("%s: expected request id in body and header, got %q and %q", test.path, errorResponse.RequestID, resp.Header.Get("X-Request-Id"))
+		}
+
+		if !errors.Is(types.ErrorFromCode(errorResponse.Code), types.ErrorFromStatus(test.status)) {
+			t.Errorf("%s: expected code to map to the error of the status", test.path)
+		}
+	}
+
+	// codes are stable and map back to the same errors
+	for _, err := range []error{&types.ErrBadRequest{}, &types.ErrUnauthorized{}, &types.ErrForbidden{}, &types.ErrNotFound{}, &types.ErrConflict{}, &types.ErrServerError{}, &types.ErrTssProcessFailed{}, &types.ErrTimeOut{}, &types.ErrTooManyRequests{}, &types.ErrPolicyRejected{Reason: "reason"}, &types.ErrApprovalPending{}} {
+		if !errors.Is(types.ErrorFromCode(types.ErrorCode(err)), err) {
+			t.Errorf("expected %T to map back from code %s", err, types.ErrorCode(err))
+		}
+	}
+
+	if types.ErrorCode(errors.New("other")) != "server_error" || types.ErrorFromCode("unknown") != nil {
+		t.Errorf("expected unknown errors to be server_error")
+	}
+}
+
 // tested through integration tests
 // func TestSign(t *testing.T) {}
 
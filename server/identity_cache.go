@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+/////////
+//
+// identityMiddleware resolves the bearer token through the auth provider on every /identify and /authorize.
+// The identity cache avoids hammering the auth provider during bursts (e.g. a user signing several transactions): token->userId is kept for a short time.
+//
+/////////
+
+const identityCacheMaxEntries = 10000
+const identityCacheMaxNegativeTtl = 10 * time.Second // rejected tokens are cached shorter, a user might just have logged in again
+
+// IdentityCacheStats are the metrics of the identity cache
+type IdentityCacheStats struct {
+	Hits         uint64 // userId found in cache
+	NegativeHits uint64 // rejection found in cache
+	Misses       uint64 // auth provider called
+	Entries      int
+}
+
+// HitRate is the share of identity lookups served by the cache, including rejections
+func (stats IdentityCacheStats) HitRate() float64 {
+	total := stats.Hits + stats.NegativeHits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits+stats.NegativeHits) / float64(total)
+}
+
+type identityCacheEntry struct {
+	userId    string
+	err       error // rejection of the auth provider (negative caching)
+	expiresAt time.Time
+}
+
+// identityCache is a bounded TTL cache of token->userId
+type identityCache struct {
+	ttl          time.Duration
+	negativeTtl  time.Duration
+	maxEntries   int
+	mu           sync.Mutex
+	entries      map[string]identityCacheEntry // by hash of auth config and token
+	hits         atomic.Uint64
+	negativeHits atomic.Uint64
+	misses       atomic.Uint64
+}
+
+// newIdentityCache creates an identity cache, disabled if ttl is 0
+func newIdentityCache(ttl time.Duration, maxEntries int) *identityCache {
+	return &identityCache{
+		ttl:         ttl,
+		negativeTtl: min(ttl, identityCacheMaxNegativeTtl),
+		maxEntries:  maxEntries,
+		entries:     make(map[string]identityCacheEntry),
+	}
+}
+
+// identify gets the userId from the auth provider, through the identity cache
+func (server *Server) identify(ctx context.Context, authConfig *AuthConfig, token string) (string, error) {
+	cache := server._identityCache
+
+	if cache.ttl <= 0 {
+		return server.authProviders(ctx, authConfig, token)
+	}
+
+	key := identityCacheKey(authConfig, token)
+
+	if entry, ok := cache.get(key); ok {
+		if entry.err != nil {
+			cache.negativeHits.Add(1)
+		} else {
+			cache.hits.Add(1)
+		}
+		return entry.userId, entry.err
+	}
+
+	cache.misses.Add(1)
+
+	userId, err := server.authProviders(ctx, authConfig, token)
+
+	if err == nil {
+		cache.set(key, identityCacheEntry{userId: userId}, cache.ttl, token)
+	} else if errors.Is(err, &types.ErrBadRequest{}) || errors.Is(err, &types.ErrUnauthorized{}) || errors.Is(err, &types.ErrNotFound{}) {
+		// only rejections are cached, not transient errors of the auth provider
+		cache.set(key, identityCacheEntry{err: err}, cache.negativeTtl, token)
+	}
+
+	return userId, err
+}
+
+// IdentityCacheStats returns the metrics of the identity cache
+func (server *Server) IdentityCacheStats() IdentityCacheStats {
+	cache := server._identityCache
+
+	cache.mu.Lock()
+	entries := len(cache.entries)
+	cache.mu.Unlock()
+
+	return IdentityCacheStats{
+		Hits:         cache.hits.Load(),
+		NegativeHits: cache.negativeHits.Load(),
+		Misses:       cache.misses.Load(),
+		Entries:      entries,
+	}
+}
+
+func (cache *identityCache) get(key string) (identityCacheEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return identityCacheEntry{}, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(cache.entries, key)
+		return identityCacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+// set caches the entry for ttl, but never beyond the expiration of the token (if it is a JWT)
+func (cache *identityCache) set(key string, entry identityCacheEntry, ttl time.Duration, token string) {
+	entry.expiresAt = time.Now().Add(ttl)
+	if exp, ok := tokenExpiration(token); ok && exp.Before(entry.expiresAt) {
+		entry.expiresAt = exp
+	}
+
+	if !entry.expiresAt.After(time.Now()) {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.entries) >= cache.maxEntries {
+		cache.evict()
+	}
+
+	cache.entries[key] = entry
+}
+
+// evict removes the expired entries, then random entries if the cache is still full. Requires the lock.
+func (cache *identityCache) evict() {
+	now := time.Now()
+	for key, entry := range cache.entries {
+		if now.After(entry.expiresAt) {
+			delete(cache.entries, key)
+		}
+	}
+
+	for key := range cache.entries {
+		if len(cache.entries) < cache.maxEntries {
+			break
+		}
+		delete(cache.entries, key)
+	}
+}
+
+// identityCacheKey hashes the auth config and the token, tokens are not kept in memory as is
+func identityCacheKey(authConfig *AuthConfig, token string) string {
+	settings := make([]string, 0, len(authConfig.Settings))
+	for key, value := range authConfig.Settings {
+		settings = append(settings, key+"="+value)
+	}
+	sort.Strings(settings)
+
+	hash := sha256.New()
+	hash.Write([]byte(authConfig.Provider + "\x00" + strings.Join(settings, "\x00") + "\x00" + token))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// tokenExpiration returns the exp claim of the token if it is a JWT. The token is not verified, this is only used to shorten caching.
+func tokenExpiration(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp *json.Number `json:"exp"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(exp), 0), true
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+func TestIdentityCache(t *testing.T) {
+	_server := NewServer(nil, &Config{IdentityCacheTtl: 60}, nil, false)
+
+	// provider counting its calls: "valid-*" tokens are accepted, "down" fails like an unreachable provider, others are rejected
+	calls := 0
+	_server.RegisterAuthProvider("counting", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		calls++
+		if token == "down" {
+			return "", errors.New("auth provider unreachable")
+		}
+		if len(token) > 6 && token[:6] == "valid-" {
+			return "user-" + token[6:], nil
+		}
+		return "", &types.ErrUnauthorized{}
+	}))
+
+	authConfig := &AuthConfig{Provider: "counting"}
+	ctx := context.Background()
+
+	///////////////////
+	/// TEST 1 : userId is cached
+
+	for i := 0; i < 3; i++ {
+		userId, err := _server.identify(ctx, authConfig, "valid-1")
+		if err != nil || userId != "user-1" {
+			t.Fatalf("Failed test 1: expected user-1, got %s (%v)", userId, err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Failed test 1: expected 1 call to the auth provider, got %d", calls)
+	}
+
+	///////////////////
+	/// TEST 2 : cache depends on the auth config
+
+	_, err := _server.identify(ctx, &AuthConfig{Provider: "counting", Settings: map[string]string{"tenant": "other"}}, "valid-1")
+	if err != nil || calls != 2 {
+		t.Errorf("Failed test 2: expected auth provider to be called for another auth config, got %d calls (%v)", calls, err)
+	}
+
+	///////////////////
+	/// TEST 3 : negative caching of rejections, but not of transient errors
+
+	calls = 0
+	for i := 0; i < 3; i++ {
+		_, err := _server.identify(ctx, authConfig, "invalid")
+		if !errors.Is(err, &types.ErrUnauthorized{}) {
+			t.Fatalf("Failed test 3: expected ErrUnauthorized, got %v", err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Failed test 3: expected 1 call to the auth provider for rejected token, got %d", calls)
+	}
+
+	calls = 0
+	for i := 0; i < 3; i++ {
+		_, err := _server.identify(ctx, authConfig, "down")
+		if err == nil {
+			t.Fatalf("Failed test 3: expected error")
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("Failed test 3: expected transient errors not to be cached, got %d calls", calls)
+	}
+
+	///////////////////
+	/// TEST 4 : entries do not outlive the token
+
+	calls = 0
+	expiredToken := "valid-2." + fakeJWTPayload(time.Now().Add(-time.Minute)) + ".signature"
+
+	for i := 0; i < 2; i++ {
+		_server.identify(ctx, authConfig, expiredToken)
+	}
+
+	if calls != 2 {
+		t.Errorf("Failed test 4: expected expired token not to be cached, got %d calls", calls)
+	}
+
+	exp, ok := tokenExpiration("header." + fakeJWTPayload(time.Unix(1700000000, 0)) + ".signature")
+	if !ok || exp.Unix() != 1700000000 {
+		t.Errorf("Failed test 4: expected token expiration, got %s (%v)", exp, ok)
+	}
+
+	///////////////////
+	/// TEST 5 : metrics
+
+	stats := _server.IdentityCacheStats()
+	if stats.Hits != 2 || stats.NegativeHits != 2 || stats.Misses != 8 || stats.Entries != 3 {
+		t.Errorf("Failed test 5: unexpected stats %+v", stats)
+	}
+
+	if stats.HitRate() != 4.0/12.0 {
+		t.Errorf("Failed test 5: expected hit rate of 1/3, got %f", stats.HitRate())
+	}
+
+	///////////////////
+	/// TEST 6 : cache is bounded
+
+	_server._identityCache.maxEntries = 10
+	for i := 0; i < 20; i++ {
+		_server.identify(ctx, authConfig, fmt.Sprintf("valid-%d", i))
+	}
+
+	if entries := _server.IdentityCacheStats().Entries; entries > 10 {
+		t.Errorf("Failed test 6: expected at most 10 entries, got %d", entries)
+	}
+
+	///////////////////
+	/// TEST 7 : disabled cache
+
+	disabledServer := NewServer(nil, &Config{}, nil, false)
+	disabledServer.RegisterAuthProvider("counting", _server._authProviders["counting"])
+
+	calls = 0
+	for i := 0; i < 3; i++ {
+		disabledServer.identify(ctx, authConfig, "valid-1")
+	}
+
+	if calls != 3 {
+		t.Errorf("Failed test 7: expected auth provider to be called every time, got %d calls", calls)
+	}
+}
+
+func fakeJWTPayload(exp time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+}
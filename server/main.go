@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/CAFxX/httpcompression"
@@ -18,45 +19,73 @@ import (
 )
 
 type Server struct {
-	_vault         Vault
-	_cache         *cache.Cache
-	_config        *Config
-	_wasm          []byte
-	_router        *chi.Mux
-	_getAuthConfig func(context.Context, *Server) (*AuthConfig, error)
+	_vault           Vault
+	_cache           *cache.Cache
+	_config          *Config
+	_wasm            []byte
+	_router          *chi.Mux
+	_getAuthConfig   func(context.Context, *Server) (*AuthConfig, error)
+	_getPolicy       func(context.Context, *Server) (*Policy, error)
+	_authProviders   map[string]AuthProvider // by name, see RegisterAuthProvider
+	_authProvidersMu sync.RWMutex
+	_identityCache   *identityCache
+	_rpcLimiter      *rateLimiter
+	_spending        *spendingTracker // value signed today by user and chain (policy daily limits)
+	_approvals       *approvalQueue   // signing requests waiting for an approval
+	_jwks            sync.Map         // JWKS caches by url (jwt and oidc auth types)
+	_oidc            sync.Map         // discovery caches by issuer (oidc auth type)
 }
 
 type Vault interface {
 	WalletExists(ctx context.Context, foreignKey string) error
+	WalletScheme(ctx context.Context, foreignKey string) (tss.Scheme, error)
+	DeviceExists(ctx context.Context, foreignKey string, peerID string) error
 	StoreWallet(ctx context.Context, foreignKey string, peerID string, userAgent string, dkgResult *tss.DkgResult) (string, error)
 	RetrieveWallet(ctx context.Context, foreignKey string) (*tss.DkgResult, error)
 	AddPeer(ctx context.Context, foreignKey string, peerID string, userAgent string, updatedDkgResult *tss.DkgResult) error
+	RemovePeer(ctx context.Context, foreignKey string, peerID string, updatedDkgResult *tss.DkgResult) error
+	UpdateWallet(ctx context.Context, foreignKey string, updatedDkgResult *tss.DkgResult) error
+	RecordSignature(ctx context.Context, foreignKey string, peerID string, message []byte) error
+	RotateMetadata(ctx context.Context, foreignKey string, peerID string) (string, error)
+	ClaimMetadata(ctx context.Context, foreignKey string, peerID string) (string, error)
 }
 
 // NewServer creates a new server object used in the "cmd" package and in tests
 func NewServer(vault Vault, config *Config, wasmBinary []byte, logging bool) *Server {
 	server := Server{
-		_vault:  vault,
-		_cache:  cache.New(2*time.Minute, 3*time.Minute),
-		_config: config,
-		_wasm:   wasmBinary,
+		_vault:         vault,
+		_cache:         cache.New(2*time.Minute, 3*time.Minute),
+		_identityCache: newIdentityCache(time.Duration(config.IdentityCacheTtl)*time.Second, identityCacheMaxEntries),
+		_rpcLimiter:    newRateLimiter(config.RpcRateLimit),
+		_spending:      newSpendingTracker(),
+		_approvals:     newApprovalQueue(),
+		_config:        config,
+		_wasm:          wasmBinary,
 	}
 
 	// Auth Config
 	server._getAuthConfig = func(ctx context.Context, server *Server) (*AuthConfig, error) {
-		return &AuthConfig{
-			AuthType:       server._config.AuthType,
-			AuthServerUrl:  server._config.AuthServerUrl,
-			SupabaseUrl:    server._config.SupabaseUrl,
-			SupabaseApiKey: server._config.SupabaseApiKey,
-		}, nil
+		authConfig := server.tenant(ctx).Auth
+		if authConfig == nil {
+			return nil, errors.New("no auth config for tenant")
+		}
+		return authConfig, nil
+	}
+
+	// Policy
+	server._getPolicy = func(ctx context.Context, server *Server) (*Policy, error) {
+		return server.tenant(ctx).Policy, nil
 	}
 
+	server._authProviders = make(map[string]AuthProvider)
+	server.registerBuiltinAuthProviders()
+
 	// Router
 
 	r := chi.NewRouter()
 
 	// global middlewares
+	r.Use(middleware.RequestID)
 	if logging {
 		r.Use(middleware.Logger)
 	}
@@ -64,9 +93,6 @@ func NewServer(vault Vault, config *Config, wasmBinary []byte, logging bool) *Se
 	// r.Use(cors.Default().Handler)
 	r.Use(server.headerMiddleware)
 
-	// debug rpc
-	r.HandleFunc("/rpc", server.RpcHandler)
-
 	// wasm
 	compress, err := httpcompression.DefaultAdapter()
 	if err != nil {
@@ -78,12 +104,28 @@ func NewServer(vault Vault, config *Config, wasmBinary []byte, logging bool) *Se
 	r.With(server.identityMiddleware).Get("/identify", server.IdentifyHandler)
 	r.With(server.identityMiddleware).Get("/authorize", server.AuthorizeHandler)
 
+	// JSON-RPC gateway
+	r.With(server.identityMiddleware).Post("/rpc/{chainId}", server.RpcHandler)
+
 	// TSS operations
 	r.With(server.authMiddleware).Get("/dkg", server.DkgHandler)
 	r.With(server.authMiddleware).Get("/sign", server.SignHandler)
+	r.With(server.authMiddleware).Get("/sign-tx", server.SignTxHandler)          // transaction decoded and hashed by the server
+	r.With(server.authMiddleware).Get("/sign-psbt", server.SignPsbtHandler)      // bitcoin transaction decoded and hashed by the server, input by input
 	r.With(server.authMiddleware).Get("/export", server.ExportHandler)           // export private key
+	r.With(server.authMiddleware).Get("/refresh", server.RefreshHandler)         // refresh shares
 	r.With(server.authMiddleware).Get("/register", server.RegisterDeviceHandler) // multi-device
 	r.With(server.authMiddleware).Get("/accept", server.AcceptDeviceHandler)     // multi-device
+	r.With(server.authMiddleware).Get("/revoke", server.RevokeDeviceHandler)     // multi-device
+
+	// metadata management
+	r.With(server.authMiddleware).Get("/rotate-metadata", server.RotateMetadataHandler)
+	r.With(server.authMiddleware).Get("/metadata", server.ClaimMetadataHandler) // metadata rotated by another device
+
+	// admin (approvals of signing requests)
+	r.With(server.adminMiddleware).Get("/admin/approvals", server.ApprovalsHandler)
+	r.With(server.adminMiddleware).Post("/admin/approvals/{id}/approve", server.ApproveHandler)
+	r.With(server.adminMiddleware).Post("/admin/approvals/{id}/deny", server.DenyHandler)
 
 	server._router = r
 
@@ -125,8 +167,49 @@ func (server *Server) Start() {
 	if !server._config.DevMode {
 
 		// Check that all communications happen through https
-		if !strings.Contains(server._config.AuthServerUrl, "https") || !strings.Contains(server._config.SupabaseUrl, "https") || !strings.Contains(server._config.ClientOrigin, "https") {
-			log.Fatal("Server not in dev mode and not all targets are https")
+		targets := []string{server._config.ClientOrigin}
+		switch server._config.AuthType {
+		case "custom":
+			targets = append(targets, server._config.AuthServerUrl)
+		case "supabase":
+			targets = append(targets, server._config.SupabaseUrl)
+		case "jwt":
+			if len(server._config.JwtPublicKey) == 0 {
+				targets = append(targets, server._config.JwksUrl)
+			}
+		case "oidc":
+			targets = append(targets, server._config.OidcIssuerUrl)
+		}
+
+		for _, tenant := range server._config.Tenants {
+			targets = append(targets, tenant.ClientOrigins...)
+			if tenant.Auth != nil {
+				for key, value := range tenant.Auth.Settings {
+					if strings.HasSuffix(key, "Url") && len(value) > 0 {
+						targets = append(targets, value)
+					}
+				}
+			}
+		}
+
+		for _, upstream := range server._config.RpcUpstreams {
+			targets = append(targets, upstream)
+		}
+
+		for _, tenant := range server._config.Tenants {
+			for _, upstream := range tenant.RpcUpstreams {
+				targets = append(targets, upstream)
+			}
+		}
+
+		if len(server._config.ApprovalWebhookUrl) > 0 {
+			targets = append(targets, server._config.ApprovalWebhookUrl)
+		}
+
+		for _, target := range targets {
+			if !strings.Contains(target, "https") {
+				log.Fatal("Server not in dev mode and not all targets are https")
+			}
 		}
 
 	}
@@ -139,23 +222,68 @@ func (server *Server) Start() {
 }
 
 type Config struct {
-	DevMode         bool
-	Export          bool
-	MultiDevice     bool
-	Port            int
-	DbConnectionUrl string
-	ClientOrigin    string
-	AuthType        string
-	AuthServerUrl   string
-	SupabaseUrl     string
-	SupabaseApiKey  string
+	DevMode          bool
+	Export           bool
+	MultiDevice      bool
+	Port             int
+	VaultType        string // postgres (default), sqlite or memory
+	KeyFile          string // key encryption key file of the vault (envelope encryption), optional
+	DbConnectionUrl  string
+	ClientOrigin     string
+	AuthType         string
+	AuthServerUrl    string
+	SupabaseUrl      string
+	SupabaseApiKey   string
+	JwtIssuer        string            // jwt auth type: expected iss claim
+	JwtAudience      string            // jwt auth type: expected aud claim
+	JwksUrl          string            // jwt auth type: JWKS of the auth provider
+	JwtPublicKey     string            // jwt auth type: PEM public key, instead of JwksUrl
+	JwtUserIdClaim   string            // jwt auth type: claim holding the user id, sub by default
+	OidcIssuerUrl    string            // oidc auth type: issuer, used for discovery
+	OidcAudience     string            // oidc auth type: expected aud claim (usually the client id)
+	OidcUserIdClaim  string            // oidc auth type: claim holding the user id, sub by default
+	IdentityCacheTtl int               // seconds during which the userId of a token is cached (not cached if 0)
+	Tenants          []*Tenant         // apps served by the server, replacing ClientOrigin, Export, MultiDevice and the auth config if any
+	TenantResolution string            // how the tenant of a request is found: header (default), subdomain or apiKey
+	RpcUpstreams     map[string]string // JSON-RPC gateway: upstream url by chain id, gateway disabled if empty (default of the tenants)
+	RpcMethods       []string          // JSON-RPC gateway: allowed methods, read methods and eth_sendRawTransaction by default (default of the tenants)
+	RpcRateLimit     int               // JSON-RPC gateway: requests per minute per user of a tenant (unlimited if 0)
+	Policy           *Policy           // rules checked before co-signing, everything allowed if nil
+
+	ApprovalWebhookUrl    string // called with the signing requests requiring an approval (see Policy), optional
+	ApprovalWebhookSecret string // key of the HMAC-SHA256 signature of the webhook body (M-SIGNATURE header), optional
+	ApprovalTimeout       int    // seconds a signing request waits for its approval before replying approval_pending (immediately if 0)
+	AdminApiKey           string // admin endpoints (approvals), disabled if empty. With tenants, each tenant has its own (Tenant.AdminApiKey)
+}
+
+// authConfig returns the auth config of the server config, settings are named like in the config file
+func (config *Config) authConfig() *AuthConfig {
+	return &AuthConfig{
+		Provider: config.AuthType,
+		Settings: map[string]string{
+			"authServerUrl":   config.AuthServerUrl,
+			"supabaseUrl":     config.SupabaseUrl,
+			"supabaseApiKey":  config.SupabaseApiKey,
+			"jwtIssuer":       config.JwtIssuer,
+			"jwtAudience":     config.JwtAudience,
+			"jwksUrl":         config.JwksUrl,
+			"jwtPublicKey":    config.JwtPublicKey,
+			"jwtUserIdClaim":  config.JwtUserIdClaim,
+			"oidcIssuerUrl":   config.OidcIssuerUrl,
+			"oidcAudience":    config.OidcAudience,
+			"oidcUserIdClaim": config.OidcUserIdClaim,
+		},
+	}
 }
 
 func (server *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", server._config.ClientOrigin)
+		w.Header().Set("Access-Control-Allow-Origin", server.allowedOrigin(r))
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, M-METADATA")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, M-METADATA, M-TENANT, M-API-KEY")
+		if server.multiTenant() {
+			w.Header().Add("Vary", "Origin")
+		}
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
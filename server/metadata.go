@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+// RotateMetadataHandler re-encrypts the wallet of the user with a new client key and returns it as the new metadata
+// goes through the authMiddleware to confirm the access token, get the userId and the current metadata
+// requires the peerID of the device (provided as URL parameter)
+// the previous metadata cannot decrypt the wallet anymore: the other devices of the wallet get the new one from ClaimMetadataHandler, sealed with their public share
+// wallets without the public shares of their devices need to be refreshed first ("refresh_required")
+func (server *Server) RotateMetadataHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get userId and access token from context
+	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
+	if !ok {
+		// If there's no userID in the context, report an error and return.
+		log.Println("RotateMetadataHandler - authorization info not found")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	token, ok := r.Context().Value(types.ContextKey("token")).(string)
+	if !ok {
+		// If there's no token in the context, report an error and return.
+		log.Println("RotateMetadataHandler - authorization info not found")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	clientPeerID := r.URL.Query().Get("peer")
+
+	err := server._vault.DeviceExists(r.Context(), userId, clientPeerID)
+	if err != nil {
+		log.Println("RotateMetadataHandler - device calling is not part of the wallet:", clientPeerID)
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	metadata, err := server._vault.RotateMetadata(r.Context(), userId, clientPeerID) // RotateMetadata uses the current metadata from context
+	if err != nil {
+		log.Println("RotateMetadataHandler - error while rotating metadata:", err)
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
+		} else if errors.Is(err, &types.ErrConflict{}) {
+			httpError(w, r, "Conflict", http.StatusConflict)
+		} else if errors.Is(err, &types.ErrRefreshRequired{}) {
+			httpTypedError(w, r, err, "The public shares of the devices are unknown, refresh the wallet first.", http.StatusConflict)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Delete token from cache: it holds the previous metadata
+	server._cache.Delete(token)
+
+	w.Write([]byte(metadata))
+}
+
+// ClaimMetadataHandler returns the latest metadata of the wallet to a device whose metadata was rotated by another device (RotateMetadataHandler)
+// goes through the authMiddleware to confirm the access token, get the userId and the metadata of the device
+// requires the peerID of the device (provided as URL parameter)
+// the new metadata is sealed for the device (hex), only its share opens it: it can be claimed again, holding a previous metadata does not give it
+// the body is empty if the metadata was not rotated, the current metadata then needs to be valid
+func (server *Server) ClaimMetadataHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Get userId and access token from context
+	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
+	if !ok {
+		// If there's no userID in the context, report an error and return.
+		log.Println("ClaimMetadataHandler - authorization info not found")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	token, ok := r.Context().Value(types.ContextKey("token")).(string)
+	if !ok {
+		// If there's no token in the context, report an error and return.
+		log.Println("ClaimMetadataHandler - authorization info not found")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	clientPeerID := r.URL.Query().Get("peer")
+
+	sealedMetadata, err := server._vault.ClaimMetadata(r.Context(), userId, clientPeerID)
+	if err != nil {
+		log.Println("ClaimMetadataHandler - error while claiming metadata:", err)
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Device does not exist.", http.StatusNotFound)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if len(sealedMetadata) == 0 {
+		// Not rotated: the current metadata needs to be valid
+		_, err = server._vault.RetrieveWallet(r.Context(), userId) // RetrieveWallet uses the metadata from context
+		if err != nil {
+			log.Println("ClaimMetadataHandler - metadata is not valid:", err)
+			httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Delete token from cache to avoid re-use
+	server._cache.Delete(token)
+
+	w.Write([]byte(sealedMetadata))
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/tx"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+/////////
+//
+// The server is a mandatory co-signer, hence the natural place to enforce rules on what the wallets can sign.
+// The policy of the tenant is checked before the signing process starts: a rejection replies with the policy_rejected code and the reason (types.ErrPolicyRejected on the client side).
+// Transactions signed through /sign-tx are checked against the rules. Raw messages (/sign) cannot be, they are only allowed with AllowMessages.
+// This includes every flow signing through /sign: Ethereum messages (EIP-191 and EIP-712) and BIP-340 Schnorr signatures.
+// ERC-20 calls (transfer, transferFrom and approve) are decoded: their recipient is checked and their amount counts against MaxDailyTokenValue.
+// Bitcoin PSBTs signed through /sign-psbt are decoded as well: their outputs are checked against the recipients, and their value against MaxDailyBitcoinValue.
+//
+/////////
+
+// Policy holds the rules checked by the server before co-signing
+type Policy struct {
+	ChainIds          []uint64 // allowed chains, all if empty
+	AllowedRecipients []string // allowed recipients (to address), all if empty
+	DeniedRecipients  []string // denied recipients (to address)
+	AllowedMethods    []string // allowed contract method selectors (e.g. 0xa9059cbb), all if empty. Plain transfers (no data) are always allowed
+	MaxGasPrice       *big.Int // max gas price (max fee per gas for EIP-1559 transactions) in wei, no limit if nil
+	MaxDailyValue     *big.Int // max value sent by a user on a chain per day (UTC) in wei, no limit if nil. Only the native value: tokens are limited by MaxDailyTokenValue
+	AllowMessages     bool     // allows signing raw messages through /sign, which cannot be checked against the rules
+
+	// max amount of a token (by contract address) transferred or approved by a user on a chain per day (UTC), in the smallest unit of the token
+	// no limit if empty, otherwise tokens which are not listed are denied
+	MaxDailyTokenValue map[string]*big.Int
+
+	MaxDailyBitcoinValue *big.Int // max value sent by a user to other addresses on a Bitcoin network per day (UTC) in sats, no limit if nil
+
+	ApprovalAboveValue        *big.Int // transactions sending more than this value (in wei) need an approval, none if nil
+	ApprovalAboveBitcoinValue *big.Int // bitcoin transactions sending more than this value (in sats) to other addresses need an approval, none if nil
+	ApprovalForMessages       bool     // raw messages need an approval
+
+	// ERC-20 calls moving more than this amount of a token (by contract address, in the smallest unit of the token) need an approval
+	// none if empty, otherwise the calls of tokens which are not listed always need one
+	ApprovalAboveTokenValue map[string]*big.Int
+}
+
+// Check verifies the transaction against the rules of the policy which do not depend on previous transactions (types.ErrPolicyRejected if it breaks one)
+func (policy *Policy) Check(ethTx *tx.EthereumTx) error {
+	transaction := ethTx.Tx()
+
+	if len(policy.ChainIds) > 0 {
+		chainId := ethTx.ChainId()
+		allowed := false
+		for _, allowedChainId := range policy.ChainIds {
+			if chainId.IsUint64() && chainId.Uint64() == allowedChainId {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &types.ErrPolicyRejected{Reason: "chain " + chainId.String() + " not allowed"}
+		}
+	}
+
+	recipient := ""
+	if transaction.To() != nil {
+		recipient = transaction.To().Hex()
+	}
+
+	if containsFold(policy.DeniedRecipients, recipient) {
+		return &types.ErrPolicyRejected{Reason: "recipient " + recipient + " denied"}
+	}
+
+	tokenCall, err := ethTx.TokenCall()
+	if err != nil {
+		return &types.ErrPolicyRejected{Reason: err.Error()}
+	}
+
+	if tokenCall != nil && containsFold(policy.DeniedRecipients, tokenCall.Recipient.Hex()) {
+		return &types.ErrPolicyRejected{Reason: "token recipient " + tokenCall.Recipient.Hex() + " denied"}
+	}
+
+	if len(policy.AllowedRecipients) > 0 && !containsFold(policy.AllowedRecipients, recipient) {
+		return &types.ErrPolicyRejected{Reason: "recipient " + recipient + " not allowed"}
+	}
+
+	if data := transaction.Data(); len(data) > 0 && len(policy.AllowedMethods) > 0 {
+		if len(data) < 4 {
+			return &types.ErrPolicyRejected{Reason: "invalid method selector"}
+		}
+
+		selector := "0x" + hex.EncodeToString(data[:4])
+		if !containsFold(policy.AllowedMethods, selector) {
+			return &types.ErrPolicyRejected{Reason: "method " + selector + " not allowed"}
+		}
+	}
+
+	if policy.MaxGasPrice != nil && transaction.GasFeeCap().Cmp(policy.MaxGasPrice) > 0 {
+		return &types.ErrPolicyRejected{Reason: "gas price above " + policy.MaxGasPrice.String() + " wei"}
+	}
+
+	if policy.MaxDailyValue != nil && transaction.Value().Cmp(policy.MaxDailyValue) > 0 {
+		return &types.ErrPolicyRejected{Reason: "value above daily limit of " + policy.MaxDailyValue.String() + " wei"}
+	}
+
+	if tokenCall != nil && len(policy.MaxDailyTokenValue) > 0 {
+		limit := policy.tokenLimit(tokenCall.Token.Hex())
+		if limit == nil {
+			return &types.ErrPolicyRejected{Reason: "token " + tokenCall.Token.Hex() + " not allowed"}
+		}
+		if tokenCall.Amount.Cmp(limit) > 0 {
+			return &types.ErrPolicyRejected{Reason: "amount of token " + tokenCall.Token.Hex() + " above daily limit of " + limit.String()}
+		}
+	}
+
+	return nil
+}
+
+// tokenLimit returns the daily limit of the token, nil if not listed
+func (policy *Policy) tokenLimit(token string) *big.Int {
+	return tokenValue(policy.MaxDailyTokenValue, token)
+}
+
+// tokenValue returns the value of the token in values (by contract address, whatever the case), nil if not listed
+func tokenValue(values map[string]*big.Int, token string) *big.Int {
+	for address, value := range values {
+		if strings.EqualFold(address, token) {
+			return value
+		}
+	}
+	return nil
+}
+
+// CheckPsbt verifies the outputs of the bitcoin transaction against the rules of the policy which do not depend on previous transactions (types.ErrPolicyRejected if it breaks one)
+// The recipients of the policy apply to the addresses of the outputs, change excluded
+func (policy *Policy) CheckPsbt(spend *bitcoin.Spend) error {
+	for _, output := range spend.Outputs {
+		if output.Value == 0 && len(output.Address) == 0 {
+			continue // data carrier (OP_RETURN), nothing sent
+		}
+
+		if containsFold(policy.DeniedRecipients, output.Address) {
+			return &types.ErrPolicyRejected{Reason: "recipient " + output.Address + " denied"}
+		}
+
+		if len(policy.AllowedRecipients) > 0 && !containsFold(policy.AllowedRecipients, output.Address) {
+			return &types.ErrPolicyRejected{Reason: "recipient " + output.Address + " not allowed"}
+		}
+	}
+
+	if policy.MaxDailyBitcoinValue != nil && big.NewInt(spend.Value).Cmp(policy.MaxDailyBitcoinValue) > 0 {
+		return &types.ErrPolicyRejected{Reason: "value above daily limit of " + policy.MaxDailyBitcoinValue.String() + " sats"}
+	}
+
+	return nil
+}
+
+// checkPolicy verifies that the policy of the tenant allows the user to sign (ethTx is nil for raw messages)
+// The value of the transaction is reserved against the daily limit: release must be called if the transaction ends up not being signed
+func (server *Server) checkPolicy(ctx context.Context, userId string, ethTx *tx.EthereumTx) (release func(), err error) {
+	release = func() {}
+
+	policy, err := server._getPolicy(ctx, server)
+	if err != nil || policy == nil {
+		return release, err
+	}
+
+	if ethTx == nil {
+		if !policy.AllowMessages {
+			return release, &types.ErrPolicyRejected{Reason: "raw messages cannot be signed, only transactions"}
+		}
+		return release, nil
+	}
+
+	err = policy.Check(ethTx)
+	if err != nil {
+		return release, err
+	}
+
+	var releases []func()
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	if policy.MaxDailyValue != nil {
+		key := userId + ":" + ethTx.ChainId().String()
+		value := ethTx.Tx().Value()
+
+		day, ok := server._spending.reserve(key, value, policy.MaxDailyValue)
+		if !ok {
+			return release, &types.ErrPolicyRejected{Reason: "daily limit of " + policy.MaxDailyValue.String() + " wei reached"}
+		}
+
+		releases = append(releases, func() { server._spending.release(day, key, value) })
+	}
+
+	tokenCall, _ := ethTx.TokenCall() // already checked by Check
+	if tokenCall != nil && len(policy.MaxDailyTokenValue) > 0 {
+		key := userId + ":" + ethTx.ChainId().String() + ":" + strings.ToLower(tokenCall.Token.Hex())
+		limit := policy.tokenLimit(tokenCall.Token.Hex())
+
+		day, ok := server._spending.reserve(key, tokenCall.Amount, limit)
+		if !ok {
+			release()
+			return func() {}, &types.ErrPolicyRejected{Reason: "daily limit of " + limit.String() + " for token " + tokenCall.Token.Hex() + " reached"}
+		}
+
+		releases = append(releases, func() { server._spending.release(day, key, tokenCall.Amount) })
+	}
+
+	return release, nil
+}
+
+// checkPsbtPolicy verifies that the policy of the tenant allows the user to sign an input of the bitcoin transaction
+// The inputs of a transaction are signed one by one: its value is reserved against the daily limit once, settle must be called once the input is signed or not.
+// The reservation is only released if no input of the transaction was signed: the signed inputs are usable, even if the others never are.
+func (server *Server) checkPsbtPolicy(ctx context.Context, userId string, spend *bitcoin.Spend) (settle func(signed bool), err error) {
+	settle = func(bool) {}
+
+	policy, err := server._getPolicy(ctx, server)
+	if err != nil || policy == nil {
+		return settle, err
+	}
+
+	err = policy.CheckPsbt(spend)
+	if err != nil {
+		return settle, err
+	}
+
+	if policy.MaxDailyBitcoinValue != nil {
+		key := userId + ":bitcoin:" + spend.Network
+		value := big.NewInt(spend.Value)
+
+		day, ok := server._spending.reserveOnce(key, spend.TxID, value, policy.MaxDailyBitcoinValue)
+		if !ok {
+			return settle, &types.ErrPolicyRejected{Reason: "daily limit of " + policy.MaxDailyBitcoinValue.String() + " sats reached"}
+		}
+
+		settle = func(signed bool) { server._spending.settleOnce(day, key, spend.TxID, value, signed) }
+	}
+
+	return settle, nil
+}
+
+// UpdateGetPolicy changes the policy getter (e.g. to load policies by user from a database), nil policies allow everything
+func (server *Server) UpdateGetPolicy(getPolicy func(context.Context, *Server) (*Policy, error)) {
+	server._getPolicy = getPolicy
+}
+
+// spendingTracker keeps the value signed today (UTC) by key, in memory: each server instance keeps its own count,
+// hence the daily limits only hold when a single instance co-signs for the users (or when the users are always routed to the same one)
+type spendingTracker struct {
+	mu       sync.Mutex
+	day      string
+	spent    map[string]*big.Int
+	reserved map[string]*onceReservation // reservations made once (see reserveOnce), by key and id
+}
+
+// onceReservation is a value reserved once for several signatures (e.g. the inputs of a bitcoin transaction)
+type onceReservation struct {
+	pending int  // signatures in progress
+	signed  bool // at least one signature succeeded: the value is spent
+}
+
+func newSpendingTracker() *spendingTracker {
+	return &spendingTracker{spent: make(map[string]*big.Int), reserved: make(map[string]*onceReservation)}
+}
+
+// reserve adds value to the value spent today by key if it stays within limit, and returns the day of the reservation
+func (tracker *spendingTracker) reserve(key string, value *big.Int, limit *big.Int) (string, bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.rollover()
+
+	return tracker.day, tracker.add(key, value, limit)
+}
+
+// reserveOnce is reserve for a value which is reserved at most once per id (e.g. a bitcoin transaction whose inputs are signed one by one)
+// Each successful reserveOnce needs a settleOnce
+func (tracker *spendingTracker) reserveOnce(key string, id string, value *big.Int, limit *big.Int) (string, bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.rollover()
+
+	if reservation, ok := tracker.reserved[key+":"+id]; ok {
+		reservation.pending++
+		return tracker.day, true
+	}
+
+	if !tracker.add(key, value, limit) {
+		return tracker.day, false
+	}
+
+	tracker.reserved[key+":"+id] = &onceReservation{pending: 1}
+	return tracker.day, true
+}
+
+// add adds value to the value spent today by key if it stays within limit. Requires the lock.
+func (tracker *spendingTracker) add(key string, value *big.Int, limit *big.Int) bool {
+	spent, ok := tracker.spent[key]
+	if !ok {
+		spent = new(big.Int)
+	}
+
+	total := new(big.Int).Add(spent, value)
+	if total.Cmp(limit) > 0 {
+		return false
+	}
+
+	tracker.spent[key] = total
+	return true
+}
+
+// release removes value from the value spent by key on the day of the reservation (nothing to release if the day changed since)
+func (tracker *spendingTracker) release(day string, key string, value *big.Int) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.subtract(day, key, value)
+}
+
+// settleOnce ends a signature reserved with reserveOnce. The value is released once no signature of id is in progress, if none succeeded:
+// the next reserveOnce of id then reserves the value again. Once a signature succeeded, the value stays spent for the day.
+func (tracker *spendingTracker) settleOnce(day string, key string, id string, value *big.Int, signed bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	reservation, ok := tracker.reserved[key+":"+id]
+	if tracker.day != day || !ok {
+		return
+	}
+
+	reservation.pending--
+	reservation.signed = reservation.signed || signed
+	if reservation.pending > 0 || reservation.signed {
+		return
+	}
+
+	delete(tracker.reserved, key+":"+id)
+	tracker.subtract(day, key, value)
+}
+
+// rollover starts a new day if the day changed (UTC). Requires the lock.
+func (tracker *spendingTracker) rollover() {
+	if today := time.Now().UTC().Format(time.DateOnly); tracker.day != today {
+		tracker.day = today
+		tracker.spent = make(map[string]*big.Int)
+		tracker.reserved = make(map[string]*onceReservation)
+	}
+}
+
+// subtract removes value from the value spent by key on day (nothing to remove if the day changed since). Requires the lock.
+func (tracker *spendingTracker) subtract(day string, key string, value *big.Int) {
+	if tracker.day != day {
+		return
+	}
+
+	if spent, ok := tracker.spent[key]; ok {
+		spent = new(big.Int).Sub(spent, value)
+		if spent.Sign() < 0 {
+			spent.SetInt64(0)
+		}
+		tracker.spent[key] = spent
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
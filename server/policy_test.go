@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/tx"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+func TestPolicy(t *testing.T) {
+	newTx := func(jsonEncodedTx string, chainId any) *tx.EthereumTx {
+		ethTx, err := tx.NewEthereumTxWithJson(jsonEncodedTx, chainId)
+		if err != nil {
+			t.Fatalf("could not create tx: %s", err)
+		}
+		return ethTx
+	}
+
+	// tokenTx calls the token contract with the method selector, for the recipient and the amount (hex encoded)
+	tokenTx := func(token string, selector string, recipient string, amount string) *tx.EthereumTx {
+		data := selector + strings.Repeat("0", 24) + strings.TrimPrefix(recipient, "0x") + fmt.Sprintf("%064s", amount)
+		return newTx(`{"to":"`+token+`","value":"0","nonce":1,"gasLimit":60000,"gasPrice":"1000000000","data":"`+data+`"}`, 1)
+	}
+
+	recipient := "0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8"
+	token := "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48"
+	transfer := newTx(`{"to":"`+recipient+`","value":"1000","nonce":1,"gasLimit":21000,"gasPrice":"1000000000"}`, 1)
+	erc20Transfer := tokenTx(token, "0xa9059cbb", recipient, "3e8") // 1000
+	approve := tokenTx(token, "0x095ea7b3", recipient, "3e8")
+	invalidTransfer := newTx(`{"to":"`+token+`","value":"0","nonce":1,"gasLimit":60000,"gasPrice":"1000000000","data":"0xa9059cbb0000"}`, 1)
+
+	///////////////////
+	/// TEST 1 : rules
+
+	for i, test := range []struct {
+		policy  Policy
+		ethTx   *tx.EthereumTx
+		allowed bool
+	}{
+		{Policy{}, transfer, true},
+		{Policy{ChainIds: []uint64{1, 8453}}, transfer, true},
+		{Policy{ChainIds: []uint64{8453}}, transfer, false},
+		{Policy{AllowedRecipients: []string{"0x809CCC37D2DD55A8E8FA58FC51D101C6B22425A8"}}, transfer, true},
+		{Policy{AllowedRecipients: []string{"0x0000000000000000000000000000000000000001"}}, transfer, false},
+		{Policy{DeniedRecipients: []string{recipient}}, transfer, false},
+		{Policy{AllowedMethods: []string{"0xa9059cbb"}}, transfer, true}, // plain transfers always allowed
+		{Policy{AllowedMethods: []string{"0xa9059cbb"}}, erc20Transfer, true},
+		{Policy{AllowedMethods: []string{"0xa9059cbb"}}, approve, false},
+		{Policy{MaxGasPrice: big.NewInt(1000000000)}, transfer, true},
+		{Policy{MaxGasPrice: big.NewInt(999999999)}, transfer, false},
+		{Policy{MaxDailyValue: big.NewInt(999)}, transfer, false},
+		{Policy{MaxDailyValue: big.NewInt(999)}, erc20Transfer, true}, // native value only
+		{Policy{DeniedRecipients: []string{recipient}}, erc20Transfer, false},
+		{Policy{DeniedRecipients: []string{recipient}}, approve, false},
+		{Policy{MaxDailyTokenValue: map[string]*big.Int{token: big.NewInt(1000)}}, erc20Transfer, true},
+		{Policy{MaxDailyTokenValue: map[string]*big.Int{token: big.NewInt(999)}}, erc20Transfer, false},
+		{Policy{MaxDailyTokenValue: map[string]*big.Int{token: big.NewInt(999)}}, approve, false},
+		{Policy{MaxDailyTokenValue: map[string]*big.Int{recipient: big.NewInt(1000)}}, erc20Transfer, false}, // token not listed
+		{Policy{}, invalidTransfer, false},
+	} {
+		err := test.policy.Check(test.ethTx)
+		if test.allowed && err != nil {
+			t.Errorf("Failed test 1.%d: expected tx to be allowed, got %s", i, err)
+		}
+		if !test.allowed && !errors.Is(err, &types.ErrPolicyRejected{}) {
+			t.Errorf("Failed test 1.%d: expected policy rejection, got %v", i, err)
+		}
+	}
+
+	///////////////////
+	/// TEST 2 : daily limit by user and chain, released when not signed
+
+	policy := &Policy{MaxDailyValue: big.NewInt(2500)}
+	_server := NewServer(nil, &Config{Policy: policy}, nil, false)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := _server.checkPolicy(ctx, "alice", transfer)
+		if err != nil {
+			t.Fatalf("Failed test 2: expected tx %d to be within the daily limit, got %s", i, err)
+		}
+	}
+
+	release, err := _server.checkPolicy(ctx, "alice", transfer)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) {
+		t.Errorf("Failed test 2: expected daily limit to be reached, got %v", err)
+	}
+	release()
+
+	_, err = _server.checkPolicy(ctx, "bob", transfer)
+	if err != nil {
+		t.Errorf("Failed test 2: expected daily limit to be by user, got %s", err)
+	}
+
+	release, err = _server.checkPolicy(ctx, "bob", transfer)
+	if err != nil {
+		t.Fatalf("Failed test 2: expected tx within the daily limit, got %s", err)
+	}
+	release() // e.g. signing failed
+
+	_, err = _server.checkPolicy(ctx, "bob", transfer)
+	if err != nil {
+		t.Errorf("Failed test 2: expected released value not to count, got %s", err)
+	}
+
+	///////////////////
+	/// TEST 3 : daily limit of tokens, by user, chain and token
+
+	tokenPolicy := &Policy{MaxDailyTokenValue: map[string]*big.Int{token: big.NewInt(2500)}}
+	_tokenServer := NewServer(nil, &Config{Policy: tokenPolicy}, nil, false)
+
+	for i := 0; i < 2; i++ {
+		_, err := _tokenServer.checkPolicy(ctx, "alice", erc20Transfer)
+		if err != nil {
+			t.Fatalf("Failed test 3: expected token transfer %d to be within the daily limit, got %s", i, err)
+		}
+	}
+
+	_, err = _tokenServer.checkPolicy(ctx, "alice", approve)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) {
+		t.Errorf("Failed test 3: expected daily limit of the token to be reached, got %v", err)
+	}
+
+	_, err = _tokenServer.checkPolicy(ctx, "alice", transfer)
+	if err != nil {
+		t.Errorf("Failed test 3: expected native value not to count against the token limit, got %s", err)
+	}
+
+	release, err = _tokenServer.checkPolicy(ctx, "bob", erc20Transfer)
+	if err != nil {
+		t.Fatalf("Failed test 3: expected daily limit of the token to be by user, got %s", err)
+	}
+	release()
+
+	///////////////////
+	/// TEST 4 : raw messages
+
+	_, err = _server.checkPolicy(ctx, "alice", nil)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) {
+		t.Errorf("Failed test 4: expected raw message to be rejected, got %v", err)
+	}
+
+	policy.AllowMessages = true
+
+	_, err = _server.checkPolicy(ctx, "alice", nil)
+	if err != nil {
+		t.Errorf("Failed test 4: expected raw message to be allowed, got %s", err)
+	}
+
+	///////////////////
+	/// TEST 5 : policy getter
+
+	_server.UpdateGetPolicy(func(ctx context.Context, server *Server) (*Policy, error) {
+		return nil, nil
+	})
+
+	_, err = _server.checkPolicy(ctx, "alice", approve)
+	if err != nil {
+		t.Errorf("Failed test 5: expected no policy to allow everything, got %s", err)
+	}
+}
+
+func TestPsbtPolicy(t *testing.T) {
+	recipient := "bcrt1q77zw6x35srwfl3grt26yc46fyphmwj4s9kyq8e"
+	spend := &bitcoin.Spend{
+		Network: "regtest",
+		TxID:    "tx1",
+		Outputs: []bitcoin.SpendOutput{{Address: recipient, Value: 1000}, {Value: 0}}, // with a data carrier output
+		Value:   1000,
+		Fee:     200,
+	}
+
+	///////////////////
+	/// TEST 1 : rules
+
+	for i, test := range []struct {
+		policy  Policy
+		allowed bool
+	}{
+		{Policy{}, true},
+		{Policy{AllowedRecipients: []string{recipient}}, true},
+		{Policy{AllowedRecipients: []string{"bcrt1q0000000000000000000000000000000000000"}}, false},
+		{Policy{DeniedRecipients: []string{recipient}}, false},
+		{Policy{MaxDailyBitcoinValue: big.NewInt(1000)}, true},
+		{Policy{MaxDailyBitcoinValue: big.NewInt(999)}, false},
+		{Policy{MaxDailyValue: big.NewInt(999)}, true}, // wei, not sats
+	} {
+		err := test.policy.CheckPsbt(spend)
+		if test.allowed && err != nil {
+			t.Errorf("Failed test 1.%d: expected psbt to be allowed, got %s", i, err)
+		}
+		if !test.allowed && !errors.Is(err, &types.ErrPolicyRejected{}) {
+			t.Errorf("Failed test 1.%d: expected policy rejection, got %v", i, err)
+		}
+	}
+
+	///////////////////
+	/// TEST 2 : daily limit counted once per transaction, whatever the number of inputs
+
+	_server := NewServer(nil, &Config{Policy: &Policy{MaxDailyBitcoinValue: big.NewInt(2500)}}, nil, false)
+	ctx := context.Background()
+
+	for input := 0; input < 3; input++ {
+		_, err := _server.checkPsbtPolicy(ctx, "alice", spend)
+		if err != nil {
+			t.Fatalf("Failed test 2: expected input %d to be within the daily limit, got %s", input, err)
+		}
+	}
+
+	spend2 := *spend
+	spend2.TxID = "tx2"
+	settle, err := _server.checkPsbtPolicy(ctx, "alice", &spend2)
+	if err != nil {
+		t.Fatalf("Failed test 2: expected second tx to be within the daily limit, got %s", err)
+	}
+	settle(false) // e.g. signing failed
+
+	spend3 := *spend
+	spend3.TxID = "tx3"
+	_, err = _server.checkPsbtPolicy(ctx, "alice", &spend3)
+	if err != nil {
+		t.Errorf("Failed test 2: expected released tx not to count, got %s", err)
+	}
+
+	spend4 := *spend
+	spend4.TxID = "tx4"
+	_, err = _server.checkPsbtPolicy(ctx, "alice", &spend4)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) {
+		t.Errorf("Failed test 2: expected daily limit to be reached, got %v", err)
+	}
+
+	spend4.Network = "mainnet"
+	_, err = _server.checkPsbtPolicy(ctx, "alice", &spend4)
+	if err != nil {
+		t.Errorf("Failed test 2: expected daily limit to be by network, got %s", err)
+	}
+
+	///////////////////
+	/// TEST 3 : not released once an input of the transaction was signed
+
+	_server = NewServer(nil, &Config{Policy: &Policy{MaxDailyBitcoinValue: big.NewInt(1500)}}, nil, false)
+
+	// first input signed, signing of the second one aborted
+	settle, err = _server.checkPsbtPolicy(ctx, "alice", spend)
+	if err != nil {
+		t.Fatalf("Failed test 3: expected first input to be within the daily limit, got %s", err)
+	}
+	settle(true)
+
+	settle, err = _server.checkPsbtPolicy(ctx, "alice", spend)
+	if err != nil {
+		t.Fatalf("Failed test 3: expected second input to be within the daily limit, got %s", err)
+	}
+	settle(false)
+
+	_, err = _server.checkPsbtPolicy(ctx, "alice", &spend2)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) {
+		t.Errorf("Failed test 3: expected signed tx to still count after an aborted input, got %v", err)
+	}
+
+	// inputs signed concurrently: the failure of one does not release the other
+	_server = NewServer(nil, &Config{Policy: &Policy{MaxDailyBitcoinValue: big.NewInt(1500)}}, nil, false)
+
+	settleFirst, err := _server.checkPsbtPolicy(ctx, "alice", spend)
+	if err != nil {
+		t.Fatalf("Failed test 3: expected first input to be within the daily limit, got %s", err)
+	}
+	settleSecond, err := _server.checkPsbtPolicy(ctx, "alice", spend)
+	if err != nil {
+		t.Fatalf("Failed test 3: expected second input to be within the daily limit, got %s", err)
+	}
+	settleFirst(false)
+	settleSecond(true)
+
+	_, err = _server.checkPsbtPolicy(ctx, "alice", &spend2)
+	if !errors.Is(err, &types.ErrPolicyRejected{}) {
+		t.Errorf("Failed test 3: expected tx signed concurrently to count, got %v", err)
+	}
+}
+
+func TestPolicyRejectionResponse(t *testing.T) {
+	_vault := vault.NewMemoryVault()
+	_server := NewServer(_vault, &Config{DevMode: true, AuthType: "static", Policy: &Policy{}}, nil, false)
+	_server.RegisterAuthProvider("static", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		return token, nil
+	}))
+
+	metadata, err := _vault.StoreWallet(context.Background(), "alice", "client", "test", &tss.DkgResult{BKs: map[string]tss.BK{"client": {}, "server": {}}})
+	if err != nil {
+		t.Fatalf("could not store wallet: %s", err)
+	}
+
+	testServer := httptest.NewServer(_server.Router())
+	defer testServer.Close()
+
+	req, _ := http.NewRequest("GET", testServer.URL+"/authorize", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	req.Header.Set("M-METADATA", metadata)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("could not get access token: %v", err)
+	}
+
+	token, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// raw message with a policy not allowing messages
+	resp, err = http.Get(testServer.URL + "/sign?msg=abcd&peer=client&token=" + string(token))
+	if err != nil {
+		t.Fatalf("could not request /sign: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var errorResponse types.ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&errorResponse)
+
+	if resp.StatusCode != 403 || errorResponse.Code != "policy_rejected" || len(errorResponse.Message) == 0 {
+		t.Errorf("expected 403 policy_rejected with reason, got %d %+v", resp.StatusCode, errorResponse)
+	}
+
+	if !errors.Is(types.ErrorFromCode(errorResponse.Code), &types.ErrPolicyRejected{}) {
+		t.Errorf("expected code to map back to ErrPolicyRejected")
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/go-chi/chi"
+)
+
+/////////
+//
+// The JSON-RPC gateway allows frontends to use Meemaw as their single authenticated RPC endpoint: POST /rpc/{chainId} with the auth token of the user.
+// Requests (single or batch) are parsed, filtered by method (RpcMethods), rate limited by user (RpcRateLimit) and forwarded to the upstream of the chain (RpcUpstreams).
+// Upstreams and methods are those of the tenant of the request, users are rate limited within their tenant.
+//
+/////////
+
+const rpcMaxBodySize = 1 << 20
+const rpcMaxBatchSize = 100
+
+// defaultRpcMethods are the methods allowed when RpcMethods is not configured: reading the chain and sending signed transactions
+var defaultRpcMethods = []string{
+	"eth_blockNumber",
+	"eth_call",
+	"eth_chainId",
+	"eth_estimateGas",
+	"eth_feeHistory",
+	"eth_gasPrice",
+	"eth_getBalance",
+	"eth_getBlockByHash",
+	"eth_getBlockByNumber",
+	"eth_getCode",
+	"eth_getLogs",
+	"eth_getStorageAt",
+	"eth_getTransactionByHash",
+	"eth_getTransactionCount",
+	"eth_getTransactionReceipt",
+	"eth_maxPriorityFeePerGas",
+	"eth_sendRawTransaction",
+	"net_version",
+	"web3_clientVersion",
+}
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   rpcError        `json:"error"`
+}
+
+func newRpcErrorResponse(id json.RawMessage, code int, message string) rpcErrorResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return rpcErrorResponse{JSONRPC: "2.0", ID: id, Error: rpcError{Code: code, Message: message}}
+}
+
+// RpcHandler forwards the JSON-RPC requests of the user to the upstream of the chain
+// goes through identityMiddleware to get the tenant (upstreams and methods) and the userId (rate limit)
+func (server *Server) RpcHandler(w http.ResponseWriter, r *http.Request) {
+	// Get userId from context
+	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
+	if !ok {
+		log.Println("RpcHandler - userId not found in context")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	tenant := server.tenant(r.Context())
+
+	// Get upstream of the chain
+	chainId := chi.URLParam(r, "chainId")
+	upstream, ok := tenant.RpcUpstreams[chainId]
+	if !ok {
+		log.Println("RpcHandler - no upstream for chain", chainId)
+		httpError(w, r, "Chain not supported", http.StatusNotFound)
+		return
+	}
+
+	// Parse JSON-RPC request(s)
+	body, err := io.ReadAll(io.LimitReader(r.Body, rpcMaxBodySize+1))
+	if err != nil {
+		log.Println("RpcHandler - error reading body:", err)
+		httpError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > rpcMaxBodySize {
+		httpError(w, r, "Request too large", http.StatusBadRequest)
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	batch := len(body) > 0 && body[0] == '['
+
+	var items []json.RawMessage
+	if batch {
+		err = json.Unmarshal(body, &items)
+	} else {
+		items = []json.RawMessage{body}
+		err = json.Unmarshal(body, new(json.RawMessage))
+	}
+
+	if err != nil {
+		writeJSON(w, newRpcErrorResponse(nil, rpcParseError, "Parse error"))
+		return
+	}
+
+	if len(items) == 0 {
+		writeJSON(w, newRpcErrorResponse(nil, rpcInvalidRequest, "Invalid Request"))
+		return
+	}
+
+	if len(items) > rpcMaxBatchSize {
+		httpError(w, r, "Batch too large", http.StatusBadRequest)
+		return
+	}
+
+	// Rate limit, each request of a batch counts
+	// userId is namespaced by tenant (see identityMiddleware): users of different tenants sharing an id have their own limit
+	if !server._rpcLimiter.allow(userId, len(items)) {
+		log.Println("RpcHandler - rate limit reached for user", userId)
+		httpError(w, r, "Rate limit reached", http.StatusTooManyRequests)
+		return
+	}
+
+	// Filter requests, only valid requests with allowed methods are forwarded
+	var forwarded []json.RawMessage
+	var rejected []any
+	for _, item := range items {
+		var request rpcRequest
+		err := json.Unmarshal(item, &request)
+		if err != nil || request.JSONRPC != "2.0" || len(request.Method) == 0 {
+			rejected = append(rejected, newRpcErrorResponse(request.ID, rpcInvalidRequest, "Invalid Request"))
+			continue
+		}
+
+		if !rpcMethodAllowed(tenant, request.Method) {
+			rejected = append(rejected, newRpcErrorResponse(request.ID, rpcMethodNotFound, "Method not allowed: "+request.Method))
+			continue
+		}
+
+		forwarded = append(forwarded, item)
+	}
+
+	if !batch {
+		if len(rejected) > 0 {
+			writeJSON(w, rejected[0])
+			return
+		}
+
+		response, err := forwardRpc(upstream, forwarded[0])
+		if err != nil {
+			log.Println("RpcHandler - upstream error:", err)
+			httpError(w, r, "Upstream error", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+		return
+	}
+
+	responses := make([]any, 0, len(items))
+	if len(forwarded) > 0 {
+		forwardedBatch, err := json.Marshal(forwarded)
+		if err != nil {
+			log.Println("RpcHandler - error encoding batch:", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		response, err := forwardRpc(upstream, forwardedBatch)
+		if err != nil {
+			log.Println("RpcHandler - upstream error:", err)
+			httpError(w, r, "Upstream error", http.StatusBadGateway)
+			return
+		}
+
+		var upstreamResponses []json.RawMessage
+		err = json.Unmarshal(response, &upstreamResponses)
+		if err != nil {
+			log.Println("RpcHandler - upstream did not respond with a batch:", err)
+			httpError(w, r, "Upstream error", http.StatusBadGateway)
+			return
+		}
+
+		for _, upstreamResponse := range upstreamResponses {
+			responses = append(responses, upstreamResponse)
+		}
+	}
+
+	responses = append(responses, rejected...)
+
+	writeJSON(w, responses)
+}
+
+// rpcMethodAllowed returns whether the tenant allows the method (defaultRpcMethods if not configured)
+func rpcMethodAllowed(tenant *Tenant, method string) bool {
+	methods := tenant.RpcMethods
+	if len(methods) == 0 {
+		methods = defaultRpcMethods
+	}
+
+	for _, allowed := range methods {
+		if allowed == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardRpc posts the JSON-RPC payload to the upstream and returns its response
+func forwardRpc(upstream string, payload []byte) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(upstream, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10*rpcMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, &upstreamStatusError{status: resp.StatusCode}
+	}
+
+	return body, nil
+}
+
+type upstreamStatusError struct {
+	status int
+}
+
+func (err *upstreamStatusError) Error() string {
+	return "upstream responded with status " + http.StatusText(err.status)
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// rateLimiter limits the number of requests by key per minute (fixed window)
+type rateLimiter struct {
+	limit   int // per minute, unlimited if 0
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// allow returns whether n more requests of key are allowed, and counts them if so
+func (limiter *rateLimiter) allow(key string, n int) bool {
+	if limiter.limit <= 0 {
+		return true
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+
+	// forget the windows of inactive keys from time to time
+	if len(limiter.windows) > 10000 {
+		for windowKey, window := range limiter.windows {
+			if now.Sub(window.start) >= time.Minute {
+				delete(limiter.windows, windowKey)
+			}
+		}
+	}
+
+	window, ok := limiter.windows[key]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		window = &rateWindow{start: now}
+		limiter.windows[key] = window
+	}
+
+	if window.count+n > limiter.limit {
+		return false
+	}
+
+	window.count += n
+	return true
+}
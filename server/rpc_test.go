@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+func TestRpcGateway(t *testing.T) {
+	// upstream answering the method as result, and recording the forwarded methods
+	var mu sync.Mutex
+	var forwardedMethods []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		respond := func(item json.RawMessage) map[string]any {
+			var request rpcRequest
+			json.Unmarshal(item, &request)
+			mu.Lock()
+			forwardedMethods = append(forwardedMethods, request.Method)
+			mu.Unlock()
+			return map[string]any{"jsonrpc": "2.0", "id": request.ID, "result": request.Method}
+		}
+
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) == nil {
+			var responses []map[string]any
+			for _, item := range batch {
+				responses = append(responses, respond(item))
+			}
+			json.NewEncoder(w).Encode(responses)
+			return
+		}
+
+		json.NewEncoder(w).Encode(respond(body))
+	}))
+	defer upstream.Close()
+
+	config := &Config{
+		DevMode:      true,
+		AuthType:     "static",
+		RpcUpstreams: map[string]string{"1": upstream.URL},
+		RpcRateLimit: 5,
+	}
+
+	_server := NewServer(nil, config, nil, false)
+	_server.RegisterAuthProvider("static", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		if token == "invalid" {
+			return "", &types.ErrUnauthorized{}
+		}
+		return "user-" + token, nil
+	}))
+
+	testServer := httptest.NewServer(_server.Router())
+	defer testServer.Close()
+
+	request := func(token, chainId, body string) (int, string) {
+		req, err := http.NewRequest("POST", testServer.URL+"/rpc/"+chainId, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not create request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %s", err)
+		}
+		defer resp.Body.Close()
+
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	resetForwarded := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		methods := forwardedMethods
+		forwardedMethods = nil
+		return methods
+	}
+
+	///////////////////
+	/// TEST 1 : allowed method is forwarded
+
+	statusCode, body := request("alice", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+	if statusCode != 200 || !strings.Contains(body, `"result":"eth_blockNumber"`) || !strings.Contains(body, `"id":1`) {
+		t.Errorf("Failed test 1: expected upstream response, got %d %s", statusCode, body)
+	}
+
+	///////////////////
+	/// TEST 2 : disallowed method is rejected without reaching the upstream
+
+	resetForwarded()
+
+	statusCode, body = request("alice", "1", `{"jsonrpc":"2.0","id":2,"method":"eth_accounts","params":[]}`)
+	if statusCode != 200 || !strings.Contains(body, `-32601`) || !strings.Contains(body, `"id":2`) {
+		t.Errorf("Failed test 2: expected method not allowed, got %d %s", statusCode, body)
+	}
+
+	if methods := resetForwarded(); len(methods) != 0 {
+		t.Errorf("Failed test 2: expected nothing forwarded, got %v", methods)
+	}
+
+	///////////////////
+	/// TEST 3 : batch, only allowed methods are forwarded
+
+	statusCode, body = request("bob", "1", `[
+		{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":2,"method":"personal_sign","params":["0x00","0x00"]},
+		{"jsonrpc":"2.0","id":3,"method":"eth_getBalance","params":["0x00","latest"]},
+		{"id":4,"method":"eth_chainId"}
+	]`)
+
+	var responses []struct {
+		ID     int       `json:"id"`
+		Result string    `json:"result"`
+		Error  *rpcError `json:"error"`
+	}
+	err := json.Unmarshal([]byte(body), &responses)
+	if statusCode != 200 || err != nil || len(responses) != 4 {
+		t.Fatalf("Failed test 3: expected 4 responses, got %d %s", statusCode, body)
+	}
+
+	byId := make(map[int]*rpcError)
+	for _, response := range responses {
+		byId[response.ID] = response.Error
+	}
+	if byId[1] != nil || byId[3] != nil || byId[2] == nil || byId[2].Code != rpcMethodNotFound || byId[4] == nil || byId[4].Code != rpcInvalidRequest {
+		t.Errorf("Failed test 3: unexpected responses %s", body)
+	}
+
+	if methods := resetForwarded(); len(methods) != 2 {
+		t.Errorf("Failed test 3: expected 2 methods forwarded, got %v", methods)
+	}
+
+	///////////////////
+	/// TEST 4 : parse error and unknown chain
+
+	statusCode, body = request("alice", "1", `{"jsonrpc":"2.0",`)
+	if statusCode != 200 || !strings.Contains(body, `-32700`) {
+		t.Errorf("Failed test 4: expected parse error, got %d %s", statusCode, body)
+	}
+
+	statusCode, body = request("alice", "137", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 404 || errorResponseCode(body) != "not_found" {
+		t.Errorf("Failed test 4: expected 404 for unknown chain, got %d %s", statusCode, body)
+	}
+
+	///////////////////
+	/// TEST 5 : auth required
+
+	statusCode, _ = request("invalid", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 401 {
+		t.Errorf("Failed test 5: expected 401, got %d", statusCode)
+	}
+
+	///////////////////
+	/// TEST 6 : rate limit by user (alice used 2 requests, bob 4)
+
+	statusCode, _ = request("alice", "1", `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"},{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}]`)
+	if statusCode != 200 {
+		t.Errorf("Failed test 6: expected alice to be below the limit, got %d", statusCode)
+	}
+
+	statusCode, body = request("alice", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 429 || errorResponseCode(body) != "too_many_requests" {
+		t.Errorf("Failed test 6: expected 429 for alice, got %d %s", statusCode, body)
+	}
+
+	statusCode, _ = request("bob", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 200 {
+		t.Errorf("Failed test 6: expected bob to be below the limit, got %d", statusCode)
+	}
+}
+
+func TestRpcGatewayTenants(t *testing.T) {
+	// upstreams answering their name as result
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var request rpcRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": request.ID, "result": name})
+		}))
+	}
+	upstream1, upstream2 := newUpstream("upstream-app1"), newUpstream("upstream-app2")
+	defer upstream1.Close()
+	defer upstream2.Close()
+
+	config := &Config{
+		DevMode:      true,
+		RpcRateLimit: 2,
+		Tenants: []*Tenant{
+			{ID: "app1", Auth: &AuthConfig{Provider: "static"}, RpcUpstreams: map[string]string{"1": upstream1.URL}},
+			{ID: "app2", Auth: &AuthConfig{Provider: "static"}, RpcUpstreams: map[string]string{"1": upstream2.URL, "137": upstream2.URL}, RpcMethods: []string{"eth_chainId", "eth_accounts"}},
+		},
+	}
+
+	_server := NewServer(nil, config, nil, false)
+	_server.RegisterAuthProvider("static", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		return token, nil
+	}))
+
+	testServer := httptest.NewServer(_server.Router())
+	defer testServer.Close()
+
+	request := func(tenantId, chainId, body string) (int, string) {
+		req, err := http.NewRequest("POST", testServer.URL+"/rpc/"+chainId, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not create request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer alice")
+		req.Header.Set("M-TENANT", tenantId)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %s", err)
+		}
+		defer resp.Body.Close()
+
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	///////////////////
+	/// TEST 1 : each tenant uses its own upstreams
+
+	statusCode, body := request("app1", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 200 || !strings.Contains(body, "upstream-app1") {
+		t.Errorf("Failed test 1: expected upstream of app1, got %d %s", statusCode, body)
+	}
+
+	statusCode, body = request("app2", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 200 || !strings.Contains(body, "upstream-app2") {
+		t.Errorf("Failed test 1: expected upstream of app2, got %d %s", statusCode, body)
+	}
+
+	statusCode, _ = request("app1", "137", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 404 {
+		t.Errorf("Failed test 1: expected 404 for chain of another tenant, got %d", statusCode)
+	}
+
+	///////////////////
+	/// TEST 2 : each tenant uses its own methods
+
+	statusCode, body = request("app1", "1", `{"jsonrpc":"2.0","id":2,"method":"eth_accounts"}`)
+	if statusCode != 200 || !strings.Contains(body, `-32601`) {
+		t.Errorf("Failed test 2: expected method not allowed for app1, got %d %s", statusCode, body)
+	}
+
+	///////////////////
+	/// TEST 3 : the same user id is rate limited within each tenant (app1 used 2 requests, app2 1)
+
+	statusCode, body = request("app1", "1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if statusCode != 429 || errorResponseCode(body) != "too_many_requests" {
+		t.Errorf("Failed test 3: expected 429 for alice of app1, got %d %s", statusCode, body)
+	}
+
+	statusCode, body = request("app2", "1", `{"jsonrpc":"2.0","id":2,"method":"eth_accounts"}`)
+	if statusCode != 200 || !strings.Contains(body, "upstream-app2") {
+		t.Errorf("Failed test 3: expected alice of app2 to be below the limit, got %d %s", statusCode, body)
+	}
+}
+
+func errorResponseCode(body string) string {
+	var errorResponse types.ErrorResponse
+	json.Unmarshal([]byte(body), &errorResponse)
+	return errorResponse.Code
+}
@@ -1,35 +1,215 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
-
-	_ "embed"
+	"time"
 )
 
-//go:embed sqlc/schema.sql
-var schema string
+/////////
+//
+// The schema of the postgres database evolves through versioned migrations (sqlc/migrations), applied in order and recorded in the schema_migrations table.
+// Migrations are forward only: a migration, once released, never changes. Evolving the schema means adding a new migration file, named <version>_<name>.sql.
+//
+/////////
 
-func LoadSchema(_db *sql.DB, path string) error {
-	var queries []string
+//go:embed sqlc/migrations/*.sql
+var migrationFiles embed.FS
 
-	if path == "" {
-		queries = strings.Split(schema, ";")
-	} else {
-		schemaFile, err := os.ReadFile(path)
+// Migration is a versioned change of the database schema
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus is a migration and when it was applied (nil if pending)
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations, ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "sqlc/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %s should be named <version>_<name>.sql", entry.Name())
+		}
+
+		versionInt, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s should be named <version>_<name>.sql", entry.Name())
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("sqlc/migrations", entry.Name()))
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version: versionInt,
+			Name:    name,
+			SQL:     string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// MigrationsStatus returns all migrations with the date they were applied on the database, if any
+func MigrationsStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createMigrationsTable(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i].Migration = migration
+		if appliedAt, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &appliedAt
 		}
-		queries = strings.Split(string(schemaFile), ";")
 	}
 
-	for _, query := range queries {
-		_, err := _db.Exec(query)
+	return statuses, nil
+}
+
+// MigrateUp applies all pending migrations in order, each one in its own transaction, and returns the applied ones
+// Concurrent servers can migrate at the same time, each migration is only applied once
+func MigrateUp(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createMigrationsTable(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		ok, err := applyMigration(ctx, db, migration)
 		if err != nil {
-			return err
+			return applied, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
 		}
+
+		if ok {
+			log.Printf("Applied migration %d_%s\n", migration.Version, migration.Name)
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// applyMigration applies the migration if it was not already applied, returns whether it was
+func applyMigration(ctx context.Context, db *sql.DB, migration Migration) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Only one migration at a time, other servers wait here
+	_, err = tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE")
+	if err != nil {
+		return false, err
+	}
+
+	var version int64
+	err = tx.QueryRowContext(ctx, "SELECT version FROM schema_migrations WHERE version = $1", migration.Version).Scan(&version)
+	if err == nil {
+		return false, nil // already applied
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	// Executed as a whole (no parameters), the migration can hold several statements
+	_, err = tx.ExecContext(ctx, migration.SQL)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func createMigrationsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version bigint PRIMARY KEY,
+    name text NOT NULL DEFAULT '',
+    applied_at timestamp with time zone NOT NULL DEFAULT now()
+)`)
+	return err
+}
+
+// LoadSchema loads the schema in the database
+// Deprecated: use MigrateUp. With an empty path, LoadSchema applies the pending migrations, otherwise it executes the given file as a whole.
+func LoadSchema(_db *sql.DB, path string) error {
+	if path == "" {
+		_, err := MigrateUp(context.Background(), _db)
+		return err
+	}
+
+	schemaFile, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	_, err = _db.Exec(string(schemaFile))
+	return err
 }
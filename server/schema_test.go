@@ -0,0 +1,24 @@
+package server
+
+import "testing"
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("could not load migrations: %s", err)
+	}
+
+	if len(migrations) == 0 {
+		t.Fatalf("no migration embedded")
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != int64(i+1) {
+			t.Errorf("expected migration %d to have version %d, got %d", i, i+1, migration.Version)
+		}
+
+		if len(migration.Name) == 0 || len(migration.SQL) == 0 {
+			t.Errorf("expected migration %d to have a name and SQL, got %+v", migration.Version, migration)
+		}
+	}
+}
@@ -1,11 +1,12 @@
-CREATE TABLE users (
+-- Initial schema, as loaded by LoadSchema before versioned migrations
+-- Idempotent, as are the following migrations replaying upgrade.sql, so that databases created before versioned migrations can be migrated
+
+CREATE TABLE IF NOT EXISTS users (
     id BIGSERIAL PRIMARY KEY,
     foreign_key text NOT NULL DEFAULT ''
 );
 
--- CREATE UNIQUE INDEX user_identifier ON public.users USING btree (foreign_key);
-
-CREATE TABLE wallets (
+CREATE TABLE IF NOT EXISTS wallets (
     id BIGSERIAL PRIMARY KEY,
     user_id bigint NOT NULL REFERENCES users(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
     public_address text NOT NULL DEFAULT '',
@@ -13,14 +14,10 @@ CREATE TABLE wallets (
     nonce bytea NOT NULL DEFAULT E'\\x'
 );
 
--- CREATE UNIQUE INDEX wallet_identifier ON public.wallets USING btree (user_id, public_address);
-
-CREATE TABLE devices (
+CREATE TABLE IF NOT EXISTS devices (
     id BIGSERIAL PRIMARY KEY,
     user_id bigint NOT NULL REFERENCES users(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
     wallet_id bigint NOT NULL REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
     peer_id text NOT NULL DEFAULT '',
     user_agent text NOT NULL DEFAULT ''
 );
-
--- CREATE UNIQUE INDEX device_identifier ON public.devices USING btree (user_id, wallet_id, peer_id);
\ No newline at end of file
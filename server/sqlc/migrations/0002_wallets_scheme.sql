@@ -0,0 +1,3 @@
+-- Signature scheme of the wallet (tss.Scheme), existing wallets are ECDSA
+
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS scheme text NOT NULL DEFAULT 'ecdsa-secp256k1';
@@ -0,0 +1,10 @@
+-- Devices which took part in signing messages
+
+CREATE TABLE IF NOT EXISTS signatures (
+    id BIGSERIAL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    wallet_id bigint NOT NULL REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    peer_id text NOT NULL DEFAULT '',
+    message bytea NOT NULL DEFAULT E'\\x',
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
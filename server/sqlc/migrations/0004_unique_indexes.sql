@@ -0,0 +1,8 @@
+-- One user per foreign key, one wallet per address per user, one device per peer per wallet
+-- Fails if the database already holds duplicates: they need to be removed manually before migrating
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_identifier ON users USING btree (foreign_key);
+
+CREATE UNIQUE INDEX IF NOT EXISTS wallet_identifier ON wallets USING btree (user_id, public_address);
+
+CREATE UNIQUE INDEX IF NOT EXISTS device_identifier ON devices USING btree (user_id, wallet_id, peer_id);
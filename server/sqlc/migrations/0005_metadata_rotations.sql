@@ -0,0 +1,11 @@
+-- Client keys (metadata) rotated by a device, each wrapped by the previous one, waiting for the other devices of the wallet
+
+CREATE TABLE IF NOT EXISTS metadata_rotations (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id bigint NOT NULL REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    peer_id text NOT NULL DEFAULT '',
+    wrapped_metadata bytea NOT NULL DEFAULT E'\\x',
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS metadata_rotation_device ON metadata_rotations USING btree (wallet_id, peer_id);
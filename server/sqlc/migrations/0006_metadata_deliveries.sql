@@ -0,0 +1,10 @@
+-- Client key (metadata) rotated by a device, sealed for each of the other devices of the wallet with its public share
+-- Replaces metadata_rotations: client keys wrapped by the previous (possibly leaked) one are dropped, the devices concerned need to be rotated again
+
+DROP TABLE IF EXISTS metadata_rotations;
+
+CREATE TABLE IF NOT EXISTS metadata_deliveries (
+    wallet_id bigint PRIMARY KEY REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    sealed_metadata bytea NOT NULL DEFAULT E'\\x',
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
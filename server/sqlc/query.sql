@@ -29,8 +29,8 @@ WITH new_user AS (
     RETURNING id AS user_id
 ),
 new_wallet AS (
-    INSERT INTO wallets (user_id, public_address, encrypted_dkg_results, nonce)
-    SELECT user_id, sqlc.arg('PublicAddress'), sqlc.arg('EncryptedDkgResults'), sqlc.arg('Nonce')
+    INSERT INTO wallets (user_id, public_address, encrypted_dkg_results, nonce, scheme)
+    SELECT user_id, sqlc.arg('PublicAddress'), sqlc.arg('EncryptedDkgResults'), sqlc.arg('Nonce'), sqlc.arg('Scheme')
     FROM new_user
     ON CONFLICT DO NOTHING
     RETURNING id AS wallet_id, user_id
@@ -60,6 +60,75 @@ SELECT user_id, wallet_id, sqlc.arg('UserAgent'), sqlc.arg('PeerId')
 FROM updated_wallet
 RETURNING *;
 
+-- name: AddSignature :one
+INSERT INTO signatures (user_id, wallet_id, peer_id, message)
+SELECT devices.user_id, devices.wallet_id, devices.peer_id, sqlc.arg('Message')
+FROM devices
+INNER JOIN users ON devices.user_id = users.id
+WHERE users.foreign_key = sqlc.arg('ForeignKey')
+    AND devices.peer_id = sqlc.arg('PeerId')
+LIMIT 1
+RETURNING *;
+
+-- name: RemoveDevice :one
+WITH existing_user AS (
+    SELECT id AS user_id
+    FROM users
+    WHERE foreign_key = sqlc.arg('ForeignKey')
+),
+removed_device AS (
+    DELETE FROM devices
+    USING existing_user
+    WHERE devices.user_id = existing_user.user_id
+        AND devices.peer_id = sqlc.arg('PeerId')
+    RETURNING devices.wallet_id
+)
+UPDATE wallets
+SET encrypted_dkg_results = sqlc.arg('EncryptedDkgResults'),
+    nonce = sqlc.arg('Nonce')
+FROM removed_device
+WHERE wallets.id = removed_device.wallet_id
+RETURNING wallets.*;
+
+-- name: RotateWalletKey :one
+WITH rotated_wallet AS (
+    UPDATE wallets
+    SET encrypted_dkg_results = sqlc.arg('EncryptedDkgResults'),
+        nonce = sqlc.arg('Nonce')
+    WHERE id = sqlc.arg('WalletId')
+        AND nonce = sqlc.arg('PreviousNonce')
+    RETURNING wallets.id
+),
+delivery AS (
+    INSERT INTO metadata_deliveries (wallet_id, sealed_metadata)
+    SELECT rotated_wallet.id, sqlc.arg('SealedMetadata')
+    FROM rotated_wallet
+    ON CONFLICT (wallet_id) DO UPDATE
+    SET sealed_metadata = excluded.sealed_metadata,
+        created_at = now()
+)
+SELECT id FROM rotated_wallet;
+
+-- name: UpdateWallet :one
+WITH updated_wallet AS (
+    UPDATE wallets
+    SET encrypted_dkg_results = sqlc.arg('EncryptedDkgResults'),
+        nonce = sqlc.arg('Nonce')
+    FROM users
+    WHERE wallets.user_id = users.id
+        AND users.foreign_key = sqlc.arg('ForeignKey')
+        AND wallets.public_address = sqlc.arg('PublicAddress')
+    RETURNING wallets.id
+),
+resealed_delivery AS (
+    UPDATE metadata_deliveries
+    SET sealed_metadata = sqlc.arg('SealedMetadata')
+    FROM updated_wallet
+    WHERE metadata_deliveries.wallet_id = updated_wallet.id
+        AND octet_length(sqlc.arg('SealedMetadata')) > 0
+)
+SELECT id FROM updated_wallet;
+
 
 ------- SELECTS -------
 
@@ -80,6 +149,19 @@ WHERE user_id = sqlc.arg('UserId');
 SELECT * FROM devices
 WHERE user_id = sqlc.arg('UserId');
 
+-- name: GetUserSignatures :many
+SELECT * FROM signatures
+WHERE user_id = sqlc.arg('UserId')
+ORDER BY id;
+
+-- name: GetMetadataDelivery :one
+SELECT metadata_deliveries.*
+FROM metadata_deliveries
+INNER JOIN wallets ON metadata_deliveries.wallet_id = wallets.id
+INNER JOIN users ON wallets.user_id = users.id
+WHERE users.foreign_key = sqlc.arg('ForeignKey')
+LIMIT 1;
+
 -- name: GetWalletByAddress :one
 SELECT * FROM wallets
 WHERE public_address = sqlc.arg('PublicAddress');
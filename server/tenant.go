@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+/////////
+//
+// A server can serve several apps (tenants), each with its own auth provider, client origins, policy, RPC upstreams, admin api key and options.
+// The tenant is resolved on /identify and /authorize (by header, subdomain or API key), then bound to the access token for the TSS operations.
+// The users of a tenant are stored in the vault under namespaced foreign keys (<tenant id>:<user id>), so users of different tenants never collide.
+// Without tenants in the config, the server serves a single app configured by Config, with foreign keys as is.
+//
+/////////
+
+// Tenant is an app served by the server
+type Tenant struct {
+	ID            string            // unique, also the subdomain of the tenant with the subdomain resolution
+	ApiKeys       []string          // keys identifying the tenant with the apiKey resolution
+	ClientOrigins []string          // origins allowed for the tenant, "*" allows all
+	Export        bool              // allows users to export their private key
+	MultiDevice   bool              // allows users to add devices and backups to their wallet
+	Auth          *AuthConfig       // auth provider of the tenant
+	Policy        *Policy           // rules checked before co-signing, everything allowed if nil
+	RpcUpstreams  map[string]string // JSON-RPC gateway: upstream url by chain id, gateway disabled if empty
+	RpcMethods    []string          // JSON-RPC gateway: allowed methods, read methods and eth_sendRawTransaction by default
+	AdminApiKey   string            // admin endpoints (approvals of the users of the tenant), disabled if empty
+}
+
+var errUnknownTenant = errors.New("unknown tenant")
+
+// ForeignKey namespaces the userId of the tenant, for the vault
+func (tenant *Tenant) ForeignKey(userId string) string {
+	if len(tenant.ID) == 0 {
+		return userId
+	}
+	return tenant.ID + ":" + userId
+}
+
+// allowsOrigin returns whether the origin (scheme and host) is one of the client origins of the tenant
+func (tenant *Tenant) allowsOrigin(origin string) bool {
+	for _, clientOrigin := range tenant.ClientOrigins {
+		if clientOrigin == "*" || strings.TrimSuffix(clientOrigin, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// multiTenant returns whether the server serves several tenants
+func (server *Server) multiTenant() bool {
+	return len(server._config.Tenants) > 0
+}
+
+// tenant returns the tenant of the request (set by identityMiddleware, or by authMiddleware from the access token), or the single tenant described by Config
+func (server *Server) tenant(ctx context.Context) *Tenant {
+	if tenant, ok := ctx.Value(types.ContextKey("tenantConfig")).(*Tenant); ok && tenant != nil {
+		return tenant
+	}
+
+	return &Tenant{
+		ClientOrigins: []string{server._config.ClientOrigin},
+		Export:        server._config.Export,
+		MultiDevice:   server._config.MultiDevice,
+		Auth:          server._config.authConfig(),
+		Policy:        server._config.Policy,
+		RpcUpstreams:  server._config.RpcUpstreams,
+		RpcMethods:    server._config.RpcMethods,
+		AdminApiKey:   server._config.AdminApiKey,
+	}
+}
+
+// resolveTenant finds the tenant of the request, according to the tenant resolution of the config:
+// header (M-TENANT holds the tenant id, default), subdomain (first label of the host is the tenant id) or apiKey (M-API-KEY holds a key of the tenant)
+func (server *Server) resolveTenant(r *http.Request) (*Tenant, error) {
+	if !server.multiTenant() {
+		return server.tenant(r.Context()), nil
+	}
+
+	switch server._config.TenantResolution {
+	case "", "header":
+		return server.tenantById(r.Header.Get("M-TENANT"))
+	case "subdomain":
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // no port
+		}
+		subdomain, _, ok := strings.Cut(host, ".")
+		if !ok {
+			return nil, errUnknownTenant
+		}
+		return server.tenantById(subdomain)
+	case "apiKey":
+		apiKey := r.Header.Get("M-API-KEY")
+		if len(apiKey) == 0 {
+			return nil, errUnknownTenant
+		}
+		for _, tenant := range server._config.Tenants {
+			for _, tenantApiKey := range tenant.ApiKeys {
+				if subtle.ConstantTimeCompare([]byte(apiKey), []byte(tenantApiKey)) == 1 {
+					return tenant, nil
+				}
+			}
+		}
+		return nil, errUnknownTenant
+	default:
+		return nil, errors.New("wrong tenant resolution: " + server._config.TenantResolution)
+	}
+}
+
+func (server *Server) tenantById(id string) (*Tenant, error) {
+	if len(id) == 0 {
+		return nil, errUnknownTenant
+	}
+
+	for _, tenant := range server._config.Tenants {
+		if tenant.ID == id {
+			return tenant, nil
+		}
+	}
+
+	return nil, errUnknownTenant
+}
+
+// allowedOrigin returns the origin to allow in CORS headers: the configured origin, or the origin of the request if a tenant allows it
+// Preflight requests do not carry the tenant headers, hence all tenants are considered
+func (server *Server) allowedOrigin(r *http.Request) string {
+	if !server.multiTenant() {
+		return server._config.ClientOrigin
+	}
+
+	origin := r.Header.Get("Origin")
+	for _, tenant := range server._config.Tenants {
+		if tenant.allowsOrigin(origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// originPatterns returns the client origins of the tenant without scheme, as expected by websocket.Accept
+func (server *Server) originPatterns(ctx context.Context) ([]string, error) {
+	var patterns []string
+	for _, clientOrigin := range server.tenant(ctx).ClientOrigins {
+		if clientOrigin == "*" {
+			patterns = append(patterns, "*")
+			continue
+		}
+
+		u, err := url.Parse(clientOrigin)
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, u.Host+u.Path)
+	}
+
+	return patterns, nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	app1 := &Tenant{
+		ID:            "app1",
+		ApiKeys:       []string{"key-app1"},
+		ClientOrigins: []string{"https://app1.example"},
+		Export:        true,
+		Auth:          &AuthConfig{Provider: "static", Settings: map[string]string{"prefix": "app1-user-"}},
+	}
+	app2 := &Tenant{
+		ID:            "app2",
+		ApiKeys:       []string{"key-app2"},
+		ClientOrigins: []string{"https://app2.example"},
+		MultiDevice:   true,
+		Auth:          &AuthConfig{Provider: "static", Settings: map[string]string{"prefix": ""}},
+	}
+
+	config := &Config{
+		DevMode: true,
+		Tenants: []*Tenant{app1, app2},
+	}
+
+	_server := NewServer(nil, config, nil, false)
+	_server.RegisterAuthProvider("static", AuthProviderFunc(func(ctx context.Context, token string) (string, error) {
+		return AuthSettings(ctx)["prefix"] + token, nil
+	}))
+
+	testServer := httptest.NewServer(_server.Router())
+	defer testServer.Close()
+
+	request := func(method, path string, headers map[string]string, host string) (*http.Response, string) {
+		req, err := http.NewRequest(method, testServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("could not create request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer alice")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		if len(host) > 0 {
+			req.Host = host
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %s", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	///////////////////
+	/// TEST 1 : header resolution, users of different tenants never collide
+
+	resp, userId := request("GET", "/identify", map[string]string{"M-TENANT": "app1"}, "")
+	if resp.StatusCode != 200 || userId != "app1:app1-user-alice" {
+		t.Errorf("Failed test 1: expected app1:app1-user-alice, got %d %s", resp.StatusCode, userId)
+	}
+
+	resp, userId = request("GET", "/identify", map[string]string{"M-TENANT": "app2"}, "")
+	if resp.StatusCode != 200 || userId != "app2:alice" {
+		t.Errorf("Failed test 1: expected app2:alice, got %d %s", resp.StatusCode, userId)
+	}
+
+	for _, tenantId := range []string{"", "unknown"} {
+		resp, _ = request("GET", "/identify", map[string]string{"M-TENANT": tenantId}, "")
+		if resp.StatusCode != 401 {
+			t.Errorf("Failed test 1: expected 401 for tenant %q, got %d", tenantId, resp.StatusCode)
+		}
+	}
+
+	///////////////////
+	/// TEST 2 : origins by tenant
+
+	resp, _ = request("GET", "/identify", map[string]string{"M-TENANT": "app1", "Origin": "https://app2.example"}, "")
+	if resp.StatusCode != 403 {
+		t.Errorf("Failed test 2: expected 403 for origin of another tenant, got %d", resp.StatusCode)
+	}
+
+	resp, _ = request("OPTIONS", "/identify", map[string]string{"Origin": "https://app2.example"}, "")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://app2.example" {
+		t.Errorf("Failed test 2: expected origin of app2 to be allowed, got %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	resp, _ = request("OPTIONS", "/identify", map[string]string{"Origin": "https://evil.example"}, "")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Failed test 2: expected unknown origin not to be allowed, got %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	///////////////////
+	/// TEST 3 : subdomain resolution
+
+	config.TenantResolution = "subdomain"
+
+	resp, userId = request("GET", "/identify", nil, "app2.meemaw.example:8421")
+	if resp.StatusCode != 200 || userId != "app2:alice" {
+		t.Errorf("Failed test 3: expected app2:alice, got %d %s", resp.StatusCode, userId)
+	}
+
+	resp, _ = request("GET", "/identify", map[string]string{"M-TENANT": "app2"}, "meemaw.example")
+	if resp.StatusCode != 401 {
+		t.Errorf("Failed test 3: expected 401 for unknown subdomain, got %d", resp.StatusCode)
+	}
+
+	///////////////////
+	/// TEST 4 : api key resolution
+
+	config.TenantResolution = "apiKey"
+
+	resp, userId = request("GET", "/identify", map[string]string{"M-API-KEY": "key-app1"}, "")
+	if resp.StatusCode != 200 || userId != "app1:app1-user-alice" {
+		t.Errorf("Failed test 4: expected app1:app1-user-alice, got %d %s", resp.StatusCode, userId)
+	}
+
+	resp, _ = request("GET", "/identify", map[string]string{"M-API-KEY": "wrong-key", "M-TENANT": "app1"}, "")
+	if resp.StatusCode != 401 {
+		t.Errorf("Failed test 4: expected 401 for wrong api key, got %d", resp.StatusCode)
+	}
+
+	///////////////////
+	/// TEST 5 : access tokens are bound to the tenant
+
+	resp, accessToken := request("GET", "/authorize", map[string]string{"M-API-KEY": "key-app2", "M-METADATA": "metadata"}, "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Failed test 5: expected access token, got %d %s", resp.StatusCode, accessToken)
+	}
+
+	params, found := _server._cache.Get(accessToken)
+	if !found {
+		t.Fatalf("Failed test 5: access token not found in cache")
+	}
+
+	tokenParams := params.(tokenParameters)
+	if tokenParams.userId != "app2:alice" || tokenParams.tenant != app2 {
+		t.Errorf("Failed test 5: expected access token of app2:alice, got %+v", tokenParams)
+	}
+
+	///////////////////
+	/// TEST 6 : single tenant, configured by Config
+
+	singleServer := NewServer(nil, &Config{ClientOrigin: "https://app.example", Export: true, AuthType: "custom"}, nil, false)
+	tenant := singleServer.tenant(context.Background())
+
+	if tenant.ForeignKey("alice") != "alice" || !tenant.Export || tenant.MultiDevice || tenant.Auth.Provider != "custom" {
+		t.Errorf("Failed test 6: unexpected single tenant %+v", tenant)
+	}
+
+	patterns, err := singleServer.originPatterns(context.Background())
+	if err != nil || len(patterns) != 1 || patterns[0] != "app.example" {
+		t.Errorf("Failed test 6: expected app.example origin pattern, got %v (%v)", patterns, err)
+	}
+}
@@ -7,7 +7,8 @@ import (
 	"errors"
 	"log"
 	"net/http"
-	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/getmeemaw/meemaw/utils/tss"
@@ -23,55 +24,55 @@ import (
 // The multi-device process needs to be initiated by a new device by using RegisterDeviceHandler, then accepted by an existing device by using AcceptDeviceHandler.
 // The way it works is through a TSS process between 3 actors: new device, existing device, server.
 // Those 3 actors communicate 1-1 with each other, which means that the server needs to manage 2 websocket connections (with each device) and route messages accordingly.
+// For wallets with a threshold above 2, other existing devices take part in the process by joining the accepting device (tssSession), with their own websocket connection.
 //
 /////////
 
 type PublicWallet struct {
 	PublicKey tss.PubkeyStr
 	BKs       map[string]tss.BK
+	Threshold uint32
+	Scheme    tss.Scheme
 }
 
 // RegisterDeviceHandler is called by a new device wanting to "join" the wallet by creating a new share for itself, in collaboration with existing peers
 func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !server._config.MultiDevice {
+	if !server.tenant(r.Context()).MultiDevice {
 		log.Println("RegisterDeviceHandler - config disables multi-device")
-		http.Error(w, "Multi-device unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "Multi-device unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Get userId and access token from context
 	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
 	if !ok {
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
 	log.Println("RegisterDeviceHandler userId:", userId)
 
-	// WS connection
+	if !server.supportsAdding(w, r, userId) {
+		return
+	}
 
-	// Parse clientOrigin URL (to remove scheme from it)
-	var origin string
-	if server._config.ClientOrigin != "*" {
-		u, err := url.Parse(server._config.ClientOrigin)
-		if err != nil {
-			log.Println("ClientOrigin wrongly configured")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	// WS connection
 
-		origin = u.Host + u.Path
-	} else {
-		origin = "*"
+	// Client origins of the tenant (without scheme)
+	originPatterns, err := server.originPatterns(r.Context())
+	if err != nil {
+		log.Println("ClientOrigin wrongly configured:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns: []string{origin},
+		OriginPatterns: originPatterns,
 	})
 	if err != nil {
 		log.Println("RegisterDeviceHandler - Error accepting websocket:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
@@ -84,7 +85,7 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 	errs := make(chan error, 2)
 
 	newClientPeerIdCh := make(chan string, 1)
-	existingClientPeerIdCh := make(chan string, 1)
+	existingClientPeerIdCh := make(chan []string, 1)
 	useragentCh := make(chan string, 1)
 	metadataCh := make(chan string, 1)
 	adderCh := make(chan *tss.ServerAdd, 1)
@@ -103,7 +104,7 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 
 	var metadata string
 	var newClientPeerID string
-	var existingClientPeerID string
+	var existingClientPeerIDs []string
 
 	var adder *tss.ServerAdd
 
@@ -147,13 +148,14 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 				newClientPeerID = string(msg.Msg)
 
 				newClientPeerIdCh <- newClientPeerID
-				existingClientPeerID = <-existingClientPeerIdCh
+				existingClientPeerIDs = <-existingClientPeerIdCh
 
 				useragentCh <- r.UserAgent()
 
+				// all the existing devices taking part in the process (comma-separated)
 				PeerIdBroadcastMsg := ws.Message{
 					Type: ws.PeerIdBroadcastMessage,
-					Msg:  existingClientPeerID,
+					Msg:  strings.Join(existingClientPeerIDs, ","),
 				}
 				err = wsjson.Write(ctx, c, PeerIdBroadcastMsg)
 				if err != nil {
@@ -185,10 +187,10 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 				if err != nil {
 					log.Println("could not retrieve wallet:", err)
 					if errors.Is(err, &types.ErrNotFound{}) {
-						http.Error(w, "Wallet does not exist.", http.StatusNotFound)
+						httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
 						return
 					} else {
-						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+						httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 						return
 					}
 				}
@@ -197,10 +199,10 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 				log.Println("RegisterDeviceHandler - wallet retrieved share:", dkgResult.Share)
 
 				// Prepare Adding process
-				adder, err = tss.NewServerAdd(newClientPeerID, existingClientPeerID, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs)
+				adder, err = tss.NewServerAdd(newClientPeerID, existingClientPeerIDs, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs, dkgResult.PublicShares, dkgResult.GetThreshold(), dkgResult.GetScheme())
 				if err != nil {
 					log.Println("Error when creating new server Add:", err)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 					return
 				}
 
@@ -216,6 +218,8 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 				wallet := PublicWallet{
 					PublicKey: dkgResult.Pubkey,
 					BKs:       dkgResult.BKs,
+					Threshold: dkgResult.GetThreshold(),
+					Scheme:    dkgResult.GetScheme(),
 				}
 				walletJSON, err := json.Marshal(wallet)
 				if err != nil {
@@ -266,7 +270,7 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 				}
 
 				// Handle tss message (NOTE : will automatically, in ServerAdd.HandleMessage, redirect to other client if needs be)
-				err = adder.HandleMessage(tssMsg)
+				err = adder.HandleMessage(newClientPeerID, tssMsg)
 				if err != nil {
 					log.Println("could not handle tss msg:", err)
 					errs <- err
@@ -312,7 +316,7 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 	err = ws.ProcessErrors(errs, ctx, c, "RegisterDeviceHandler")
 	if err != nil {
 		c.Close(websocket.StatusInternalError, "RegisterDeviceHandler process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -366,11 +370,12 @@ func (server *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Reque
 ///////////////////////////////////////////////
 
 // AcceptDeviceHandler is called by a device already part of the TSS wallet. In collaboration with the server and the new device, a new share is created for the new device
+// optional URL parameter peers (comma-separated peerIDs of all accepting devices) : for wallets with a threshold above 2, the other devices join the process with the join=true and peer URL parameters
 func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !server._config.MultiDevice {
+	if !server.tenant(r.Context()).MultiDevice {
 		log.Println("RegisterDeviceHandler - config disables multi-device")
-		http.Error(w, "Multi-device unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "Multi-device unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -378,38 +383,62 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
 	if !ok {
 		log.Println("Could not find userId")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	if params.Get("join") == "true" {
+		server.joinAcceptDevice(w, r, userId, params.Get("peer"))
+		return
+	}
+
+	if !server.supportsAdding(w, r, userId) {
 		return
 	}
 
+	// Accepting devices (by default, only the device calling)
+	var acceptingPeerIDs []string
+	if len(params.Get("peers")) > 0 {
+		acceptingPeerIDs = strings.Split(params.Get("peers"), ",")
+	}
+
 	// Get inter-handlers channels
 	newClientPeerIdCh, existingClientPeerIdCh, useragentCh, metadataCh, adderCh, existingDeviceTssDoneCh, newDeviceDoneCh, existingDeviceDoneCh, err := server.GetInterHandlersChannels(userId)
 	if err != nil {
-		http.Error(w, "Channel not found", http.StatusUnauthorized)
+		httpError(w, r, "Channel not found", http.StatusUnauthorized)
 		return
 	}
 
-	// Parse clientOrigin URL (to remove scheme from it)
-	var origin string
-	if server._config.ClientOrigin != "*" {
-		u, err := url.Parse(server._config.ClientOrigin)
-		if err != nil {
-			log.Println("ClientOrigin wrongly configured")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	// The other accepting devices join through the session
+	sessionKey := userId + "-addsession"
+	numJoiners := 0
+	if len(acceptingPeerIDs) > 0 {
+		numJoiners = len(acceptingPeerIDs) - 1
+	}
+	session := newTssSession(0, tss.SchemeECDSA, numJoiners, acceptingPeerIDs)
+	err = server.openTssSession(sessionKey, session)
+	if err != nil {
+		log.Println("Adding device already in progress")
+		httpError(w, r, "Conflict", http.StatusConflict)
+		return
+	}
+	defer server.closeTssSession(sessionKey, session)
 
-		origin = u.Host + u.Path
-	} else {
-		origin = "*"
+	// Client origins of the tenant (without scheme)
+	originPatterns, err := server.originPatterns(r.Context())
+	if err != nil {
+		log.Println("ClientOrigin wrongly configured:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns: []string{origin},
+		OriginPatterns: originPatterns,
 	})
 	if err != nil {
 		log.Println("AcceptDeviceHandler - Error accepting websocket:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
@@ -466,7 +495,15 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 
 				existingClientPeerID = string(msg.Msg)
 
-				existingClientPeerIdCh <- existingClientPeerID
+				if len(acceptingPeerIDs) == 0 {
+					acceptingPeerIDs = []string{existingClientPeerID}
+				} else if !slices.Contains(acceptingPeerIDs, existingClientPeerID) {
+					log.Println("Device calling is not part of accepting devices:", existingClientPeerID)
+					errs <- errUnexpectedDevice
+					return
+				}
+
+				existingClientPeerIdCh <- acceptingPeerIDs
 				newClientPeerID = <-newClientPeerIdCh
 
 				PeerIdBroadcastMsg := ws.Message{
@@ -497,6 +534,15 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 
 				log.Println("adder:", adder)
 
+				// Wait for the other accepting devices
+				_, err = session.waitJoiners(ctx, existingClientPeerID)
+				if err != nil {
+					log.Println("Error while waiting for accepting devices:", err)
+					errs <- err
+					return
+				}
+				session.start(adder, acceptingPeerIDs)
+
 				// send MetadataAckMessage (so that client can start tss process on his side)
 				ack := ws.Message{
 					Type: ws.MetadataAckMessage,
@@ -540,7 +586,7 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 				}
 
 				// Handle tss message (NOTE : will automatically, in ServerAdd.HandleMessage, redirect to other client if needs be)
-				err = adder.HandleMessage(tssMsg)
+				err = adder.HandleMessage(existingClientPeerID, tssMsg)
 				if err != nil {
 					log.Println("could not handle tss msg:", err)
 					errs <- err
@@ -585,7 +631,13 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	}()
 
 	// Wait for tss start
-	<-startTss
+	select {
+	case <-startTss:
+	case <-ctx.Done():
+		log.Println("AcceptDeviceHandler - tss process did not start:", ctx.Err())
+		c.Close(websocket.StatusInternalError, "adder process failed")
+		return
+	}
 
 	// Get channel from adder /!\ needs to be initialised first => this line needs to be after <-startTss
 	log.Println("AcceptDeviceHandler - trying to GetDoneChan()")
@@ -603,7 +655,7 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		log.Println("AcceptDeviceHandler - Error while adder process:", err)
 		c.Close(websocket.StatusInternalError, "adder process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -615,7 +667,7 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	if !ok {
 		log.Println("AcceptDeviceHandler - Error while merging dkg results:", err)
 		c.Close(websocket.StatusInternalError, "adder process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -624,7 +676,7 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	err = server._vault.AddPeer(context.WithValue(r.Context(), types.ContextKey("metadata"), metadata), userId, newClientPeerID, userAgent, mergedDkgResult) // add metadata to context
 	if err != nil {
 		log.Println("Error while storing adding peer in DB:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -639,7 +691,7 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	err = ws.ProcessErrors(errs, ctx, c, "AcceptDeviceHandler")
 	if err != nil {
 		c.Close(websocket.StatusInternalError, "AcceptDeviceHandler process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -647,6 +699,9 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 
 	<-newDeviceDoneCh
 
+	// let the other accepting devices know that the new device is done
+	session.finish("", nil)
+
 	log.Println("AcceptDeviceHandler - sending NewDeviceDoneMessage")
 
 	// send newDeviceDoneMessage to existing device
@@ -670,8 +725,172 @@ func (server *Server) AcceptDeviceHandler(w http.ResponseWriter, r *http.Request
 	c.Close(websocket.StatusNormalClosure, "dkg process finished successfully")
 }
 
+// supportsAdding verifies that devices can be added to the wallet of the user, replying with an error if not
+// Adding a device reshares an ECDSA key: EdDSA wallets get ErrUnsupportedScheme
+func (server *Server) supportsAdding(w http.ResponseWriter, r *http.Request, userId string) bool {
+	scheme, err := server._vault.WalletScheme(r.Context(), userId)
+	if err != nil {
+		log.Println("could not get scheme of wallet:", err)
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	if scheme != tss.SchemeECDSA {
+		log.Println("adding devices is not supported for scheme", scheme)
+		httpTypedError(w, r, &types.ErrUnsupportedScheme{}, "Adding devices is only supported for "+string(tss.SchemeECDSA)+" wallets.", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// joinAcceptDevice lets another existing device take part in the adding process started by the accepting device (threshold above 2)
+// A failure only ends the connection of this device: the accepting device fails the whole process if needs be
+func (server *Server) joinAcceptDevice(w http.ResponseWriter, r *http.Request, userId string, peerID string) {
+	// Find the adding process started by the accepting device
+	session, err := server.getTssSession(userId + "-addsession")
+	if err != nil {
+		log.Println("No adding process to join:", err)
+		httpError(w, r, "No device addition in progress.", http.StatusNotFound)
+		return
+	}
+
+	if !session.expects(peerID) {
+		log.Println("Device not expected in adding process:", peerID)
+		httpError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if !server.isRegisteredDevice(w, r, userId, peerID) {
+		return
+	}
+
+	// Client origins of the tenant (without scheme)
+	originPatterns, err := server.originPatterns(r.Context())
+	if err != nil {
+		log.Println("ClientOrigin wrongly configured:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: originPatterns,
+	})
+	if err != nil {
+		log.Println("joinAcceptDevice - Error accepting websocket:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer c.Close(websocket.StatusInternalError, "the sky is falling")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	serverDone := make(chan struct{})
+	errs := make(chan error, 2)
+
+	// Wait for the accepting device to start the process
+	err = session.join(ctx, sessionPeer{peerID: peerID, userAgent: r.UserAgent()})
+	if err == nil {
+		err = session.waitReady(ctx)
+	}
+	if err != nil {
+		log.Println("joinAcceptDevice - Error while waiting for accepting device:", err)
+		c.Close(websocket.StatusInternalError, "adder process failed")
+		return
+	}
+
+	adder, ok := session.actor.(*tss.ServerAdd)
+	if !ok {
+		log.Println("joinAcceptDevice - unexpected tss process")
+		c.Close(websocket.StatusInternalError, "adder process failed")
+		return
+	}
+
+	// Share the new device and the accepting devices with the device
+	err = wsjson.Write(ctx, c, ws.Message{Type: ws.PeerIdBroadcastMessage, Msg: adder.GetNewPeerID()})
+	if err != nil {
+		log.Println("error writing json through websocket:", err)
+		return
+	}
+
+	payload, err := ws.EncodePeers(ws.Peers{PeerIDs: session.peerIDs})
+	if err != nil {
+		log.Println("Error encoding peers:", err)
+		c.Close(websocket.StatusInternalError, "adder process failed")
+		return
+	}
+
+	err = wsjson.Write(ctx, c, ws.Message{Type: ws.PeersMessage, Msg: payload})
+	if err != nil {
+		log.Println("error writing json through websocket:", err)
+		return
+	}
+
+	go func() {
+		for {
+			var msg ws.Message
+			err := wsjson.Read(ctx, c, &msg)
+			if err != nil {
+				if ctx.Err() == context.Canceled || websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+					return
+				}
+
+				log.Println("joinAcceptDevice - error reading message from websocket:", err)
+				errs <- err
+				return
+			}
+
+			if msg.Type != ws.TssMessage {
+				log.Println("joinAcceptDevice - Unexpected message type:", msg.Type)
+				continue
+			}
+
+			tssMsg, err := ws.DecodeTssMessage(msg.Msg)
+			if err != nil {
+				log.Println("could not decode tss msg:", err)
+				errs <- err
+				return
+			}
+
+			// Handle tss message (NOTE : will automatically, in ServerAdd.HandleMessage, redirect to other client if needs be)
+			err = adder.HandleMessage(peerID, tssMsg)
+			if err != nil {
+				log.Println("could not handle tss msg:", err)
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	go ws.TssSend(func() (tss.Message, error) { return adder.GetNextMessageToSend(peerID) }, serverDone, errs, ctx, c, "joinAcceptDevice")
+
+	// Wait for the new device to be stored by the accepting device
+	_, err = session.wait(ctx)
+	if err != nil {
+		log.Println("joinAcceptDevice - adding process failed:", err)
+		c.Close(websocket.StatusInternalError, "adder process failed")
+		return
+	}
+
+	err = wsjson.Write(ctx, c, ws.Message{Type: ws.NewDeviceDoneMessage, Msg: ""})
+	if err != nil {
+		log.Println("error writing json through websocket:", err)
+		return
+	}
+
+	close(serverDone)
+	cancel()
+
+	c.Close(websocket.StatusNormalClosure, "dkg process finished successfully")
+}
+
 // Returns channels : metadata, adder, new device done, existing device done
-func (server *Server) GetInterHandlersChannels(userId string) (chan string, chan string, chan string, chan string, chan *tss.ServerAdd, chan struct{}, chan struct{}, chan struct{}, error) {
+func (server *Server) GetInterHandlersChannels(userId string) (chan string, chan []string, chan string, chan string, chan *tss.ServerAdd, chan struct{}, chan struct{}, chan struct{}, error) {
 
 	// NewClientPeerID
 	newClientPeerIdChInterface, ok := server._cache.Get(userId + "-newclientpeeridch")
@@ -693,7 +912,7 @@ func (server *Server) GetInterHandlersChannels(userId string) (chan string, chan
 		return nil, nil, nil, nil, nil, nil, nil, nil, errors.New("channel not found")
 	}
 
-	existingClientPeerIdCh, ok := existingClientPeerIdChInterface.(chan string)
+	existingClientPeerIdCh, ok := existingClientPeerIdChInterface.(chan []string)
 	if !ok {
 		log.Println("could not assert existingClientPeerIdCh")
 		return nil, nil, nil, nil, nil, nil, nil, nil, errors.New("wrong channel")
@@ -2,12 +2,11 @@ package server
 
 import (
 	"context"
-	"database/sql"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/getmeemaw/meemaw/utils/tss"
@@ -19,56 +18,99 @@ import (
 
 // DkgHandler performs the dkg process from the server side
 // goes through the authMiddleware to confirm the access token and get the userId
+// optional URL parameters: threshold (number of peers required to sign, server included, default 2), devices (number of devices taking part in the dkg, default 1) and scheme (tss.Scheme, default ECDSA)
+// when more than one device takes part in the dkg, the other devices join it with the join=true URL parameter
 func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 	// Get userId and access token from context
 	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
 	if !ok {
 		log.Println("DkgHandler - authorization info not found")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
 	log.Println("DkgHandler userId:", userId)
 
-	// Check if no existing wallet for that user
-	err := server._vault.WalletExists(r.Context(), userId)
-	if err == nil {
-		log.Println("DkgHandler - Wallet already exists for that user.")
-		http.Error(w, "Conflict", http.StatusConflict)
-		return
-	} else if err != sql.ErrNoRows {
-		log.Println("DkgHandler - Error when getting user for dkg, but not sql.ErrNoRows although it should:", err)
-		http.Error(w, "Conflict", http.StatusConflict)
-		return
-	}
+	params := r.URL.Query()
+	join := params.Get("join") == "true"
+	sessionKey := userId + "-dkgsession"
 
-	// WS connection
+	var session *tssSession
+	var threshold uint32
+	var devices int
+	var scheme tss.Scheme
 
-	// Parse clientOrigin URL (to remove scheme from it)
-	var origin string
-	if server._config.ClientOrigin != "*" {
-		u, err := url.Parse(server._config.ClientOrigin)
+	if join {
+		// Find the dkg started by another device
+		var err error
+		session, err = server.getTssSession(sessionKey)
 		if err != nil {
-			log.Println("DkgHandler - ClientOrigin wrongly configured")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Println("DkgHandler - no dkg to join:", err)
+			httpError(w, r, "No wallet creation in progress.", http.StatusNotFound)
 			return
 		}
-
-		origin = u.Host + u.Path
 	} else {
-		origin = "*"
+		// Check if no existing wallet for that user
+		err := server._vault.WalletExists(r.Context(), userId)
+		if err == nil {
+			log.Println("DkgHandler - Wallet already exists for that user.")
+			httpError(w, r, "Conflict", http.StatusConflict)
+			return
+		} else if !errors.Is(err, &types.ErrNotFound{}) {
+			log.Println("DkgHandler - Error when getting user for dkg, but not ErrNotFound although it should:", err)
+			httpError(w, r, "Conflict", http.StatusConflict)
+			return
+		}
+
+		// Check if no wallet creation in progress for that user
+		_, err = server.getTssSession(sessionKey)
+		if err == nil {
+			log.Println("DkgHandler - Wallet creation already in progress for that user.")
+			httpError(w, r, "Conflict", http.StatusConflict)
+			return
+		}
+
+		// Get threshold and number of devices
+		threshold, devices, scheme, err = getDkgParameters(params)
+		if err != nil {
+			log.Println("DkgHandler - invalid dkg parameters:", err)
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// WS connection
+
+	// Client origins of the tenant (without scheme)
+	originPatterns, err := server.originPatterns(r.Context())
+	if err != nil {
+		log.Println("DkgHandler - ClientOrigin wrongly configured:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns: []string{origin},
+		OriginPatterns: originPatterns,
 	})
 	if err != nil {
 		log.Println("DkgHandler - Error accepting websocket:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
 
+	// Open the dkg session (other devices can join from now on)
+	if !join {
+		session = newTssSession(threshold, scheme, devices-1, nil)
+		err = server.openTssSession(sessionKey, session)
+		if err != nil {
+			log.Println("DkgHandler - Wallet creation already in progress for that user.")
+			c.Close(websocket.StatusPolicyViolation, "wallet creation already in progress")
+			return
+		}
+		defer server.closeTssSession(sessionKey, session)
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
 	defer cancel()
 
@@ -77,6 +119,7 @@ func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 	errs := make(chan error, 2)
 
 	var clientPeerID string
+	var joiners []sessionPeer
 
 	var dkg *tss.ServerDkg
 
@@ -122,18 +165,67 @@ func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 
 				log.Println("DkgHandler - received PeerIdBroadcastMessage:", clientPeerID)
 
-				// Prepare DKG process
-				dkg, err = tss.NewServerDkg(clientPeerID)
+				if join {
+					// Let the leading device know about this device
+					err = session.join(ctx, sessionPeer{peerID: clientPeerID, userAgent: r.UserAgent()})
+					if err != nil {
+						log.Println("DkgHandler - could not join dkg:", err)
+						errs <- err
+						return
+					}
+				} else {
+					// Wait for the other devices
+					joiners, err = session.waitJoiners(ctx, clientPeerID)
+					if err != nil {
+						log.Println("DkgHandler - error while waiting for other devices:", err)
+						session.finish("", err)
+						errs <- err
+						return
+					}
+
+					peerIDs := []string{clientPeerID}
+					for _, joiner := range joiners {
+						peerIDs = append(peerIDs, joiner.peerID)
+					}
+
+					// Prepare DKG process
+					dkg, err = tss.NewServerDkg(peerIDs, session.threshold, session.scheme)
+					if err != nil {
+						log.Println("Error when creating new server dkg:", err)
+						session.finish("", err)
+						errs <- err
+						return
+					}
+
+					session.start(dkg, peerIDs)
+				}
+
+				err = session.waitReady(ctx)
 				if err != nil {
-					log.Println("Error when creating new server dkg:", err)
+					log.Println("DkgHandler - dkg did not start:", err)
 					errs <- err
 					return
 				}
 
-				startTss <- struct{}{}
+				// Share all peers with the device
+				payload, err := ws.EncodePeers(ws.Peers{Threshold: session.threshold, Scheme: session.scheme, PeerIDs: session.peerIDs})
+				if err != nil {
+					log.Println("DkgHandler - could not encode peers:", err)
+					errs <- err
+					return
+				}
+
+				err = wsjson.Write(ctx, c, ws.Message{Type: ws.PeersMessage, Msg: payload})
+				if err != nil {
+					log.Println("error writing json through websocket:", err)
+					errs <- err
+					return
+				}
 
 				stage = 30
 
+				close(startTss)
+
 			case ws.TssMessage:
 				// verify stage : if tss message but we're at storage stage or further, discard
 				if stage > msg.Type.MsgStage {
@@ -145,23 +237,15 @@ func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 				log.Println("DkgHandler - received TssMessage:", msg)
 
 				// Decode TSS msg
-				byteString, err := hex.DecodeString(msg.Msg)
+				tssMsg, err := ws.DecodeTssMessage(msg.Msg)
 				if err != nil {
-					log.Println("DkgHandler - error decoding hex:", err)
+					log.Println("DkgHandler - could not decode tss msg:", err)
 					errs <- err
 					return
 				}
 
-				tssMsg := &tss.Message{}
-				err = json.Unmarshal(byteString, &tssMsg)
-				if err != nil {
-					log.Println("DkgHandler - could not unmarshal tss msg:", err)
-					errs <- err
-					return
-				}
-
-				// Handle tss message (NOTE : will automatically, in ServerAdd.HandleMessage, redirect to other client if needs be)
-				err = dkg.HandleMessage(tssMsg)
+				// Handle tss message (NOTE : will automatically, in ServerDkg.HandleMessage, redirect to other client if needs be)
+				err = session.actor.HandleMessage(clientPeerID, tssMsg)
 				if err != nil {
 					log.Println("DkgHandler - could not handle tss msg:", err)
 					errs <- err
@@ -188,43 +272,86 @@ func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// Wait for tss start
-	<-startTss
-
-	// Get channel from adder /!\ needs to be initialised first => this line needs to be after <-startTss
-	log.Println("DkgHandler - trying to GetDoneChan()")
-
-	// TSS sending and listening for finish signal
-	go ws.TssSend(dkg.GetNextMessageToSend, serverDone, errs, ctx, c, "DkgHandler")
-
-	// Start Adder process.
-	dkgResult, err := dkg.Process()
-	if err != nil {
-		log.Println("DkgHandler - Error while dkg process:", err)
+	select {
+	case <-startTss:
+	case err = <-errs:
+		log.Println("DkgHandler - dkg could not start:", err)
 		c.Close(websocket.StatusInternalError, "dkg process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
-	}
-
-	// Error management
-	err = ws.ProcessErrors(errs, ctx, c, "DkgHandler")
-	if err != nil {
-		log.Println("DkgHandler - dkg process failed:", err)
-		c.Close(websocket.StatusInternalError, "DkgHandler process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	case <-ctx.Done():
+		log.Println("DkgHandler - timeout before dkg start")
+		c.Close(websocket.StatusInternalError, "dkg process timed out")
 		return
 	}
 
-	stage = 40 // only move to next stage after tss process is done
+	// TSS sending (messages targeted at this device) and listening for finish signal
+	go ws.TssSend(func() (tss.Message, error) { return session.actor.GetNextMessageToSend(clientPeerID) }, serverDone, errs, ctx, c, "DkgHandler")
 
-	log.Println("DkgHandler - storing wallet")
+	var metadata string
 
-	// Store dkgResult
-	userAgent := r.UserAgent()
-	metadata, err := server._vault.StoreWallet(r.Context(), userId, clientPeerID, userAgent, dkgResult) // use context from request
-	if err != nil {
-		log.Println("DkgHandler - Error while storing dkg result:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if join {
+		// Wait for the leading device to run the dkg and store the wallet
+		metadata, err = session.wait(ctx)
+		if err != nil {
+			log.Println("DkgHandler - dkg failed:", err)
+			c.Close(websocket.StatusInternalError, "dkg process failed")
+			return
+		}
+
+		// Error management
+		err = ws.ProcessErrors(errs, ctx, c, "DkgHandler")
+		if err != nil {
+			log.Println("DkgHandler - dkg process failed:", err)
+			c.Close(websocket.StatusInternalError, "DkgHandler process failed")
+			return
+		}
+
+		stage = 40
+	} else {
+		// Start DKG process.
+		dkgResult, err := dkg.Process()
+		if err != nil {
+			log.Println("DkgHandler - Error while dkg process:", err)
+			session.finish("", err)
+			c.Close(websocket.StatusInternalError, "dkg process failed")
+			return
+		}
+
+		// Error management
+		err = ws.ProcessErrors(errs, ctx, c, "DkgHandler")
+		if err != nil {
+			log.Println("DkgHandler - dkg process failed:", err)
+			session.finish("", err)
+			c.Close(websocket.StatusInternalError, "DkgHandler process failed")
+			return
+		}
+
+		stage = 40 // only move to next stage after tss process is done
+
+		log.Println("DkgHandler - storing wallet")
+
+		// Store dkgResult
+		userAgent := r.UserAgent()
+		metadata, err = server._vault.StoreWallet(r.Context(), userId, clientPeerID, userAgent, dkgResult) // use context from request
+		if err != nil {
+			log.Println("DkgHandler - Error while storing dkg result:", err)
+			session.finish("", err)
+			c.Close(websocket.StatusInternalError, "could not store wallet")
+			return
+		}
+
+		// Store other devices
+		for _, joiner := range joiners {
+			err = server._vault.AddPeer(context.WithValue(r.Context(), types.ContextKey("metadata"), metadata), userId, joiner.peerID, joiner.userAgent, dkgResult) // add metadata to context
+			if err != nil {
+				log.Println("DkgHandler - Error while storing device:", err)
+				session.finish("", err)
+				c.Close(websocket.StatusInternalError, "could not store wallet")
+				return
+			}
+		}
+
+		session.finish(metadata, nil)
 	}
 
 	log.Println("DkgHandler - sending metadata")
@@ -237,7 +364,6 @@ func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 	err = wsjson.Write(ctx, c, ack)
 	if err != nil {
 		log.Println("error writing json through websocket:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -252,3 +378,41 @@ func (server *Server) DkgHandler(w http.ResponseWriter, r *http.Request) {
 	// CLOSE WEBSOCKET
 	c.Close(websocket.StatusNormalClosure, "dkg process finished successfully")
 }
+
+// getDkgParameters reads the threshold, the number of devices and the scheme of the wallet to be created from URL parameters
+func getDkgParameters(params url.Values) (uint32, int, tss.Scheme, error) {
+	threshold := 2
+	devices := 1
+
+	var err error
+
+	if len(params.Get("threshold")) > 0 {
+		threshold, err = strconv.Atoi(params.Get("threshold"))
+		if err != nil {
+			return 0, 0, "", err
+		}
+	}
+
+	if len(params.Get("devices")) > 0 {
+		devices, err = strconv.Atoi(params.Get("devices"))
+		if err != nil {
+			return 0, 0, "", err
+		}
+	}
+
+	if threshold < 0 || devices < 1 {
+		return 0, 0, "", tss.ErrInvalidThreshold
+	}
+
+	err = tss.ValidateThreshold(uint32(threshold), devices+1)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	scheme, err := tss.ParseScheme(params.Get("scheme"))
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	return uint32(threshold), devices, scheme, nil
+}
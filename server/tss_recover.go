@@ -14,9 +14,9 @@ import (
 // NOTE - potential improvement for the future: asymmetric encryption of the server shares based on a public encryption key shared by the client, to avoid MITM attack vectors. However, avoid making the wasm file heavier.
 func (server *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !server._config.Export {
+	if !server.tenant(r.Context()).Export {
 		log.Println("ExportHandler - config disables export")
-		http.Error(w, "Export unauthorized", http.StatusUnauthorized)
+		httpError(w, r, "Export unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -25,7 +25,7 @@ func (server *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		// If there's no userID in the context, report an error and return.
 		log.Println("ExportHandler - authorization info not found")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
@@ -33,7 +33,7 @@ func (server *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		// If there's no token in the context, report an error and return.
 		log.Println("ExportHandler - authorization info not found")
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
@@ -42,11 +42,11 @@ func (server *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if errors.Is(err, &types.ErrNotFound{}) {
 			log.Println("ExportHandler - wallet does not exist")
-			http.Error(w, "Wallet does not exist.", http.StatusNotFound)
+			httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
 			return
 		} else {
 			log.Println("ExportHandler - error while retrieving wallet:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 	}
@@ -55,7 +55,7 @@ func (server *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
 	ret, err := json.Marshal(dkgResult)
 	if err != nil {
 		log.Println("ExportHandler - could not marshal dkgResult")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/getmeemaw/meemaw/utils/ws"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// RefreshHandler performs the refresh of the shares of a wallet from the server side: all shares are re-randomised, the public key and address stay the same
+// goes through the authMiddleware to confirm the access token and get the userId
+// requires the peerID of the device (provided as URL parameter)
+// every device of the wallet needs to take part in the refresh: the first device starts it, the other devices join with the join=true URL parameter
+// if a device of the wallet is lost, the refresh cannot happen: it needs to be revoked first (RevokeHandler), the error code is then "devices_missing" (ErrDevicesMissing)
+// once the refresh succeeded, every device acknowledges it has its new share (RefreshAckMessage): the previous server share is only replaced after all acks,
+// the websocket being closed normally only after that (devices should only keep their new share then)
+func (server *Server) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	// Get userId and access token from context
+	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
+	if !ok {
+		// If there's no userID in the context, report an error and return.
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	token, ok := r.Context().Value(types.ContextKey("token")).(string)
+	if !ok {
+		// If there's no token in the context, report an error and return.
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	clientPeerID := params.Get("peer")
+	join := params.Get("join") == "true"
+
+	sessionKey := userId + "-refreshsession"
+
+	var err error
+	var session *tssSession
+	var refresher *tss.ServerRefresh
+
+	if join {
+		// Find the refresh process started by another device
+		session, err = server.getTssSession(sessionKey)
+		if err != nil {
+			log.Println("No refresh process to join:", err)
+			httpError(w, r, "No refresh in progress.", http.StatusNotFound)
+			return
+		}
+
+		if !session.expects(clientPeerID) {
+			log.Println("Device not expected in refresh process:", clientPeerID)
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		// Retrieve wallet from DB for given userId
+		dkgResult, err := server._vault.RetrieveWallet(r.Context(), userId) // RetrieveWallet can use metadata from context if required
+		if err != nil {
+			if errors.Is(err, &types.ErrNotFound{}) {
+				httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
+				return
+			} else {
+				httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if dkgResult.GetScheme() != tss.SchemeECDSA {
+			log.Println("refresh is not supported for scheme", dkgResult.GetScheme())
+			httpTypedError(w, r, &types.ErrUnsupportedScheme{}, "Refresh is only supported for "+string(tss.SchemeECDSA)+" wallets.", http.StatusBadRequest)
+			return
+		}
+
+		devices := dkgResult.GetClientPeerIDs()
+		if !slices.Contains(devices, clientPeerID) {
+			log.Println("Device calling is not part of the wallet:", clientPeerID)
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		// Prepare refresh process
+		refresher, err = tss.NewServerRefresh(dkgResult)
+		if err != nil {
+			log.Println("Error initialising refresh tss:", err)
+			if errors.Is(err, tss.ErrMissingPeers) {
+				httpTypedError(w, r, &types.ErrDevicesMissing{}, "All devices of the wallet must take part in the refresh, revoke the lost devices first.", http.StatusConflict)
+			} else if errors.Is(err, tss.ErrUnknownPeer) || errors.Is(err, tss.ErrNotEnoughSigners) {
+				httpError(w, r, "Bad Request", http.StatusBadRequest)
+			} else {
+				httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		session = newTssSession(dkgResult.GetThreshold(), dkgResult.GetScheme(), len(devices)-1, devices)
+		err = server.openTssSession(sessionKey, session)
+		if err != nil {
+			log.Println("Refresh already in progress")
+			httpError(w, r, "Conflict", http.StatusConflict)
+			return
+		}
+		defer server.closeTssSession(sessionKey, session)
+	}
+
+	// Client origins of the tenant (without scheme)
+	originPatterns, err := server.originPatterns(r.Context())
+	if err != nil {
+		log.Println("ClientOrigin wrongly configured:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: originPatterns,
+	})
+	if err != nil {
+		log.Println("Error accepting websocket:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer c.Close(websocket.StatusInternalError, "the sky is falling")
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	refreshDone := make(chan struct{})
+	errs := make(chan error, 2)
+
+	// Wait for all devices
+	if join {
+		err = session.join(ctx, sessionPeer{peerID: clientPeerID, userAgent: r.UserAgent()})
+	} else {
+		// Devices get less time to join than the whole refresh, for the leading device to learn about missing ones before its own timeout
+		joinCtx, joinCancel := context.WithTimeout(ctx, 30*time.Second)
+		var joiners []sessionPeer
+		joiners, err = session.waitJoiners(joinCtx, clientPeerID)
+		joinCancel()
+		if err == nil {
+			peerIDs := []string{clientPeerID}
+			for _, joiner := range joiners {
+				peerIDs = append(peerIDs, joiner.peerID)
+			}
+			session.start(refresher, peerIDs)
+		}
+	}
+	if err == nil {
+		err = session.waitReady(ctx)
+	}
+	if err != nil {
+		log.Println("Error while waiting for devices:", err)
+		if !join {
+			session.finish("", err) // a joiner failing only ends its own connection, the leader fails the session if needs be
+			if errors.Is(err, context.DeadlineExceeded) {
+				// some devices never joined: the close reason is the error code, for the device to know it needs to revoke them
+				c.Close(websocket.StatusTryAgainLater, types.ErrorCode(&types.ErrDevicesMissing{}))
+				return
+			}
+		}
+		c.Close(websocket.StatusInternalError, "refresh process failed")
+		return
+	}
+
+	// Share refreshing devices with the device
+	payload, err := ws.EncodePeers(ws.Peers{Threshold: session.threshold, Scheme: session.scheme, PeerIDs: session.peerIDs})
+	if err != nil {
+		log.Println("Error encoding peers:", err)
+		c.Close(websocket.StatusInternalError, "refresh process failed")
+		return
+	}
+
+	err = wsjson.Write(ctx, c, ws.Message{Type: ws.PeersMessage, Msg: payload})
+	if err != nil {
+		log.Println("error writing json through websocket:", err)
+		return
+	}
+
+	go func() {
+		acked := false
+		for {
+			var msg ws.Message
+			err := wsjson.Read(ctx, c, &msg)
+			if err != nil {
+				if ctx.Err() == context.Canceled || websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+					return
+				}
+
+				log.Println("error reading message from websocket:", err)
+				errs <- err
+				return
+			}
+
+			if msg.Type == ws.RefreshAckMessage {
+				if !acked {
+					acked = true
+					session.ack(clientPeerID)
+				}
+				continue
+			}
+
+			if msg.Type != ws.TssMessage {
+				log.Println("RefreshHandler - Unexpected message type:", msg.Type)
+				continue
+			}
+
+			tssMsg, err := ws.DecodeTssMessage(msg.Msg)
+			if err != nil {
+				log.Println("could not decode tss msg:", err)
+				errs <- err
+				return
+			}
+
+			// Handle tss message (NOTE : will automatically, in ServerRefresh.HandleMessage, redirect to other client if needs be)
+			err = session.actor.HandleMessage(clientPeerID, tssMsg)
+			if err != nil {
+				log.Println("could not handle tss msg:", err)
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	go ws.TssSend(func() (tss.Message, error) { return session.actor.GetNextMessageToSend(clientPeerID) }, refreshDone, errs, ctx, c, "RefreshHandler")
+
+	if join {
+		// Wait for the refresh process run by the leading device (including the storage of the new server share)
+		_, err = session.wait(ctx)
+	} else {
+		// Start refresh process
+		var refreshedDkgResult *tss.DkgResult
+		refreshedDkgResult, err = refresher.Process()
+		if err == nil {
+			// Keep the previous server share until every device has its new one
+			err = session.waitAcks(ctx)
+			if err != nil {
+				log.Println("Error waiting for the devices to confirm the refresh:", err)
+			}
+		}
+		if err == nil {
+			// Replace the server share, in a single update
+			err = server._vault.UpdateWallet(r.Context(), userId, refreshedDkgResult)
+			if err != nil {
+				log.Println("Error storing refreshed wallet:", err)
+			}
+		}
+		session.finish("", err)
+	}
+	close(refreshDone)
+	if err != nil {
+		log.Println("Error during refresh process:", err)
+		c.Close(websocket.StatusInternalError, "refresh process failed")
+		return
+	}
+
+	c.Close(websocket.StatusNormalClosure, "refresh process finished successfully")
+
+	// Delete token from cache to avoid re-use
+	server._cache.Delete(token)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+// RevokeDeviceHandler removes a device from the wallet: its device row is deleted and its BK is removed from the server dkgResult, so that the server does not take part in any TSS process with it anymore
+// goes through the authMiddleware to confirm the access token and get the userId
+// requires the peerID of the device calling (peer) and the peerID of the device to be revoked (device), provided as URL parameters. A device can revoke itself.
+// the share of the revoked device remains mathematically valid until the remaining devices refresh their shares (see RefreshHandler)
+func (server *Server) RevokeDeviceHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !server.tenant(r.Context()).MultiDevice {
+		log.Println("RevokeDeviceHandler - config disables multi device")
+		httpError(w, r, "Multi device unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Get userId and access token from context
+	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
+	if !ok {
+		// If there's no userID in the context, report an error and return.
+		log.Println("RevokeDeviceHandler - authorization info not found")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	token, ok := r.Context().Value(types.ContextKey("token")).(string)
+	if !ok {
+		// If there's no token in the context, report an error and return.
+		log.Println("RevokeDeviceHandler - authorization info not found")
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	clientPeerID := params.Get("peer")
+	revokedPeerID := params.Get("device")
+
+	if len(revokedPeerID) == 0 {
+		log.Println("RevokeDeviceHandler - no device to revoke")
+		httpError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// Retrieve wallet from DB for given userId
+	dkgResult, err := server._vault.RetrieveWallet(r.Context(), userId) // RetrieveWallet can use metadata from context if required
+	if err != nil {
+		if errors.Is(err, &types.ErrNotFound{}) {
+			log.Println("RevokeDeviceHandler - wallet does not exist")
+			httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
+			return
+		} else {
+			log.Println("RevokeDeviceHandler - error while retrieving wallet:", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only a device of the wallet can revoke devices
+	if _, ok := dkgResult.BKs[clientPeerID]; !ok {
+		log.Println("RevokeDeviceHandler - device calling is not part of the wallet:", clientPeerID)
+		httpError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	updatedDkgResult, err := tss.RemovePeer(dkgResult, revokedPeerID)
+	if err != nil {
+		log.Println("RevokeDeviceHandler - error removing device:", err)
+		if errors.Is(err, tss.ErrUnknownPeer) {
+			httpError(w, r, "Device does not exist.", http.StatusNotFound)
+		} else if errors.Is(err, tss.ErrNotEnoughSigners) || errors.Is(err, tss.ErrServerIsNotAClient) {
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = server._vault.RemovePeer(r.Context(), userId, revokedPeerID, updatedDkgResult)
+	if err != nil {
+		log.Println("RevokeDeviceHandler - error while removing device from DB:", err)
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Device does not exist.", http.StatusNotFound)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Delete token from cache to avoid re-use
+	server._cache.Delete(token)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+)
+
+/////////
+//
+// A tssSession allows several devices of the same user to take part in a single TSS process (dkg, sign), each through its own websocket connection.
+// The device opening the session (leader) waits for the other devices (joiners) to connect, then prepares the server side of the TSS process (actor).
+// Each connection then sends the messages targeted at its own device and hands the incoming messages to the shared actor, which relays them between devices if needs be.
+// The leader runs the TSS process and shares the outcome with the joiners when done.
+//
+/////////
+
+var (
+	errSessionNotFound  = errors.New("tss session not found")
+	errSessionExists    = errors.New("tss session already exists")
+	errUnexpectedDevice = errors.New("device not expected in tss session")
+)
+
+// tssActor is the server side of a TSS process shared by several devices (ServerDkg, ServerSigner)
+type tssActor interface {
+	GetNextMessageToSend(peerID string) (tss.Message, error)
+	HandleMessage(from string, msg *tss.Message) error // from: peer of the connection, the only sender accepted
+}
+
+type sessionPeer struct {
+	peerID    string
+	userAgent string
+}
+
+type tssSession struct {
+	threshold  uint32
+	scheme     tss.Scheme
+	numJoiners int
+	expected   map[string]bool // if not empty, only these peers can take part in the session
+	joins      chan sessionPeer
+	ready      chan struct{}
+	actor      tssActor
+	peerIDs    []string
+	acks       chan string
+	done       chan struct{}
+	doneOnce   sync.Once
+	metadata   string
+	err        error
+}
+
+func newTssSession(threshold uint32, scheme tss.Scheme, numJoiners int, expectedPeerIDs []string) *tssSession {
+	expected := make(map[string]bool)
+	for _, peerID := range expectedPeerIDs {
+		expected[peerID] = true
+	}
+
+	return &tssSession{
+		threshold:  threshold,
+		scheme:     scheme,
+		numJoiners: numJoiners,
+		expected:   expected,
+		joins:      make(chan sessionPeer, numJoiners),
+		ready:      make(chan struct{}),
+		acks:       make(chan string, numJoiners+1),
+		done:       make(chan struct{}),
+	}
+}
+
+// expects returns true if the given peer can take part in the session
+func (s *tssSession) expects(peerID string) bool {
+	return len(s.expected) == 0 || s.expected[peerID]
+}
+
+// join is used by joiners to announce their device to the leader
+func (s *tssSession) join(ctx context.Context, peer sessionPeer) error {
+	if !s.expects(peer.peerID) {
+		return errUnexpectedDevice
+	}
+
+	select {
+	case s.joins <- peer:
+		return nil
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return errUnexpectedDevice // all joiners already there
+	}
+}
+
+// waitJoiners is used by the leader to wait for all the other devices of the session
+func (s *tssSession) waitJoiners(ctx context.Context, leaderPeerID string) ([]sessionPeer, error) {
+	seen := map[string]bool{leaderPeerID: true}
+	joiners := make([]sessionPeer, 0, s.numJoiners)
+
+	for len(joiners) < s.numJoiners {
+		select {
+		case peer := <-s.joins:
+			if seen[peer.peerID] {
+				log.Println("tss session - device joined twice:", peer.peerID)
+				return nil, errUnexpectedDevice
+			}
+			seen[peer.peerID] = true
+			joiners = append(joiners, peer)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return joiners, nil
+}
+
+// start is used by the leader to share the actor and the client peers of the TSS process, which lets every connection start
+func (s *tssSession) start(actor tssActor, peerIDs []string) {
+	s.actor = actor
+	s.peerIDs = peerIDs
+	close(s.ready)
+}
+
+// waitReady waits for the leader to start the TSS process
+func (s *tssSession) waitReady(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ack is used by every connection to confirm that its device has the outcome of the TSS process (refresh)
+func (s *tssSession) ack(peerID string) {
+	select {
+	case s.acks <- peerID:
+	default: // more acks than devices, the extra ones are ignored
+	}
+}
+
+// waitAcks is used by the leader to wait for the confirmation of every device of the TSS process
+func (s *tssSession) waitAcks(ctx context.Context) error {
+	acked := make(map[string]bool)
+
+	for len(acked) < len(s.peerIDs) {
+		select {
+		case peerID := <-s.acks:
+			if !slices.Contains(s.peerIDs, peerID) {
+				return errUnexpectedDevice
+			}
+			acked[peerID] = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// finish is used by the leader to share the outcome of the TSS process (metadata for the dkg)
+func (s *tssSession) finish(metadata string, err error) {
+	s.doneOnce.Do(func() {
+		s.metadata = metadata
+		s.err = err
+		close(s.done)
+	})
+}
+
+// wait is used by joiners to wait for the outcome of the TSS process
+func (s *tssSession) wait(ctx context.Context) (string, error) {
+	select {
+	case <-s.done:
+		return s.metadata, s.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// openTssSession stores a new session in cache, it fails if a session already exists for that key
+func (server *Server) openTssSession(key string, session *tssSession) error {
+	err := server._cache.Add(key, session, time.Minute)
+	if err != nil {
+		log.Println("could not open tss session:", err)
+		return errSessionExists
+	}
+	return nil
+}
+
+// closeTssSession removes the session from cache and unblocks joiners if the leader failed before finishing
+func (server *Server) closeTssSession(key string, session *tssSession) {
+	session.finish("", errors.New("tss session closed"))
+	server._cache.Delete(key)
+}
+
+func (server *Server) getTssSession(key string) (*tssSession, error) {
+	sessionInterface, ok := server._cache.Get(key)
+	if !ok {
+		return nil, errSessionNotFound
+	}
+
+	session, ok := sessionInterface.(*tssSession)
+	if !ok {
+		log.Println("could not assert tss session")
+		return nil, errSessionNotFound
+	}
+
+	return session, nil
+}
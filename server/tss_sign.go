@@ -4,99 +4,364 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/tx"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
 	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/getmeemaw/meemaw/utils/ws"
 	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
 )
 
 // SignHandler performs the signing process from the server side
 // goes through the authMiddleware to confirm the access token and get the userId
-// requires a hex-encoded message to be signed (provided as URL parameter)
+// requires a hex-encoded message to be signed and the peerID of the device (provided as URL parameters)
+// optional URL parameter peers (comma-separated peerIDs of all signing devices) : for wallets with a threshold above 2, the other devices join the signing process with the join=true URL parameter
+// optional URL parameter signature (schnorr or taproot) : BIP-340 Schnorr signature of a 32 bytes message with an ECDSA wallet, for its public key or for its taproot output key
+// optional URL parameter path (non-hardened derivation path, e.g. m/0/1, see tss.DeriveDkgResult) : signature with the child key of the wallet at path, also accepted by SignTxHandler
 func (server *Server) SignHandler(w http.ResponseWriter, r *http.Request) {
+	// Get message to be signed from URL parameters
+	msg := r.URL.Query().Get("msg")
+
+	if len(msg) == 0 {
+		httpError(w, r, "No message to be signed", http.StatusBadRequest)
+		return
+	}
+
+	message, err := hex.DecodeString(msg)
+	if err != nil {
+		log.Println("Error decoding msg:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	signatureType := r.URL.Query().Get("signature")
+	if signatureType != "" && signatureType != tss.SignatureSchnorr && signatureType != tss.SignatureTaproot {
+		httpError(w, r, "Unknown signature type", http.StatusBadRequest)
+		return
+	}
+
+	server.sign(w, r, message, signatureType, nil, nil)
+}
+
+// SignTxHandler performs the signing process of an Ethereum transaction from the server side
+// goes through the authMiddleware to confirm the access token and get the userId
+// requires the json-encoded transaction (tx), its chainId and the peerID of the device (provided as URL parameters), same optional parameters as SignHandler
+// the server decodes the transaction and computes the hash itself, so that it knows what it signs (the client computes the same hash for its side of the signing process)
+func (server *Server) SignTxHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	if len(params.Get("tx")) == 0 || len(params.Get("chainId")) == 0 {
+		httpError(w, r, "No transaction to be signed", http.StatusBadRequest)
+		return
+	}
+
+	ethTx, err := tx.NewEthereumTxWithJson(params.Get("tx"), params.Get("chainId"))
+	if err != nil {
+		log.Println("Error decoding tx:", err)
+		httpError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = ethTx.Validate()
+	if err != nil {
+		log.Println("Invalid tx:", err)
+		httpError(w, r, "Invalid transaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message := ethTx.GenerateMessage()
+
+	log.Println("SignTxHandler - signing tx", hex.EncodeToString(message), "on chain", ethTx.ChainId())
+
+	server.sign(w, r, message, "", ethTx, nil)
+}
+
+// SignPsbtHandler performs the signing process of an input of a Bitcoin transaction (PSBT) from the server side
+// goes through the authMiddleware to confirm the access token and get the userId
+// requires the base64 or hex encoded PSBT (psbt), the index of the input (input), the network (mainnet, testnet, signet or regtest) and the peerID of the device (provided as URL parameters), same optional parameters as SignHandler but path
+// the signature type depends on the input (taproot for taproot inputs), the signature parameter is optional but must match it
+// the server decodes the PSBT and computes the sighash of the input itself, so that the policy and the approvers see the outputs and amounts (the client computes the same sighash for its side of the signing process)
+func (server *Server) SignPsbtHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
+	if !ok {
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+
+	if len(params.Get("psbt")) == 0 || len(params.Get("input")) == 0 {
+		httpError(w, r, "No transaction to be signed", http.StatusBadRequest)
+		return
+	}
+
+	// Inputs are signed with the key of the wallet
+	if len(params.Get("path")) > 0 {
+		httpError(w, r, "Invalid derivation path", http.StatusBadRequest)
+		return
+	}
+
+	index, err := strconv.Atoi(params.Get("input"))
+	if err != nil {
+		httpError(w, r, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	dkgResult, err := server._vault.RetrieveWallet(r.Context(), userId)
+	if err != nil {
+		if errors.Is(err, &types.ErrNotFound{}) {
+			httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
+		} else {
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	_psbt, err := bitcoin.NewPsbt(params.Get("psbt"), dkgResult.Pubkey)
+	if err != nil {
+		log.Println("Error decoding psbt:", err)
+		httpError(w, r, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	spend, err := _psbt.Spend(params.Get("network"))
+	if err != nil {
+		log.Println("Error decoding outputs of psbt:", err)
+		httpError(w, r, "Invalid transaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sighashes, err := _psbt.Sighashes()
+	if err != nil {
+		log.Println("Error computing sighashes of psbt:", err)
+		httpError(w, r, "Invalid transaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	i := slices.IndexFunc(sighashes, func(sighash bitcoin.InputSighash) bool { return sighash.Index == index })
+	if i < 0 {
+		httpError(w, r, "Input not spending from the wallet", http.StatusBadRequest)
+		return
+	}
+
+	signatureType := ""
+	if sighashes[i].Taproot {
+		signatureType = tss.SignatureTaproot
+	}
+	if len(params.Get("signature")) > 0 && params.Get("signature") != signatureType {
+		httpError(w, r, "Wrong signature type for input", http.StatusBadRequest)
+		return
+	}
+
+	log.Println("SignPsbtHandler - signing input", index, "of tx", spend.TxID, "on", spend.Network)
+
+	server.sign(w, r, sighashes[i].Message, signatureType, nil, spend)
+}
+
+// sign runs the signing process of message with the device (and the other signing devices, if any)
+// signatureType is the signature type (tss.SignatureSchnorr or tss.SignatureTaproot), empty for the signature of the scheme of the wallet
+// ethTx is the transaction message is the hash of, spend the bitcoin transaction message is the sighash of an input of, both nil for raw messages
+func (server *Server) sign(w http.ResponseWriter, r *http.Request, message []byte, signatureType string, ethTx *tx.EthereumTx, spend *bitcoin.Spend) {
 	// Get userId and access token from context
 	userId, ok := r.Context().Value(types.ContextKey("userId")).(string)
 	if !ok {
 		// If there's no userID in the context, report an error and return.
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
 	token, ok := r.Context().Value(types.ContextKey("token")).(string)
 	if !ok {
 		// If there's no token in the context, report an error and return.
-		http.Error(w, "Authorization info not found", http.StatusUnauthorized)
+		httpError(w, r, "Authorization info not found", http.StatusUnauthorized)
 		return
 	}
 
-	// Get message to be signed from URL parameters
 	params := r.URL.Query()
-	msg := params.Get("msg")
 	clientPeerID := params.Get("peer")
-	// clientPeerID := "client"
+	join := params.Get("join") == "true"
 
-	if len(msg) == 0 {
-		http.Error(w, "No message to be signed", http.StatusBadRequest)
-		return
-	}
+	var err error
 
-	message, err := hex.DecodeString(msg)
+	// Derivation path of the signing key (by default, the key of the wallet)
+	path := params.Get("path")
+	indexes, err := tss.ParseDerivationPath(path)
 	if err != nil {
-		log.Println("Error decoding msg:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Println("Invalid derivation path:", err)
+		httpError(w, r, "Invalid derivation path", http.StatusBadRequest)
 		return
 	}
 
-	// Retrieve wallet from DB for given userId
-	dkgResult, err := server._vault.RetrieveWallet(r.Context(), userId) // RetrieveWallet can use metadata from context if required
-	if err != nil {
-		if errors.Is(err, &types.ErrNotFound{}) {
-			http.Error(w, "Wallet does not exist.", http.StatusNotFound)
+	// Signing devices (by default, only the device calling)
+	signers := []string{clientPeerID}
+	if len(params.Get("peers")) > 0 {
+		signers = strings.Split(params.Get("peers"), ",")
+	}
+
+	sessionKey := userId + "-signsession-" + hex.EncodeToString(message) // same session for /sign and /sign-tx, devices can join either way
+	if signatureType != "" {
+		sessionKey += "-" + signatureType // devices joining must produce the same type of signature
+	}
+	if len(indexes) > 0 {
+		sessionKey += "-path" + fmt.Sprint(indexes) // and sign with the same key
+	}
+
+	var session *tssSession
+	var signer *tss.ServerSigner
+	signed := false // the policy reservation is released if the signing fails
+
+	if join {
+		// Find the signing process started by another device
+		session, err = server.getTssSession(sessionKey)
+		if err != nil {
+			log.Println("No signing process to join:", err)
+			httpError(w, r, "No signing in progress.", http.StatusNotFound)
+			return
+		}
+
+		if !session.expects(clientPeerID) {
+			log.Println("Device not expected in signing process:", clientPeerID)
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if !server.isRegisteredDevice(w, r, userId, clientPeerID) {
+			return
+		}
+	} else {
+		if !slices.Contains(signers, clientPeerID) {
+			log.Println("Device calling is not part of signing devices:", clientPeerID)
+			httpError(w, r, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		// Retrieve wallet from DB for given userId
+		dkgResult, err := server._vault.RetrieveWallet(r.Context(), userId) // RetrieveWallet can use metadata from context if required
+		if err != nil {
+			if errors.Is(err, &types.ErrNotFound{}) {
+				httpError(w, r, "Wallet does not exist.", http.StatusNotFound)
+				return
+			} else {
+				httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Revoked (or unknown) devices cannot sign
+		if _, ok := dkgResult.BKs[clientPeerID]; !ok {
+			log.Println("Device calling is not part of the wallet:", clientPeerID)
+			httpError(w, r, "Device not registered", http.StatusForbidden)
+			return
+		}
+
+		if !server.isRegisteredDevice(w, r, userId, clientPeerID) {
 			return
+		}
+
+		// Child key of the wallet: public key and server share tweaked, the devices tweak their own shares
+		if len(indexes) > 0 {
+			dkgResult, err = tss.DeriveDkgResult(dkgResult, path)
+			if err != nil {
+				log.Println("Error deriving key:", err)
+				httpError(w, r, "Invalid derivation path", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Check the policy of the tenant (the devices joining sign the same message)
+		var settle func(signed bool)
+		if spend != nil {
+			settle, err = server.checkPsbtPolicy(r.Context(), userId, spend)
 		} else {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			var release func()
+			release, err = server.checkPolicy(r.Context(), userId, ethTx)
+			settle = func(signed bool) {
+				if !signed {
+					release()
+				}
+			}
+		}
+		if err != nil {
+			var policyErr *types.ErrPolicyRejected
+			if errors.As(err, &policyErr) {
+				log.Println("Signing rejected by policy:", err)
+				httpTypedError(w, r, policyErr, policyErr.Reason, http.StatusForbidden)
+			} else {
+				log.Println("Error checking policy:", err)
+				httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			}
 			return
 		}
-	}
+		defer func() { settle(signed) }()
 
-	// Prepare signing process
-	signer, err := tss.NewServerSigner(clientPeerID, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs, message)
-	if err != nil {
-		log.Println("Error initialising signer tss:", err)
-		if strings.Contains(err.Error(), "invalid point") {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		// Wait for the approval, if the policy requires one (webhook or admin endpoints)
+		var settleApproval func(signed bool)
+		settleApproval, err = server.waitApproval(r.Context(), sessionKey, userId, clientPeerID, message, signatureType, path, ethTx, spend)
+		if err != nil {
+			var policyErr *types.ErrPolicyRejected
+			if errors.As(err, &policyErr) {
+				log.Println("Signing denied by approver:", err)
+				httpTypedError(w, r, policyErr, policyErr.Reason, http.StatusForbidden)
+			} else if errors.Is(err, &types.ErrApprovalPending{}) {
+				log.Println("Signing waiting for approval")
+				httpTypedError(w, r, err, "Approval pending, sign again once approved", http.StatusForbidden)
+			} else {
+				log.Println("Error waiting for approval:", err)
+				httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		defer func() { settleApproval(signed) }()
+
+		// Prepare signing process
+		if signatureType == "" {
+			signer, err = tss.NewServerSigner(signers, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs, dkgResult.PublicShares, dkgResult.GetThreshold(), dkgResult.GetScheme(), message)
 		} else {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			signer, err = tss.NewServerSignerSchnorr(signers, dkgResult.Pubkey, dkgResult.Share, dkgResult.BKs, dkgResult.PublicShares, dkgResult.GetThreshold(), dkgResult.GetScheme(), signatureType == tss.SignatureTaproot, message)
+		}
+		if err != nil {
+			log.Println("Error initialising signer tss:", err)
+			if strings.Contains(err.Error(), "invalid point") || errors.Is(err, tss.ErrUnknownPeer) || errors.Is(err, tss.ErrNotEnoughSigners) || errors.Is(err, tss.ErrDuplicatePeer) || errors.Is(err, tss.ErrServerIsNotAClient) || errors.Is(err, tss.ErrUnsupportedScheme) || errors.Is(err, tss.ErrInvalidMessage) {
+				httpError(w, r, "Bad Request", http.StatusBadRequest)
+			} else {
+				httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
 		}
-		return
-	}
 
-	// Parse clientOrigin URL (to remove scheme from it)
-	var origin string
-	if server._config.ClientOrigin != "*" {
-		u, err := url.Parse(server._config.ClientOrigin)
+		session = newTssSession(dkgResult.GetThreshold(), dkgResult.GetScheme(), len(signers)-1, signers)
+		err = server.openTssSession(sessionKey, session)
 		if err != nil {
-			log.Println("ClientOrigin wrongly configured")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Println("Signing of that message already in progress")
+			httpError(w, r, "Conflict", http.StatusConflict)
 			return
 		}
+		defer server.closeTssSession(sessionKey, session)
+	}
 
-		origin = u.Host + u.Path
-	} else {
-		origin = "*"
+	// Client origins of the tenant (without scheme)
+	originPatterns, err := server.originPatterns(r.Context())
+	if err != nil {
+		log.Println("ClientOrigin wrongly configured:", err)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns: []string{origin},
+		OriginPatterns: originPatterns,
 	})
 	if err != nil {
 		log.Println("Error accepting websocket:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	defer c.Close(websocket.StatusInternalError, "the sky is falling")
@@ -104,22 +369,107 @@ func (server *Server) SignHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
 	defer cancel()
 
+	signingDone := make(chan struct{})
 	errs := make(chan error, 2)
 
-	go tss.Send(signer, ctx, errs, c)
-	go tss.Receive(signer, ctx, errs, c)
+	// Wait for all signing devices
+	if join {
+		err = session.join(ctx, sessionPeer{peerID: clientPeerID, userAgent: r.UserAgent()})
+	} else {
+		_, err = session.waitJoiners(ctx, clientPeerID)
+		if err == nil {
+			session.start(signer, signers)
+		}
+	}
+	if err == nil {
+		err = session.waitReady(ctx)
+	}
+	if err != nil {
+		log.Println("Error while waiting for signing devices:", err)
+		if !join {
+			session.finish("", err) // a joiner failing only ends its own connection, the leader fails the session if needs be
+		}
+		c.Close(websocket.StatusInternalError, "signing process failed")
+		return
+	}
+
+	// Share signing devices with the device
+	payload, err := ws.EncodePeers(ws.Peers{Threshold: session.threshold, Scheme: session.scheme, PeerIDs: session.peerIDs})
+	if err != nil {
+		log.Println("Error encoding peers:", err)
+		c.Close(websocket.StatusInternalError, "signing process failed")
+		return
+	}
 
-	// Start signing process
-	_, err = signer.Process()
+	err = wsjson.Write(ctx, c, ws.Message{Type: ws.PeersMessage, Msg: payload})
+	if err != nil {
+		log.Println("error writing json through websocket:", err)
+		return
+	}
+
+	go func() {
+		for {
+			var msg ws.Message
+			err := wsjson.Read(ctx, c, &msg)
+			if err != nil {
+				if ctx.Err() == context.Canceled || websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+					return
+				}
+
+				log.Println("error reading message from websocket:", err)
+				errs <- err
+				return
+			}
+
+			if msg.Type != ws.TssMessage {
+				log.Println("SignHandler - Unexpected message type:", msg.Type)
+				continue
+			}
+
+			tssMsg, err := ws.DecodeTssMessage(msg.Msg)
+			if err != nil {
+				log.Println("could not decode tss msg:", err)
+				errs <- err
+				return
+			}
+
+			// Handle tss message (NOTE : will automatically, in ServerSigner.HandleMessage, redirect to other client if needs be)
+			err = session.actor.HandleMessage(clientPeerID, tssMsg)
+			if err != nil {
+				log.Println("could not handle tss msg:", err)
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	go ws.TssSend(func() (tss.Message, error) { return session.actor.GetNextMessageToSend(clientPeerID) }, signingDone, errs, ctx, c, "SignHandler")
+
+	if join {
+		// Wait for the signing process run by the leading device
+		_, err = session.wait(ctx)
+	} else {
+		// Start signing process
+		_, err = signer.Process()
+		session.finish("", err)
+		signed = err == nil
+	}
 	if err != nil {
 		log.Println("Error launching signer.Process:", err)
 		c.Close(websocket.StatusInternalError, "signing process failed")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	// Keep track of the device which signed (each device of a multi-device signing records itself)
+	err = server._vault.RecordSignature(r.Context(), userId, clientPeerID, message)
+	if err != nil {
+		log.Println("Error recording signature:", err) // the signature exists anyway, do not fail
+	}
+
 	time.Sleep(time.Second) // let the signing process finish cleanly on client side
 
+	close(signingDone)
+
 	c.Close(websocket.StatusNormalClosure, "signing process finished successfully")
 
 	// Delete token from cache to avoid re-use
@@ -127,3 +477,19 @@ func (server *Server) SignHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Note: no need to return the signature as the client will have it as well
 }
+
+// isRegisteredDevice verifies that the device is registered for the user, and replies with an error if not
+func (server *Server) isRegisteredDevice(w http.ResponseWriter, r *http.Request, userId string, peerID string) bool {
+	err := server._vault.DeviceExists(r.Context(), userId, peerID)
+	if err != nil {
+		if errors.Is(err, &types.ErrNotFound{}) {
+			log.Println("Device not registered:", peerID)
+			httpError(w, r, "Device not registered", http.StatusForbidden)
+		} else {
+			log.Println("Error verifying device:", err)
+			httpError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,279 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+/////////
+//
+// Every vault backend stores the dkg results of the server encrypted with a client key (the metadata of the client), so that server shares are not fully exposed in case of a breach.
+// If a KeyManager is configured, they are also encrypted with a server-side key: a DB dump and a stolen metadata are not enough to recover the server share.
+//
+/////////
+
+// newClientKey generates the client key of a new wallet (returned to the client as metadata)
+func newClientKey() ([]byte, error) {
+	return generateRandomBytes(32)
+}
+
+// clientKeyFromContext returns the client key provided by the client as metadata
+func clientKeyFromContext(ctx context.Context) ([]byte, error) {
+	clientKeyStr, ok := ctx.Value(types.ContextKey("metadata")).(string)
+	if !ok {
+		return nil, errors.New("could not find customer identifier")
+	}
+
+	clientKey, err := hex.DecodeString(clientKeyStr)
+	if err != nil {
+		log.Println("error hex decoding clientKey(", clientKeyStr, "):", err)
+		return nil, err
+	}
+
+	return clientKey, nil
+}
+
+// keyEncryption adds the envelope encryption of the dkg results to a vault backend, if a KeyManager is configured
+// The dkg result encrypted with the client key is encrypted again with a random data key, itself wrapped by the key manager (see keymanager.go)
+// Without key manager, dkg results are only encrypted with the client key. Dkg results stored before a key manager was configured can still be read.
+type keyEncryption struct {
+	_keyManager KeyManager
+}
+
+// UpdateKeyManager changes the key manager used to encrypt dkg results from now on (nil to disable envelope encryption)
+func (k *keyEncryption) UpdateKeyManager(keyManager KeyManager) {
+	k._keyManager = keyManager
+}
+
+// envelopePrefix marks dkg results stored with envelope encryption
+var envelopePrefix = []byte("meemaw-envelope-v1:")
+
+// envelope is the stored form of a dkg result with envelope encryption
+type envelope struct {
+	KeyID      string // key of the key manager which wrapped the data key
+	WrappedKey []byte // data key, wrapped by the key manager
+	Nonce      []byte
+	Ciphertext []byte // dkg result encrypted with the client key, then with the data key
+}
+
+// encryptDkgResult encodes the dkg result to json and encrypts it with the client key (and the key manager, if any), returning the nonce and the ciphertext
+func (k *keyEncryption) encryptDkgResult(ctx context.Context, dkgResult *tss.DkgResult, clientKey []byte) ([]byte, []byte, error) {
+	jsonDkgResult, err := json.Marshal(dkgResult)
+	if err != nil {
+		log.Println("could not marshal dkgResults to json")
+		return nil, nil, err
+	}
+
+	nonce, encryptedDkgResult, err := encryptAES(jsonDkgResult, clientKey)
+	if err != nil {
+		log.Println("error while encrypting with client key:", err)
+		return nil, nil, err
+	}
+
+	if k._keyManager == nil {
+		return nonce, encryptedDkgResult, nil
+	}
+
+	sealedDkgResult, err := sealEnvelope(ctx, k._keyManager, encryptedDkgResult)
+	if err != nil {
+		log.Println("error while encrypting with key manager:", err)
+		return nil, nil, err
+	}
+
+	return nonce, sealedDkgResult, nil
+}
+
+// decryptDkgResult decrypts the dkg result with the key manager (if it was stored with envelope encryption) and the client key, then decodes it
+// scheme is the scheme stored in clear alongside the encrypted dkg result (if any), it must match the decrypted dkg result
+func (k *keyEncryption) decryptDkgResult(ctx context.Context, nonce, encryptedDkgResult, clientKey []byte, scheme string) (*tss.DkgResult, error) {
+	if bytes.HasPrefix(encryptedDkgResult, envelopePrefix) {
+		if k._keyManager == nil {
+			log.Println("dkg result stored with envelope encryption but no key manager configured")
+			return nil, ErrNoKeyManager
+		}
+
+		var err error
+		encryptedDkgResult, err = openEnvelope(ctx, k._keyManager, encryptedDkgResult)
+		if err != nil {
+			log.Println("could not decrypt with key manager:", err)
+			return nil, err
+		}
+	}
+
+	jsonDkgResults, err := decryptAES(nonce, encryptedDkgResult, clientKey)
+	if err != nil {
+		log.Println("could not decrypt AES using clientKey:", err)
+		return nil, err
+	}
+
+	dkgResult := &tss.DkgResult{}
+	err = json.Unmarshal(jsonDkgResults, dkgResult)
+	if err != nil {
+		log.Println("could not unmarshal jsonDkgResults")
+		return nil, err
+	}
+
+	if scheme != "" && scheme != string(dkgResult.GetScheme()) {
+		log.Println("scheme of stored wallet does not match its dkg results:", scheme)
+		return nil, errors.New("wallet scheme mismatch")
+	}
+
+	return dkgResult, nil
+}
+
+// sealClientKey seals the client key of a wallet for each of the given devices with its public share, as stored metadata deliveries (by peerID)
+// Only the device holding the share can open it (tss.DkgResult.OpenSealed): neither a previous client key nor the database give it to anyone else
+func sealClientKey(dkgResult *tss.DkgResult, clientKey []byte, peerIDs []string) ([]byte, error) {
+	sealed := make(map[string][]byte, len(peerIDs))
+	for _, peerID := range peerIDs {
+		publicShare, ok := dkgResult.PublicShares[peerID]
+		if !ok {
+			log.Println("no public share to seal the client key for:", peerID)
+			return nil, &types.ErrRefreshRequired{}
+		}
+
+		sealedClientKey, err := tss.SealForPeer(dkgResult.GetScheme(), publicShare, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		sealed[peerID] = sealedClientKey
+	}
+
+	return json.Marshal(sealed)
+}
+
+// sealedClientKeyOf returns the client key sealed for the device in the stored metadata deliveries, nil if there is none
+func sealedClientKeyOf(sealedMetadata []byte, peerID string) ([]byte, error) {
+	if len(sealedMetadata) == 0 {
+		return nil, nil
+	}
+
+	var sealed map[string][]byte
+	err := json.Unmarshal(sealedMetadata, &sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealed[peerID], nil
+}
+
+// otherPeerIDs returns the client peers of the wallet, except the given one
+func otherPeerIDs(dkgResult *tss.DkgResult, peerID string) []string {
+	var peerIDs []string
+	for _, id := range dkgResult.GetClientPeerIDs() {
+		if id != peerID {
+			peerIDs = append(peerIDs, id)
+		}
+	}
+	return peerIDs
+}
+
+// sealEnvelope encrypts plaintext with a new data key, wrapped by the key manager
+func sealEnvelope(ctx context.Context, keyManager KeyManager, plaintext []byte) ([]byte, error) {
+	dataKey, err := generateRandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext, err := encryptAES(plaintext, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrappedKey, err := keyManager.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := json.Marshal(envelope{
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, envelopePrefix...), sealed...), nil
+}
+
+// openEnvelope unwraps the data key with the key manager and decrypts the sealed plaintext
+func openEnvelope(ctx context.Context, keyManager KeyManager, sealed []byte) ([]byte, error) {
+	var env envelope
+	err := json.Unmarshal(bytes.TrimPrefix(sealed, envelopePrefix), &env)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := keyManager.UnwrapKey(ctx, env.KeyID, env.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptAES(env.Nonce, env.Ciphertext, dataKey)
+}
+
+// Encrypt a plaintext message using AES-GCM.
+func encryptAES(plaintext, key []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Generate a random nonce. Ensure it is unique for each encryption with the same key.
+	nonce, err := generateRandomBytes(aesGCM.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Encrypt the plaintext using the nonce.
+	ciphertext := aesGCM.Seal(nil, nonce, plaintext, nil)
+	return nonce, ciphertext, nil
+}
+
+// Decrypt a ciphertext message using AES-GCM.
+func decryptAES(nonce, ciphertext, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt the ciphertext using the nonce.
+	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// Generate random bytes using crypto/rand, which is secure for cryptographic purposes.
+func generateRandomBytes(size int) ([]byte, error) {
+	bytes := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, bytes); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
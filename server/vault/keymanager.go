@@ -0,0 +1,168 @@
+package vault
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrNoKeyManager = errors.New("no key manager configured")
+var ErrUnknownKey = errors.New("unknown key encryption key")
+var ErrKeyFileNotFound = errors.New("key file not found, create it with: meemaw keygen")
+
+// KeyManager holds the key encryption key(s) of the server, used to wrap the data keys encrypting the dkg results in the vault (envelope encryption)
+// The key encryption key should never be stored alongside the DB
+type KeyManager interface {
+	// WrapKey encrypts a data key with the current key encryption key, returning the ID of that key and the wrapped data key
+	WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error)
+	// UnwrapKey decrypts a data key wrapped by the key encryption key keyID
+	UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+///////
+/// FILE
+///////
+
+// FileKeyManager is a KeyManager based on a local key file, holding hex encoded 32 bytes keys, one per line
+// The first key is the current one, used to wrap new data keys. The following ones are previous keys, kept to unwrap data keys wrapped before a rotation.
+type FileKeyManager struct {
+	_currentKeyID string
+	_keys         map[string][]byte // by key ID
+}
+
+// NewFileKeyManager loads the keys of the key file at path, which needs to exist (see CreateKeyFile)
+// A missing key file is an error rather than a new key: wallets encrypted with the lost key would silently become unreadable
+func NewFileKeyManager(path string) (*FileKeyManager, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyFileNotFound, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keyManager := &FileKeyManager{_keys: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("key file should contain hex encoded 32 bytes keys")
+		}
+
+		keyID := fileKeyID(key)
+		if len(keyManager._currentKeyID) == 0 {
+			keyManager._currentKeyID = keyID
+		}
+		keyManager._keys[keyID] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keyManager._currentKeyID) == 0 {
+		return nil, errors.New("no key in key file")
+	}
+
+	return keyManager, nil
+}
+
+// WrapKey encrypts a data key with the current key of the key file
+func (keyManager *FileKeyManager) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	nonce, wrappedKey, err := encryptAES(dataKey, keyManager._keys[keyManager._currentKeyID])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyManager._currentKeyID, append(nonce, wrappedKey...), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by any key of the key file
+func (keyManager *FileKeyManager) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	key, ok := keyManager._keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if len(wrappedKey) < 12 {
+		return nil, errors.New("wrapped key too short")
+	}
+
+	return decryptAES(wrappedKey[:12], wrappedKey[12:], key) // AES-GCM standard nonce size
+}
+
+// CreateKeyFile writes a new key in a new key file only readable by the current user, it fails if the file already exists
+func CreateKeyFile(path string) error {
+	key, err := generateRandomBytes(32)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(hex.EncodeToString(key) + "\n")
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// fileKeyID identifies a key without revealing it
+func fileKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return "file:" + hex.EncodeToString(hash[:8])
+}
+
+///////
+/// KMS
+///////
+
+// KMS is the subset of a KMS or HSM API required by KMSKeyManager: encryption and decryption with a key that never leaves the KMS
+// e.g. Encrypt/Decrypt of AWS or GCP KMS, or C_Encrypt/C_Decrypt of a PKCS#11 token, behind a thin wrapper
+type KMS interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// KMSKeyManager is a KeyManager delegating the wrapping of data keys to a KMS or HSM
+type KMSKeyManager struct {
+	_kms   KMS
+	_keyID string
+}
+
+// NewKMSKeyManager creates a key manager wrapping data keys with the key keyID of the KMS
+// Data keys wrapped by other keys of the KMS (e.g. before a rotation) can still be unwrapped, as long as the KMS still holds them
+func NewKMSKeyManager(kms KMS, keyID string) *KMSKeyManager {
+	return &KMSKeyManager{_kms: kms, _keyID: keyID}
+}
+
+// WrapKey encrypts a data key in the KMS
+func (keyManager *KMSKeyManager) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrappedKey, err := keyManager._kms.Encrypt(ctx, keyManager._keyID, dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyManager._keyID, wrappedKey, nil
+}
+
+// UnwrapKey decrypts a data key in the KMS
+func (keyManager *KMSKeyManager) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	return keyManager._kms.Decrypt(ctx, keyID, wrappedKey)
+}
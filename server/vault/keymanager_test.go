@@ -0,0 +1,314 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/vault/vaulttest"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+func TestFileKeyManager(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "meemaw.key")
+
+	// a missing key file is not created silently
+	_, err := NewFileKeyManager(path)
+	if !errors.Is(err, ErrKeyFileNotFound) {
+		t.Fatalf("expected ErrKeyFileNotFound, got %v", err)
+	}
+
+	err = CreateKeyFile(path)
+	if err != nil {
+		t.Fatalf("could not create key file: %s", err)
+	}
+
+	err = CreateKeyFile(path)
+	if err == nil {
+		t.Errorf("expected error when creating a key file over an existing one")
+	}
+
+	keyManager, err := NewFileKeyManager(path)
+	if err != nil {
+		t.Fatalf("could not load key file: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("key file not created: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected key file to be only readable by owner, got %s", info.Mode().Perm())
+	}
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	keyID, wrappedKey, err := keyManager.WrapKey(ctx, dataKey)
+	if err != nil {
+		t.Fatalf("could not wrap key: %s", err)
+	}
+
+	if bytes.Contains(wrappedKey, dataKey) {
+		t.Errorf("wrapped key contains the data key")
+	}
+
+	// the same key file can be loaded again
+	keyManager, err = NewFileKeyManager(path)
+	if err != nil {
+		t.Fatalf("could not load key file: %s", err)
+	}
+
+	unwrappedKey, err := keyManager.UnwrapKey(ctx, keyID, wrappedKey)
+	if err != nil || !bytes.Equal(unwrappedKey, dataKey) {
+		t.Errorf("expected data key to be unwrapped, got %x (%v)", unwrappedKey, err)
+	}
+
+	_, err = keyManager.UnwrapKey(ctx, "file:unknown", wrappedKey)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+
+	// rotation: new key first, previous key kept to unwrap existing data keys
+	previousKey, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read key file: %s", err)
+	}
+
+	newKey, err := generateRandomBytes(32)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	err = os.WriteFile(path, append([]byte("# current key first\n"+hex.EncodeToString(newKey)+"\n"), previousKey...), 0600)
+	if err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+
+	keyManager, err = NewFileKeyManager(path)
+	if err != nil {
+		t.Fatalf("could not load rotated key file: %s", err)
+	}
+
+	newKeyID, _, err := keyManager.WrapKey(ctx, dataKey)
+	if err != nil || newKeyID == keyID {
+		t.Errorf("expected new key to be used after rotation, got %s (%v)", newKeyID, err)
+	}
+
+	unwrappedKey, err = keyManager.UnwrapKey(ctx, keyID, wrappedKey)
+	if err != nil || !bytes.Equal(unwrappedKey, dataKey) {
+		t.Errorf("expected data key wrapped before rotation to be unwrapped, got %x (%v)", unwrappedKey, err)
+	}
+
+	// malformed key file
+	badPath := filepath.Join(t.TempDir(), "bad.key")
+	err = os.WriteFile(badPath, []byte("not a key\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+
+	_, err = NewFileKeyManager(badPath)
+	if err == nil {
+		t.Errorf("expected error with malformed key file")
+	}
+}
+
+func TestKMSKeyManager(t *testing.T) {
+	ctx := context.Background()
+	kms := newLocalKMS(t, "key-1", "key-2")
+
+	keyManager := NewKMSKeyManager(kms, "key-1")
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	keyID, wrappedKey, err := keyManager.WrapKey(ctx, dataKey)
+	if err != nil || keyID != "key-1" {
+		t.Fatalf("could not wrap key: %s (%v)", keyID, err)
+	}
+
+	// after a rotation in the KMS, data keys wrapped by the previous key can still be unwrapped
+	keyManager = NewKMSKeyManager(kms, "key-2")
+
+	unwrappedKey, err := keyManager.UnwrapKey(ctx, keyID, wrappedKey)
+	if err != nil || !bytes.Equal(unwrappedKey, dataKey) {
+		t.Errorf("expected data key to be unwrapped, got %x (%v)", unwrappedKey, err)
+	}
+
+	_, err = keyManager.UnwrapKey(ctx, "key-2", wrappedKey)
+	if err == nil {
+		t.Errorf("expected error when unwrapping with another key")
+	}
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	keyManager, err := newTestFileKeyManager(t, "meemaw.key")
+	if err != nil {
+		t.Fatalf("could not create key file: %s", err)
+	}
+
+	dkgResult := &tss.DkgResult{Share: "123456789", Address: "0x5749A8Ed0C00C963c7b19ea05A51131077305c8A", PeerID: "server"}
+
+	vault := NewMemoryVault()
+	vault.UpdateKeyManager(keyManager)
+
+	metadata, err := vault.StoreWallet(ctx, "envelope-user", "client", "userAgent", dkgResult)
+	if err != nil {
+		t.Fatalf("could not store wallet: %s", err)
+	}
+
+	ctx = context.WithValue(ctx, types.ContextKey("metadata"), metadata)
+
+	// a DB dump and the metadata are not enough to recover the share
+	clientKey, _ := hex.DecodeString(metadata)
+	stored := vault.wallets["envelope-user"]
+	if bytes.Contains(stored.encryptedDkgResult, []byte(dkgResult.Share)) {
+		t.Errorf("share stored in clear")
+	}
+
+	_, err = decryptAES(stored.nonce, stored.encryptedDkgResult, clientKey)
+	if err == nil {
+		t.Errorf("expected dkg result not to be decrypted with the client key only")
+	}
+
+	withoutKeyManager := &keyEncryption{}
+	_, err = withoutKeyManager.decryptDkgResult(ctx, stored.nonce, stored.encryptedDkgResult, clientKey, "")
+	if !errors.Is(err, ErrNoKeyManager) {
+		t.Errorf("expected ErrNoKeyManager, got %v", err)
+	}
+
+	otherKeyManager, err := newTestFileKeyManager(t, "other.key")
+	if err != nil {
+		t.Fatalf("could not create key file: %s", err)
+	}
+
+	withOtherKeyManager := &keyEncryption{_keyManager: otherKeyManager}
+	_, err = withOtherKeyManager.decryptDkgResult(ctx, stored.nonce, stored.encryptedDkgResult, clientKey, "")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+
+	retrieved, err := vault.RetrieveWallet(ctx, "envelope-user")
+	if err != nil || retrieved.Share != dkgResult.Share {
+		t.Errorf("expected dkg result to be retrieved, got %+v (%v)", retrieved, err)
+	}
+
+	// dkg results stored before a key manager was configured can still be read, and get envelope encryption on the next write
+	legacyVault := NewMemoryVault()
+
+	metadata, err = legacyVault.StoreWallet(context.Background(), "legacy-user", "client", "userAgent", dkgResult)
+	if err != nil {
+		t.Fatalf("could not store wallet: %s", err)
+	}
+
+	ctx = context.WithValue(context.Background(), types.ContextKey("metadata"), metadata)
+
+	legacyVault.UpdateKeyManager(keyManager)
+
+	retrieved, err = legacyVault.RetrieveWallet(ctx, "legacy-user")
+	if err != nil || retrieved.Share != dkgResult.Share {
+		t.Fatalf("expected legacy dkg result to be retrieved, got %+v (%v)", retrieved, err)
+	}
+
+	err = legacyVault.UpdateWallet(ctx, "legacy-user", retrieved)
+	if err != nil {
+		t.Fatalf("could not update wallet: %s", err)
+	}
+
+	if !bytes.HasPrefix(legacyVault.wallets["legacy-user"].encryptedDkgResult, envelopePrefix) {
+		t.Errorf("expected dkg result to be stored with envelope encryption after update")
+	}
+}
+
+func TestKeyManagerConformance(t *testing.T) {
+	keyManager, err := newTestFileKeyManager(t, "meemaw.key")
+	if err != nil {
+		t.Fatalf("could not create key file: %s", err)
+	}
+
+	t.Run("MemoryFileKeyManager", func(t *testing.T) {
+		vaulttest.Run(t, func() server.Vault {
+			vault := NewMemoryVault()
+			vault.UpdateKeyManager(keyManager)
+			return vault
+		})
+	})
+
+	t.Run("SQLiteKMSKeyManager", func(t *testing.T) {
+		kms := newLocalKMS(t, "key-1")
+		vaulttest.Run(t, func() server.Vault {
+			vault, err := OpenSQLiteVault(":memory:")
+			if err != nil {
+				t.Fatalf("could not open sqlite vault: %s", err)
+			}
+			t.Cleanup(func() { vault.Close() })
+			vault.UpdateKeyManager(NewKMSKeyManager(kms, "key-1"))
+			return vault
+		})
+	})
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+// localKMS is a local stand-in for a KMS or HSM, keys never leave it
+type localKMS struct {
+	keys map[string][]byte
+}
+
+func newLocalKMS(t *testing.T, keyIDs ...string) *localKMS {
+	kms := &localKMS{keys: make(map[string][]byte)}
+	for _, keyID := range keyIDs {
+		key, err := generateRandomBytes(32)
+		if err != nil {
+			t.Fatalf("could not generate kms key: %s", err)
+		}
+		kms.keys[keyID] = key
+	}
+	return kms
+}
+
+func (kms *localKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	key, ok := kms.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	nonce, ciphertext, err := encryptAES(plaintext, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, ciphertext...), nil
+}
+
+func (kms *localKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	key, ok := kms.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if len(ciphertext) < 12 {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return decryptAES(ciphertext[:12], ciphertext[12:], key)
+}
+
+// newTestFileKeyManager creates a key file with a new key and loads it
+func newTestFileKeyManager(t *testing.T, name string) (*FileKeyManager, error) {
+	path := filepath.Join(t.TempDir(), name)
+
+	err := CreateKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFileKeyManager(path)
+}
@@ -0,0 +1,335 @@
+package vault
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+)
+
+// MemoryVault is a vault keeping everything in memory, useful for local development and tests
+// Everything is lost when the server stops
+type MemoryVault struct {
+	keyEncryption
+	mu      sync.RWMutex
+	wallets map[string]*memoryWallet // by foreign key
+}
+
+type memoryWallet struct {
+	address            string
+	scheme             string
+	nonce              []byte
+	encryptedDkgResult []byte
+	devices            map[string]string // user agent by peerID
+	signatures         []memorySignature
+	sealedMetadata     []byte // client key rotated by a device, sealed for each of the other devices (see sealClientKey)
+}
+
+type memorySignature struct {
+	peerID    string
+	message   []byte
+	createdAt time.Time
+}
+
+func NewMemoryVault() *MemoryVault {
+	return &MemoryVault{wallets: make(map[string]*memoryWallet)}
+}
+
+// WalletExists verifies if a wallet already exists (types.ErrNotFound if not)
+func (vault *MemoryVault) WalletExists(ctx context.Context, foreignKey string) error {
+	vault.mu.RLock()
+	defer vault.mu.RUnlock()
+
+	if _, ok := vault.wallets[foreignKey]; !ok {
+		return &types.ErrNotFound{}
+	}
+
+	return nil
+}
+
+// WalletScheme returns the scheme of the wallet of the user (types.ErrNotFound if there is none), without decrypting it
+func (vault *MemoryVault) WalletScheme(ctx context.Context, foreignKey string) (tss.Scheme, error) {
+	vault.mu.RLock()
+	defer vault.mu.RUnlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		return "", &types.ErrNotFound{}
+	}
+
+	return tss.ParseScheme(wallet.scheme)
+}
+
+// DeviceExists verifies if a device is registered for the user
+func (vault *MemoryVault) DeviceExists(ctx context.Context, foreignKey string, peerID string) error {
+	vault.mu.RLock()
+	defer vault.mu.RUnlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		return &types.ErrNotFound{}
+	}
+
+	if _, ok := wallet.devices[peerID]; !ok {
+		return &types.ErrNotFound{}
+	}
+
+	return nil
+}
+
+// RecordSignature keeps track of the device which took part in the signing of a message
+func (vault *MemoryVault) RecordSignature(ctx context.Context, foreignKey string, peerID string, message []byte) error {
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		return &types.ErrNotFound{}
+	}
+
+	if _, ok := wallet.devices[peerID]; !ok {
+		return &types.ErrNotFound{}
+	}
+
+	wallet.signatures = append(wallet.signatures, memorySignature{
+		peerID:    peerID,
+		message:   append([]byte(nil), message...),
+		createdAt: time.Now(),
+	})
+
+	return nil
+}
+
+///////
+
+// StoreWallet inserts a wallet (if it already exists, it does nothing, no error returned)
+func (vault *MemoryVault) StoreWallet(ctx context.Context, foreignKey string, peerID string, userAgent string, dkgResult *tss.DkgResult) (string, error) {
+
+	// Generate client key :
+	clientKey, err := newClientKey() // return to client
+	if err != nil {
+		return "", err
+	}
+
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, dkgResult, clientKey)
+	if err != nil {
+		return "", err
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	if _, ok := vault.wallets[foreignKey]; ok {
+		log.Println("wallet already exists for that user, not stored")
+		return hex.EncodeToString(clientKey), nil
+	}
+
+	vault.wallets[foreignKey] = &memoryWallet{
+		address:            dkgResult.Address,
+		scheme:             string(dkgResult.GetScheme()),
+		nonce:              nonceClient,
+		encryptedDkgResult: ClientEncryptedDkgResult,
+		devices:            map[string]string{peerID: userAgent},
+	}
+
+	return hex.EncodeToString(clientKey), nil
+}
+
+// AddPeer adds a device, including updating the BKs
+// Requires the metadata in the context
+func (vault *MemoryVault) AddPeer(ctx context.Context, foreignKey string, peerID string, userAgent string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
+	if err != nil {
+		return err
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		log.Println("no wallet to add device to")
+		return &types.ErrNotFound{}
+	}
+
+	wallet.nonce = nonceClient
+	wallet.encryptedDkgResult = ClientEncryptedDkgResult
+	wallet.devices[peerID] = userAgent
+
+	return nil
+}
+
+// RemovePeer deletes a device, including updating the BKs
+// Requires the metadata in the context
+func (vault *MemoryVault) RemovePeer(ctx context.Context, foreignKey string, peerID string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
+	if err != nil {
+		return err
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		log.Println("no device to remove:", peerID)
+		return &types.ErrNotFound{}
+	}
+
+	if _, ok := wallet.devices[peerID]; !ok {
+		log.Println("no device to remove:", peerID)
+		return &types.ErrNotFound{}
+	}
+
+	delete(wallet.devices, peerID)
+	wallet.nonce = nonceClient
+	wallet.encryptedDkgResult = ClientEncryptedDkgResult
+
+	return nil
+}
+
+// UpdateWallet replaces the dkg result of an existing wallet (e.g. after a refresh of the shares)
+// The wallet is identified by its address, which cannot change
+// Requires the metadata in the context
+func (vault *MemoryVault) UpdateWallet(ctx context.Context, foreignKey string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
+	if err != nil {
+		return err
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok || wallet.address != updatedDkgResult.Address {
+		log.Println("no wallet to update for that address:", updatedDkgResult.Address)
+		return &types.ErrNotFound{}
+	}
+
+	// The shares changed: a rotated client key not claimed yet needs to be sealed for the new ones
+	var sealedMetadata []byte
+	if len(wallet.sealedMetadata) > 0 {
+		sealedMetadata, err = sealClientKey(updatedDkgResult, clientKey, updatedDkgResult.GetClientPeerIDs())
+		if err != nil {
+			return err
+		}
+	}
+
+	wallet.nonce = nonceClient
+	wallet.encryptedDkgResult = ClientEncryptedDkgResult
+	wallet.sealedMetadata = sealedMetadata
+
+	return nil
+}
+
+// RotateMetadata re-encrypts the wallet with a new client key, returned as the new metadata of the wallet
+// The previous client key (i.e. the current metadata) is required in the context
+// The other devices of the wallet get the new client key with ClaimMetadata, sealed with their public share
+func (vault *MemoryVault) RotateMetadata(ctx context.Context, foreignKey string, peerID string) (string, error) {
+	previousClientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		log.Println("error getting signing params: no wallet for that user")
+		return "", &types.ErrNotFound{}
+	}
+
+	dkgResult, err := vault.decryptDkgResult(ctx, wallet.nonce, wallet.encryptedDkgResult, previousClientKey, wallet.scheme)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate new client key :
+	clientKey, err := newClientKey() // return to client
+	if err != nil {
+		return "", err
+	}
+
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, dkgResult, clientKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Other devices get the new client key on their next call (ClaimMetadata)
+	sealedMetadata, err := sealClientKey(dkgResult, clientKey, otherPeerIDs(dkgResult, peerID))
+	if err != nil {
+		return "", err
+	}
+
+	wallet.nonce = nonceClient
+	wallet.encryptedDkgResult = ClientEncryptedDkgResult
+	wallet.sealedMetadata = sealedMetadata
+
+	return hex.EncodeToString(clientKey), nil
+}
+
+// ClaimMetadata returns the latest client key of the wallet sealed for the device (hex), if it was rotated by another device ("" if it was not)
+// Only the device can open it, with its share: it is not removed once claimed, a device can claim it again until the next rotation
+func (vault *MemoryVault) ClaimMetadata(ctx context.Context, foreignKey string, peerID string) (string, error) {
+	vault.mu.RLock()
+	defer vault.mu.RUnlock()
+
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		log.Println("error getting signing params: no wallet for that user")
+		return "", &types.ErrNotFound{}
+	}
+
+	if _, ok := wallet.devices[peerID]; !ok {
+		return "", &types.ErrNotFound{}
+	}
+
+	sealedClientKey, err := sealedClientKeyOf(wallet.sealedMetadata, peerID)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sealedClientKey), nil
+}
+
+// RetrieveWallet retrieves the wallet of the user (foreignKey is a loose foreign key, the format will depend on the auth provider)
+// Requires the metadata in the context
+func (vault *MemoryVault) RetrieveWallet(ctx context.Context, foreignKey string) (*tss.DkgResult, error) {
+	vault.mu.RLock()
+	wallet, ok := vault.wallets[foreignKey]
+	if !ok {
+		vault.mu.RUnlock()
+		log.Println("error getting signing params: no wallet for that user")
+		return nil, &types.ErrNotFound{}
+	}
+	nonce, encryptedDkgResult, scheme := wallet.nonce, wallet.encryptedDkgResult, wallet.scheme
+	vault.mu.RUnlock()
+
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return vault.decryptDkgResult(ctx, nonce, encryptedDkgResult, clientKey, scheme)
+}
@@ -0,0 +1,15 @@
+package vault_test
+
+import (
+	"testing"
+
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/server/vault/vaulttest"
+)
+
+func TestMemoryVault(t *testing.T) {
+	vaulttest.Run(t, func() server.Vault {
+		return vault.NewMemoryVault()
+	})
+}
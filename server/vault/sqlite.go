@@ -0,0 +1,493 @@
+package vault
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+
+	_ "modernc.org/sqlite"
+
+	_ "embed"
+)
+
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// SQLiteVault is a vault embedded in the server, based on SQLite, useful for small deployments
+type SQLiteVault struct {
+	keyEncryption
+	_db *sql.DB
+}
+
+// OpenSQLiteVault opens (or creates) the SQLite database at path (":memory:" for a throw away database) and loads the schema
+func OpenSQLiteVault(path string) (*SQLiteVault, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only has one writer anyway, and each connection to ":memory:" would be a different database
+	db.SetMaxOpenConns(1)
+
+	vault, err := NewSQLiteVault(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return vault, nil
+}
+
+// NewSQLiteVault creates a vault based on an opened SQLite database, loading the schema if required
+func NewSQLiteVault(db *sql.DB) (*SQLiteVault, error) {
+	_, err := db.Exec(sqliteSchema)
+	if err != nil {
+		log.Println("could not load sqlite schema:", err)
+		return nil, err
+	}
+
+	return &SQLiteVault{_db: db}, nil
+}
+
+// Close closes the underlying database
+func (vault *SQLiteVault) Close() error {
+	return vault._db.Close()
+}
+
+// WalletExists verifies if a wallet already exists (types.ErrNotFound if not)
+func (vault *SQLiteVault) WalletExists(ctx context.Context, foreignKey string) error {
+	var userID int64
+	err := vault._db.QueryRowContext(ctx, `SELECT id FROM users WHERE foreign_key = ? LIMIT 1`, foreignKey).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// WalletScheme returns the scheme of the wallet of the user (types.ErrNotFound if there is none), without decrypting it
+func (vault *SQLiteVault) WalletScheme(ctx context.Context, foreignKey string) (tss.Scheme, error) {
+	var scheme string
+	err := vault._db.QueryRowContext(ctx, `
+		SELECT wallets.scheme
+		FROM users
+		INNER JOIN wallets ON users.id = wallets.user_id
+		WHERE users.foreign_key = ?
+		LIMIT 1`, foreignKey).Scan(&scheme)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", &types.ErrNotFound{}
+		}
+		return "", err
+	}
+
+	return tss.ParseScheme(scheme)
+}
+
+// DeviceExists verifies if a device is registered for the user
+func (vault *SQLiteVault) DeviceExists(ctx context.Context, foreignKey string, peerID string) error {
+	var deviceID int64
+	err := vault._db.QueryRowContext(ctx, `
+		SELECT devices.id
+		FROM devices
+		INNER JOIN users ON devices.user_id = users.id
+		WHERE users.foreign_key = ? AND devices.peer_id = ?
+		LIMIT 1`, foreignKey, peerID).Scan(&deviceID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// RecordSignature keeps track of the device which took part in the signing of a message
+func (vault *SQLiteVault) RecordSignature(ctx context.Context, foreignKey string, peerID string, message []byte) error {
+	res, err := vault._db.ExecContext(ctx, `
+		INSERT INTO signatures (user_id, wallet_id, peer_id, message)
+		SELECT devices.user_id, devices.wallet_id, devices.peer_id, ?
+		FROM devices
+		INNER JOIN users ON devices.user_id = users.id
+		WHERE users.foreign_key = ? AND devices.peer_id = ?
+		LIMIT 1`, message, foreignKey, peerID)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+///////
+
+// StoreWallet inserts a wallet (if it already exists, it does nothing, no error returned)
+func (vault *SQLiteVault) StoreWallet(ctx context.Context, foreignKey string, peerID string, userAgent string, dkgResult *tss.DkgResult) (string, error) {
+
+	// Generate client key :
+	clientKey, err := newClientKey() // return to client
+	if err != nil {
+		return "", err
+	}
+
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, dkgResult, clientKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Store in DB, user, wallet and device at once
+	tx, err := vault._db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO users (foreign_key) VALUES (?) ON CONFLICT DO NOTHING`, foreignKey)
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		log.Println("wallet already exists for that user, not stored")
+		return hex.EncodeToString(clientKey), nil
+	}
+
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	res, err = tx.ExecContext(ctx, `
+		INSERT INTO wallets (user_id, public_address, encrypted_dkg_results, nonce, scheme)
+		VALUES (?, ?, ?, ?, ?)`, userID, dkgResult.Address, ClientEncryptedDkgResult, nonceClient, string(dkgResult.GetScheme()))
+	if err != nil {
+		return "", err
+	}
+
+	walletID, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO devices (user_id, wallet_id, user_agent, peer_id)
+		VALUES (?, ?, ?, ?)`, userID, walletID, userAgent, peerID)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(clientKey), nil
+}
+
+// AddPeer adds a device in DB, including updating the BKs, in a single transaction
+// Requires the metadata in the context
+func (vault *SQLiteVault) AddPeer(ctx context.Context, foreignKey string, peerID string, userAgent string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := vault._db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID, walletID int64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE wallets
+		SET encrypted_dkg_results = ?, nonce = ?
+		WHERE user_id = (SELECT id FROM users WHERE foreign_key = ?)
+		RETURNING user_id, id`, ClientEncryptedDkgResult, nonceClient, foreignKey).Scan(&userID, &walletID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("no wallet to add device to")
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO devices (user_id, wallet_id, user_agent, peer_id)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, wallet_id, peer_id) DO UPDATE SET user_agent = excluded.user_agent`, userID, walletID, userAgent, peerID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemovePeer deletes a device from DB, including updating the BKs, in a single transaction
+// Requires the metadata in the context
+func (vault *SQLiteVault) RemovePeer(ctx context.Context, foreignKey string, peerID string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := vault._db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var walletID int64
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM devices
+		WHERE user_id = (SELECT id FROM users WHERE foreign_key = ?) AND peer_id = ?
+		RETURNING wallet_id`, foreignKey, peerID).Scan(&walletID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("no device to remove:", peerID)
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE wallets
+		SET encrypted_dkg_results = ?, nonce = ?
+		WHERE id = ?`, ClientEncryptedDkgResult, nonceClient, walletID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateWallet replaces the dkg result of an existing wallet (e.g. after a refresh of the shares), in a single transaction
+// The wallet is identified by its address, which cannot change
+// Requires the metadata in the context
+func (vault *SQLiteVault) UpdateWallet(ctx context.Context, foreignKey string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := vault._db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var walletID int64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE wallets
+		SET encrypted_dkg_results = ?, nonce = ?
+		WHERE user_id = (SELECT id FROM users WHERE foreign_key = ?) AND public_address = ?
+		RETURNING id`,
+		ClientEncryptedDkgResult, nonceClient, foreignKey, updatedDkgResult.Address).Scan(&walletID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("no wallet to update for that address:", updatedDkgResult.Address)
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	// The shares changed: a rotated client key not claimed yet needs to be sealed for the new ones
+	var pending int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM metadata_deliveries WHERE wallet_id = ?`, walletID).Scan(&pending)
+	if err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		sealedMetadata, err := sealClientKey(updatedDkgResult, clientKey, updatedDkgResult.GetClientPeerIDs())
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE metadata_deliveries SET sealed_metadata = ? WHERE wallet_id = ?`, sealedMetadata, walletID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RotateMetadata re-encrypts the wallet with a new client key, returned as the new metadata of the wallet
+// The previous client key (i.e. the current metadata) is required in the context
+// The wallet is only replaced if it did not change in the meantime (types.ErrConflict otherwise), in a single transaction
+// The other devices of the wallet get the new client key with ClaimMetadata, sealed with their public share
+func (vault *SQLiteVault) RotateMetadata(ctx context.Context, foreignKey string, peerID string) (string, error) {
+	previousClientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := vault._db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// get dkgResults
+	var walletID int64
+	var nonce, encryptedDkgResult []byte
+	var scheme string
+	err = tx.QueryRowContext(ctx, `
+		SELECT wallets.id, wallets.nonce, wallets.encrypted_dkg_results, wallets.scheme
+		FROM users
+		INNER JOIN wallets ON users.id = wallets.user_id
+		WHERE users.foreign_key = ?
+		LIMIT 1`, foreignKey).Scan(&walletID, &nonce, &encryptedDkgResult, &scheme)
+	if err != nil {
+		log.Println("error getting signing params:", err)
+		return "", &types.ErrNotFound{}
+	}
+
+	dkgResult, err := vault.decryptDkgResult(ctx, nonce, encryptedDkgResult, previousClientKey, scheme)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate new client key :
+	clientKey, err := newClientKey() // return to client
+	if err != nil {
+		return "", err
+	}
+
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, dkgResult, clientKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Other devices get the new client key on their next call (ClaimMetadata)
+	sealedMetadata, err := sealClientKey(dkgResult, clientKey, otherPeerIDs(dkgResult, peerID))
+	if err != nil {
+		return "", err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE wallets
+		SET encrypted_dkg_results = ?, nonce = ?
+		WHERE id = ? AND nonce = ?`, ClientEncryptedDkgResult, nonceClient, walletID, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		log.Println("wallet changed during metadata rotation")
+		return "", &types.ErrConflict{}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO metadata_deliveries (wallet_id, sealed_metadata)
+		VALUES (?, ?)
+		ON CONFLICT (wallet_id) DO UPDATE
+		SET sealed_metadata = excluded.sealed_metadata, created_at = CURRENT_TIMESTAMP`, walletID, sealedMetadata)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(clientKey), nil
+}
+
+// ClaimMetadata returns the latest client key of the wallet sealed for the device (hex), if it was rotated by another device ("" if it was not)
+// Only the device can open it, with its share: it is not removed once claimed, a device can claim it again until the next rotation
+func (vault *SQLiteVault) ClaimMetadata(ctx context.Context, foreignKey string, peerID string) (string, error) {
+	var sealedMetadata []byte
+	err := vault._db.QueryRowContext(ctx, `
+		SELECT COALESCE(metadata_deliveries.sealed_metadata, x'')
+		FROM users
+		INNER JOIN wallets ON users.id = wallets.user_id
+		INNER JOIN devices ON wallets.id = devices.wallet_id
+		LEFT JOIN metadata_deliveries ON wallets.id = metadata_deliveries.wallet_id
+		WHERE users.foreign_key = ? AND devices.peer_id = ?
+		LIMIT 1`, foreignKey, peerID).Scan(&sealedMetadata)
+	if err != nil {
+		log.Println("error getting device wallet:", err)
+		return "", &types.ErrNotFound{}
+	}
+
+	sealedClientKey, err := sealedClientKeyOf(sealedMetadata, peerID)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sealedClientKey), nil
+}
+
+// RetrieveWallet retrieves a wallet from DB based on the userID of the user (which is a loose foreign key, the format will depend on the auth provider)
+func (vault *SQLiteVault) RetrieveWallet(ctx context.Context, foreignKey string) (*tss.DkgResult, error) {
+
+	// get dkgResults
+	var nonce, encryptedDkgResult []byte
+	var scheme string
+	err := vault._db.QueryRowContext(ctx, `
+		SELECT wallets.nonce, wallets.encrypted_dkg_results, wallets.scheme
+		FROM users
+		INNER JOIN wallets ON users.id = wallets.user_id
+		WHERE users.foreign_key = ?
+		LIMIT 1`, foreignKey).Scan(&nonce, &encryptedDkgResult, &scheme)
+	if err != nil {
+		log.Println("error getting signing params:", err)
+		return nil, &types.ErrNotFound{}
+	}
+
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypt dkg results (the scheme column is stored in clear, it must match the encrypted dkg results)
+	return vault.decryptDkgResult(ctx, nonce, encryptedDkgResult, clientKey, scheme)
+}
+
+// expectOneRow returns types.ErrNotFound if the statement did not affect any row
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return &types.ErrNotFound{}
+	}
+
+	return nil
+}
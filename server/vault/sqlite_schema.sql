@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    foreign_key TEXT NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_identifier ON users (foreign_key);
+
+CREATE TABLE IF NOT EXISTS wallets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    public_address TEXT NOT NULL DEFAULT '',
+    encrypted_dkg_results BLOB NOT NULL DEFAULT x'',
+    nonce BLOB NOT NULL DEFAULT x'',
+    scheme TEXT NOT NULL DEFAULT 'ecdsa-secp256k1'
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS wallet_identifier ON wallets (user_id, public_address);
+
+CREATE TABLE IF NOT EXISTS devices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    wallet_id INTEGER NOT NULL REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    peer_id TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS device_identifier ON devices (user_id, wallet_id, peer_id);
+
+CREATE TABLE IF NOT EXISTS signatures (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    wallet_id INTEGER NOT NULL REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    peer_id TEXT NOT NULL DEFAULT '',
+    message BLOB NOT NULL DEFAULT x'',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TABLE IF EXISTS metadata_rotations;
+
+CREATE TABLE IF NOT EXISTS metadata_deliveries (
+    wallet_id INTEGER PRIMARY KEY REFERENCES wallets(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+    sealed_metadata BLOB NOT NULL DEFAULT x'',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,43 @@
+package vault_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/server/vault/vaulttest"
+)
+
+func TestSQLiteVault(t *testing.T) {
+	vaulttest.Run(t, func() server.Vault {
+		sqliteVault, err := vault.OpenSQLiteVault(":memory:")
+		if err != nil {
+			t.Fatalf("could not open sqlite vault: %s", err)
+		}
+		t.Cleanup(func() { sqliteVault.Close() })
+		return sqliteVault
+	})
+}
+
+func TestSQLiteVaultFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meemaw.db")
+
+	// the schema is loaded only if required, the same file can be opened several times
+	for i := 0; i < 2; i++ {
+		sqliteVault, err := vault.OpenSQLiteVault(path)
+		if err != nil {
+			t.Fatalf("could not open sqlite vault (attempt %d): %s", i+1, err)
+		}
+		sqliteVault.Close()
+	}
+
+	vaulttest.Run(t, func() server.Vault {
+		sqliteVault, err := vault.OpenSQLiteVault(path)
+		if err != nil {
+			t.Fatalf("could not open sqlite vault: %s", err)
+		}
+		t.Cleanup(func() { sqliteVault.Close() })
+		return sqliteVault
+	})
+}
@@ -0,0 +1,532 @@
+// Package vaulttest is the conformance test suite of the server.Vault implementations
+// Every vault backend must pass it, see vault/memory_test.go, vault/sqlite_test.go and test/integration for postgres
+package vaulttest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+	"github.com/getamis/alice/crypto/elliptic"
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+const dkgResultStr = `{"Pubkey":{"X":"64927784304280585002232059641609611887834878205473395822489518307235035286543","Y":"25782693251874019172725009347410644829502824377621177953293307398262537993134"},"BKs":{"client":{"X":"111886675541902333686715770753860772166725964179322493963066654360904646044329","Rank":0},"server":{"X":"105724717407398644489128719447825679148844350134379485277252132502254966714726","Rank":0}},"Share":"98852749347118528790599917495626273581652498656930690683302586059893129350566","Address":"0x5749A8Ed0C00C963c7b19ea05A51131077305c8A","PeerID":"server"}`
+
+// Run runs the conformance test suite against the vault returned by newVault
+// newVault can return the same vault for every test, each test uses its own users
+func Run(t *testing.T, newVault func() server.Vault) {
+	t.Run("WalletExists", func(t *testing.T) { testWalletExists(t, newVault()) })
+	t.Run("WalletScheme", func(t *testing.T) { testWalletScheme(t, newVault()) })
+	t.Run("StoreAndRetrieveWallet", func(t *testing.T) { testStoreAndRetrieveWallet(t, newVault()) })
+	t.Run("RetrieveWalletMetadata", func(t *testing.T) { testRetrieveWalletMetadata(t, newVault()) })
+	t.Run("DeviceExists", func(t *testing.T) { testDeviceExists(t, newVault()) })
+	t.Run("AddPeer", func(t *testing.T) { testAddPeer(t, newVault()) })
+	t.Run("RemovePeer", func(t *testing.T) { testRemovePeer(t, newVault()) })
+	t.Run("UpdateWallet", func(t *testing.T) { testUpdateWallet(t, newVault()) })
+	t.Run("RecordSignature", func(t *testing.T) { testRecordSignature(t, newVault()) })
+	t.Run("RotateMetadata", func(t *testing.T) { testRotateMetadata(t, newVault()) })
+	t.Run("ClaimMetadata", func(t *testing.T) { testClaimMetadata(t, newVault()) })
+}
+
+/////////////
+/// TESTS ///
+/////////////
+
+func testWalletExists(t *testing.T, vault server.Vault) {
+	ctx := context.Background()
+	foreignKey := newForeignKey()
+
+	err := vault.WalletExists(ctx, foreignKey)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound before storing wallet, got %v", err)
+	}
+
+	storeWallet(t, vault, foreignKey, "client")
+
+	err = vault.WalletExists(ctx, foreignKey)
+	if err != nil {
+		t.Errorf("expected wallet to exist after storing it, got %v", err)
+	}
+}
+
+func testWalletScheme(t *testing.T, vault server.Vault) {
+	ctx := context.Background()
+	foreignKey := newForeignKey()
+
+	_, err := vault.WalletScheme(ctx, foreignKey)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound before storing wallet, got %v", err)
+	}
+
+	// wallets without scheme are ECDSA
+	storeWallet(t, vault, foreignKey, "client")
+
+	scheme, err := vault.WalletScheme(ctx, foreignKey)
+	if err != nil || scheme != tss.SchemeECDSA {
+		t.Errorf("expected scheme %s, got %s (err: %v)", tss.SchemeECDSA, scheme, err)
+	}
+
+	foreignKey = newForeignKey()
+	dkgResult := newDkgResult(t)
+	dkgResult.Scheme = tss.SchemeEdDSA
+	storeWallet(t, vault, foreignKey, "client", dkgResult)
+
+	scheme, err = vault.WalletScheme(ctx, foreignKey)
+	if err != nil || scheme != tss.SchemeEdDSA {
+		t.Errorf("expected scheme %s, got %s (err: %v)", tss.SchemeEdDSA, scheme, err)
+	}
+}
+
+func testStoreAndRetrieveWallet(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+
+	dkgResult := newDkgResult(t)
+	ctx := storeWallet(t, vault, foreignKey, "client", dkgResult)
+
+	dkgResultRetrieved, err := vault.RetrieveWallet(ctx, foreignKey)
+	if err != nil {
+		t.Fatalf("expected dkgResult, got error: %s", err)
+	}
+
+	assertSameDkgResult(t, dkgResult, dkgResultRetrieved)
+
+	_, err = vault.RetrieveWallet(ctx, newForeignKey())
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown user, got %v", err)
+	}
+}
+
+func testRetrieveWalletMetadata(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+	storeWallet(t, vault, foreignKey, "client")
+
+	// no metadata
+	_, err := vault.RetrieveWallet(context.Background(), foreignKey)
+	if err == nil {
+		t.Errorf("expected error without metadata")
+	}
+
+	// metadata of another wallet
+	otherCtx := storeWallet(t, vault, newForeignKey(), "client")
+	_, err = vault.RetrieveWallet(otherCtx, foreignKey)
+	if err == nil {
+		t.Errorf("expected error with wrong metadata")
+	}
+
+	// metadata not hex encoded
+	badCtx := context.WithValue(context.Background(), types.ContextKey("metadata"), "not-hex")
+	_, err = vault.RetrieveWallet(badCtx, foreignKey)
+	if err == nil {
+		t.Errorf("expected error with malformed metadata")
+	}
+}
+
+func testDeviceExists(t *testing.T, vault server.Vault) {
+	ctx := context.Background()
+	foreignKey := newForeignKey()
+
+	err := vault.DeviceExists(ctx, foreignKey, "client")
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown user, got %v", err)
+	}
+
+	storeWallet(t, vault, foreignKey, "client")
+
+	err = vault.DeviceExists(ctx, foreignKey, "client")
+	if err != nil {
+		t.Errorf("expected device to exist, got %v", err)
+	}
+
+	err = vault.DeviceExists(ctx, foreignKey, "other-device")
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown device, got %v", err)
+	}
+}
+
+func testAddPeer(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+	ctx := storeWallet(t, vault, foreignKey, "client")
+
+	updatedDkgResult := newDkgResult(t)
+	updatedDkgResult.BKs["new-device"] = tss.BK{X: "12345", Rank: 0}
+
+	err := vault.AddPeer(ctx, foreignKey, "new-device", "userAgent", updatedDkgResult)
+	if err != nil {
+		t.Fatalf("expected device to be added, got %v", err)
+	}
+
+	err = vault.DeviceExists(ctx, foreignKey, "new-device")
+	if err != nil {
+		t.Errorf("expected added device to exist, got %v", err)
+	}
+
+	dkgResultRetrieved, err := vault.RetrieveWallet(ctx, foreignKey)
+	if err != nil {
+		t.Fatalf("expected dkgResult, got error: %s", err)
+	}
+	assertSameDkgResult(t, updatedDkgResult, dkgResultRetrieved)
+
+	err = vault.AddPeer(ctx, newForeignKey(), "new-device", "userAgent", updatedDkgResult)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound when adding device to unknown user, got %v", err)
+	}
+}
+
+func testRemovePeer(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+	ctx := storeWallet(t, vault, foreignKey, "client")
+
+	dkgResult := newDkgResult(t)
+	dkgResult.BKs["other-device"] = tss.BK{X: "12345", Rank: 0}
+
+	err := vault.AddPeer(ctx, foreignKey, "other-device", "userAgent", dkgResult)
+	if err != nil {
+		t.Fatalf("expected device to be added, got %v", err)
+	}
+
+	updatedDkgResult := newDkgResult(t)
+	err = vault.RemovePeer(ctx, foreignKey, "other-device", updatedDkgResult)
+	if err != nil {
+		t.Fatalf("expected device to be removed, got %v", err)
+	}
+
+	err = vault.DeviceExists(ctx, foreignKey, "other-device")
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for removed device, got %v", err)
+	}
+
+	err = vault.DeviceExists(ctx, foreignKey, "client")
+	if err != nil {
+		t.Errorf("expected remaining device to exist, got %v", err)
+	}
+
+	dkgResultRetrieved, err := vault.RetrieveWallet(ctx, foreignKey)
+	if err != nil {
+		t.Fatalf("expected dkgResult, got error: %s", err)
+	}
+	assertSameDkgResult(t, updatedDkgResult, dkgResultRetrieved)
+
+	err = vault.RemovePeer(ctx, foreignKey, "other-device", updatedDkgResult)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound when removing device twice, got %v", err)
+	}
+}
+
+func testUpdateWallet(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+	ctx := storeWallet(t, vault, foreignKey, "client")
+
+	updatedDkgResult := newDkgResult(t)
+	updatedDkgResult.Share = "12345"
+
+	err := vault.UpdateWallet(ctx, foreignKey, updatedDkgResult)
+	if err != nil {
+		t.Fatalf("expected wallet to be updated, got %v", err)
+	}
+
+	dkgResultRetrieved, err := vault.RetrieveWallet(ctx, foreignKey)
+	if err != nil {
+		t.Fatalf("expected dkgResult, got error: %s", err)
+	}
+	assertSameDkgResult(t, updatedDkgResult, dkgResultRetrieved)
+
+	otherWallet := newDkgResult(t)
+	otherWallet.Address = "0x0000000000000000000000000000000000000000"
+
+	err = vault.UpdateWallet(ctx, foreignKey, otherWallet)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound when updating another address, got %v", err)
+	}
+
+	err = vault.UpdateWallet(ctx, newForeignKey(), updatedDkgResult)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound when updating unknown user, got %v", err)
+	}
+}
+
+func testRecordSignature(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+	ctx := storeWallet(t, vault, foreignKey, "client")
+
+	err := vault.RecordSignature(ctx, foreignKey, "client", []byte("message"))
+	if err != nil {
+		t.Errorf("expected signature to be recorded, got %v", err)
+	}
+
+	err = vault.RecordSignature(ctx, foreignKey, "other-device", []byte("message"))
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown device, got %v", err)
+	}
+
+	err = vault.RecordSignature(ctx, newForeignKey(), "client", []byte("message"))
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown user, got %v", err)
+	}
+}
+
+func testRotateMetadata(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+
+	dkgResult := newDkgResult(t)
+	ctx := storeWallet(t, vault, foreignKey, "client", dkgResult)
+
+	metadata, err := vault.RotateMetadata(ctx, foreignKey, "client")
+	if err != nil {
+		t.Fatalf("expected metadata to be rotated, got %v", err)
+	}
+
+	if metadata == ctx.Value(types.ContextKey("metadata")) {
+		t.Errorf("expected new metadata to be different")
+	}
+
+	// previous metadata cannot decrypt the wallet anymore
+	_, err = vault.RetrieveWallet(ctx, foreignKey)
+	if err == nil {
+		t.Errorf("expected error with previous metadata")
+	}
+
+	newCtx := context.WithValue(context.Background(), types.ContextKey("metadata"), metadata)
+
+	dkgResultRetrieved, err := vault.RetrieveWallet(newCtx, foreignKey)
+	if err != nil {
+		t.Fatalf("expected dkgResult with new metadata, got error: %s", err)
+	}
+	assertSameDkgResult(t, dkgResult, dkgResultRetrieved)
+
+	// previous metadata cannot rotate anymore either
+	_, err = vault.RotateMetadata(ctx, foreignKey, "client")
+	if err == nil {
+		t.Errorf("expected error when rotating with previous metadata")
+	}
+
+	_, err = vault.RotateMetadata(newCtx, newForeignKey(), "client")
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown user, got %v", err)
+	}
+}
+
+func testClaimMetadata(t *testing.T, vault server.Vault) {
+	foreignKey := newForeignKey()
+
+	dkgResult := newDkgResult(t)
+	dkgResult.BKs["other-device"] = tss.BK{X: "12345", Rank: 0}
+	devices := withPublicShares(t, dkgResult, "client", "other-device")
+	ctx := storeWallet(t, vault, foreignKey, "client", dkgResult)
+
+	err := vault.AddPeer(ctx, foreignKey, "other-device", "userAgent", dkgResult)
+	if err != nil {
+		t.Fatalf("expected device to be added, got %v", err)
+	}
+
+	// nothing to claim before a rotation
+	sealedMetadata, err := vault.ClaimMetadata(ctx, foreignKey, "other-device")
+	if err != nil || sealedMetadata != "" {
+		t.Errorf("expected no metadata to claim, got %s (%v)", sealedMetadata, err)
+	}
+
+	// two rotations by the first device, the initial metadata leaked and the other device still holds it
+	rotatedMetadata, err := vault.RotateMetadata(ctx, foreignKey, "client")
+	if err != nil {
+		t.Fatalf("expected metadata to be rotated, got %v", err)
+	}
+
+	rotatedCtx := context.WithValue(context.Background(), types.ContextKey("metadata"), rotatedMetadata)
+	rotatedMetadata, err = vault.RotateMetadata(rotatedCtx, foreignKey, "client")
+	if err != nil {
+		t.Fatalf("expected metadata to be rotated again, got %v", err)
+	}
+	rotatedCtx = context.WithValue(context.Background(), types.ContextKey("metadata"), rotatedMetadata)
+
+	// the rotating device has nothing to claim
+	sealedMetadata, err = vault.ClaimMetadata(rotatedCtx, foreignKey, "client")
+	if err != nil || sealedMetadata != "" {
+		t.Errorf("expected no metadata to claim for the rotating device, got %s (%v)", sealedMetadata, err)
+	}
+
+	// an attacker holding the leaked metadata gets the metadata sealed for the other device, but cannot open it
+	attackerSealedMetadata, err := vault.ClaimMetadata(ctx, foreignKey, "other-device")
+	if err != nil || attackerSealedMetadata == "" {
+		t.Fatalf("expected sealed metadata, got %s (%v)", attackerSealedMetadata, err)
+	}
+
+	if attackerSealedMetadata == rotatedMetadata {
+		t.Errorf("expected metadata to be sealed")
+	}
+
+	attacker := withPublicShares(t, newDkgResult(t), "other-device")["other-device"]
+	_, err = openSealedMetadata(attacker, attackerSealedMetadata)
+	if !errors.Is(err, tss.ErrInvalidSealed) {
+		t.Errorf("expected ErrInvalidSealed when opening without the share of the device, got %v", err)
+	}
+
+	_, err = vault.RetrieveWallet(ctx, foreignKey)
+	if err == nil {
+		t.Errorf("expected error with the leaked metadata")
+	}
+
+	// the other device still gets the latest metadata, as many times as needed
+	for i := 0; i < 2; i++ {
+		sealedMetadata, err = vault.ClaimMetadata(ctx, foreignKey, "other-device")
+		if err != nil {
+			t.Fatalf("expected metadata to be claimed, got %v", err)
+		}
+
+		metadata, err := openSealedMetadata(devices["other-device"], sealedMetadata)
+		if err != nil {
+			t.Fatalf("expected sealed metadata to be opened by the device, got %v", err)
+		}
+
+		if metadata != rotatedMetadata {
+			t.Errorf("expected latest metadata to be claimed")
+		}
+	}
+
+	dkgResultRetrieved, err := vault.RetrieveWallet(rotatedCtx, foreignKey)
+	if err != nil {
+		t.Fatalf("expected dkgResult with claimed metadata, got error: %s", err)
+	}
+	assertSameDkgResult(t, dkgResult, dkgResultRetrieved)
+
+	// after a refresh, the metadata is sealed for the new shares
+	refreshedDkgResult := newDkgResult(t)
+	refreshedDkgResult.BKs = dkgResult.BKs
+	refreshedDevices := withPublicShares(t, refreshedDkgResult, "client", "other-device")
+
+	err = vault.UpdateWallet(rotatedCtx, foreignKey, refreshedDkgResult)
+	if err != nil {
+		t.Fatalf("expected wallet to be updated, got %v", err)
+	}
+
+	sealedMetadata, err = vault.ClaimMetadata(ctx, foreignKey, "other-device")
+	if err != nil {
+		t.Fatalf("expected metadata to be claimed after refresh, got %v", err)
+	}
+
+	metadata, err := openSealedMetadata(refreshedDevices["other-device"], sealedMetadata)
+	if err != nil || metadata != rotatedMetadata {
+		t.Errorf("expected latest metadata to be opened with the refreshed share, got %s (%v)", metadata, err)
+	}
+
+	_, err = openSealedMetadata(devices["other-device"], sealedMetadata)
+	if !errors.Is(err, tss.ErrInvalidSealed) {
+		t.Errorf("expected ErrInvalidSealed when opening with the previous share, got %v", err)
+	}
+
+	_, err = vault.ClaimMetadata(ctx, foreignKey, "unknown-device")
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		t.Errorf("expected ErrNotFound for unknown device, got %v", err)
+	}
+
+	// without the public shares of the devices (wallets stored before they were kept), the metadata cannot be sealed
+	legacyForeignKey := newForeignKey()
+	legacyDkgResult := newDkgResult(t)
+	legacyDkgResult.BKs["other-device"] = tss.BK{X: "12345", Rank: 0}
+	legacyCtx := storeWallet(t, vault, legacyForeignKey, "client", legacyDkgResult)
+
+	_, err = vault.RotateMetadata(legacyCtx, legacyForeignKey, "client")
+	if !errors.Is(err, &types.ErrRefreshRequired{}) {
+		t.Errorf("expected ErrRefreshRequired without public shares, got %v", err)
+	}
+
+	_, err = vault.RetrieveWallet(legacyCtx, legacyForeignKey)
+	if err != nil {
+		t.Errorf("expected metadata to be unchanged when rotation fails, got %v", err)
+	}
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func newForeignKey() string {
+	return "vaulttest-user-" + uuid.New().String()
+}
+
+func newDkgResult(t *testing.T) *tss.DkgResult {
+	var dkgResult tss.DkgResult
+	err := json.Unmarshal([]byte(dkgResultStr), &dkgResult)
+	if err != nil {
+		t.Fatalf("could not unmarshal dkgResult: %s", err)
+	}
+	return &dkgResult
+}
+
+// storeWallet stores a wallet for foreignKey with device peerID and returns a context holding its metadata
+func storeWallet(t *testing.T, vault server.Vault, foreignKey string, peerID string, dkgResults ...*tss.DkgResult) context.Context {
+	dkgResult := newDkgResult(t)
+	if len(dkgResults) > 0 {
+		dkgResult = dkgResults[0]
+	}
+
+	metadata, err := vault.StoreWallet(context.Background(), foreignKey, peerID, "userAgent", dkgResult)
+	if err != nil {
+		t.Fatalf("could not store wallet: %s", err)
+	}
+
+	return context.WithValue(context.Background(), types.ContextKey("metadata"), metadata)
+}
+
+func assertSameDkgResult(t *testing.T, expected, got *tss.DkgResult) {
+	if expected.Pubkey != got.Pubkey || expected.Share != got.Share || expected.Address != got.Address || expected.PeerID != got.PeerID || expected.GetScheme() != got.GetScheme() {
+		t.Errorf("expected dkgResult stored to be retrieved intact - expected %+v, got %+v", expected, got)
+		return
+	}
+
+	if len(expected.BKs) != len(got.BKs) {
+		t.Errorf("expected %d BKs, got %d", len(expected.BKs), len(got.BKs))
+		return
+	}
+
+	for key, value := range expected.BKs {
+		if got.BKs[key] != value {
+			t.Errorf("expected BK %s to be %+v, got %+v", key, value, got.BKs[key])
+		}
+	}
+}
+
+// withPublicShares gives random shares to the given devices of dkgResult, keeps their public shares in it and returns the dkg result of each device
+func withPublicShares(t *testing.T, dkgResult *tss.DkgResult, peerIDs ...string) map[string]*tss.DkgResult {
+	curve := elliptic.Secp256k1()
+
+	dkgResult.PublicShares = make(map[string]tss.PubkeyStr)
+	devices := make(map[string]*tss.DkgResult)
+	for _, peerID := range peerIDs {
+		share, err := rand.Int(rand.Reader, curve.Params().N)
+		if err != nil {
+			t.Fatalf("could not generate share: %s", err)
+		}
+
+		publicShare := ecpointgrouplaw.ScalarBaseMult(curve, share)
+		dkgResult.PublicShares[peerID] = tss.PubkeyStr{X: publicShare.GetX().String(), Y: publicShare.GetY().String()}
+
+		device := *dkgResult
+		device.PeerID = peerID
+		device.Share = share.String()
+		devices[peerID] = &device
+	}
+
+	return devices
+}
+
+// openSealedMetadata opens the metadata claimed by a device (ClaimMetadata), as the client does
+func openSealedMetadata(device *tss.DkgResult, sealedMetadata string) (string, error) {
+	sealed, err := hex.DecodeString(sealedMetadata)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := device.OpenSealed(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(metadata), nil
+}
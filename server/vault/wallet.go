@@ -2,13 +2,9 @@ package vault
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"io"
 	"log"
 
 	"github.com/getmeemaw/meemaw/server/database"
@@ -16,7 +12,9 @@ import (
 	"github.com/getmeemaw/meemaw/utils/types"
 )
 
+// Vault is the Postgres vault, based on the sqlc queries
 type Vault struct {
+	keyEncryption
 	_queries *database.Queries
 }
 
@@ -24,10 +22,67 @@ func NewVault(queries *database.Queries) *Vault {
 	return &Vault{_queries: queries}
 }
 
-// WalletExists verifies if a wallet already exists
+// WalletExists verifies if a wallet already exists (types.ErrNotFound if not)
 func (vault *Vault) WalletExists(ctx context.Context, foreignKey string) error {
 	_, err := vault._queries.GetUserByForeignKey(ctx, foreignKey)
-	return err
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+	return nil
+}
+
+// WalletScheme returns the scheme of the wallet of the user (types.ErrNotFound if there is none), without decrypting it
+func (vault *Vault) WalletScheme(ctx context.Context, foreignKey string) (tss.Scheme, error) {
+	res, err := vault._queries.GetUserSigningParameters(ctx, foreignKey)
+	if err != nil || !res.ID.Valid {
+		return "", &types.ErrNotFound{}
+	}
+
+	return tss.ParseScheme(res.Scheme.String)
+}
+
+// DeviceExists verifies if a device is registered for the user
+func (vault *Vault) DeviceExists(ctx context.Context, foreignKey string, peerID string) error {
+	user, err := vault._queries.GetUserByForeignKey(ctx, foreignKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	devices, err := vault._queries.GetUserDevices(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if device.PeerID == peerID {
+			return nil
+		}
+	}
+
+	return &types.ErrNotFound{}
+}
+
+// RecordSignature keeps track of the device which took part in the signing of a message
+func (vault *Vault) RecordSignature(ctx context.Context, foreignKey string, peerID string, message []byte) error {
+	_, err := vault._queries.AddSignature(ctx, database.AddSignatureParams{
+		Message:    message,
+		ForeignKey: foreignKey,
+		PeerId:     peerID,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	return nil
 }
 
 ///////
@@ -36,23 +91,15 @@ func (vault *Vault) WalletExists(ctx context.Context, foreignKey string) error {
 // Tested in integration tests (with throw away db)
 func (vault *Vault) StoreWallet(ctx context.Context, foreignKey string, peerID string, userAgent string, dkgResult *tss.DkgResult) (string, error) {
 
-	// Encode dkgResults to json
-	jsonDkgResult, err := json.Marshal(dkgResult)
-	if err != nil {
-		log.Println("could not marshal dkgResults to json")
-		return "", err
-	}
-
 	// Generate client key :
-	clientKey := make([]byte, 32) // return to client
-	if _, err := io.ReadFull(rand.Reader, clientKey); err != nil {
+	clientKey, err := newClientKey() // return to client
+	if err != nil {
 		return "", err
 	}
 
 	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
-	nonceClient, ClientEncryptedDkgResult, err := encryptAES(jsonDkgResult, clientKey)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, dkgResult, clientKey)
 	if err != nil {
-		log.Println("error while encrypting with client key:", err)
 		return "", err
 	}
 
@@ -64,10 +111,15 @@ func (vault *Vault) StoreWallet(ctx context.Context, foreignKey string, peerID s
 		PublicAddress:       dkgResult.Address,
 		EncryptedDkgResults: ClientEncryptedDkgResult,
 		Nonce:               nonceClient,
+		Scheme:              string(dkgResult.GetScheme()),
 	}
 
 	_, err = vault._queries.Dkg(ctx, dkgQueryParams)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("wallet already exists for that user, not stored")
+			return hex.EncodeToString(clientKey), nil
+		}
 		return "", err
 	}
 
@@ -77,139 +129,221 @@ func (vault *Vault) StoreWallet(ctx context.Context, foreignKey string, peerID s
 // AddPeer adds a device in DB, including updating the BKs
 // Requires the metadata in the context
 func (vault *Vault) AddPeer(ctx context.Context, foreignKey string, peerID string, userAgent string, updatedDkgResult *tss.DkgResult) error {
-	// get client key from context
-	clientKeyStr, ok := ctx.Value(types.ContextKey("metadata")).(string)
-	if !ok {
-		return errors.New("could not find customer identifier")
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
 	}
 
-	clientKey, err := hex.DecodeString(clientKeyStr)
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
 	if err != nil {
-		log.Println("error hex decoding clientKey(", clientKeyStr, "):", err)
 		return err
 	}
 
-	// Encode dkgResults to json
-	jsonDkgResult, err := json.Marshal(updatedDkgResult)
+	// Update in DB
+	dkgQueryParams := database.AddPeerParams{
+		UserAgent:           userAgent,
+		PeerId:              peerID,
+		ForeignKey:          foreignKey,
+		EncryptedDkgResults: ClientEncryptedDkgResult,
+		Nonce:               nonceClient,
+	}
+
+	_, err = vault._queries.AddPeer(ctx, dkgQueryParams)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("no wallet to add device to")
+			return &types.ErrNotFound{}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// RemovePeer deletes a device from DB, including updating the BKs, in a single statement
+// Requires the metadata in the context
+func (vault *Vault) RemovePeer(ctx context.Context, foreignKey string, peerID string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
 	if err != nil {
-		log.Println("could not marshal dkgResults to json")
 		return err
 	}
 
 	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
-	nonceClient, ClientEncryptedDkgResult, err := encryptAES(jsonDkgResult, clientKey)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
 	if err != nil {
-		log.Println("error while encrypting with client key:", err)
 		return err
 	}
 
 	// Update in DB
-	dkgQueryParams := database.AddPeerParams{
-		UserAgent:           userAgent,
-		PeerId:              peerID,
+	removeQueryParams := database.RemoveDeviceParams{
 		ForeignKey:          foreignKey,
+		PeerId:              peerID,
 		EncryptedDkgResults: ClientEncryptedDkgResult,
 		Nonce:               nonceClient,
 	}
 
-	_, err = vault._queries.AddPeer(ctx, dkgQueryParams)
+	_, err = vault._queries.RemoveDevice(ctx, removeQueryParams)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("no device to remove:", peerID)
+			return &types.ErrNotFound{}
+		}
 		return err
 	}
 
 	return nil
 }
 
-// RetrieveWallet retrieves a wallet from DB based on the userID of the user (which is a loose foreign key, the format will depend on the auth provider)
-// Tested in integration tests (with throw away db)
-func (vault *Vault) RetrieveWallet(ctx context.Context, foreignKey string) (*tss.DkgResult, error) {
+// UpdateWallet replaces the dkg result of an existing wallet (e.g. after a refresh of the shares), in a single statement
+// The wallet is identified by its address, which cannot change
+// Requires the metadata in the context
+func (vault *Vault) UpdateWallet(ctx context.Context, foreignKey string, updatedDkgResult *tss.DkgResult) error {
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
 
-	// get dkgResults
-	res, err := vault._queries.GetUserSigningParameters(ctx, foreignKey)
+	// Encrypt dkgResults with client key (so that server shares are not fully exposed in case of a breach)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, updatedDkgResult, clientKey)
 	if err != nil {
-		log.Println("error getting signing params:", err)
-		return nil, &types.ErrNotFound{}
+		return err
+	}
+
+	// The shares changed: a rotated client key not claimed yet needs to be sealed for the new ones
+	var sealedMetadata []byte
+	_, err = vault._queries.GetMetadataDelivery(ctx, foreignKey)
+	if err == nil {
+		sealedMetadata, err = sealClientKey(updatedDkgResult, clientKey, updatedDkgResult.GetClientPeerIDs())
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
 	}
 
-	// get client key from context
-	clientKeyStr, ok := ctx.Value(types.ContextKey("metadata")).(string)
-	if !ok {
-		return nil, errors.New("could not find customer identifier")
+	// Update in DB
+	updateQueryParams := database.UpdateWalletParams{
+		EncryptedDkgResults: ClientEncryptedDkgResult,
+		Nonce:               nonceClient,
+		ForeignKey:          foreignKey,
+		PublicAddress:       updatedDkgResult.Address,
+		SealedMetadata:      sealedMetadata,
 	}
 
-	clientKey, err := hex.DecodeString(clientKeyStr)
+	_, err = vault._queries.UpdateWallet(ctx, updateQueryParams)
 	if err != nil {
-		log.Println("error hex decoding clientKey(", clientKeyStr, "):", err)
-		return nil, err
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("no wallet to update for that address:", updatedDkgResult.Address)
+			return &types.ErrNotFound{}
+		}
+		return err
 	}
 
-	// decrypt dkg results
-	jsonDkgResults, err := decryptAES(res.Nonce, res.EncryptedDkgResults, clientKey)
+	return nil
+}
+
+// RotateMetadata re-encrypts the wallet with a new client key, returned as the new metadata of the wallet
+// The previous client key (i.e. the current metadata) is required in the context
+// The wallet is only replaced if it did not change in the meantime (types.ErrConflict otherwise), in a single statement
+// The other devices of the wallet get the new client key with ClaimMetadata, sealed with their public share
+func (vault *Vault) RotateMetadata(ctx context.Context, foreignKey string, peerID string) (string, error) {
+
+	// get dkgResults
+	res, err := vault._queries.GetUserSigningParameters(ctx, foreignKey)
+	if err != nil || !res.ID.Valid {
+		log.Println("error getting signing params:", err)
+		return "", &types.ErrNotFound{}
+	}
+
+	previousClientKey, err := clientKeyFromContext(ctx)
 	if err != nil {
-		log.Println("could not decrypt AES using clientKey:", err)
-		return nil, err
+		return "", err
 	}
 
-	// decode json into *tss.DkgResult
-	dkgResult := &tss.DkgResult{}
-	err = json.Unmarshal(jsonDkgResults, dkgResult)
+	dkgResult, err := vault.decryptDkgResult(ctx, res.Nonce, res.EncryptedDkgResults, previousClientKey, res.Scheme.String)
 	if err != nil {
-		log.Println("could not unmarshal jsonDkgResults")
-		return nil, err
+		return "", err
 	}
 
-	return dkgResult, nil
-}
+	// Generate new client key :
+	clientKey, err := newClientKey() // return to client
+	if err != nil {
+		return "", err
+	}
 
-// Encrypt a plaintext message using AES-GCM.
-func encryptAES(plaintext, key []byte) ([]byte, []byte, error) {
-	block, err := aes.NewCipher(key)
+	nonceClient, ClientEncryptedDkgResult, err := vault.encryptDkgResult(ctx, dkgResult, clientKey)
 	if err != nil {
-		return nil, nil, err
+		return "", err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	// Other devices get the new client key on their next call (ClaimMetadata)
+	sealedMetadata, err := sealClientKey(dkgResult, clientKey, otherPeerIDs(dkgResult, peerID))
 	if err != nil {
-		return nil, nil, err
+		return "", err
+	}
+
+	// Update in DB, only if the wallet did not change since it was read
+	rotateQueryParams := database.RotateWalletKeyParams{
+		EncryptedDkgResults: ClientEncryptedDkgResult,
+		Nonce:               nonceClient,
+		WalletId:            res.ID.Int64,
+		PreviousNonce:       res.Nonce,
+		SealedMetadata:      sealedMetadata,
 	}
 
-	// Generate a random nonce. Ensure it is unique for each encryption with the same key.
-	nonce, err := generateRandomBytes(aesGCM.NonceSize())
+	_, err = vault._queries.RotateWalletKey(ctx, rotateQueryParams)
 	if err != nil {
-		return nil, nil, err
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Println("wallet changed during metadata rotation")
+			return "", &types.ErrConflict{}
+		}
+		return "", err
 	}
 
-	// Encrypt the plaintext using the nonce.
-	ciphertext := aesGCM.Seal(nil, nonce, plaintext, nil)
-	return nonce, ciphertext, nil
+	return hex.EncodeToString(clientKey), nil
 }
 
-// Decrypt a ciphertext message using AES-GCM.
-func decryptAES(nonce, ciphertext, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// ClaimMetadata returns the latest client key of the wallet sealed for the device (hex), if it was rotated by another device ("" if it was not)
+// Only the device can open it, with its share: it is not removed once claimed, a device can claim it again until the next rotation
+func (vault *Vault) ClaimMetadata(ctx context.Context, foreignKey string, peerID string) (string, error) {
+	err := vault.DeviceExists(ctx, foreignKey, peerID)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	delivery, err := vault._queries.GetMetadataDelivery(ctx, foreignKey)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
 	}
 
-	// Decrypt the ciphertext using the nonce.
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	sealedClientKey, err := sealedClientKeyOf(delivery.SealedMetadata, peerID)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return plaintext, nil
+	return hex.EncodeToString(sealedClientKey), nil
 }
 
-// Generate random bytes using crypto/rand, which is secure for cryptographic purposes.
-func generateRandomBytes(size int) ([]byte, error) {
-	bytes := make([]byte, size)
-	if _, err := io.ReadFull(rand.Reader, bytes); err != nil {
+// RetrieveWallet retrieves a wallet from DB based on the userID of the user (which is a loose foreign key, the format will depend on the auth provider)
+// Tested in integration tests (with throw away db)
+func (vault *Vault) RetrieveWallet(ctx context.Context, foreignKey string) (*tss.DkgResult, error) {
+
+	// get dkgResults
+	res, err := vault._queries.GetUserSigningParameters(ctx, foreignKey)
+	if err != nil {
+		log.Println("error getting signing params:", err)
+		return nil, &types.ErrNotFound{}
+	}
+
+	clientKey, err := clientKeyFromContext(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return bytes, nil
+
+	// decrypt dkg results (the scheme column is stored in clear, it must match the encrypted dkg results)
+	return vault.decryptDkgResult(ctx, res.Nonce, res.EncryptedDkgResults, clientKey, res.Scheme.String)
 }
@@ -1,6 +1,7 @@
 package integration
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
@@ -93,11 +94,11 @@ func TestMain(m *testing.M) {
 		log.Fatalf("Could not connect to docker: %s", err)
 	}
 
-	// Loading schema
-	log.Println("Loading schema")
-	err = server.LoadSchema(db, "")
+	// Applying migrations
+	log.Println("Applying migrations")
+	_, err = server.MigrateUp(context.Background(), db)
 	if err != nil {
-		log.Fatalf("Could not load schema: %s", err)
+		log.Fatalf("Could not apply migrations: %s", err)
 	}
 
 	////////
@@ -0,0 +1,54 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/google/uuid"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	///////////////////
+	/// TEST 1 : all migrations applied by TestMain
+
+	statuses, err := server.MigrationsStatus(ctx, db)
+	if err != nil {
+		t.Fatalf("Failed test 1: could not get migrations status: %s", err)
+	}
+
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("Failed test 1: migration %d_%s not applied", status.Version, status.Name)
+		}
+	}
+
+	///////////////////
+	/// TEST 2 : migrating again does nothing
+
+	applied, err := server.MigrateUp(ctx, db)
+	if err != nil {
+		t.Errorf("Failed test 2: could not migrate again: %s", err)
+	} else if len(applied) != 0 {
+		t.Errorf("Failed test 2: expected no migration to be applied, got %d", len(applied))
+	}
+
+	///////////////////
+	/// TEST 3 : unique indexes
+
+	queries := database.New(db)
+	foreignKey := "my-migration-user-" + uuid.New().String()
+
+	_, err = queries.AddUser(ctx, foreignKey)
+	if err != nil {
+		t.Fatalf("Failed test 3: could not add user: %s", err)
+	}
+
+	_, err = queries.AddUser(ctx, foreignKey) // ON CONFLICT DO NOTHING: no row returned
+	if err == nil {
+		t.Errorf("Failed test 3: expected user to be unique")
+	}
+}
@@ -0,0 +1,250 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestRotateMetadata(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : rotate metadata, then only the new metadata can be used
+
+	testCase = "test 1 (rotate metadata)"
+
+	err = rotateMetadataTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : two devices, the second one gets the metadata rotated by the first one
+
+	testCase = "test 2 (rotate metadata with two devices)"
+
+	err = rotateMetadataTwoDevicesTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func rotateMetadataTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- rotateMetadataTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func rotateMetadataTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	dkgResult, metadata, err := client.Dkg(host, authData)
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	newMetadata, err := client.RotateMetadata(host, string(dkgResultBytes), metadata, authData)
+	if err != nil {
+		log.Println("Error rotating metadata:", err)
+		return err
+	}
+
+	if len(newMetadata) == 0 || newMetadata == metadata {
+		return errors.New("metadata not rotated")
+	}
+
+	// Previous metadata cannot be used anymore
+	_, err = client.Sign(host, []byte("test rotate previous "+uuid.New().String()), string(dkgResultBytes), metadata, authData)
+	if err == nil {
+		return errors.New("previous metadata could still sign")
+	}
+
+	_, err = client.RotateMetadata(host, string(dkgResultBytes), metadata, authData)
+	if err == nil {
+		return errors.New("previous metadata could still rotate")
+	}
+
+	// New metadata can
+	_, err = client.Sign(host, []byte("test rotate new "+uuid.New().String()), string(dkgResultBytes), newMetadata, authData)
+	if err != nil {
+		log.Println("Error signing with new metadata:", err)
+		return err
+	}
+
+	return nil
+}
+
+func rotateMetadataTwoDevicesTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- rotateMetadataTwoDevicesTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func rotateMetadataTwoDevicesTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	// Create wallet with two devices, any of them can sign with the server
+	dkgResults := make([]*tss.DkgResult, 2)
+	metadatas := make([]string, 2)
+	errs := make(chan error, 2)
+
+	go func() {
+		var err error
+		dkgResults[0], metadatas[0], err = client.DkgWithOptions(host, authData, client.DkgOptions{Threshold: 2, Devices: 2})
+		errs <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond) // let the first device start the dkg
+
+	go func() {
+		var err error
+		dkgResults[1], metadatas[1], err = client.JoinDkg(host, authData)
+		errs <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			log.Println("Error during dkg:", err)
+			return err
+		}
+	}
+
+	dkgResultStrs := make([]string, 2)
+	for i, dkgResult := range dkgResults {
+		dkgResultBytes, err := json.Marshal(dkgResult)
+		if err != nil {
+			return err
+		}
+		dkgResultStrs[i] = string(dkgResultBytes)
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	// Nothing to update before a rotation
+	metadata, err := client.UpdateMetadata(host, dkgResultStrs[1], metadatas[1], authData)
+	if err != nil {
+		log.Println("Error updating metadata before rotation:", err)
+		return err
+	}
+	if metadata != metadatas[1] {
+		return errors.New("metadata updated without rotation")
+	}
+
+	// First device rotates
+	newMetadata, err := client.RotateMetadata(host, dkgResultStrs[0], metadatas[0], authData)
+	if err != nil {
+		log.Println("Error rotating metadata:", err)
+		return err
+	}
+
+	// Second device cannot sign with its previous metadata
+	_, err = client.Sign(host, []byte("test rotate second device previous "+uuid.New().String()), dkgResultStrs[1], metadatas[1], authData)
+	if err == nil {
+		return errors.New("second device could still sign with previous metadata")
+	}
+
+	// An attacker holding the previous metadata of the second device (but not its share) gets nothing usable
+	attackerDkgResult := *dkgResults[1]
+	attackerDkgResult.Share = "12345"
+	attackerDkgResultBytes, err := json.Marshal(&attackerDkgResult)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateMetadata(host, string(attackerDkgResultBytes), metadatas[1], authData)
+	if !errors.Is(err, tss.ErrInvalidSealed) {
+		log.Println("Expected ErrInvalidSealed for the attacker, got:", err)
+		return errors.New("rotated metadata opened without the share of the device")
+	}
+
+	// Second device still gets the new metadata, as many times as needed
+	for i := 0; i < 2; i++ {
+		metadata, err = client.UpdateMetadata(host, dkgResultStrs[1], metadatas[1], authData)
+		if err != nil {
+			log.Println("Error updating metadata of second device:", err)
+			return err
+		}
+		if metadata != newMetadata {
+			return errors.New("second device did not get the rotated metadata")
+		}
+	}
+
+	// Both devices sign with the new metadata
+	for i := range dkgResultStrs {
+		_, err = client.Sign(host, []byte("test rotate device new "+uuid.New().String()), dkgResultStrs[i], newMetadata, authData)
+		if err != nil {
+			log.Println("Error signing with new metadata:", err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestDerivation(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : ECDSA wallet, signature with the child key at a non-hardened path
+
+	testCase = "test 1 (ECDSA wallet, signature with a child key)"
+
+	err = derivationTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : hardened path
+
+	testCase = "test 2 (hardened path)"
+
+	host, closeServer := thresholdTestServer()
+	dkgResult, metadata, err := client.Dkg(host, "auth-data-test")
+	if err != nil {
+		t.Fatalf("Failed %s: %s", testCase, err)
+	}
+
+	dkgResultBytes, _ := json.Marshal(dkgResult)
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	message := crypto.Keccak256([]byte("test derivation hardened"))
+	signature, err := client.SignWithOptions(host, message, string(dkgResultBytes), metadata, "auth-data-test", client.SignOptions{Path: "m/0'/1"})
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrBadRequest{}, signature, t)
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func derivationTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- derivationTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func derivationTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+	path := "m/0/1"
+
+	dkgResult, metadata, err := client.Dkg(host, authData)
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	address, err := client.DeriveAddress(string(dkgResultBytes), path)
+	if err != nil {
+		return err
+	}
+
+	if address == dkgResult.Address {
+		return errors.New("child address is the address of the wallet")
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	message := crypto.Keccak256([]byte("test derivation " + uuid.New().String()))
+
+	signature, err := client.SignWithOptions(host, message, string(dkgResultBytes), metadata, authData, client.SignOptions{Path: path})
+	if err != nil {
+		log.Println("Error signing:", err)
+		return err
+	}
+
+	// the signature must recover the child key, not the key of the wallet
+	publicKey, err := crypto.SigToPub(message, signature.Signature)
+	if err != nil {
+		return err
+	}
+
+	if crypto.PubkeyToAddress(*publicKey).Hex() != address {
+		return errors.New("signature does not recover the child address")
+	}
+
+	return nil
+}
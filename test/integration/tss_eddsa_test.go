@@ -0,0 +1,145 @@
+package integration
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestEdDSA(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : EdDSA wallet, dkg then sign, signature verified as standard ed25519
+
+	testCase = "test 1 (EdDSA wallet, dkg then sign)"
+
+	err = eddsaTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : unknown scheme
+
+	testCase = "test 2 (unknown scheme)"
+
+	host, closeServer := thresholdTestServer()
+	dkgResult, _, err := client.DkgWithOptions(host, "auth-data-test", client.DkgOptions{Scheme: "schnorr-unknown"})
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrBadRequest{}, dkgResult, t)
+
+	///////////////////
+	/// TEST 3 : adding a device to an EdDSA wallet is rejected
+
+	testCase = "test 3 (register device with EdDSA wallet)"
+
+	host, closeServer = thresholdTestServer()
+	dkgResult, metadata, err := client.DkgWithOptions(host, "auth-data-test", client.DkgOptions{Scheme: string(tss.SchemeEdDSA)})
+	if err != nil {
+		closeServer()
+		t.Fatalf("Failed %s: %s", testCase, err)
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	newDkgResult, _, err := client.RegisterDevice(host, "auth-data-test", "device")
+	types.ProcessShouldError(testCase, err, &types.ErrUnsupportedScheme{}, newDkgResult, t)
+
+	///////////////////
+	/// TEST 4 : refreshing an EdDSA wallet is rejected
+
+	testCase = "test 4 (refresh EdDSA wallet)"
+
+	dkgResultBytes, _ := json.Marshal(dkgResult)
+	refreshedDkgResult, err := client.Refresh(host, string(dkgResultBytes), metadata, "auth-data-test")
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrUnsupportedScheme{}, refreshedDkgResult, t)
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func eddsaTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- eddsaTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func eddsaTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	dkgResult, metadata, err := client.DkgWithOptions(host, authData, client.DkgOptions{Scheme: string(tss.SchemeEdDSA)})
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	if dkgResult.GetScheme() != tss.SchemeEdDSA {
+		return errors.New("wrong scheme stored in dkg result")
+	}
+
+	pubkey, err := hex.DecodeString(dkgResult.Address)
+	if err != nil || len(pubkey) != ed25519.PublicKeySize {
+		return errors.New("address of EdDSA wallet is not an ed25519 public key")
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	message := []byte("test eddsa " + uuid.New().String())
+
+	signature, err := client.Sign(host, message, string(dkgResultBytes), metadata, authData)
+	if err != nil {
+		log.Println("Error signing:", err)
+		return err
+	}
+
+	if !ed25519.Verify(pubkey, message, signature.Signature) {
+		return errors.New("ed25519 signature does not verify")
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+// destination of the test transactions (regtest address of another key)
+const psbtDestination = "bcrt1q77zw6x35srwfl3grt26yc46fyphmwj4s9kyq8e"
+
+func TestPsbt(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : segwit and taproot inputs signed through /sign-psbt, valid transaction
+
+	testCase = "test 1 (segwit and taproot inputs)"
+
+	err = psbtTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : outputs checked against the policy of the server
+
+	testCase = "test 2 (recipient denied by the policy)"
+
+	host, closeServer := psbtTestServer(&server.Policy{DeniedRecipients: []string{psbtDestination}})
+	dkgResult, metadata, err := client.Dkg(host, "auth-data-test")
+	if err != nil {
+		t.Fatalf("Failed %s: %s", testCase, err)
+	}
+
+	dkgResultBytes, _ := json.Marshal(dkgResult)
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	encodedPsbt, _, err := newTestPsbt(dkgResult)
+	if err != nil {
+		t.Fatalf("Failed %s: %s", testCase, err)
+	}
+
+	signed, err := client.SignPsbt(host, encodedPsbt, "regtest", string(dkgResultBytes), metadata, "auth-data-test")
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrPolicyRejected{}, signed, t)
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func psbtTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- psbtTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(2 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func psbtTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	// bitcoin transactions are not raw messages: allowed by a policy without allowMessages
+	host, closeServer := psbtTestServer(&server.Policy{MaxDailyBitcoinValue: big.NewInt(100000)})
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	dkgResult, metadata, err := client.Dkg(host, authData)
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	encodedPsbt, prevTx, err := newTestPsbt(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	rawTx, err := client.SignPsbt(host, encodedPsbt, "regtest", string(dkgResultBytes), metadata, authData)
+	if err != nil {
+		log.Println("Error signing psbt:", err)
+		return err
+	}
+
+	// run the scripts of the inputs of the signed transaction
+	raw, err := hex.DecodeString(rawTx)
+	if err != nil {
+		return err
+	}
+
+	var signedTx wire.MsgTx
+	err = signedTx.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for _, txIn := range signedTx.TxIn {
+		fetcher.AddPrevOut(txIn.PreviousOutPoint, prevTx.TxOut[txIn.PreviousOutPoint.Index])
+	}
+	sigHashes := txscript.NewTxSigHashes(&signedTx, fetcher)
+
+	for i, txIn := range signedTx.TxIn {
+		prevOut := prevTx.TxOut[txIn.PreviousOutPoint.Index]
+		engine, err := txscript.NewEngine(prevOut.PkScript, &signedTx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+		if err != nil {
+			return err
+		}
+		err = engine.Execute()
+		if err != nil {
+			log.Println("Input", i, "not valid:", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newTestPsbt returns a PSBT spending a P2WPKH and a P2TR output of the wallet to psbtDestination, and the transaction of the spent outputs
+func newTestPsbt(dkgResult *tss.DkgResult) (string, *wire.MsgTx, error) {
+	publicKey, err := bitcoin.PublicKey(dkgResult.Pubkey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p2wpkh, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey.SerializeCompressed()), &chaincfg.RegressionNetParams)
+	if err != nil {
+		return "", nil, err
+	}
+	p2tr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(publicKey)), &chaincfg.RegressionNetParams)
+	if err != nil {
+		return "", nil, err
+	}
+	destination, err := btcutil.DecodeAddress(psbtDestination, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return "", nil, err
+	}
+
+	prevTx := wire.NewMsgTx(2)
+	prevTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0}, []byte(uuid.New().String()), nil))
+	for _, address := range []btcutil.Address{p2wpkh, p2tr} {
+		script, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			return "", nil, err
+		}
+		prevTx.AddTxOut(wire.NewTxOut(50000, script))
+	}
+	prevHash := prevTx.TxHash()
+
+	destinationScript, err := txscript.PayToAddrScript(destination)
+	if err != nil {
+		return "", nil, err
+	}
+
+	outpoints := []*wire.OutPoint{wire.NewOutPoint(&prevHash, 0), wire.NewOutPoint(&prevHash, 1)}
+	packet, err := psbt.New(outpoints, []*wire.TxOut{wire.NewTxOut(90000, destinationScript)}, 2, 0, []uint32{wire.MaxTxInSequenceNum, wire.MaxTxInSequenceNum})
+	if err != nil {
+		return "", nil, err
+	}
+
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := range outpoints {
+		err = updater.AddInWitnessUtxo(prevTx.TxOut[i], i)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return encoded, prevTx, nil
+}
+
+// psbtTestServer starts a server with the policy
+func psbtTestServer(policy *server.Policy) (string, func()) {
+	authServer := httptest.NewServer(http.HandlerFunc(getCustomAuthHandler("my-psbt-user-" + uuid.New().String())))
+
+	var config = server.Config{
+		AuthServerUrl: "http://" + authServer.Listener.Addr().String(),
+		AuthType:      "custom",
+		ClientOrigin:  "localhost",
+		DevMode:       true,
+		Policy:        policy,
+	}
+
+	queries := database.New(db)
+
+	_server := server.NewServer(vault.NewVault(queries), &config, nil, logging)
+
+	meemawServer := httptest.NewServer(_server.Router())
+
+	return "http://" + meemawServer.Listener.Addr().String(), func() {
+		meemawServer.Close()
+		authServer.Close()
+	}
+}
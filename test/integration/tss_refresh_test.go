@@ -0,0 +1,226 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestRefresh(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : 2-of-2 wallet, refresh then sign with the new share, old share cannot sign anymore
+
+	testCase = "test 1 (2-of-2 wallet refresh)"
+
+	err = refreshTestProcessLimitedInTime(2, 1)
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : 2-of-3 wallet, both devices take part in the refresh
+
+	testCase = "test 2 (2-of-3 wallet refresh)"
+
+	err = refreshTestProcessLimitedInTime(2, 2)
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 3 : no refresh to join
+
+	testCase = "test 3 (no refresh to join)"
+
+	host, closeServer := thresholdTestServer()
+	dkgResult, metadata, err := client.Dkg(host, "auth-data-test")
+	if err != nil {
+		t.Errorf("Failed %s: could not create wallet: %s", testCase, err)
+	} else {
+		dkgResultBytes, _ := json.Marshal(dkgResult)
+		refreshedDkgResult, err := client.JoinRefresh(host, string(dkgResultBytes), metadata, "auth-data-test")
+		types.ProcessShouldError(testCase, err, &types.ErrNotFound{}, refreshedDkgResult, t)
+	}
+	closeServer()
+
+	///////////////////
+	/// TEST 4 : a device of the wallet does not join the refresh (lost), the error asks to revoke it
+
+	testCase = "test 4 (lost device)"
+
+	host, closeServer = thresholdTestServer()
+	dkgResults := make([]*tss.DkgResult, 2)
+	metadatas := make([]string, 2)
+	dkgErrs := make(chan error, 2)
+	go func() {
+		var err error
+		dkgResults[0], metadatas[0], err = client.DkgWithOptions(host, "auth-data-test", client.DkgOptions{Threshold: 2, Devices: 2})
+		dkgErrs <- err
+	}()
+	time.Sleep(200 * time.Millisecond) // let the first device start the dkg
+	go func() {
+		var err error
+		dkgResults[1], metadatas[1], err = client.JoinDkg(host, "auth-data-test")
+		dkgErrs <- err
+	}()
+	err = errors.Join(<-dkgErrs, <-dkgErrs)
+	if err != nil {
+		t.Errorf("Failed %s: could not create wallet: %s", testCase, err)
+	} else {
+		time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+		dkgResultBytes, _ := json.Marshal(dkgResults[0])
+		refreshedDkgResult, err := client.Refresh(host, string(dkgResultBytes), metadatas[0], "auth-data-test")
+		types.ProcessShouldError(testCase, err, &types.ErrDevicesMissing{}, refreshedDkgResult, t)
+	}
+	closeServer()
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func refreshTestProcessLimitedInTime(threshold, devices int) error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- refreshTestProcess(threshold, devices)
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(2 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func refreshTestProcess(threshold, devices int) error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	// Create wallet with all devices
+	dkgResults := make([]*tss.DkgResult, devices)
+	metadatas := make([]string, devices)
+	errs := make(chan error, devices)
+
+	go func() {
+		var err error
+		dkgResults[0], metadatas[0], err = client.DkgWithOptions(host, authData, client.DkgOptions{Threshold: threshold, Devices: devices})
+		errs <- err
+	}()
+
+	for i := 1; i < devices; i++ {
+		time.Sleep(200 * time.Millisecond) // let the first device start the dkg
+
+		go func(i int) {
+			var err error
+			dkgResults[i], metadatas[i], err = client.JoinDkg(host, authData)
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < devices; i++ {
+		if err := <-errs; err != nil {
+			log.Println("Error during dkg:", err)
+			return err
+		}
+	}
+
+	dkgResultStrs := make([]string, devices)
+	for i, dkgResult := range dkgResults {
+		dkgResultBytes, err := json.Marshal(dkgResult)
+		if err != nil {
+			return err
+		}
+		dkgResultStrs[i] = string(dkgResultBytes)
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	// Refresh with all devices
+	refreshedDkgResults := make([]*tss.DkgResult, devices)
+
+	go func() {
+		var err error
+		refreshedDkgResults[0], err = client.Refresh(host, dkgResultStrs[0], metadatas[0], authData)
+		errs <- err
+	}()
+
+	for i := 1; i < devices; i++ {
+		time.Sleep(200 * time.Millisecond) // let the first device start the refresh
+
+		go func(i int) {
+			var err error
+			refreshedDkgResults[i], err = client.JoinRefresh(host, dkgResultStrs[i], metadatas[i], authData)
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < devices; i++ {
+		if err := <-errs; err != nil {
+			log.Println("Error during refresh:", err)
+			return err
+		}
+	}
+
+	for i, refreshedDkgResult := range refreshedDkgResults {
+		if refreshedDkgResult.Address != dkgResults[i].Address || refreshedDkgResult.Pubkey != dkgResults[i].Pubkey {
+			return errors.New("refresh changed the wallet")
+		}
+
+		if refreshedDkgResult.Share == dkgResults[i].Share {
+			return errors.New("refresh did not change the share")
+		}
+	}
+
+	refreshedDkgResultBytes, err := json.Marshal(refreshedDkgResults[0])
+	if err != nil {
+		return err
+	}
+
+	message := []byte("test refresh " + uuid.New().String())
+
+	// The refreshed share can sign
+	_, err = client.Sign(host, message, string(refreshedDkgResultBytes), metadatas[0], authData)
+	if err != nil {
+		log.Println("Error signing with refreshed share:", err)
+		return err
+	}
+
+	// The old share cannot sign anymore
+	_, err = client.Sign(host, []byte("test refresh old share "+uuid.New().String()), dkgResultStrs[0], metadatas[0], authData)
+	if err == nil {
+		return errors.New("old share could still sign after refresh")
+	}
+
+	return nil
+}
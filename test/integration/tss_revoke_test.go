@@ -0,0 +1,166 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestRevokeDevice(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : 2-of-3 wallet, revoke a device without refresh
+
+	testCase = "test 1 (revoke without refresh)"
+
+	err = revokeTestProcessLimitedInTime(false)
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : 2-of-3 wallet, revoke a device then refresh the shares of the remaining peers
+
+	testCase = "test 2 (revoke with refresh)"
+
+	err = revokeTestProcessLimitedInTime(true)
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func revokeTestProcessLimitedInTime(refresh bool) error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- revokeTestProcess(refresh)
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(2 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func revokeTestProcess(refresh bool) error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	// Create 2-of-3 wallet with 2 devices
+	dkgResults := make([]*tss.DkgResult, 2)
+	metadatas := make([]string, 2)
+	errs := make(chan error, 2)
+
+	go func() {
+		var err error
+		dkgResults[0], metadatas[0], err = client.DkgWithOptions(host, authData, client.DkgOptions{Threshold: 2, Devices: 2})
+		errs <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond) // let the first device start the dkg
+
+	go func() {
+		var err error
+		dkgResults[1], metadatas[1], err = client.JoinDkg(host, authData)
+		errs <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			log.Println("Error during dkg:", err)
+			return err
+		}
+	}
+
+	dkgResultStrs := make([]string, 2)
+	for i, dkgResult := range dkgResults {
+		dkgResultBytes, err := json.Marshal(dkgResult)
+		if err != nil {
+			return err
+		}
+		dkgResultStrs[i] = string(dkgResultBytes)
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	// First device revokes the second one
+	updatedDkgResult, err := client.RevokeDevice(host, dkgResultStrs[0], metadatas[0], authData, dkgResults[1].PeerID, refresh)
+	if err != nil {
+		log.Println("Error revoking device:", err)
+		return err
+	}
+
+	if _, ok := updatedDkgResult.BKs[dkgResults[1].PeerID]; ok {
+		return errors.New("revoked device still in dkgResult")
+	}
+
+	if refresh && updatedDkgResult.Share == dkgResults[0].Share {
+		return errors.New("share not refreshed after revocation")
+	}
+
+	updatedDkgResultBytes, err := json.Marshal(updatedDkgResult)
+	if err != nil {
+		return err
+	}
+
+	// Revoked device cannot sign anymore
+	_, err = client.Sign(host, []byte("test revoked "+uuid.New().String()), dkgResultStrs[1], metadatas[1], authData)
+	if !errors.Is(err, &types.ErrForbidden{}) {
+		return errors.New("revoked device could still sign")
+	}
+
+	// Remaining device can still sign
+	_, err = client.Sign(host, []byte("test revoke "+uuid.New().String()), string(updatedDkgResultBytes), metadatas[0], authData)
+	if err != nil {
+		log.Println("Error signing with remaining device:", err)
+		return err
+	}
+
+	// Device already revoked
+	_, err = client.RevokeDevice(host, string(updatedDkgResultBytes), metadatas[0], authData, dkgResults[1].PeerID, false)
+	if !errors.Is(err, &types.ErrNotFound{}) {
+		return errors.New("revoking an unknown device did not fail")
+	}
+
+	// Last device cannot be revoked, the threshold would not be reachable anymore
+	_, err = client.RevokeDevice(host, string(updatedDkgResultBytes), metadatas[0], authData, dkgResults[0].PeerID, false)
+	if !errors.Is(err, &types.ErrBadRequest{}) {
+		return errors.New("revoking the last device did not fail")
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package integration
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/tx/bitcoin"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestSchnorr(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : ECDSA wallet, BIP-340 signatures for the public key and for the taproot output key
+
+	testCase = "test 1 (ECDSA wallet, schnorr and taproot signatures)"
+
+	err = schnorrTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : message of another size than 32 bytes
+
+	testCase = "test 2 (message of another size than 32 bytes)"
+
+	host, closeServer := thresholdTestServer()
+	dkgResult, metadata, err := client.Dkg(host, "auth-data-test")
+	if err != nil {
+		t.Fatalf("Failed %s: %s", testCase, err)
+	}
+
+	dkgResultBytes, _ := json.Marshal(dkgResult)
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	signature, err := client.SignSchnorr(host, []byte("not a hash"), string(dkgResultBytes), metadata, "auth-data-test", false)
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrBadRequest{}, signature, t)
+
+	///////////////////
+	/// TEST 3 : EdDSA wallet
+
+	testCase = "test 3 (EdDSA wallet)"
+
+	host, closeServer = thresholdTestServer()
+	dkgResult, metadata, err = client.DkgWithOptions(host, "auth-data-test", client.DkgOptions{Scheme: string(tss.SchemeEdDSA)})
+	if err != nil {
+		t.Fatalf("Failed %s: %s", testCase, err)
+	}
+
+	dkgResultBytes, _ = json.Marshal(dkgResult)
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	message := sha256.Sum256([]byte("test schnorr eddsa"))
+	signature, err = client.SignSchnorr(host, message[:], string(dkgResultBytes), metadata, "auth-data-test", false)
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrBadRequest{}, signature, t)
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func schnorrTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- schnorrTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func schnorrTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	dkgResult, metadata, err := client.Dkg(host, authData)
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	publicKey, err := bitcoin.PublicKey(dkgResult.Pubkey)
+	if err != nil {
+		return err
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	for _, taproot := range []bool{false, true} {
+		message := sha256.Sum256([]byte("test schnorr " + uuid.New().String()))
+
+		signature, err := client.SignSchnorr(host, message[:], string(dkgResultBytes), metadata, authData, taproot)
+		if err != nil {
+			log.Println("Error signing:", err)
+			return err
+		}
+
+		// BIP-340 verification, with the x-only public key
+		var key *btcec.PublicKey
+		if taproot {
+			key, err = schnorr.ParsePubKey(schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(publicKey)))
+		} else {
+			key, err = schnorr.ParsePubKey(schnorr.SerializePubKey(publicKey))
+		}
+		if err != nil {
+			return err
+		}
+
+		sig, err := schnorr.ParseSignature(signature.Signature)
+		if err != nil {
+			return err
+		}
+
+		if !sig.Verify(message[:], key) {
+			return errors.New("schnorr signature does not verify")
+		}
+	}
+
+	return nil
+}
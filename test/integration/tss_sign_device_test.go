@@ -0,0 +1,122 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestSignDevice(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : signing device is recorded
+
+	testCase = "test 1 (signing device is recorded)"
+
+	err = signDeviceTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func signDeviceTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- signDeviceTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+func signDeviceTestProcess() error {
+	queries := database.New(db)
+
+	_, err := queries.Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	dkgResult, metadata, err := client.Dkg(host, authData)
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	// Registered device signs, and is recorded as such
+	message := []byte("test sign device " + uuid.New().String())
+
+	_, err = client.Sign(host, message, string(dkgResultBytes), metadata, authData)
+	if err != nil {
+		log.Println("Error signing:", err)
+		return err
+	}
+
+	user, err := queries.GetUserByAddress(context.Background(), dkgResult.Address)
+	if err != nil {
+		return err
+	}
+
+	signatures, err := queries.GetUserSignatures(context.Background(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(signatures) != 1 || signatures[0].PeerID != dkgResult.PeerID || !bytes.Equal(signatures[0].Message, message) {
+		return errors.New("signing device not recorded")
+	}
+
+	// Unknown device is forbidden
+	dkgResult.PeerID = "unknown-device"
+	dkgResultBytes, err = json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Sign(host, []byte("test sign unknown device "+uuid.New().String()), string(dkgResultBytes), metadata, authData)
+	if !errors.Is(err, &types.ErrForbidden{}) {
+		return errors.New("unknown device was not forbidden")
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package integration
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server/database"
+	meemawTypes "github.com/getmeemaw/meemaw/utils/types"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestSignTx(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : transaction signed through /sign-tx
+
+	testCase = "test 1 (transaction signed through /sign-tx)"
+
+	err = signTxTestProcessLimitedInTime()
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func signTxTestProcessLimitedInTime() error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- signTxTestProcess()
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(1 * time.Minute):
+		return &meemawTypes.ErrTimeOut{}
+	}
+}
+
+func signTxTestProcess() error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	dkgResult, metadata, err := client.Dkg(host, authData)
+	if err != nil {
+		log.Println("Error during dkg:", err)
+		return err
+	}
+
+	dkgResultBytes, err := json.Marshal(dkgResult)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	// Valid transaction is signed by the wallet
+	jsonEncodedTx := `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":10000000000000,"nonce":5,"gasLimit":21000,"gasPrice":34}`
+
+	signedTx, err := client.SignEthTransaction(host, jsonEncodedTx, "11155111", string(dkgResultBytes), metadata, authData)
+	if err != nil {
+		log.Println("Error signing tx:", err)
+		return err
+	}
+
+	rawSignedTx, err := hex.DecodeString(signedTx)
+	if err != nil {
+		return err
+	}
+
+	var recoveredTx types.Transaction
+	err = recoveredTx.UnmarshalBinary(rawSignedTx)
+	if err != nil {
+		return err
+	}
+
+	sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(11155111)), &recoveredTx)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(sender.Hex(), dkgResult.Address) {
+		return errors.New("transaction not signed by the wallet: " + sender.Hex())
+	}
+
+	// Invalid transaction is rejected by the server
+	_, err = client.SignEthTransaction(host, `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasPrice":34}`, "11155111", string(dkgResultBytes), metadata, authData)
+	if !errors.Is(err, &meemawTypes.ErrBadRequest{}) {
+		return errors.New("invalid transaction was not rejected")
+	}
+
+	return nil
+}
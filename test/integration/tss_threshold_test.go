@@ -0,0 +1,318 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getmeemaw/meemaw/client"
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/utils/tss"
+	"github.com/getmeemaw/meemaw/utils/types"
+	"github.com/google/uuid"
+)
+
+//////////////////////
+/// TEST SCENARIOS ///
+//////////////////////
+
+func TestThreshold(t *testing.T) {
+
+	var testCase string
+	var err error
+
+	///////////////////
+	/// TEST 1 : 2-of-3 wallet, each device signs with the server
+
+	testCase = "test 1 (2-of-3 wallet, each device signs with the server)"
+
+	err = thresholdTestProcessLimitedInTime(2, 2)
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 2 : 3-of-3 wallet, both devices sign together
+
+	testCase = "test 2 (3-of-3 wallet, both devices sign together)"
+
+	err = thresholdTestProcessLimitedInTime(3, 2)
+	if err != nil {
+		t.Errorf("Failed %s: %s", testCase, err)
+	} else {
+		t.Logf("Successful %s\n", testCase)
+	}
+
+	///////////////////
+	/// TEST 3 : threshold higher than number of peers
+
+	testCase = "test 3 (threshold higher than number of peers)"
+
+	host, closeServer := thresholdTestServer()
+	dkgResult, _, err := client.DkgWithOptions(host, "auth-data-test", client.DkgOptions{Threshold: 4, Devices: 2})
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrBadRequest{}, dkgResult, t)
+
+	///////////////////
+	/// TEST 4 : no dkg to join
+
+	testCase = "test 4 (no dkg to join)"
+
+	host, closeServer = thresholdTestServer()
+	dkgResult, _, err = client.JoinDkg(host, "auth-data-test")
+	closeServer()
+	types.ProcessShouldError(testCase, err, &types.ErrNotFound{}, dkgResult, t)
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+func thresholdTestProcessLimitedInTime(threshold, devices int) error {
+	errorCh := make(chan error, 1)
+
+	go func() {
+		errorCh <- thresholdTestProcess(threshold, devices)
+	}()
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-time.After(2 * time.Minute):
+		return &types.ErrTimeOut{}
+	}
+}
+
+// thresholdTestServer starts a meemaw server for a new user
+func thresholdTestServer() (string, func()) {
+	authServer := httptest.NewServer(http.HandlerFunc(getCustomAuthHandler("my-threshold-user-" + uuid.New().String())))
+
+	var config = server.Config{
+		AuthServerUrl: "http://" + authServer.Listener.Addr().String(),
+		AuthType:      "custom",
+		ClientOrigin:  "localhost",
+		DevMode:       true,
+		Export:        true,
+		MultiDevice:   true,
+	}
+
+	queries := database.New(db)
+
+	_server := server.NewServer(vault.NewVault(queries), &config, nil, logging)
+
+	meemawServer := httptest.NewServer(_server.Router())
+
+	return "http://" + meemawServer.Listener.Addr().String(), func() {
+		meemawServer.Close()
+		authServer.Close()
+	}
+}
+
+func thresholdTestProcess(threshold, devices int) error {
+	_, err := database.New(db).Status(context.Background())
+	if err != nil {
+		log.Println("Could not connect to db... ", err)
+		return err
+	}
+
+	host, closeServer := thresholdTestServer()
+	defer closeServer()
+
+	authData := "auth-data-test"
+
+	// Create wallet with all devices
+	dkgResults := make([]*tss.DkgResult, devices)
+	metadatas := make([]string, devices)
+	errs := make(chan error, devices)
+
+	go func() {
+		var err error
+		dkgResults[0], metadatas[0], err = client.DkgWithOptions(host, authData, client.DkgOptions{Threshold: threshold, Devices: devices})
+		errs <- err
+	}()
+
+	for i := 1; i < devices; i++ {
+		time.Sleep(200 * time.Millisecond) // let the first device start the dkg
+
+		go func(i int) {
+			var err error
+			dkgResults[i], metadatas[i], err = client.JoinDkg(host, authData)
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < devices; i++ {
+		if err := <-errs; err != nil {
+			log.Println("Error during dkg:", err)
+			return err
+		}
+	}
+
+	dkgResultStrs := make([]string, devices)
+	peerIDs := make([]string, devices)
+	for i, dkgResult := range dkgResults {
+		if dkgResult.Pubkey != dkgResults[0].Pubkey || metadatas[i] != metadatas[0] {
+			return errors.New("different wallets between devices")
+		}
+
+		if dkgResult.GetThreshold() != uint32(threshold) {
+			return errors.New("wrong threshold stored in dkg result")
+		}
+
+		dkgResultBytes, err := json.Marshal(dkgResult)
+		if err != nil {
+			return err
+		}
+		dkgResultStrs[i] = string(dkgResultBytes)
+		peerIDs[i] = dkgResult.PeerID
+	}
+
+	time.Sleep(1 * time.Second) // Give it 1 second to make sure it's in DB.
+
+	// Sign
+	message := []byte("test threshold " + uuid.New().String())
+
+	if threshold == 2 {
+		// Any device can sign with the server
+		for i := range dkgResultStrs {
+			_, err := client.Sign(host, message, dkgResultStrs[i], metadatas[i], authData)
+			if err != nil {
+				log.Println("Error signing with device", i, ":", err)
+				return err
+			}
+		}
+	} else {
+		// A single device is not enough
+		_, err := client.Sign(host, message, dkgResultStrs[0], metadatas[0], authData)
+		if !errors.Is(err, &types.ErrBadRequest{}) {
+			return errors.New("signing with less peers than threshold did not fail")
+		}
+
+		// All devices sign together
+		go func() {
+			_, err := client.SignWithPeers(host, message, dkgResultStrs[0], metadatas[0], authData, peerIDs[1:])
+			errs <- err
+		}()
+
+		for i := 1; i < devices; i++ {
+			time.Sleep(200 * time.Millisecond) // let the first device start the signing process
+
+			go func(i int) {
+				_, err := client.JoinSign(host, message, dkgResultStrs[i], metadatas[i], authData)
+				errs <- err
+			}(i)
+		}
+
+		for i := 0; i < devices; i++ {
+			if err := <-errs; err != nil {
+				log.Println("Error during signing:", err)
+				return err
+			}
+		}
+
+		// Add a device: all devices accept it together
+		newDeviceDone := make(chan error, 1)
+		var dkgResultNewDevice *tss.DkgResult
+		var metadataNewDevice string
+		go func() {
+			var err error
+			dkgResultNewDevice, metadataNewDevice, err = client.RegisterDevice(host, authData, "new-device")
+			newDeviceDone <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond) // let the new device register
+
+		// The accepting devices get their dkg result including the new device
+		acceptedDkgResults := make([]*tss.DkgResult, devices)
+		go func() {
+			var err error
+			acceptedDkgResults[0], err = client.AcceptDeviceWithPeers(host, dkgResultStrs[0], metadatas[0], authData, peerIDs[1:])
+			errs <- err
+		}()
+
+		for i := 1; i < devices; i++ {
+			time.Sleep(200 * time.Millisecond) // let the first device start the adding process
+
+			go func(i int) {
+				var err error
+				acceptedDkgResults[i], err = client.JoinAcceptDevice(host, dkgResultStrs[i], metadatas[i], authData)
+				errs <- err
+			}(i)
+		}
+
+		for i := 0; i < devices; i++ {
+			if err := <-errs; err != nil {
+				log.Println("Error during adding device:", err)
+				return err
+			}
+		}
+
+		if err := <-newDeviceDone; err != nil {
+			log.Println("Error during registering device:", err)
+			return err
+		}
+
+		for i, acceptedDkgResult := range acceptedDkgResults {
+			if _, ok := acceptedDkgResult.BKs[dkgResultNewDevice.PeerID]; !ok {
+				return errors.New("new device missing from accepting device")
+			}
+
+			acceptedDkgResultBytes, err := json.Marshal(acceptedDkgResult)
+			if err != nil {
+				return err
+			}
+			dkgResultStrs[i] = string(acceptedDkgResultBytes)
+		}
+
+		if dkgResultNewDevice.Pubkey != dkgResults[0].Pubkey || dkgResultNewDevice.GetThreshold() != uint32(threshold) {
+			return errors.New("different wallet on new device")
+		}
+
+		dkgResultNewDeviceBytes, err := json.Marshal(dkgResultNewDevice)
+		if err != nil {
+			return err
+		}
+
+		// The new device signs with the other devices but the first one
+		message = []byte("test threshold new device " + uuid.New().String())
+
+		go func() {
+			_, err := client.SignWithPeers(host, message, string(dkgResultNewDeviceBytes), metadataNewDevice, authData, peerIDs[1:])
+			errs <- err
+		}()
+
+		for i := 1; i < devices; i++ {
+			time.Sleep(200 * time.Millisecond) // let the new device start the signing process
+
+			go func(i int) {
+				_, err := client.JoinSign(host, message, dkgResultStrs[i], metadatas[i], authData)
+				errs <- err
+			}(i)
+		}
+
+		for i := 0; i < devices; i++ {
+			if err := <-errs; err != nil {
+				log.Println("Error during signing with new device:", err)
+				return err
+			}
+		}
+	}
+
+	// Export requires threshold-1 devices
+	_, err = client.ExportWithDevices(host, dkgResultStrs[:threshold-1], metadatas[0], authData)
+	if err != nil {
+		log.Println("Error exporting:", err)
+		return err
+	}
+
+	return nil
+}
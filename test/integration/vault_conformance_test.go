@@ -0,0 +1,17 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/getmeemaw/meemaw/server"
+	"github.com/getmeemaw/meemaw/server/database"
+	"github.com/getmeemaw/meemaw/server/vault"
+	"github.com/getmeemaw/meemaw/server/vault/vaulttest"
+)
+
+// TestPostgresVaultConformance runs the conformance test suite shared by all vault backends against the postgres vault
+func TestPostgresVaultConformance(t *testing.T) {
+	vaulttest.Run(t, func() server.Vault {
+		return vault.NewVault(database.New(db))
+	})
+}
@@ -0,0 +1,173 @@
+package tss
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+)
+
+/////////
+//
+// Non-hardened derivation of child keys from the key of an ECDSA wallet: one wallet (one dkg) serves many addresses.
+// Each level follows CKDpub of BIP-32, but this is not BIP-32: wallets have no chain code (they do not come from a seed), there is no xpub, and other BIP-32 wallets do not derive the same keys.
+// The tweak of each level, IL = HMAC-SHA512(chain code, serP(K) || index)[:32], only depends on public data: the client and the server compute it on their own, the child key being K + IL*G and the child share share + IL.
+// The shares being Shamir shares (rank 0), adding IL to all shares adds IL to the private key, whatever the signing peers.
+// The chain code of the key of the wallet is a hash of its public key: anyone knowing the public key can derive the child public keys.
+// Hardened derivation requires the private key and is not supported.
+//
+/////////
+
+var (
+	ErrInvalidPath        = errors.New("invalid derivation path")
+	ErrHardenedDerivation = errors.New("hardened derivation is not supported")
+)
+
+const _hardenedIndex uint32 = 1 << 31
+
+// tag of the hash of the public key giving the chain code of the key of the wallet
+// Changing it changes all child keys: kept as is for the wallets already deriving addresses
+const tagChainCode = "meemaw/bip32/chaincode"
+
+// ParseDerivationPath returns the indexes of a non-hardened derivation path (e.g. m/0/1, in the notation of BIP-32), an empty path (or m) being the key of the wallet itself
+func ParseDerivationPath(path string) ([]uint32, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "m"), "/")
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	var indexes []uint32
+	for _, component := range strings.Split(path, "/") {
+		if strings.HasSuffix(component, "'") || strings.HasSuffix(component, "h") || strings.HasSuffix(component, "H") {
+			return nil, fmt.Errorf("%w: %s", ErrHardenedDerivation, component)
+		}
+
+		index, err := strconv.ParseUint(component, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPath, component)
+		}
+		if uint32(index) >= _hardenedIndex {
+			return nil, fmt.Errorf("%w: %s", ErrHardenedDerivation, component)
+		}
+
+		indexes = append(indexes, uint32(index))
+	}
+
+	return indexes, nil
+}
+
+// DeriveDkgResult returns the wallet of the child key at path: public key, address, share and public shares are tweaked, BKs are left untouched
+// Works on both sides (client and server), each with its own share
+func DeriveDkgResult(dkgResult *DkgResult, path string) (*DkgResult, error) {
+	pubkey, tweak, err := deriveChild(dkgResult.Pubkey, dkgResult.GetScheme(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	share, ok := new(big.Int).SetString(dkgResult.Share, 10)
+	if !ok {
+		return nil, ErrConversion
+	}
+	share.Add(share, tweak)
+	share.Mod(share, SchemeECDSA.Curve().Params().N)
+
+	derived := *dkgResult
+	derived.Pubkey = pubkey.GetStr()
+	derived.Address = pubkey.getAddress(dkgResult.GetScheme())
+	derived.Share = share.String()
+
+	// Y_i + tweak * G for each peer, as each share gets the tweak
+	if len(dkgResult.PublicShares) > 0 {
+		tweakPoint := ecpointgrouplaw.ScalarBaseMult(SchemeECDSA.Curve(), tweak)
+		derived.PublicShares = make(map[string]PubkeyStr, len(dkgResult.PublicShares))
+		for peerID, publicShareStr := range dkgResult.PublicShares {
+			publicShare, err := NewPubkey(publicShareStr)
+			if err != nil {
+				return nil, err
+			}
+			point, err := publicShare.GetECPointOnCurve(SchemeECDSA.Curve())
+			if err != nil {
+				return nil, err
+			}
+			point, err = point.Add(tweakPoint)
+			if err != nil {
+				return nil, err
+			}
+			derivedShare := Pubkey{X: point.GetX(), Y: point.GetY()}
+			derived.PublicShares[peerID] = derivedShare.GetStr()
+		}
+	}
+
+	return &derived, nil
+}
+
+// DeriveAddress returns the address of the child key at path, as returned in DkgResult.Address for the key of the wallet
+func DeriveAddress(pubkeyStr PubkeyStr, scheme Scheme, path string) (string, error) {
+	pubkey, _, err := deriveChild(pubkeyStr, scheme, path)
+	if err != nil {
+		return "", err
+	}
+
+	return pubkey.getAddress(scheme), nil
+}
+
+// deriveChild returns the child public key at path, and the sum of the tweaks of all levels (to be added to the shares)
+func deriveChild(pubkeyStr PubkeyStr, scheme Scheme, path string) (*Pubkey, *big.Int, error) {
+	if schemeOrDefault(scheme) != SchemeECDSA {
+		return nil, nil, fmt.Errorf("%w: derivation requires an %s wallet, got %s", ErrUnsupportedScheme, SchemeECDSA, scheme)
+	}
+
+	indexes, err := ParseDerivationPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pubkey, err := NewPubkey(pubkeyStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	curve := SchemeECDSA.Curve()
+	curveN := curve.Params().N
+
+	key, err := pubkey.GetECPointOnCurve(curve)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chainCode := taggedHash(tagChainCode, compressPoint(key))
+	tweak := big.NewInt(0)
+
+	for _, index := range indexes {
+		// CKDpub of BIP-32: I = HMAC-SHA512(c, serP(K) || ser32(i))
+		mac := hmac.New(sha512.New, chainCode)
+		mac.Write(compressPoint(key))
+		mac.Write(binary.BigEndian.AppendUint32(nil, index))
+		I := mac.Sum(nil)
+
+		IL := new(big.Int).SetBytes(I[:32])
+		if IL.Cmp(curveN) >= 0 {
+			return nil, nil, fmt.Errorf("%w: invalid child at index %d", ErrInvalidPath, index)
+		}
+
+		key, err = key.Add(ecpointgrouplaw.ScalarBaseMult(curve, IL))
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.IsIdentity() {
+			return nil, nil, fmt.Errorf("%w: invalid child at index %d", ErrInvalidPath, index)
+		}
+
+		chainCode = I[32:]
+		tweak.Add(tweak, IL)
+	}
+
+	return &Pubkey{X: key.GetX(), Y: key.GetY()}, tweak.Mod(tweak, curveN), nil
+}
@@ -0,0 +1,87 @@
+package tss
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+	elliptic_alice "github.com/getamis/alice/crypto/elliptic"
+)
+
+// Scheme is the signature scheme of a wallet, i.e. the curve used for dkg and the signing protocol
+type Scheme string
+
+const (
+	SchemeECDSA Scheme = "ecdsa-secp256k1" // GG18 ECDSA on secp256k1 (Ethereum, Bitcoin, etc), default scheme
+	SchemeEdDSA Scheme = "eddsa-ed25519"   // FROST EdDSA on ed25519 (Solana, Aptos, Sui, etc)
+)
+
+var ErrUnsupportedScheme = errors.New("unsupported scheme")
+
+// ParseScheme returns the scheme corresponding to the input, an empty input being the default scheme (ECDSA)
+func ParseScheme(scheme string) (Scheme, error) {
+	switch Scheme(scheme) {
+	case "", SchemeECDSA:
+		return SchemeECDSA, nil
+	case SchemeEdDSA:
+		return SchemeEdDSA, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
+	}
+}
+
+// schemeOrDefault returns the scheme, wallets created before EdDSA was supported do not have one and are ECDSA
+func schemeOrDefault(scheme Scheme) Scheme {
+	if scheme == "" {
+		return SchemeECDSA
+	}
+	return scheme
+}
+
+// Curve returns the curve used by the scheme
+func (s Scheme) Curve() elliptic_alice.Curve {
+	if schemeOrDefault(s) == SchemeEdDSA {
+		return elliptic_alice.Ed25519()
+	}
+	return elliptic_alice.Secp256k1()
+}
+
+// GetECPointOnCurve returns the public key as a point of the given curve (GetECPoint assumes secp256k1)
+func (k *Pubkey) GetECPointOnCurve(curve elliptic_alice.Curve) (*ecpointgrouplaw.ECPoint, error) {
+	return ecpointgrouplaw.NewECPoint(curve, k.X, k.Y)
+}
+
+// GetEd25519 returns the public key in the standard ed25519 format (RFC 8032)
+func (k *Pubkey) GetEd25519() ed25519.PublicKey {
+	return encodeEd25519Point(k.X, k.Y)
+}
+
+// getAddress returns the address of the wallet depending on its scheme : Ethereum address for ECDSA, hex-encoded public key for EdDSA (each chain then derives its own address format from it)
+func (k *Pubkey) getAddress(scheme Scheme) string {
+	if schemeOrDefault(scheme) == SchemeEdDSA {
+		return hex.EncodeToString(k.GetEd25519())
+	}
+	return k.GetAddress().Hex()
+}
+
+// encodeEd25519Point encodes a point of ed25519 as per RFC 8032 : y in little-endian, with the sign of x as most significant bit
+func encodeEd25519Point(x, y *big.Int) []byte {
+	encoded := littleEndian32(y)
+	if x.Bit(0) == 1 {
+		encoded[31] |= 0x80
+	}
+	return encoded
+}
+
+// littleEndian32 returns a number lower than 2^256 as 32 bytes in little-endian
+func littleEndian32(n *big.Int) []byte {
+	bigEndian := n.FillBytes(make([]byte, 32))
+	ret := make([]byte, 32)
+	for i := range bigEndian {
+		ret[i] = bigEndian[31-i]
+	}
+	return ret
+}
@@ -0,0 +1,128 @@
+package tss
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+)
+
+/////////
+//
+// Sealing of data for one peer of a wallet (ECIES with the public share of the peer): only the holder of the share can open it.
+// The server uses it to hand data to a device without being able to read it (e.g. the key of the metadata after a rotation by another device).
+// Sealed data: ephemeral point (X || Y, 32 bytes each) || nonce || AES-256-GCM ciphertext, the key being the hash of the ephemeral point and of the shared point.
+//
+/////////
+
+var ErrInvalidSealed = errors.New("invalid sealed data")
+
+// tag of the hash giving the key of sealed data
+const tagSeal = "meemaw/seal"
+
+// SealForPeer encrypts the plaintext for the peer owning the given public share (share * G on the curve of the scheme)
+func SealForPeer(scheme Scheme, publicShare PubkeyStr, plaintext []byte) ([]byte, error) {
+	curve := scheme.Curve()
+
+	pubkey, err := NewPubkey(publicShare)
+	if err != nil {
+		return nil, err
+	}
+	point, err := pubkey.GetECPointOnCurve(curve)
+	if err != nil || point.IsIdentity() {
+		return nil, fmt.Errorf("invalid public share: %w", ErrInvalidSealed)
+	}
+
+	k, err := randomScalar(curve.Params().N)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := ecpointgrouplaw.ScalarBaseMult(curve, k)
+	shared := point.ScalarMult(k)
+
+	aead, err := sealingCipher(ephemeral, shared)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(bytes32(ephemeral.GetX()), bytes32(ephemeral.GetY())...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, nil), nil
+}
+
+// OpenSealed decrypts data sealed for the peer of the dkg result with SealForPeer
+func (r *DkgResult) OpenSealed(sealed []byte) ([]byte, error) {
+	curve := r.GetScheme().Curve()
+
+	share, ok := new(big.Int).SetString(r.Share, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid share")
+	}
+
+	if len(sealed) < 64 {
+		return nil, ErrInvalidSealed
+	}
+	ephemeral, err := ecpointgrouplaw.NewECPoint(curve, new(big.Int).SetBytes(sealed[:32]), new(big.Int).SetBytes(sealed[32:64]))
+	if err != nil || ephemeral.IsIdentity() {
+		return nil, ErrInvalidSealed
+	}
+	shared := ephemeral.ScalarMult(share)
+
+	aead, err := sealingCipher(ephemeral, shared)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 64+aead.NonceSize() {
+		return nil, ErrInvalidSealed
+	}
+	nonce := sealed[64 : 64+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, sealed[64+aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	return plaintext, nil
+}
+
+// sealingCipher returns the AES-GCM cipher keyed by the hash of the ephemeral point and of the shared point
+func sealingCipher(ephemeral, shared *ecpointgrouplaw.ECPoint) (cipher.AEAD, error) {
+	if shared.IsIdentity() {
+		return nil, ErrInvalidSealed
+	}
+
+	h := sha256.New()
+	h.Write([]byte(tagSeal))
+	h.Write(bytes32(ephemeral.GetX()))
+	h.Write(bytes32(ephemeral.GetY()))
+	h.Write(bytes32(shared.GetX()))
+	h.Write(bytes32(shared.GetY()))
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// randomScalar returns a random number in [1, n)
+func randomScalar(n *big.Int) (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
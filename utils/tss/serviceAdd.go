@@ -1,7 +1,6 @@
 package tss
 
 import (
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -10,34 +9,10 @@ import (
 	"github.com/getamis/alice/crypto/tss/ecdsa/addshare/newpeer"
 	"github.com/getamis/alice/crypto/tss/ecdsa/addshare/oldpeer"
 	"github.com/getamis/alice/types"
-	"google.golang.org/protobuf/proto"
 )
 
 func AdderGenericHandle(msg *Message, pm *PeerManager, peerID string) error {
-	msgStr, ok := msg.Message.(string)
-	if !ok {
-		log.Println("msg was not a string")
-		return errors.New("msg was not a string")
-	}
-	byteString, err := hex.DecodeString(msgStr)
-	if err != nil {
-		log.Println("error decoding hex:", err)
-		return err
-	}
-	addMsg := &addshare.Message{}
-	err = proto.Unmarshal(byteString, addMsg)
-	// err = json.Unmarshal(byteString, addMsg)
-	if err != nil {
-		log.Println("ExistingClientAdd.HandleMessage: could not proto unmarshal tss message to addshare.Message")
-		return err
-	}
-
-	if msg.PeerID == peerID { // existing client is the target peer
-		return pm.HandleMessage(addMsg)
-	} else {
-		pm.MustSend(msg.PeerID, addMsg)
-		return nil
-	}
+	return routeMessage(msg, pm, peerID, &addshare.Message{})
 }
 
 //////////
@@ -78,7 +53,7 @@ func (p *serviceAddExisting) Init(pm *PeerManager) error {
 	p.pm = pm
 
 	// AddShare needs results from DKG.
-	dkgResult, err := ConvertDKGResult(p.pubkey, p.share, p.BKs)
+	dkgResult, err := ConvertDKGResult(SchemeECDSA.Curve(), p.pubkey, p.share, p.BKs)
 	if err != nil {
 		log.Println("Cannot get DKG result", "err", err)
 		return err
@@ -227,8 +202,9 @@ func (p *serviceAddNew) OnStateChanged(oldState types.MainState, newState types.
 // ///////
 // Server
 type ServerAdd struct {
-	service     *serviceAddExisting
-	originalBKs map[string]BK
+	service              *serviceAddExisting
+	originalBKs          map[string]BK
+	originalPublicShares map[string]PubkeyStr
 }
 
 func (p *ServerAdd) GetOriginalWallet() *DkgResult {
@@ -242,35 +218,46 @@ func (p *ServerAdd) GetOriginalWallet() *DkgResult {
 	pubkeyStr := pubkey.GetStr()
 
 	dkgResult := DkgResult{
-		Pubkey:  pubkeyStr,
-		BKs:     p.originalBKs,
-		Share:   share,
-		Address: addr,
-		PeerID:  _serverID,
+		Pubkey:       pubkeyStr,
+		BKs:          p.originalBKs,
+		Share:        share,
+		Address:      addr,
+		PeerID:       _serverID,
+		Threshold:    p.service.threshold,
+		PublicShares: p.originalPublicShares,
 	}
 
 	return &dkgResult
 }
 
-func NewServerAdd(newClientPeerID string, existingClientPeerID string, pubkeyStr PubkeyStr, share string, BKs map[string]BK) (*ServerAdd, error) {
+// NewServerAdd prepares the addition of a new device to the wallet, with the server and existing devices generating the new share
+// The server and the existing devices need to reach the threshold of the wallet: t-1 existing devices take part in the process (only ECDSA wallets)
+func NewServerAdd(newClientPeerID string, existingClientPeerIDs []string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, threshold uint32, scheme Scheme) (*ServerAdd, error) {
 	// will probably need a wrapper with JSON input
 
+	if schemeOrDefault(scheme) != SchemeECDSA {
+		return nil, fmt.Errorf("%w for adding device: %s", ErrUnsupportedScheme, scheme)
+	}
+
 	pubkey, err := NewPubkey(pubkeyStr)
 	if err != nil {
 		return nil, err
 	}
 
-	newBKs := make(map[string]BK)
-	for key, value := range BKs {
-		if key == _serverID || key == existingClientPeerID {
-			newBKs[key] = value
-		}
+	threshold = thresholdOrDefault(threshold)
+
+	newBKs, err := selectBKs(BKs, existingClientPeerIDs, threshold)
+	if err != nil {
+		log.Println("error selecting peers for adding device:", err)
+		return nil, err
 	}
 
-	service := NewServiceAddExisting(pubkey, share, _threshold, newClientPeerID, newBKs)
+	service := NewServiceAddExisting(pubkey, share, threshold, newClientPeerID, newBKs)
 
 	pm := NewPeerManager(_serverID)
-	pm.AddPeer(existingClientPeerID)
+	for _, existingClientPeerID := range existingClientPeerIDs {
+		pm.AddPeer(existingClientPeerID)
+	}
 	// pm.AddPeer(AddNewClientID)
 
 	err = service.Init(pm)
@@ -284,7 +271,12 @@ func NewServerAdd(newClientPeerID string, existingClientPeerID string, pubkeyStr
 		return service.Handle(msg)
 	})
 
-	return &ServerAdd{service: service, originalBKs: BKs}, nil
+	return &ServerAdd{service: service, originalBKs: BKs, originalPublicShares: publicShares}, nil
+}
+
+// GetNewPeerID returns the peerID of the device being added
+func (p *ServerAdd) GetNewPeerID() string {
+	return p.service.newClientID
 }
 
 func (p *ServerAdd) GetDoneChan() chan struct{} {
@@ -317,11 +309,13 @@ func (p *ServerAdd) Process() (*DkgResult, error) {
 	}
 
 	dkgResult := DkgResult{
-		Pubkey:  pubkeyStr,
-		BKs:     BKs,
-		Share:   share,
-		Address: addr,
-		PeerID:  _serverID,
+		Pubkey:       pubkeyStr,
+		BKs:          BKs,
+		Share:        share,
+		Address:      addr,
+		PeerID:       _serverID,
+		Threshold:    p.service.threshold,
+		PublicShares: publicSharesStr(p.service.result.PartialPublicKeys),
 	}
 
 	return &dkgResult, nil
@@ -331,9 +325,9 @@ func (p *ServerAdd) GetNextMessageToSend(peerID string) (Message, error) {
 	return p.service.pm.GetNextMessageToSendPeer(peerID)
 }
 
-// Handle messages coming from clients : if the target is the server, consume; else, add to list of messages to be sent through MustSend
-func (p *ServerAdd) HandleMessage(msg *Message) error {
-	return AdderGenericHandle(msg, p.service.pm, _serverID)
+// Handle messages coming from the client from : if the target is the server, consume; else, add to list of messages to be sent through MustSend
+func (p *ServerAdd) HandleMessage(from string, msg *Message) error {
+	return routeClientMessage(msg, p.service.pm, from, &addshare.Message{})
 }
 
 // ///////
@@ -343,25 +337,36 @@ type ExistingClientAdd struct {
 	peerID  string
 }
 
-func NewExistingClientAdd(newClientPeerID string, peerID string, pubkeyStr PubkeyStr, share string, BKs map[string]BK) (*ExistingClientAdd, error) {
+// NewExistingClientAdd prepares the addition of a new device from an existing device, existingClientPeerIDs being all the existing devices taking part in the process (itself included)
+func NewExistingClientAdd(newClientPeerID string, peerID string, existingClientPeerIDs []string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, threshold uint32, scheme Scheme) (*ExistingClientAdd, error) {
 	// will probably need a wrapper with JSON input
 
+	if schemeOrDefault(scheme) != SchemeECDSA {
+		return nil, fmt.Errorf("%w for adding device: %s", ErrUnsupportedScheme, scheme)
+	}
+
 	pubkey, err := NewPubkey(pubkeyStr)
 	if err != nil {
 		return nil, err
 	}
 
-	newBKs := make(map[string]BK)
-	for key, value := range BKs {
-		if key == _serverID || key == peerID {
-			newBKs[key] = value
-		}
+	threshold = thresholdOrDefault(threshold)
+
+	newBKs, err := selectBKs(BKs, existingClientPeerIDs, threshold)
+	if err != nil {
+		log.Println("error selecting peers for adding device:", err)
+		return nil, err
 	}
 
-	service := NewServiceAddExisting(pubkey, share, _threshold, newClientPeerID, newBKs)
+	service := NewServiceAddExisting(pubkey, share, threshold, newClientPeerID, newBKs)
 
 	pm := NewPeerManager(peerID)
 	pm.AddPeer(_serverID)
+	for _, existingClientPeerID := range existingClientPeerIDs {
+		if existingClientPeerID != peerID {
+			pm.AddPeer(existingClientPeerID)
+		}
+	}
 	// pm.AddPeer(AddNewClientID)
 
 	err = service.Init(pm)
@@ -390,10 +395,12 @@ func (p *ExistingClientAdd) Process() (*DkgResult, error) {
 	}
 
 	res := ProcessResult{
-		PublicKey: p.service.result.PublicKey,
-		Share:     p.service.result.Share,
-		Bks:       p.service.result.Bks,
-		PeerID:    p.peerID,
+		PublicKey:    p.service.result.PublicKey,
+		Share:        p.service.result.Share,
+		Bks:          p.service.result.Bks,
+		PublicShares: p.service.result.PartialPublicKeys,
+		PeerID:       p.peerID,
+		Threshold:    p.service.threshold,
 	}
 
 	return PostProcessResult(res)
@@ -418,19 +425,26 @@ type ClientAdd struct {
 	peerID  string
 }
 
-func NewClientAdd(peerID string, acceptingDevicePeerID string, pubkeyStr PubkeyStr, BKs map[string]BK) (*ClientAdd, error) {
+// NewClientAdd prepares the addition of the new device, acceptingDevicePeerIDs being the existing devices taking part in the process
+func NewClientAdd(peerID string, acceptingDevicePeerIDs []string, pubkeyStr PubkeyStr, BKs map[string]BK, threshold uint32, scheme Scheme) (*ClientAdd, error) {
 	// will probably need a wrapper with JSON input
 
+	if schemeOrDefault(scheme) != SchemeECDSA {
+		return nil, fmt.Errorf("%w for adding device: %s", ErrUnsupportedScheme, scheme)
+	}
+
 	pubkey, err := NewPubkey(pubkeyStr)
 	if err != nil {
 		return nil, err
 	}
 
-	service := NewServiceAddNew(pubkey, _threshold, _rank, BKs)
+	service := NewServiceAddNew(pubkey, thresholdOrDefault(threshold), _rank, BKs)
 
 	pm := NewPeerManager(peerID)
 	pm.AddPeer(_serverID)
-	pm.AddPeer(acceptingDevicePeerID)
+	for _, acceptingDevicePeerID := range acceptingDevicePeerIDs {
+		pm.AddPeer(acceptingDevicePeerID)
+	}
 
 	err = service.Init(pm)
 	if err != nil {
@@ -458,10 +472,12 @@ func (p *ClientAdd) Process() (*DkgResult, error) {
 	}
 
 	res := ProcessResult{
-		PublicKey: p.service.result.PublicKey,
-		Share:     p.service.result.Share,
-		Bks:       p.service.result.Bks,
-		PeerID:    p.peerID,
+		PublicKey:    p.service.result.PublicKey,
+		Share:        p.service.result.Share,
+		Bks:          p.service.result.Bks,
+		PublicShares: p.service.result.PartialPublicKeys,
+		PeerID:       p.peerID,
+		Threshold:    p.service.threshold,
 	}
 
 	return PostProcessResult(res)
@@ -0,0 +1,296 @@
+package tss
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+	"github.com/getamis/alice/crypto/tss/ecdsa/gg18/reshare"
+	"github.com/getamis/alice/types"
+)
+
+var ErrMissingPeers = errors.New("all peers of the wallet must take part in the refresh")
+
+// serviceRefresh re-randomises the shares of all the peers of a wallet (proactive refresh), without changing the public key
+type serviceRefresh struct {
+	pm        *PeerManager
+	resharer  *reshare.Reshare
+	pubkey    *Pubkey
+	share     string
+	threshold uint32
+	BKs       map[string]BK
+	done      chan struct{}
+	result    *reshare.Result
+	err       error
+
+	// public shares of the other peers, from their result messages (the result of the resharer only holds the share)
+	publicSharesMu sync.Mutex
+	publicShares   map[string]*ecpointgrouplaw.EcPointMessage
+}
+
+func NewServiceRefresh(pubkey *Pubkey, share string, threshold uint32, BKs map[string]BK) *serviceRefresh {
+	s := &serviceRefresh{
+		pubkey:    pubkey,
+		share:     share,
+		threshold: threshold,
+		BKs:       BKs,
+		done:      make(chan struct{}),
+
+		publicShares: make(map[string]*ecpointgrouplaw.EcPointMessage),
+	}
+
+	return s
+}
+
+func (p *serviceRefresh) Init(pm *PeerManager) error {
+	p.pm = pm
+
+	// Reshare needs results from DKG.
+	dkgResult, err := ConvertDKGResult(SchemeECDSA.Curve(), p.pubkey, p.share, p.BKs)
+	if err != nil {
+		log.Println("Cannot get DKG result", "err", err)
+		return err
+	}
+
+	resharer, err := reshare.NewReshare(pm, p.threshold, dkgResult.PublicKey, dkgResult.Share, dkgResult.Bks, p)
+	if err != nil {
+		log.Println("Cannot create a new reshare", "err", err)
+		return err
+	}
+	p.resharer = resharer
+
+	return nil
+}
+
+func (p *serviceRefresh) Handle(msg types.Message) error {
+	// The proofs of the public shares are verified by the resharer before it is done
+	if reshareMsg, ok := msg.(*reshare.Message); ok && reshareMsg.GetResult() != nil {
+		p.publicSharesMu.Lock()
+		p.publicShares[msg.GetId()] = reshareMsg.GetResult().GetSiGProofMsg().GetV()
+		p.publicSharesMu.Unlock()
+	}
+
+	return p.resharer.AddMessage(msg.GetId(), msg)
+}
+
+func (p *serviceRefresh) Process() {
+	// 1. Start a Reshare process.
+	p.resharer.Start()
+	defer p.resharer.Stop()
+
+	// 2. Wait the reshare is done or failed
+	<-p.done
+}
+
+func (p *serviceRefresh) OnStateChanged(oldState types.MainState, newState types.MainState) {
+	if newState == types.StateFailed {
+		log.Println("Refresh failed", "old", oldState.String(), "new", newState.String())
+		p.err = fmt.Errorf("refresh failed")
+		close(p.done)
+		return
+	} else if newState == types.StateDone {
+		result, err := p.resharer.GetResult()
+		if err == nil {
+			p.result = result
+		} else {
+			log.Println("Failed to get result from Refresh", "err", err)
+			p.err = err
+		}
+		close(p.done)
+		return
+	}
+}
+
+// refreshedDkgResult returns the dkg result of the peer after refresh: same wallet, new share, BKs of the peers which took part in the refresh
+func (p *serviceRefresh) refreshedDkgResult(original *DkgResult, peerID string) (*DkgResult, error) {
+	if p.result == nil {
+		return nil, errors.New("could not get refresh results")
+	}
+
+	publicShares, err := p.refreshedPublicShares(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DkgResult{
+		Pubkey:       original.Pubkey,
+		BKs:          p.BKs,
+		Share:        p.result.Share.String(),
+		Address:      original.Address,
+		PeerID:       peerID,
+		Threshold:    original.GetThreshold(),
+		Scheme:       original.GetScheme(),
+		PublicShares: publicSharesStr(publicShares),
+	}, nil
+}
+
+// refreshedPublicShares returns the public shares of all the peers after refresh, nil if some are missing
+func (p *serviceRefresh) refreshedPublicShares(peerID string) (map[string]*ecpointgrouplaw.ECPoint, error) {
+	p.publicSharesMu.Lock()
+	defer p.publicSharesMu.Unlock()
+
+	publicShares := map[string]*ecpointgrouplaw.ECPoint{
+		peerID: ecpointgrouplaw.ScalarBaseMult(SchemeECDSA.Curve(), p.result.Share),
+	}
+	for id, msg := range p.publicShares {
+		publicShare, err := msg.ToPoint()
+		if err != nil {
+			return nil, err
+		}
+		publicShares[id] = publicShare
+	}
+
+	if len(publicShares) != len(p.BKs) {
+		return nil, nil
+	}
+	return publicShares, nil
+}
+
+// GetClientPeerIDs returns the peerIDs of the devices of the wallet, sorted
+func (r *DkgResult) GetClientPeerIDs() []string {
+	peerIDs := make([]string, 0, len(r.BKs))
+	for peerID := range r.BKs {
+		if peerID != _serverID {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	sort.Strings(peerIDs)
+	return peerIDs
+}
+
+// newServiceRefresh validates the refresh of the given wallet by the given client peers and prepares the corresponding service
+// For the refresh to be meaningful, every peer known by the server must take part in it (the old shares of missing peers would remain valid), hence requireAll
+func newServiceRefresh(dkgResult *DkgResult, clientPeerIDs []string, requireAll bool) (*serviceRefresh, error) {
+	if dkgResult.GetScheme() != SchemeECDSA {
+		return nil, fmt.Errorf("%w for refresh: %s", ErrUnsupportedScheme, dkgResult.GetScheme())
+	}
+
+	pubkey, err := NewPubkey(dkgResult.Pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	newBKs, err := selectBKs(dkgResult.BKs, clientPeerIDs, dkgResult.GetThreshold())
+	if err != nil {
+		log.Println("error selecting peers for refresh:", err)
+		return nil, err
+	}
+
+	if requireAll && len(newBKs) != len(dkgResult.BKs) {
+		return nil, fmt.Errorf("%w: %d of %d peers", ErrMissingPeers, len(newBKs), len(dkgResult.BKs))
+	}
+
+	return NewServiceRefresh(pubkey, dkgResult.Share, dkgResult.GetThreshold(), newBKs), nil
+}
+
+// Server
+
+// ServerRefresh is the server side of the refresh process. As for the dkg, the server relays the messages between clients.
+type ServerRefresh struct {
+	service   *serviceRefresh
+	dkgResult *DkgResult
+}
+
+// NewServerRefresh prepares the refresh of the shares of the wallet by the server and all the devices of the wallet
+// Only ECDSA wallets are supported for now
+func NewServerRefresh(dkgResult *DkgResult) (*ServerRefresh, error) {
+	clientPeerIDs := dkgResult.GetClientPeerIDs()
+
+	service, err := newServiceRefresh(dkgResult, clientPeerIDs, true)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := NewPeerManager(_serverID)
+	for _, clientPeerID := range clientPeerIDs {
+		pm.AddPeer(clientPeerID)
+	}
+
+	err = service.Init(pm)
+	if err != nil {
+		log.Println("error initialising service refresh:", err)
+		return nil, err
+	}
+
+	pm.RegisterHandleMessage(func(msg types.Message) error {
+		return service.Handle(msg)
+	})
+
+	return &ServerRefresh{service: service, dkgResult: dkgResult}, nil
+}
+
+// Process runs the refresh and returns the refreshed dkg result of the server
+func (p *ServerRefresh) Process() (*DkgResult, error) {
+	p.service.Process()
+
+	return p.service.refreshedDkgResult(p.dkgResult, _serverID)
+}
+
+// GetNextMessageToSend returns the next message to be sent to the given client (either from the server or relayed from another client)
+func (p *ServerRefresh) GetNextMessageToSend(peerID string) (Message, error) {
+	return p.service.pm.GetNextMessageToSendPeer(peerID)
+}
+
+// HandleMessage consumes a message sent by the client from and targeted at the server, or queues it for the targeted client
+func (p *ServerRefresh) HandleMessage(from string, msg *Message) error {
+	return routeClientMessage(msg, p.service.pm, from, &reshare.Message{})
+}
+
+// Client
+type ClientRefresh struct {
+	service   *serviceRefresh
+	dkgResult *DkgResult
+}
+
+// NewClientRefresh prepares the refresh of the shares of the wallet by the client, the server and the other clients (clientPeerIDs, as provided by the server, can include the client itself)
+// Peers of the local dkg result that are not part of clientPeerIDs (e.g. revoked devices) are dropped from the refreshed dkg result
+func NewClientRefresh(dkgResult *DkgResult, clientPeerIDs []string) (*ClientRefresh, error) {
+	peerIDs := []string{dkgResult.PeerID}
+	for _, peerID := range clientPeerIDs {
+		if peerID != dkgResult.PeerID {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+
+	service, err := newServiceRefresh(dkgResult, peerIDs, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := NewPeerManager(dkgResult.PeerID)
+	pm.AddPeer(_serverID)
+	for _, peerID := range peerIDs[1:] {
+		pm.AddPeer(peerID)
+	}
+
+	err = service.Init(pm)
+	if err != nil {
+		log.Println("error initialising service refresh:", err)
+		return nil, err
+	}
+
+	pm.RegisterHandleMessage(func(msg types.Message) error {
+		return service.Handle(msg)
+	})
+
+	return &ClientRefresh{service: service, dkgResult: dkgResult}, nil
+}
+
+// Process runs the refresh and returns the refreshed dkg result of the client
+func (p *ClientRefresh) Process() (*DkgResult, error) {
+	p.service.Process()
+
+	return p.service.refreshedDkgResult(p.dkgResult, p.dkgResult.PeerID)
+}
+
+// GetNextMessageToSend returns the next message to be sent, whatever the target peer: everything goes through the server which relays to the other clients
+func (p *ClientRefresh) GetNextMessageToSend() (Message, error) {
+	return p.service.pm.GetNextMessageToSendAll()
+}
+
+func (p *ClientRefresh) HandleMessage(msg *Message) error {
+	return routeMessage(msg, p.service.pm, p.dkgResult.PeerID, &reshare.Message{})
+}
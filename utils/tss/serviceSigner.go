@@ -7,6 +7,7 @@ import (
 	"math/big"
 
 	"github.com/getamis/alice/crypto/birkhoffinterpolation"
+	"github.com/getamis/alice/crypto/elliptic"
 	"github.com/getamis/alice/crypto/homo/paillier"
 	"github.com/getamis/alice/crypto/tss/dkg"
 	"github.com/getamis/alice/crypto/tss/ecdsa/gg18/signer"
@@ -44,7 +45,7 @@ var (
 )
 
 // ConvertDKGResult converts DKG result from config.
-func ConvertDKGResult(k *Pubkey, cfgShare string, cfgBKs map[string]BK) (*dkg.Result, error) {
+func ConvertDKGResult(curve elliptic.Curve, k *Pubkey, cfgShare string, cfgBKs map[string]BK) (*dkg.Result, error) {
 	// Build public key.
 	// x, ok := new(big.Int).SetString(cfgPubkey.X, 10)
 	// if !ok {
@@ -56,7 +57,7 @@ func ConvertDKGResult(k *Pubkey, cfgShare string, cfgBKs map[string]BK) (*dkg.Re
 	// 	log.Error("Cannot convert string to big int", "y", cfgPubkey.Y)
 	// 	return nil, ErrConversion
 	// }
-	pubkey, err := k.GetECPoint()
+	pubkey, err := k.GetECPointOnCurve(curve)
 	if err != nil {
 		log.Println("Cannot get public key", "err", err)
 		return nil, err
@@ -92,7 +93,7 @@ func (p *serviceSigner) Init(pm *PeerManager) error {
 	p.pm = pm
 
 	// Signer needs results from DKG.
-	dkgResult, err := ConvertDKGResult(p.pubkey, p.share, p.BKs)
+	dkgResult, err := ConvertDKGResult(SchemeECDSA.Curve(), p.pubkey, p.share, p.BKs)
 	if err != nil {
 		log.Println("Cannot get DKG result", "err", err)
 		return err
@@ -133,6 +134,10 @@ func (p *serviceSigner) Process() {
 }
 
 func (service *serviceSigner) PostProcess() (*Signature, error) {
+	if service.result == nil {
+		return nil, fmt.Errorf("could not get signer results")
+	}
+
 	publicKeyECDSA := service.pubkey.GetECDSA()
 
 	newR, newS, err := secp256k1SignatureToLowS(publicKeyECDSA, service.result.R, service.result.S)
@@ -156,6 +161,10 @@ func (service *serviceSigner) PostProcess() (*Signature, error) {
 	return &sig, nil
 }
 
+func (p *serviceSigner) GetPeerManager() *PeerManager {
+	return p.pm
+}
+
 func (p *serviceSigner) OnStateChanged(oldState types.MainState, newState types.MainState) {
 
 	// log.Println("serviceSigner - State changed", "old", oldState.String(), "new", newState.String())
@@ -0,0 +1,73 @@
+package tss
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"log"
+	"math/big"
+
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// serviceSignerEdDSA is the equivalent of serviceSigner for EdDSA wallets, using FROST (no Paillier required, see serviceSignerFrost)
+type serviceSignerEdDSA struct {
+	*serviceSignerFrost
+}
+
+func NewServiceSignerEdDSA(pubkey *Pubkey, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, message []byte) *serviceSignerEdDSA {
+	suite := frostSuite{
+		bindingTag: "FROST/ed25519/rho",
+		encode:     encodeEd25519ECPoint,
+		challenge:  ed25519Challenge,
+	}
+
+	return &serviceSignerEdDSA{serviceSignerFrost: newServiceSignerFrost(SchemeEdDSA, suite, pubkey, share, BKs, publicShares, message)}
+}
+
+// PostProcess formats the signature as a standard ed25519 signature (R || S, RFC 8032) and verifies it
+// Signature.R is the encoded R point (as a big endian number), Signature.S is the scalar S
+func (p *serviceSignerEdDSA) PostProcess() (*Signature, error) {
+	r, s, err := p.result()
+	if err != nil {
+		return nil, err
+	}
+
+	signature := append(encodeEd25519ECPoint(r), littleEndian32(s)...)
+
+	if !ed25519.Verify(p.pubkey.GetEd25519(), p.message, signature) {
+		log.Println("error: ed25519 signature does not verify")
+		return nil, ErrInvalidSignature
+	}
+
+	sig := Signature{
+		R:         new(big.Int).SetBytes(signature[:32]),
+		S:         s,
+		Signature: signature,
+	}
+
+	return &sig, nil
+}
+
+// ed25519Challenge returns the challenge of ed25519 (RFC 8032): SHA-512(R || A || M) as a little-endian number, modulo the order of the curve
+func ed25519Challenge(R, pubkey *ecpointgrouplaw.ECPoint, message []byte) *big.Int {
+	h := sha512.New()
+	h.Write(encodeEd25519ECPoint(R))
+	h.Write(encodeEd25519ECPoint(pubkey))
+	h.Write(message)
+	digest := h.Sum(nil)
+
+	for i, j := 0, len(digest)-1; i < j; i, j = i+1, j-1 {
+		digest[i], digest[j] = digest[j], digest[i]
+	}
+
+	c := new(big.Int).SetBytes(digest)
+	return c.Mod(c, R.GetCurve().Params().N)
+}
+
+// encodeEd25519ECPoint encodes a point of ed25519 as per RFC 8032
+func encodeEd25519ECPoint(point *ecpointgrouplaw.ECPoint) []byte {
+	return encodeEd25519Point(point.GetX(), point.GetY())
+}
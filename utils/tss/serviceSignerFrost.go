@@ -0,0 +1,529 @@
+package tss
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/getamis/alice/crypto/birkhoffinterpolation"
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+	frost_signer "github.com/getamis/alice/crypto/tss/eddsa/frost/signer"
+	"github.com/getamis/alice/crypto/utils"
+	"github.com/getamis/alice/types"
+	"github.com/getamis/alice/types/message"
+	sirius_log "github.com/getamis/sirius/log"
+)
+
+/////////
+//
+// serviceSignerFrost runs the 2 rounds of FROST (nonce commitments, then partial signatures) with the shares of a wallet, and is embedded by the Schnorr signing services (serviceSignerEdDSA, serviceSignerSchnorr).
+// The FROST signer of alice cannot be used: it requires the public shares of all peers, which wallets do not keep, and its challenge on secp256k1 is the one of a draft of BIP-340. The rounds are implemented here instead, with the messages of alice.
+// Partial signatures are verified one by one with the public shares of the peers (z_i * G == R_i + c * lambda_i * Y_i), so that a wrong partial signature names its peer. Wallets stored before public shares were kept only verify the aggregated signature.
+//
+/////////
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// frostSuite holds what differs between the Schnorr signature schemes signed with FROST
+type frostSuite struct {
+	evenY      bool   // only the x coordinate of R is part of the signature (BIP-340): R must have an even Y
+	bindingTag string // tag of the hash of the binding factors of the nonces
+	encode     func(point *ecpointgrouplaw.ECPoint) []byte
+	challenge  func(R, pubkey *ecpointgrouplaw.ECPoint, message []byte) *big.Int
+
+	// key (optional) returns the key verifying the signatures, whether the shares need to be negated to match it, and the tweak to be added to the signature
+	// Without it, the signatures are verified by the public key of the wallet
+	key func(publicKey *ecpointgrouplaw.ECPoint) (*ecpointgrouplaw.ECPoint, bool, *big.Int, error)
+}
+
+type serviceSignerFrost struct {
+	pm      *PeerManager
+	main    *message.MsgMain
+	round1  *frostRound1
+	scheme  Scheme
+	suite   frostSuite
+	pubkey  *Pubkey
+	share   string
+	BKs     map[string]BK
+	message []byte
+	done    chan struct{}
+	err     error
+
+	publicShares map[string]PubkeyStr
+}
+
+func newServiceSignerFrost(scheme Scheme, suite frostSuite, pubkey *Pubkey, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, message []byte) *serviceSignerFrost {
+	s := &serviceSignerFrost{
+		scheme:  scheme,
+		suite:   suite,
+		pubkey:  pubkey,
+		share:   share,
+		BKs:     BKs,
+		message: message,
+		done:    make(chan struct{}),
+
+		publicShares: publicShares,
+	}
+
+	return s
+}
+
+func (p *serviceSignerFrost) Init(pm *PeerManager) error {
+	p.pm = pm
+
+	// Signer needs results from DKG.
+	dkgResult, err := ConvertDKGResult(p.scheme.Curve(), p.pubkey, p.share, p.BKs)
+	if err != nil {
+		log.Println("Cannot get DKG result", "err", err)
+		return err
+	}
+
+	// Public shares of the signing peers, when known
+	publicShares := make(map[string]*ecpointgrouplaw.ECPoint)
+	for peerID := range p.BKs {
+		publicShareStr, ok := p.publicShares[peerID]
+		if !ok {
+			continue
+		}
+
+		publicShare, err := NewPubkey(publicShareStr)
+		if err != nil {
+			return err
+		}
+		publicShares[peerID], err = publicShare.GetECPointOnCurve(p.scheme.Curve())
+		if err != nil {
+			return err
+		}
+	}
+
+	round1, err := newFrostRound1(pm, p.suite, dkgResult.PublicKey, dkgResult.Share, dkgResult.Bks, publicShares, p.message)
+	if err != nil {
+		log.Println("Cannot create a new signer", "err", err)
+		return err
+	}
+	p.round1 = round1
+
+	p.main = message.NewMsgMain(pm.SelfID(), pm.NumPeers(), p, round1, types.MessageType(frost_signer.Type_Round1), types.MessageType(frost_signer.Type_Round2))
+
+	return nil
+}
+
+func (p *serviceSignerFrost) Handle(msg types.Message) error {
+	return p.main.AddMessage(msg.GetId(), msg)
+}
+
+func (p *serviceSignerFrost) Process() {
+	// 1. Start a Signing process.
+	p.main.Start()
+	defer p.main.Stop()
+
+	for _, peerID := range p.pm.PeerIDs() {
+		p.pm.MustSend(peerID, p.round1.round1Msg)
+	}
+
+	// 2. Wait the signing is done or failed
+	<-p.done
+}
+
+// result returns R and s of the aggregated signature
+func (p *serviceSignerFrost) result() (*ecpointgrouplaw.ECPoint, *big.Int, error) {
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+	if p.round1 == nil || p.round1.s == nil {
+		return nil, nil, fmt.Errorf("could not get signer results")
+	}
+	return p.round1.r, p.round1.s, nil
+}
+
+func (p *serviceSignerFrost) GetPeerManager() *PeerManager {
+	return p.pm
+}
+
+func (p *serviceSignerFrost) OnStateChanged(oldState types.MainState, newState types.MainState) {
+	if newState == types.StateFailed {
+		log.Println("Signing failed", "old", oldState.String(), "new", newState.String())
+		p.err = fmt.Errorf("signing failed")
+		if p.round1 != nil && p.round1.err != nil {
+			p.err = p.round1.err
+		}
+		close(p.done)
+		return
+	} else if newState == types.StateDone {
+		close(p.done)
+		return
+	}
+}
+
+//////////////
+/// ROUNDS ///
+//////////////
+
+type frostPeer struct {
+	*message.Peer
+
+	bk   *birkhoffinterpolation.BkParameter
+	coBk *big.Int
+	Y    *ecpointgrouplaw.ECPoint // public share, nil if unknown
+
+	// round 1
+	D *ecpointgrouplaw.ECPoint
+	E *ecpointgrouplaw.ECPoint
+	R *ecpointgrouplaw.ECPoint // D + rho * E
+}
+
+// frostRound1 collects the nonce commitments (D, E) of the peers, then computes the partial signature
+type frostRound1 struct {
+	pm      *PeerManager
+	suite   frostSuite
+	message []byte
+	curveN  *big.Int
+	peers   map[string]*frostPeer
+
+	pubkey      *ecpointgrouplaw.ECPoint // key verifying the signature
+	share       *big.Int
+	negateShare bool     // the key of the wallet (and hence the shares) is negated to get the key verifying the signature
+	tweak       *big.Int // public tweak added to the aggregated signature (taproot), 0 otherwise
+
+	d         *big.Int
+	e         *big.Int
+	round1Msg *frost_signer.Message
+
+	// results
+	r           *ecpointgrouplaw.ECPoint
+	negateNonce bool // R was negated to get an even Y, and hence the nonces
+	c           *big.Int
+	s           *big.Int
+	err         error // reason of the failure, e.g. the peer with a wrong partial signature
+}
+
+// frostRound2 collects the partial signatures and aggregates them
+type frostRound2 struct {
+	*frostRound1
+}
+
+func newFrostRound1(pm *PeerManager, suite frostSuite, publicKey *ecpointgrouplaw.ECPoint, share *big.Int, bks map[string]*birkhoffinterpolation.BkParameter, publicShares map[string]*ecpointgrouplaw.ECPoint, msg []byte) (*frostRound1, error) {
+	curve := publicKey.GetCurve()
+	curveN := curve.Params().N
+
+	pubkey, negateShare, tweak := publicKey, false, big.NewInt(0)
+	if suite.key != nil {
+		var err error
+		pubkey, negateShare, tweak, err = suite.key(publicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Lagrange coefficients of the signing peers
+	peers := make(map[string]*frostPeer, len(bks))
+	bkParameters := make(birkhoffinterpolation.BkParameters, 0, len(bks))
+	for peerID, bk := range bks {
+		peers[peerID] = &frostPeer{Peer: message.NewPeer(peerID), bk: bk, Y: publicShares[peerID]}
+		bkParameters = append(bkParameters, bk)
+	}
+
+	coBks, err := bkParameters.ComputeBkCoefficient(uint32(len(bkParameters)), curveN)
+	if err != nil {
+		return nil, err
+	}
+	for i, bk := range bkParameters {
+		for _, peer := range peers {
+			if peer.bk == bk {
+				peer.coBk = coBks[i]
+			}
+		}
+	}
+
+	if _, ok := peers[pm.SelfID()]; !ok {
+		return nil, ErrUnknownPeer
+	}
+
+	// Nonces
+	d, err := utils.RandomPositiveInt(curveN)
+	if err != nil {
+		return nil, err
+	}
+	e, err := utils.RandomPositiveInt(curveN)
+	if err != nil {
+		return nil, err
+	}
+
+	msgD, err := ecpointgrouplaw.ScalarBaseMult(curve, d).ToEcPointMessage()
+	if err != nil {
+		return nil, err
+	}
+	msgE, err := ecpointgrouplaw.ScalarBaseMult(curve, e).ToEcPointMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	round1Msg := &frost_signer.Message{
+		Id:   pm.SelfID(),
+		Type: frost_signer.Type_Round1,
+		Body: &frost_signer.Message_Round1{
+			Round1: &frost_signer.BodyRound1{
+				D: msgD,
+				E: msgE,
+			},
+		},
+	}
+
+	r := &frostRound1{
+		pm:          pm,
+		suite:       suite,
+		message:     msg,
+		curveN:      curveN,
+		peers:       peers,
+		pubkey:      pubkey,
+		share:       share,
+		negateShare: negateShare,
+		tweak:       tweak,
+		d:           d,
+		e:           e,
+		round1Msg:   round1Msg,
+	}
+
+	err = r.HandleMessage(sirius_log.New(), round1Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (p *frostRound1) MessageType() types.MessageType {
+	return types.MessageType(frost_signer.Type_Round1)
+}
+
+func (p *frostRound1) GetRequiredMessageCount() uint32 {
+	return p.pm.NumPeers()
+}
+
+func (p *frostRound1) IsHandled(logger sirius_log.Logger, id string) bool {
+	peer, ok := p.peers[id]
+	if !ok {
+		logger.Warn("Peer not found")
+		return false
+	}
+	return peer.GetMessage(p.MessageType()) != nil
+}
+
+func (p *frostRound1) HandleMessage(logger sirius_log.Logger, msg types.Message) error {
+	tssMsg, ok := msg.(*frost_signer.Message)
+	if !ok || tssMsg.GetRound1() == nil {
+		return ErrInvalidMessage
+	}
+
+	peer, ok := p.peers[tssMsg.GetId()]
+	if !ok {
+		logger.Warn("Peer not found")
+		return ErrUnknownPeer
+	}
+
+	D, err := tssMsg.GetRound1().GetD().ToPoint()
+	if err != nil {
+		return err
+	}
+	E, err := tssMsg.GetRound1().GetE().ToPoint()
+	if err != nil {
+		return err
+	}
+	if !D.IsSameCurve(p.pubkey) || !E.IsSameCurve(p.pubkey) || D.IsIdentity() || E.IsIdentity() {
+		return ErrInvalidMessage
+	}
+
+	peer.D = D
+	peer.E = E
+
+	return peer.AddMessage(tssMsg)
+}
+
+func (p *frostRound1) Finalize(logger sirius_log.Logger) (types.Handler, error) {
+	curve := p.pubkey.GetCurve()
+
+	// Peers ordered by their x coordinate, and list of commitments (B)
+	peers := make([]*frostPeer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].bk.GetX().Cmp(peers[j].bk.GetX()) < 0 })
+
+	var commitments []byte
+	for _, peer := range peers {
+		commitments = append(commitments, bytes32(peer.bk.GetX())...)
+		commitments = append(commitments, p.suite.encode(peer.D)...)
+		commitments = append(commitments, p.suite.encode(peer.E)...)
+	}
+
+	// R = sum(D_i + rho_i * E_i)
+	R := ecpointgrouplaw.NewIdentity(curve)
+	var selfRho *big.Int
+	for _, peer := range peers {
+		rho := hashToScalar(p.curveN, p.suite.bindingTag, bytes32(peer.bk.GetX()), p.suite.encode(p.pubkey), p.message, commitments)
+
+		Ri, err := peer.E.ScalarMult(rho).Add(peer.D)
+		if err != nil {
+			return nil, err
+		}
+		peer.R = Ri
+		R, err = R.Add(Ri)
+		if err != nil {
+			return nil, err
+		}
+
+		if peer.Id == p.pm.SelfID() {
+			selfRho = rho
+		}
+	}
+	if R.IsIdentity() {
+		return nil, ErrInvalidSignature
+	}
+
+	// k = d + rho * e, negated if R must have an even Y and does not
+	k := new(big.Int).Mul(selfRho, p.e)
+	k.Add(k, p.d)
+	if p.suite.evenY && !R.IsEvenY() {
+		k.Neg(k)
+		R = R.Neg()
+		p.negateNonce = true
+	}
+
+	p.r = R
+	p.c = p.suite.challenge(R, p.pubkey, p.message)
+
+	// z_i = k + c * lambda_i * share_i
+	share := new(big.Int).Set(p.share)
+	if p.negateShare {
+		share.Neg(share)
+	}
+
+	z := new(big.Int).Mul(p.c, p.peers[p.pm.SelfID()].coBk)
+	z.Mul(z, share)
+	z.Add(z, k)
+	z.Mod(z, p.curveN)
+
+	round2Msg := &frost_signer.Message{
+		Id:   p.pm.SelfID(),
+		Type: frost_signer.Type_Round2,
+		Body: &frost_signer.Message_Round2{
+			Round2: &frost_signer.BodyRound2{
+				Zi: z.Bytes(),
+			},
+		},
+	}
+
+	round2 := &frostRound2{frostRound1: p}
+	err := round2.HandleMessage(logger, round2Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peerID := range p.pm.PeerIDs() {
+		p.pm.MustSend(peerID, round2Msg)
+	}
+
+	return round2, nil
+}
+
+func (p *frostRound2) MessageType() types.MessageType {
+	return types.MessageType(frost_signer.Type_Round2)
+}
+
+func (p *frostRound2) IsHandled(logger sirius_log.Logger, id string) bool {
+	peer, ok := p.peers[id]
+	if !ok {
+		logger.Warn("Peer not found")
+		return false
+	}
+	return peer.GetMessage(p.MessageType()) != nil
+}
+
+func (p *frostRound2) HandleMessage(logger sirius_log.Logger, msg types.Message) error {
+	tssMsg, ok := msg.(*frost_signer.Message)
+	if !ok || tssMsg.GetRound2() == nil {
+		return ErrInvalidMessage
+	}
+
+	peer, ok := p.peers[tssMsg.GetId()]
+	if !ok {
+		logger.Warn("Peer not found")
+		return ErrUnknownPeer
+	}
+
+	return peer.AddMessage(tssMsg)
+}
+
+// Finalize verifies the partial signatures and aggregates them: s = sum(z_i) + c * tweak
+func (p *frostRound2) Finalize(logger sirius_log.Logger) (types.Handler, error) {
+	s := new(big.Int).Mul(p.c, p.tweak)
+	for _, peer := range p.peers {
+		zi := new(big.Int).SetBytes(peer.GetMessage(p.MessageType()).(*frost_signer.Message).GetRound2().GetZi())
+		if zi.Cmp(p.curveN) >= 0 || !p.verifyPartialSignature(peer, zi) {
+			log.Println("Wrong partial signature from peer", peer.Id)
+			p.err = fmt.Errorf("%w: partial signature of peer %s", ErrInvalidSignature, peer.Id)
+			return nil, p.err
+		}
+		s.Add(s, zi)
+	}
+	p.s = s.Mod(s, p.curveN)
+
+	return nil, nil
+}
+
+// verifyPartialSignature verifies z_i * G == R_i + c * lambda_i * Y_i, R_i and Y_i being negated as the nonce and the share
+// Partial signatures of peers without a known public share are only verified through the aggregated signature
+func (p *frostRound2) verifyPartialSignature(peer *frostPeer, zi *big.Int) bool {
+	if peer.Y == nil {
+		return true
+	}
+
+	Ri, Yi := peer.R, peer.Y
+	if p.negateNonce {
+		Ri = Ri.Neg()
+	}
+	if p.negateShare {
+		Yi = Yi.Neg()
+	}
+
+	e := new(big.Int).Mul(p.c, peer.coBk)
+	e.Mod(e, p.curveN)
+
+	expected, err := Yi.ScalarMult(e).Add(Ri)
+	if err != nil {
+		return false
+	}
+
+	return ecpointgrouplaw.ScalarBaseMult(p.pubkey.GetCurve(), zi).Equal(expected)
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+// taggedHash returns the BIP-340 tagged hash of the data: sha256(sha256(tag) || sha256(tag) || data)
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// hashToScalar returns the tagged hash of the data modulo the order of the curve
+func hashToScalar(curveN *big.Int, tag string, data ...[]byte) *big.Int {
+	n := new(big.Int).SetBytes(taggedHash(tag, data...))
+	return n.Mod(n, curveN)
+}
+
+// bytes32 returns a number lower than 2^256 as 32 bytes in big-endian
+func bytes32(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
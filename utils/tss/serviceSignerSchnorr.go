@@ -0,0 +1,147 @@
+package tss
+
+import (
+	"log"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/getamis/alice/crypto/ecpointgrouplaw"
+	"github.com/getamis/alice/crypto/elliptic"
+)
+
+/////////
+//
+// serviceSignerSchnorr produces BIP-340 Schnorr signatures (Bitcoin Taproot) with the shares of ECDSA wallets, no other dkg is required.
+// The shares of an ECDSA wallet are Shamir (Birkhoff) shares of the private key on secp256k1, which is all FROST needs: the signing process is FROST (see serviceSignerFrost) with the BIP-340 conventions (even Y for the nonce and the public key, tagged challenge hash).
+// For taproot key-path spends, the public key is tweaked as per BIP-341 without script tree (BIP-86). The tweak is public: it is added to the aggregated signature, the shares are left untouched.
+//
+/////////
+
+// Signature types of the signing process besides the default one (signature of the scheme of the wallet)
+const (
+	SignatureSchnorr = "schnorr" // BIP-340 Schnorr signature for the public key of the wallet
+	SignatureTaproot = "taproot" // BIP-340 Schnorr signature for the taproot output key of the wallet (BIP-86), i.e. taproot key-path spends
+)
+
+// tags of the hashes (BIP-340 tagged hashes)
+const (
+	tagChallenge = "BIP0340/challenge"
+	tagTapTweak  = "TapTweak"
+	tagBinding   = "FROST/secp256k1/rho" // binding factors of the nonces
+)
+
+type serviceSignerSchnorr struct {
+	*serviceSignerFrost
+}
+
+// NewServiceSignerSchnorr prepares the signing of message (32 bytes) with a BIP-340 Schnorr signature, for the public key of the wallet or for its taproot output key
+func NewServiceSignerSchnorr(pubkey *Pubkey, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, taproot bool, message []byte) *serviceSignerSchnorr {
+	suite := frostSuite{
+		evenY:      true,
+		bindingTag: tagBinding,
+		encode:     compressPoint,
+		challenge:  bip340Challenge,
+		key: func(publicKey *ecpointgrouplaw.ECPoint) (*ecpointgrouplaw.ECPoint, bool, *big.Int, error) {
+			return schnorrKey(publicKey, taproot)
+		},
+	}
+
+	return &serviceSignerSchnorr{serviceSignerFrost: newServiceSignerFrost(SchemeECDSA, suite, pubkey, share, BKs, publicShares, message)}
+}
+
+func (p *serviceSignerSchnorr) Init(pm *PeerManager) error {
+	if len(p.message) != 32 {
+		log.Println("Schnorr signatures require a 32 bytes message, got", len(p.message))
+		return ErrInvalidMessage
+	}
+
+	return p.serviceSignerFrost.Init(pm)
+}
+
+// PostProcess formats the signature as a BIP-340 signature (R.x || s) and verifies it
+// Signature.R is the x coordinate of R, Signature.S is the scalar s
+func (p *serviceSignerSchnorr) PostProcess() (*Signature, error) {
+	r, s, err := p.result()
+	if err != nil {
+		return nil, err
+	}
+
+	signature := append(bytes32(r.GetX()), bytes32(s)...)
+
+	pubkey, err := schnorr.ParsePubKey(bytes32(p.round1.pubkey.GetX()))
+	if err != nil {
+		log.Println("error parsing schnorr public key:", err)
+		return nil, err
+	}
+
+	sig, err := schnorr.ParseSignature(signature)
+	if err != nil || !sig.Verify(p.message, pubkey) {
+		log.Println("error: schnorr signature does not verify")
+		return nil, ErrInvalidSignature
+	}
+
+	return &Signature{
+		R:         r.GetX(),
+		S:         s,
+		Signature: signature,
+	}, nil
+}
+
+/////////////
+/// UTILS ///
+/////////////
+
+// schnorrKey returns the key verifying the signatures (x-only, hence with an even Y), whether the shares need to be negated, and the tweak to be added to the signature
+// Without taproot, the key is the public key of the wallet. With taproot, it is the output key Q = P + t*G, with t = hashTapTweak(P.x) (BIP-86)
+func schnorrKey(publicKey *ecpointgrouplaw.ECPoint, taproot bool) (*ecpointgrouplaw.ECPoint, bool, *big.Int, error) {
+	curve := publicKey.GetCurve()
+	if curve != elliptic.Secp256k1() || publicKey.IsIdentity() {
+		return nil, false, nil, ErrUnsupportedScheme
+	}
+	curveN := curve.Params().N
+
+	negate := !publicKey.IsEvenY()
+	key := publicKey
+	if negate {
+		key = publicKey.Neg()
+	}
+
+	if !taproot {
+		return key, negate, big.NewInt(0), nil
+	}
+
+	tweak := new(big.Int).SetBytes(taggedHash(tagTapTweak, bytes32(key.GetX())))
+	if tweak.Cmp(curveN) >= 0 {
+		return nil, false, nil, ErrInvalidSignature
+	}
+
+	outputKey, err := key.Add(ecpointgrouplaw.ScalarBaseMult(curve, tweak))
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if outputKey.IsIdentity() {
+		return nil, false, nil, ErrInvalidSignature
+	}
+
+	if !outputKey.IsEvenY() {
+		outputKey = outputKey.Neg()
+		negate = !negate
+		tweak.Sub(curveN, tweak)
+	}
+
+	return outputKey, negate, tweak, nil
+}
+
+// bip340Challenge returns the challenge of BIP-340: hashChallenge(R.x || P.x || m)
+func bip340Challenge(R, pubkey *ecpointgrouplaw.ECPoint, message []byte) *big.Int {
+	return hashToScalar(R.GetCurve().Params().N, tagChallenge, bytes32(R.GetX()), bytes32(pubkey.GetX()), message)
+}
+
+// compressPoint returns the compressed encoding of a point of secp256k1 (parity of Y, then X)
+func compressPoint(point *ecpointgrouplaw.ECPoint) []byte {
+	prefix := byte(0x02)
+	if !point.IsEvenY() {
+		prefix = 0x03
+	}
+	return append([]byte{prefix}, bytes32(point.GetX())...)
+}
@@ -1,7 +1,6 @@
 package tss
 
 import (
-	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/hex"
@@ -10,7 +9,7 @@ import (
 	"hash"
 	"log"
 	"math/big"
-	"time"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/getamis/alice/crypto/birkhoffinterpolation"
@@ -18,11 +17,10 @@ import (
 	elliptic_alice "github.com/getamis/alice/crypto/elliptic"
 	"github.com/getamis/alice/crypto/tss/dkg"
 	"github.com/getamis/alice/crypto/tss/ecdsa/gg18/signer"
+	frost_signer "github.com/getamis/alice/crypto/tss/eddsa/frost/signer"
 	"github.com/getamis/alice/types"
 	"golang.org/x/crypto/sha3"
 	"google.golang.org/protobuf/proto"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 
 	"github.com/decred/dcrd/dcrec/secp256k1"
 
@@ -30,7 +28,9 @@ import (
 )
 
 const _rank uint32 = 0
-const _threshold uint32 = 2
+
+// _defaultThreshold is the threshold of wallets created without an explicit policy (and of wallets created before thresholds were configurable): the server and one device are required to sign
+const _defaultThreshold uint32 = 2
 
 const _serverID = "server"
 
@@ -38,12 +38,19 @@ const _serverID = "server"
 // const AddExistingClientID = "client"
 // const AddNewClientID = "new-client"
 
-type GenericTSS interface {
-	// Process() (*Signature, error)
-	// ProcessStr() (string, error)
-	GetNextMessageToSend() ([]byte, error)
-	HandleMessage(types.Message) error
-	DkgOrSign() int
+var (
+	ErrInvalidThreshold   = errors.New("invalid threshold")
+	ErrNotEnoughSigners   = errors.New("not enough peers to reach the threshold")
+	ErrUnknownPeer        = errors.New("peer is not part of the wallet")
+	ErrDuplicatePeer      = errors.New("peer provided more than once")
+	ErrServerIsNotAClient = errors.New("server peer ID cannot be used by a client")
+	ErrUnexpectedSender   = errors.New("message not sent by the peer of the connection")
+)
+
+// tssMessage is implemented by the protobuf messages of every alice TSS process (dkg.Message, signer.Message, addshare.Message, etc)
+type tssMessage interface {
+	types.Message
+	proto.Message
 }
 
 type PubkeyStr struct {
@@ -67,18 +74,39 @@ type SigningParameters struct {
 }
 
 type DkgResult struct {
-	Pubkey  PubkeyStr
-	BKs     map[string]BK
-	Share   string
-	Address string
-	PeerID  string
+	Pubkey    PubkeyStr
+	BKs       map[string]BK
+	Share     string
+	Address   string
+	PeerID    string
+	Threshold uint32
+	Scheme    Scheme
+
+	// PublicShares are the public shares (share * G) of the peers, used to verify their partial signatures
+	// Wallets stored before they were kept do not have them
+	PublicShares map[string]PubkeyStr `json:",omitempty"`
+}
+
+// GetThreshold returns the number of peers (server included) required to sign with the wallet
+// Wallets stored before thresholds were configurable do not have one, they are 2-of-n
+func (r *DkgResult) GetThreshold() uint32 {
+	return thresholdOrDefault(r.Threshold)
+}
+
+// GetScheme returns the signature scheme of the wallet
+// Wallets stored before EdDSA was supported do not have one, they are ECDSA
+func (r *DkgResult) GetScheme() Scheme {
+	return schemeOrDefault(r.Scheme)
 }
 
 type ProcessResult struct {
-	PublicKey *ecpointgrouplaw.ECPoint
-	Share     *big.Int
-	Bks       map[string]*birkhoffinterpolation.BkParameter
-	PeerID    string
+	PublicKey    *ecpointgrouplaw.ECPoint
+	Share        *big.Int
+	Bks          map[string]*birkhoffinterpolation.BkParameter
+	PublicShares map[string]*ecpointgrouplaw.ECPoint
+	PeerID       string
+	Threshold    uint32
+	Scheme       Scheme
 }
 
 func PostProcessResult(result ProcessResult) (*DkgResult, error) {
@@ -89,7 +117,7 @@ func PostProcessResult(result ProcessResult) (*DkgResult, error) {
 	share := result.Share.String()
 	BKs := make(map[string]BK)
 
-	addr := pubkey.GetAddress().Hex()
+	addr := pubkey.getAddress(result.Scheme)
 	pubkeyStr := pubkey.GetStr()
 
 	// Build bks.
@@ -101,16 +129,136 @@ func PostProcessResult(result ProcessResult) (*DkgResult, error) {
 	}
 
 	dkgResult := DkgResult{
-		Pubkey:  pubkeyStr,
-		BKs:     BKs,
-		Share:   share,
-		Address: addr,
-		PeerID:  result.PeerID,
+		Pubkey:       pubkeyStr,
+		BKs:          BKs,
+		Share:        share,
+		Address:      addr,
+		PeerID:       result.PeerID,
+		Threshold:    thresholdOrDefault(result.Threshold),
+		Scheme:       schemeOrDefault(result.Scheme),
+		PublicShares: publicSharesStr(result.PublicShares),
 	}
 
 	return &dkgResult, nil
 }
 
+// publicSharesStr converts the public shares of the peers, nil if there are none
+func publicSharesStr(publicShares map[string]*ecpointgrouplaw.ECPoint) map[string]PubkeyStr {
+	if len(publicShares) == 0 {
+		return nil
+	}
+
+	ret := make(map[string]PubkeyStr, len(publicShares))
+	for peerID, publicShare := range publicShares {
+		pubkey := Pubkey{X: publicShare.GetX(), Y: publicShare.GetY()}
+		ret[peerID] = pubkey.GetStr()
+	}
+	return ret
+}
+
+func thresholdOrDefault(threshold uint32) uint32 {
+	if threshold == 0 {
+		return _defaultThreshold
+	}
+	return threshold
+}
+
+// ValidateThreshold verifies that a t-of-n policy is achievable, n being the total number of peers (server included)
+func ValidateThreshold(threshold uint32, numPeers int) error {
+	if threshold < 2 || int(threshold) > numPeers {
+		return fmt.Errorf("%w: %d-of-%d", ErrInvalidThreshold, threshold, numPeers)
+	}
+	return nil
+}
+
+// selectBKs returns the BKs of the server and of the given client peers, i.e. the peers taking part in a TSS process
+// It verifies that all peers are part of the wallet and that there are enough of them to reach the threshold
+func selectBKs(BKs map[string]BK, clientPeerIDs []string, threshold uint32) (map[string]BK, error) {
+	serverBK, ok := BKs[_serverID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, _serverID)
+	}
+
+	selectedBKs := map[string]BK{_serverID: serverBK}
+	for _, peerID := range clientPeerIDs {
+		if peerID == _serverID {
+			return nil, ErrServerIsNotAClient
+		}
+
+		if _, exists := selectedBKs[peerID]; exists {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicatePeer, peerID)
+		}
+
+		bk, ok := BKs[peerID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, peerID)
+		}
+
+		selectedBKs[peerID] = bk
+	}
+
+	if len(selectedBKs) < int(thresholdOrDefault(threshold)) {
+		return nil, fmt.Errorf("%w: %d peers for a threshold of %d", ErrNotEnoughSigners, len(selectedBKs), thresholdOrDefault(threshold))
+	}
+
+	return selectedBKs, nil
+}
+
+// routeMessage handles a message received through the server: if the target is the given peer, consume; else, add to list of messages to be sent through MustSend (i.e. the server relays messages between clients)
+func routeMessage(msg *Message, pm *PeerManager, peerID string, tssMsg tssMessage) error {
+	err := decodeTssMessage(msg, tssMsg)
+	if err != nil {
+		return err
+	}
+
+	return dispatchMessage(msg, pm, peerID, tssMsg)
+}
+
+// routeClientMessage handles, on the server, a message coming from the connection of the client from: a device can only send messages in its own name
+func routeClientMessage(msg *Message, pm *PeerManager, from string, tssMsg tssMessage) error {
+	err := decodeTssMessage(msg, tssMsg)
+	if err != nil {
+		return err
+	}
+
+	if from == "" || tssMsg.GetId() != from {
+		log.Println("routeClientMessage: message of", tssMsg.GetId(), "sent by", from)
+		return ErrUnexpectedSender
+	}
+
+	return dispatchMessage(msg, pm, _serverID, tssMsg)
+}
+
+func decodeTssMessage(msg *Message, tssMsg tssMessage) error {
+	msgStr, ok := msg.Message.(string)
+	if !ok {
+		log.Println("msg was not a string")
+		return errors.New("msg was not a string")
+	}
+	byteString, err := hex.DecodeString(msgStr)
+	if err != nil {
+		log.Println("error decoding hex:", err)
+		return err
+	}
+	err = proto.Unmarshal(byteString, tssMsg)
+	if err != nil {
+		log.Println("decodeTssMessage: could not proto unmarshal tss message")
+		return err
+	}
+
+	return nil
+}
+
+// dispatchMessage consumes the message if peerID is its target, else queues it for its target
+func dispatchMessage(msg *Message, pm *PeerManager, peerID string, tssMsg tssMessage) error {
+	if msg.PeerID == peerID { // target peer
+		return pm.HandleMessage(tssMsg)
+	} else {
+		pm.MustSend(msg.PeerID, tssMsg)
+		return nil
+	}
+}
+
 func NewPubkey(k PubkeyStr) (*Pubkey, error) {
 	X, ok := new(big.Int).SetString(k.X, 10)
 	if !ok {
@@ -158,7 +306,7 @@ func (k *Pubkey) GetECPoint() (*ecpointgrouplaw.ECPoint, error) {
 ///////////
 
 func MergeDkgResults(first, second *DkgResult) (*DkgResult, bool) {
-	if first.Address != second.Address || first.PeerID != second.PeerID || first.Share != second.Share || first.Pubkey.X != second.Pubkey.X || first.Pubkey.Y != second.Pubkey.Y {
+	if first.Address != second.Address || first.PeerID != second.PeerID || first.Share != second.Share || first.Pubkey.X != second.Pubkey.X || first.Pubkey.Y != second.Pubkey.Y || first.GetThreshold() != second.GetThreshold() || first.GetScheme() != second.GetScheme() {
 		return nil, false
 	}
 
@@ -172,31 +320,108 @@ func MergeDkgResults(first, second *DkgResult) (*DkgResult, bool) {
 		mergedBKs[key] = value
 	}
 
+	// Public shares are only kept if known for every peer
+	var mergedPublicShares map[string]PubkeyStr
+	if len(first.PublicShares) > 0 && len(second.PublicShares) > 0 {
+		mergedPublicShares = make(map[string]PubkeyStr)
+		for key, value := range first.PublicShares {
+			mergedPublicShares[key] = value
+		}
+		for key, value := range second.PublicShares {
+			mergedPublicShares[key] = value
+		}
+		if len(mergedPublicShares) != len(mergedBKs) {
+			mergedPublicShares = nil
+		}
+	}
+
 	ret := &DkgResult{
-		Pubkey:  first.Pubkey,
-		Share:   first.Share,
-		Address: first.Address,
-		PeerID:  first.PeerID,
-		BKs:     mergedBKs,
+		Pubkey:       first.Pubkey,
+		Share:        first.Share,
+		Address:      first.Address,
+		PeerID:       first.PeerID,
+		BKs:          mergedBKs,
+		Threshold:    first.GetThreshold(),
+		Scheme:       first.GetScheme(),
+		PublicShares: mergedPublicShares,
 	}
 
 	return ret, true
 }
 
+// RemovePeer returns the dkg result without the given device, i.e. the device cannot take part in TSS processes with the server anymore
+// The remaining peers must still reach the threshold, otherwise the wallet could not sign anymore
+// Note that the share of the removed device remains mathematically valid until the shares of the remaining peers are refreshed
+func RemovePeer(dkgResult *DkgResult, peerID string) (*DkgResult, error) {
+	if peerID == _serverID {
+		return nil, ErrServerIsNotAClient
+	}
+
+	if _, ok := dkgResult.BKs[peerID]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPeer, peerID)
+	}
+
+	if len(dkgResult.BKs)-1 < int(dkgResult.GetThreshold()) {
+		return nil, fmt.Errorf("%w: %d peers left for a threshold of %d", ErrNotEnoughSigners, len(dkgResult.BKs)-1, dkgResult.GetThreshold())
+	}
+
+	BKs := make(map[string]BK)
+	for key, value := range dkgResult.BKs {
+		if key != peerID {
+			BKs[key] = value
+		}
+	}
+
+	ret := *dkgResult
+	ret.BKs = BKs
+
+	if len(dkgResult.PublicShares) > 0 {
+		ret.PublicShares = make(map[string]PubkeyStr)
+		for key, value := range dkgResult.PublicShares {
+			if key != peerID {
+				ret.PublicShares[key] = value
+			}
+		}
+	}
+
+	return &ret, nil
+}
+
 // Server
 
+// ServerDkg is the server side of the dkg process. The server is connected to every client and relays the messages between clients.
 type ServerDkg struct {
-	service      *serviceDkg
-	clientPeerID string
+	service   *serviceDkg
+	threshold uint32
+	scheme    Scheme
 }
 
-func NewServerDkg(clientPeerID string) (*ServerDkg, error) {
-	service := NewServiceDkg(_threshold, _rank, elliptic_alice.Secp256k1())
+// NewServerDkg prepares a dkg between the server and the given clients, for a wallet of the given scheme requiring threshold peers (server included) to sign
+func NewServerDkg(clientPeerIDs []string, threshold uint32, scheme Scheme) (*ServerDkg, error) {
+	threshold = thresholdOrDefault(threshold)
+	scheme = schemeOrDefault(scheme)
+
+	err := ValidateThreshold(threshold, len(clientPeerIDs)+1)
+	if err != nil {
+		log.Println("error validating threshold:", err)
+		return nil, err
+	}
+
+	service := NewServiceDkg(threshold, _rank, scheme.Curve())
 
 	pm := NewPeerManager(_serverID)
-	pm.AddPeer(clientPeerID)
+	for _, clientPeerID := range clientPeerIDs {
+		if clientPeerID == _serverID {
+			return nil, ErrServerIsNotAClient
+		}
+		pm.AddPeer(clientPeerID)
+	}
+
+	if int(pm.NumPeers()) != len(clientPeerIDs) {
+		return nil, ErrDuplicatePeer
+	}
 
-	err := service.Init(pm)
+	err = service.Init(pm)
 	if err != nil {
 		log.Println("error initialising service DKG:", err)
 		return nil, err
@@ -206,7 +431,7 @@ func NewServerDkg(clientPeerID string) (*ServerDkg, error) {
 		return service.Handle(msg)
 	})
 
-	return &ServerDkg{service: service, clientPeerID: clientPeerID}, nil
+	return &ServerDkg{service: service, threshold: threshold, scheme: scheme}, nil
 }
 
 func (p *ServerDkg) Process() (*DkgResult, error) {
@@ -217,64 +442,58 @@ func (p *ServerDkg) Process() (*DkgResult, error) {
 	}
 
 	res := ProcessResult{
-		PublicKey: p.service.result.PublicKey,
-		Share:     p.service.result.Share,
-		Bks:       p.service.result.Bks,
-		PeerID:    p.clientPeerID,
+		PublicKey:    p.service.result.PublicKey,
+		Share:        p.service.result.Share,
+		Bks:          p.service.result.Bks,
+		PublicShares: p.service.result.Ys,
+		PeerID:       _serverID,
+		Threshold:    p.threshold,
+		Scheme:       p.scheme,
 	}
 
 	return PostProcessResult(res)
 }
 
-func (p *ServerDkg) GetNextMessageToSend() (Message, error) {
-	return p.service.pm.GetNextMessageToSendPeer(p.clientPeerID)
-}
-
-func (p *ServerDkg) HandleMessage(msg *Message) error {
-	// return p.service.pm.HandleMessage(msg)
-
-	// log.Println("HandleMessage server")
-
-	msgStr, ok := msg.Message.(string)
-	if !ok {
-		log.Println("msg was not a string")
-		return errors.New("msg was not a string")
-	}
-	byteString, err := hex.DecodeString(msgStr)
-	if err != nil {
-		log.Println("error decoding hex:", err)
-		return err
-	}
-	dkgMsg := &dkg.Message{}
-	err = proto.Unmarshal(byteString, dkgMsg)
-	// err = json.Unmarshal(byteString, addMsg)
-	if err != nil {
-		log.Println("ClientAdd.HandleMessage: could not proto unmarshal tss message to addshare.Message")
-		return err
-	}
-
-	return p.service.pm.HandleMessage(dkgMsg)
-
-	// return p.service.pm.HandleMessage(msg)
+// GetNextMessageToSend returns the next message to be sent to the given client (either from the server or relayed from another client)
+func (p *ServerDkg) GetNextMessageToSend(peerID string) (Message, error) {
+	return p.service.pm.GetNextMessageToSendPeer(peerID)
 }
 
-func (p *ServerDkg) DkgOrSign() int {
-	return 1
+// HandleMessage consumes a message sent by the client from and targeted at the server, or queues it for the targeted client
+func (p *ServerDkg) HandleMessage(from string, msg *Message) error {
+	return routeClientMessage(msg, p.service.pm, from, &dkg.Message{})
 }
 
 // Client
 type ClientDkg struct {
 	service      *serviceDkg
 	clientPeerID string
+	threshold    uint32
+	scheme       Scheme
 }
 
-func NewClientDkg(clientPeerID string) (*ClientDkg, error) {
-	service := NewServiceDkg(_threshold, _rank, elliptic_alice.Secp256k1())
+// NewClientDkg prepares a dkg between the client, the server and the clients taking part in the wallet creation (clientPeerIDs can include the client itself)
+func NewClientDkg(clientPeerID string, clientPeerIDs []string, threshold uint32, scheme Scheme) (*ClientDkg, error) {
+	threshold = thresholdOrDefault(threshold)
+	scheme = schemeOrDefault(scheme)
 
 	pm := NewPeerManager(clientPeerID)
 	pm.AddPeer(_serverID)
+	for _, peerID := range clientPeerIDs {
+		if peerID != clientPeerID {
+			pm.AddPeer(peerID)
+		}
+	}
 
-	err := service.Init(pm)
+	err := ValidateThreshold(threshold, int(pm.NumPeers())+1)
+	if err != nil {
+		log.Println("error validating threshold:", err)
+		return nil, err
+	}
+
+	service := NewServiceDkg(threshold, _rank, scheme.Curve())
+
+	err = service.Init(pm)
 	if err != nil {
 		log.Println("error initialising service DKG:", err)
 		return nil, err
@@ -284,7 +503,7 @@ func NewClientDkg(clientPeerID string) (*ClientDkg, error) {
 		return service.Handle(msg)
 	})
 
-	return &ClientDkg{service: service, clientPeerID: clientPeerID}, nil
+	return &ClientDkg{service: service, clientPeerID: clientPeerID, threshold: threshold, scheme: scheme}, nil
 }
 
 func (p *ClientDkg) Process() (*DkgResult, error) {
@@ -295,47 +514,25 @@ func (p *ClientDkg) Process() (*DkgResult, error) {
 	}
 
 	res := ProcessResult{
-		PublicKey: p.service.result.PublicKey,
-		Share:     p.service.result.Share,
-		Bks:       p.service.result.Bks,
-		PeerID:    p.clientPeerID,
+		PublicKey:    p.service.result.PublicKey,
+		Share:        p.service.result.Share,
+		Bks:          p.service.result.Bks,
+		PublicShares: p.service.result.Ys,
+		PeerID:       p.clientPeerID,
+		Threshold:    p.threshold,
+		Scheme:       p.scheme,
 	}
 
 	return PostProcessResult(res)
 }
 
+// GetNextMessageToSend returns the next message to be sent, whatever the target peer: everything goes through the server which relays to the other clients
 func (p *ClientDkg) GetNextMessageToSend() (Message, error) {
-	return p.service.pm.GetNextMessageToSendPeer(_serverID)
+	return p.service.pm.GetNextMessageToSendAll()
 }
 
 func (p *ClientDkg) HandleMessage(msg *Message) error {
-	// return p.service.pm.HandleMessage(msg)
-
-	// log.Println("HandleMessage server")
-
-	msgStr, ok := msg.Message.(string)
-	if !ok {
-		log.Println("msg was not a string")
-		return errors.New("msg was not a string")
-	}
-	byteString, err := hex.DecodeString(msgStr)
-	if err != nil {
-		log.Println("error decoding hex:", err)
-		return err
-	}
-	dkgMsg := &dkg.Message{}
-	err = proto.Unmarshal(byteString, dkgMsg)
-	// err = json.Unmarshal(byteString, addMsg)
-	if err != nil {
-		log.Println("ClientAdd.HandleMessage: could not proto unmarshal tss message to addshare.Message")
-		return err
-	}
-
-	return p.service.pm.HandleMessage(dkgMsg)
-}
-
-func (p *ClientDkg) DkgOrSign() int {
-	return 1
+	return routeMessage(msg, p.service.pm, p.clientPeerID, &dkg.Message{})
 }
 
 ////////////
@@ -354,13 +551,59 @@ type Signature struct {
 // 	V string
 // }
 
+// signingService is implemented by the signing services of each scheme (serviceSigner for ECDSA, serviceSignerEdDSA for EdDSA), and by serviceSignerSchnorr for Schnorr signatures with ECDSA wallets
+type signingService interface {
+	Init(pm *PeerManager) error
+	Handle(msg types.Message) error
+	Process()
+	PostProcess() (*Signature, error)
+	GetPeerManager() *PeerManager
+}
+
+// newSigningService returns the signing service of the scheme, and a function returning an empty TSS message of that scheme (used to decode incoming messages)
+func newSigningService(scheme Scheme, pubkey *Pubkey, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, message []byte) (signingService, func() tssMessage, error) {
+	switch schemeOrDefault(scheme) {
+	case SchemeECDSA:
+		return NewServiceSigner(pubkey, share, BKs, message), func() tssMessage { return &signer.Message{} }, nil
+	case SchemeEdDSA:
+		return NewServiceSignerEdDSA(pubkey, share, BKs, publicShares, message), func() tssMessage { return &frost_signer.Message{} }, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
+	}
+}
+
 // Server
+
+// ServerSigner is the server side of the signing process. As for the dkg, the server relays the messages between the signing clients.
 type ServerSigner struct {
-	service      *serviceSigner
-	clientPeerID string
+	service    signingService
+	newMessage func() tssMessage
+}
+
+// NewServerSigner prepares the signing of message by the server and the given clients
+// Any set of clients works as long as they are part of the wallet and, with the server, reach the threshold of the wallet
+func NewServerSigner(clientPeerIDs []string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, threshold uint32, scheme Scheme, message []byte) (*ServerSigner, error) {
+	return newServerSigner(clientPeerIDs, pubkeyStr, BKs, threshold, func(pubkey *Pubkey, BKs map[string]BK) (signingService, func() tssMessage, error) {
+		return newSigningService(scheme, pubkey, share, BKs, publicShares, message)
+	})
 }
 
-func NewServerSigner(clientPeerID string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, message []byte) (*ServerSigner, error) {
+// NewServerSignerSchnorr prepares the signing of message (32 bytes) by the server and the given clients with a BIP-340 Schnorr signature, for the public key of the wallet or for its taproot output key
+// Only ECDSA wallets (secp256k1) can produce Schnorr signatures
+func NewServerSignerSchnorr(clientPeerIDs []string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, threshold uint32, scheme Scheme, taproot bool, message []byte) (*ServerSigner, error) {
+	if schemeOrDefault(scheme) != SchemeECDSA {
+		return nil, fmt.Errorf("%w: schnorr signatures require an %s wallet, got %s", ErrUnsupportedScheme, SchemeECDSA, scheme)
+	}
+
+	return newServerSigner(clientPeerIDs, pubkeyStr, BKs, threshold, func(pubkey *Pubkey, BKs map[string]BK) (signingService, func() tssMessage, error) {
+		return NewServiceSignerSchnorr(pubkey, share, BKs, publicShares, taproot, message), func() tssMessage { return &frost_signer.Message{} }, nil
+	})
+}
+
+// signingServiceFactory returns the signing service for the public key of the wallet and the BKs of the signers, and a function returning an empty TSS message of that service
+type signingServiceFactory func(pubkey *Pubkey, BKs map[string]BK) (signingService, func() tssMessage, error)
+
+func newServerSigner(clientPeerIDs []string, pubkeyStr PubkeyStr, BKs map[string]BK, threshold uint32, newService signingServiceFactory) (*ServerSigner, error) {
 	// will probably need a wrapper with JSON input
 
 	pubkey, err := NewPubkey(pubkeyStr)
@@ -368,17 +611,21 @@ func NewServerSigner(clientPeerID string, pubkeyStr PubkeyStr, share string, BKs
 		return nil, err
 	}
 
-	newBKs := make(map[string]BK)
-	for key, value := range BKs {
-		if key == _serverID || key == clientPeerID {
-			newBKs[key] = value
-		}
+	newBKs, err := selectBKs(BKs, clientPeerIDs, threshold)
+	if err != nil {
+		log.Println("error selecting signers:", err)
+		return nil, err
 	}
 
-	service := NewServiceSigner(pubkey, share, newBKs, message)
+	service, newMessage, err := newService(pubkey, newBKs)
+	if err != nil {
+		return nil, err
+	}
 
 	pm := NewPeerManager(_serverID)
-	pm.AddPeer(clientPeerID)
+	for _, clientPeerID := range clientPeerIDs {
+		pm.AddPeer(clientPeerID)
+	}
 
 	err = service.Init(pm)
 	if err != nil {
@@ -391,38 +638,53 @@ func NewServerSigner(clientPeerID string, pubkeyStr PubkeyStr, share string, BKs
 		return service.Handle(msg)
 	})
 
-	return &ServerSigner{service: service, clientPeerID: clientPeerID}, nil
+	return &ServerSigner{service: service, newMessage: newMessage}, nil
 }
 
 func (p *ServerSigner) Process() (*Signature, error) {
 	p.service.Process()
 
-	if p.service.result == nil {
-		return nil, fmt.Errorf("could not get server signer results")
-	}
-
 	return p.service.PostProcess()
 }
 
-func (p *ServerSigner) GetNextMessageToSend() ([]byte, error) {
-	return p.service.pm.GetNextMessageToSend(p.clientPeerID)
+// GetNextMessageToSend returns the next message to be sent to the given client (either from the server or relayed from another client)
+func (p *ServerSigner) GetNextMessageToSend(peerID string) (Message, error) {
+	return p.service.GetPeerManager().GetNextMessageToSendPeer(peerID)
 }
 
-func (p *ServerSigner) HandleMessage(msg types.Message) error {
-	// log.Println("HandleMessage server")
-	return p.service.pm.HandleMessage(msg)
-}
-
-func (p *ServerSigner) DkgOrSign() int {
-	return 2
+// HandleMessage consumes a message sent by the client from and targeted at the server, or queues it for the targeted client
+func (p *ServerSigner) HandleMessage(from string, msg *Message) error {
+	return routeClientMessage(msg, p.service.GetPeerManager(), from, p.newMessage())
 }
 
 // Client
 type ClientSigner struct {
-	service *serviceSigner
+	service      signingService
+	newMessage   func() tssMessage
+	clientPeerID string
+	message      []byte
+}
+
+// NewClientSigner prepares the signing of message by the client, together with the server and the other signing clients
+func NewClientSigner(clientPeerID string, signingClientPeerIDs []string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, threshold uint32, scheme Scheme, message []byte) (*ClientSigner, error) {
+	return newClientSigner(clientPeerID, signingClientPeerIDs, pubkeyStr, BKs, threshold, message, func(pubkey *Pubkey, BKs map[string]BK) (signingService, func() tssMessage, error) {
+		return newSigningService(scheme, pubkey, share, BKs, publicShares, message)
+	})
+}
+
+// NewClientSignerSchnorr prepares the signing of message (32 bytes) by the client, together with the server and the other signing clients, with a BIP-340 Schnorr signature
+// Only ECDSA wallets (secp256k1) can produce Schnorr signatures
+func NewClientSignerSchnorr(clientPeerID string, signingClientPeerIDs []string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, publicShares map[string]PubkeyStr, threshold uint32, scheme Scheme, taproot bool, message []byte) (*ClientSigner, error) {
+	if schemeOrDefault(scheme) != SchemeECDSA {
+		return nil, fmt.Errorf("%w: schnorr signatures require an %s wallet, got %s", ErrUnsupportedScheme, SchemeECDSA, scheme)
+	}
+
+	return newClientSigner(clientPeerID, signingClientPeerIDs, pubkeyStr, BKs, threshold, message, func(pubkey *Pubkey, BKs map[string]BK) (signingService, func() tssMessage, error) {
+		return NewServiceSignerSchnorr(pubkey, share, BKs, publicShares, taproot, message), func() tssMessage { return &frost_signer.Message{} }, nil
+	})
 }
 
-func NewClientSigner(clientPeerID string, pubkeyStr PubkeyStr, share string, BKs map[string]BK, message []byte) (*ClientSigner, error) {
+func newClientSigner(clientPeerID string, signingClientPeerIDs []string, pubkeyStr PubkeyStr, BKs map[string]BK, threshold uint32, message []byte, newService signingServiceFactory) (*ClientSigner, error) {
 	// will probably need a wrapper with JSON input
 
 	pubkey, err := NewPubkey(pubkeyStr)
@@ -430,21 +692,34 @@ func NewClientSigner(clientPeerID string, pubkeyStr PubkeyStr, share string, BKs
 		return nil, err
 	}
 
-	newBKs := make(map[string]BK)
-	for key, value := range BKs {
-		if key == _serverID || key == clientPeerID {
-			newBKs[key] = value
+	clientPeerIDs := []string{clientPeerID}
+	for _, peerID := range signingClientPeerIDs {
+		if peerID != clientPeerID {
+			clientPeerIDs = append(clientPeerIDs, peerID)
 		}
 	}
 
-	service := NewServiceSigner(pubkey, share, newBKs, message)
+	newBKs, err := selectBKs(BKs, clientPeerIDs, threshold)
+	if err != nil {
+		log.Println("error selecting signers:", err)
+		return nil, err
+	}
+
+	service, newMessage, err := newService(pubkey, newBKs)
+	if err != nil {
+		return nil, err
+	}
 
 	pm := NewPeerManager(clientPeerID)
-	pm.AddPeer(_serverID)
+	for peerID := range newBKs {
+		if peerID != clientPeerID {
+			pm.AddPeer(peerID)
+		}
+	}
 
 	err = service.Init(pm)
 	if err != nil {
-		log.Println("error initialising service DKG:", err)
+		log.Println("error initialising service signer:", err)
 		return nil, err
 	}
 
@@ -453,149 +728,27 @@ func NewClientSigner(clientPeerID string, pubkeyStr PubkeyStr, share string, BKs
 		return service.Handle(msg)
 	})
 
-	return &ClientSigner{service: service}, nil
+	return &ClientSigner{service: service, newMessage: newMessage, clientPeerID: clientPeerID, message: message}, nil
 }
 
 func (p *ClientSigner) Process() (*Signature, error) {
 	p.service.Process()
 
-	if p.service.result == nil {
-		return nil, fmt.Errorf("could not get client signer results")
-	}
-
 	return p.service.PostProcess()
 }
 
-func (p *ClientSigner) GetNextMessageToSend() ([]byte, error) {
-	return p.service.pm.GetNextMessageToSend(_serverID)
+// GetNextMessageToSend returns the next message to be sent, whatever the target peer: everything goes through the server which relays to the other clients
+func (p *ClientSigner) GetNextMessageToSend() (Message, error) {
+	return p.service.GetPeerManager().GetNextMessageToSendAll()
 }
 
-func (p *ClientSigner) HandleMessage(msg types.Message) error {
-	// log.Println("HandleMessage client")
-	return p.service.pm.HandleMessage(msg)
+func (p *ClientSigner) HandleMessage(msg *Message) error {
+	return routeMessage(msg, p.service.GetPeerManager(), p.clientPeerID, p.newMessage())
 }
 
 func (p *ClientSigner) Test() []byte {
 	// log.Println("HandleMessage client")
-	return p.service.message
-}
-
-func (p *ClientSigner) DkgOrSign() int {
-	return 2
-}
-
-///////////////////////
-/// UTILS WEBSOCKET ///
-///////////////////////
-
-func Receive(tss GenericTSS, ctx context.Context, errs chan error, c *websocket.Conn) {
-	// defer wg.Done()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("done receiving because of <-ctx.Done()")
-			return
-		default:
-			var v string
-			err := wsjson.Read(ctx, c, &v)
-			if err != nil {
-				if ctx.Err() == context.Canceled {
-					log.Println("read operation canceled")
-					errs <- err
-					return
-				} else {
-					log.Println("error reading message from websocket:", err)
-					log.Println("websocket.CloseStatus(err):", websocket.CloseStatus(err))
-					errs <- err
-					return
-				}
-			}
-			// log.Printf("Received: %v\n", v)
-
-			tssType := tss.DkgOrSign()
-			msg, err := stringToMsg(v, tssType)
-			if err != nil {
-				log.Println("could not convert string to message:", err)
-				errs <- err
-				return
-			}
-
-			err = tss.HandleMessage(msg)
-			if err != nil {
-				log.Println("could not handle tss msg:", err)
-				errs <- err
-				return
-			}
-		}
-	}
-}
-
-func Send(tss GenericTSS, ctx context.Context, errs chan error, c *websocket.Conn) {
-	// defer wg.Done()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("done sending because of <-ctx.Done()")
-			return
-		default:
-			msg, err := tss.GetNextMessageToSend()
-			if err != nil {
-				log.Println("error getting next message:", err)
-				errs <- err
-				return
-			}
-
-			encodedMsg := hex.EncodeToString(msg)
-
-			// log.Println("trying send, next encoded message to send:", encodedMsg)
-
-			if msg != nil {
-				// log.Println("trying to send message:", encodedMsg)
-				err := wsjson.Write(ctx, c, encodedMsg)
-				if err != nil {
-					log.Println("error writing json through websocket:", err)
-					errs <- err
-					return
-				}
-			}
-
-			time.Sleep(10 * time.Millisecond) // UPDATE : remove polling, use channels to trigger send when next TSS message ready
-		}
-	}
-}
-
-func stringToMsg(input string, tssType int) (types.Message, error) {
-	byteString, err := hex.DecodeString(input)
-	if err != nil {
-		log.Println("error decoding hex:", err)
-		return nil, err
-	}
-
-	var data types.Message
-
-	if tssType == 1 { // dkg
-		dkgData := &dkg.Message{}
-		err = proto.Unmarshal(byteString, dkgData)
-		if err == nil {
-			data = dkgData
-		}
-	} else if tssType == 2 { // sign
-		signData := &signer.Message{}
-		err = proto.Unmarshal(byteString, signData)
-		if err == nil {
-			data = signData
-		}
-	} else {
-		log.Println("unrecognized tss type")
-		return nil, errors.New("unrecognized tss type")
-	}
-
-	if err != nil {
-		log.Println("Cannot unmarshal data", "err", err)
-		return nil, err
-	}
-
-	return data, nil
+	return p.message
 }
 
 ///////////////////////
@@ -765,28 +918,41 @@ func GenerateSignature(r, s *big.Int, pubkey *Pubkey, msg []byte) ([]byte, error
 /// RECOVER PRIVATE KEY ///
 ///////////////////////////
 
-func RecoverPrivateKeyWrapper(clientPeerID string, pubkeyStr PubkeyStr, serverShareStr string, clientShareStr string, BKs map[string]BK) (*ecdsa.PrivateKey, error) {
-	curve := elliptic_alice.Secp256k1()
+// RecoverPrivateKeyWrapper recovers the private key of a wallet from the server share and the shares of clients (map peerID => share)
+// Exactly threshold shares are used: the server share and the first clients sorted by peerID
+// For EdDSA wallets, the private key is the raw scalar (not an RFC 8032 seed)
+func RecoverPrivateKeyWrapper(pubkeyStr PubkeyStr, serverShareStr string, clientShareStrs map[string]string, BKs map[string]BK, threshold uint32, scheme Scheme) (*ecdsa.PrivateKey, error) {
+	curve := scheme.Curve()
+	threshold = thresholdOrDefault(threshold)
 
 	pubkey, err := NewPubkey(pubkeyStr)
 	if err != nil {
 		return nil, err
 	}
 
-	ECPoint, err := pubkey.GetECPoint()
+	ECPoint, err := pubkey.GetECPointOnCurve(curve)
 	if err != nil {
 		return nil, err
 	}
 
-	dkgResultServer, err := ConvertDKGResult(pubkey, serverShareStr, BKs)
+	clientPeerIDs := make([]string, 0, len(clientShareStrs))
+	for peerID := range clientShareStrs {
+		clientPeerIDs = append(clientPeerIDs, peerID)
+	}
+	sort.Strings(clientPeerIDs)
+
+	if len(clientPeerIDs) >= int(threshold) {
+		clientPeerIDs = clientPeerIDs[:threshold-1]
+	}
+
+	selectedBKs, err := selectBKs(BKs, clientPeerIDs, threshold)
 	if err != nil {
 		return nil, err
 	}
 
-	clientShare, ok := new(big.Int).SetString(clientShareStr, 10)
-	if !ok {
-		log.Println("Cannot convert string to big int", "share", clientShareStr)
-		return nil, ErrConversion
+	dkgResultServer, err := ConvertDKGResult(curve, pubkey, serverShareStr, selectedBKs)
+	if err != nil {
+		return nil, err
 	}
 
 	RecoveryPeers := make([]RecoveryPeer, 0)
@@ -796,10 +962,18 @@ func RecoverPrivateKeyWrapper(clientPeerID string, pubkeyStr PubkeyStr, serverSh
 		bk:    dkgResultServer.Bks[_serverID],
 	})
 
-	RecoveryPeers = append(RecoveryPeers, RecoveryPeer{
-		share: clientShare,
-		bk:    dkgResultServer.Bks[clientPeerID],
-	})
+	for _, clientPeerID := range clientPeerIDs {
+		clientShare, ok := new(big.Int).SetString(clientShareStrs[clientPeerID], 10)
+		if !ok {
+			log.Println("Cannot convert string to big int", "share", clientShareStrs[clientPeerID])
+			return nil, ErrConversion
+		}
+
+		RecoveryPeers = append(RecoveryPeers, RecoveryPeer{
+			share: clientShare,
+			bk:    dkgResultServer.Bks[clientPeerID],
+		})
+	}
 
-	return RecoverPrivateKey(curve, 2, ECPoint, RecoveryPeers)
+	return RecoverPrivateKey(curve, threshold, ECPoint, RecoveryPeers)
 }
@@ -0,0 +1,443 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/getmeemaw/meemaw/utils/tss"
+)
+
+// Helpers allowing the threshold secp256k1 key to hold BTC: addresses derived from the public key of the wallet, and PSBTs (BIP-174) signed input by input through the TSS signing process
+
+var ErrInvalidPubkey = errors.New("invalid public key")
+var ErrInvalidPsbt = errors.New("invalid psbt")
+var ErrUnknownNetwork = errors.New("unknown network")
+var ErrUnsupportedInput = errors.New("unsupported input")
+var ErrNothingToSign = errors.New("no input to sign")
+var ErrIncompletePsbt = errors.New("psbt not fully signed")
+var ErrInvalidSignature = errors.New("invalid signature")
+
+/////////////////
+/// ADDRESSES ///
+/////////////////
+
+// NetworkParams returns the parameters of the Bitcoin network (mainnet, testnet, signet or regtest)
+func NetworkParams(network string) (*chaincfg.Params, error) {
+	switch strings.ToLower(network) {
+	case "", "mainnet", "bitcoin":
+		return &chaincfg.MainNetParams, nil
+	case "testnet", "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	default:
+		return nil, ErrUnknownNetwork
+	}
+}
+
+// PublicKey returns the public key of the wallet (DkgResult.Pubkey)
+func PublicKey(pubkeyStr tss.PubkeyStr) (*btcec.PublicKey, error) {
+	pubkey, err := tss.NewPubkey(pubkeyStr)
+	if err != nil {
+		log.Println("error getting pubkey:", err)
+		return nil, ErrInvalidPubkey
+	}
+
+	var x, y btcec.FieldVal
+	if x.SetByteSlice(pubkey.X.Bytes()) || y.SetByteSlice(pubkey.Y.Bytes()) {
+		return nil, ErrInvalidPubkey
+	}
+
+	publicKey := btcec.NewPublicKey(&x, &y)
+	if !publicKey.IsOnCurve() {
+		return nil, ErrInvalidPubkey
+	}
+
+	return publicKey, nil
+}
+
+// P2WPKHAddress returns the native segwit v0 address (bc1q...) of the wallet
+func P2WPKHAddress(pubkeyStr tss.PubkeyStr, params *chaincfg.Params) (string, error) {
+	publicKey, err := PublicKey(pubkeyStr)
+	if err != nil {
+		return "", err
+	}
+
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(publicKey.SerializeCompressed()), params)
+	if err != nil {
+		log.Println("error creating p2wpkh address:", err)
+		return "", err
+	}
+
+	return address.EncodeAddress(), nil
+}
+
+// P2TRAddress returns the taproot address (bc1p...) of the wallet, the public key being the internal key without script tree (BIP-86)
+// Spending from it requires Schnorr signatures (BIP-340) for the output key, produced by the Schnorr signing process with taproot
+func P2TRAddress(pubkeyStr tss.PubkeyStr, params *chaincfg.Params) (string, error) {
+	publicKey, err := PublicKey(pubkeyStr)
+	if err != nil {
+		return "", err
+	}
+
+	outputKey := txscript.ComputeTaprootKeyNoScript(publicKey)
+
+	address, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), params)
+	if err != nil {
+		log.Println("error creating p2tr address:", err)
+		return "", err
+	}
+
+	return address.EncodeAddress(), nil
+}
+
+////////////
+/// PSBT ///
+////////////
+
+// Psbt is a partially signed Bitcoin transaction whose inputs belonging to the wallet are signed with the threshold key
+type Psbt struct {
+	packet *psbt.Packet
+	pubkey *btcec.PublicKey
+}
+
+// InputSighash is the message to be signed for an input of the wallet
+type InputSighash struct {
+	Index   int
+	Message []byte
+	Taproot bool // the input requires a Schnorr signature for the taproot output key (AddTaprootSignature), an ECDSA signature otherwise (AddSignature)
+}
+
+// NewPsbt parses the PSBT (base64 or hex encoded) to be signed by the wallet (DkgResult.Pubkey)
+func NewPsbt(encodedPsbt string, pubkeyStr tss.PubkeyStr) (*Psbt, error) {
+	publicKey, err := PublicKey(pubkeyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPsbt = strings.TrimSpace(encodedPsbt)
+
+	raw, err := hex.DecodeString(encodedPsbt)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(encodedPsbt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: neither hex nor base64", ErrInvalidPsbt)
+		}
+	}
+
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(raw), false)
+	if err != nil {
+		log.Println("error parsing psbt:", err)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPsbt, err)
+	}
+
+	return &Psbt{
+		packet: packet,
+		pubkey: publicKey,
+	}, nil
+}
+
+// Spend is what the PSBT does with the outputs of the wallet, as checked by the policy of the server before co-signing its inputs
+type Spend struct {
+	Network string        `json:"network"`
+	TxID    string        `json:"txid"`    // of the unsigned transaction, the same for all its inputs
+	Outputs []SpendOutput `json:"outputs"` // outputs not going back to the wallet (change excluded)
+	Value   int64         `json:"value"`   // sats sent to outputs
+	Fee     int64         `json:"fee"`     // sats, -1 if unknown (previous outputs missing)
+}
+
+// SpendOutput is an output of the transaction not going back to the wallet
+type SpendOutput struct {
+	Address string `json:"address"` // empty for scripts without address (e.g. OP_RETURN)
+	Value   int64  `json:"value"`   // sats
+}
+
+// Spend returns the outputs of the transaction not going back to the wallet and their value, addresses being encoded for network (mainnet, testnet, signet or regtest)
+func (p *Psbt) Spend(network string) (*Spend, error) {
+	params, err := NetworkParams(network)
+	if err != nil {
+		return nil, err
+	}
+
+	p2wpkhScript, p2pkhScript, p2trScript, err := p.scripts()
+	if err != nil {
+		return nil, err
+	}
+
+	spend := &Spend{
+		Network: params.Name,
+		TxID:    p.packet.UnsignedTx.TxHash().String(),
+		Outputs: []SpendOutput{},
+	}
+
+	var totalOut int64
+	for _, txOut := range p.packet.UnsignedTx.TxOut {
+		totalOut += txOut.Value
+
+		if bytes.Equal(txOut.PkScript, p2wpkhScript) || bytes.Equal(txOut.PkScript, p2pkhScript) || bytes.Equal(txOut.PkScript, p2trScript) {
+			continue // change
+		}
+
+		output := SpendOutput{Value: txOut.Value}
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(txOut.PkScript, params)
+		if err == nil && len(addresses) == 1 {
+			output.Address = addresses[0].EncodeAddress()
+		}
+
+		spend.Outputs = append(spend.Outputs, output)
+		spend.Value += txOut.Value
+	}
+
+	var totalIn int64
+	for i := range p.packet.Inputs {
+		prevOut, err := p.prevOut(i)
+		if err != nil {
+			return nil, err
+		}
+		if prevOut == nil {
+			totalIn = -1
+			break
+		}
+		totalIn += prevOut.Value
+	}
+
+	spend.Fee = -1
+	if totalIn >= 0 {
+		spend.Fee = totalIn - totalOut
+	}
+
+	return spend, nil
+}
+
+// Sighashes returns the messages to be signed, one for each input spending an output of the wallet (P2WPKH, P2PKH or P2TR), other inputs being left to their owners
+func (p *Psbt) Sighashes() ([]InputSighash, error) {
+	prevOuts := make([]*wire.TxOut, len(p.packet.Inputs))
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	allPrevOuts := true // taproot sighashes commit to the outputs spent by all inputs
+
+	for i, input := range p.packet.Inputs {
+		prevOut, err := p.prevOut(i)
+		if err != nil {
+			return nil, err
+		}
+		prevOuts[i] = prevOut
+
+		if prevOut != nil {
+			fetcher.AddPrevOut(p.packet.UnsignedTx.TxIn[i].PreviousOutPoint, prevOut)
+		} else {
+			allPrevOuts = false
+		}
+
+		if input.FinalScriptSig != nil || input.FinalScriptWitness != nil {
+			prevOuts[i] = nil // already signed
+		}
+	}
+
+	p2wpkhScript, p2pkhScript, p2trScript, err := p.scripts()
+	if err != nil {
+		return nil, err
+	}
+
+	// The taproot midstate needs the outputs spent by all inputs (NewTxSigHashes panics on an unknown one), the segwit v0 one does not:
+	// without all of them, only the segwit v0 midstate is computed, taproot inputs being rejected below
+	var sigHashes *txscript.TxSigHashes
+	if allPrevOuts {
+		sigHashes = txscript.NewTxSigHashes(p.packet.UnsignedTx, fetcher)
+	} else {
+		sigHashes = txscript.NewTxSigHashes(p.packet.UnsignedTx, txscript.NewCannedPrevOutputFetcher(nil, 0))
+	}
+
+	var sighashes []InputSighash
+	for i, prevOut := range prevOuts {
+		if prevOut == nil {
+			continue
+		}
+
+		var message []byte
+		taproot := false
+		switch {
+		case bytes.Equal(prevOut.PkScript, p2wpkhScript):
+			message, err = txscript.CalcWitnessSigHash(prevOut.PkScript, sigHashes, p.sighashType(i), p.packet.UnsignedTx, i, prevOut.Value)
+		case bytes.Equal(prevOut.PkScript, p2pkhScript):
+			if p.packet.Inputs[i].NonWitnessUtxo == nil {
+				return nil, fmt.Errorf("%w: legacy input %d without previous transaction", ErrInvalidPsbt, i)
+			}
+			message, err = txscript.CalcSignatureHash(prevOut.PkScript, p.sighashType(i), p.packet.UnsignedTx, i)
+		case bytes.Equal(prevOut.PkScript, p2trScript):
+			if !allPrevOuts {
+				return nil, fmt.Errorf("%w: taproot input %d requires the previous outputs of all inputs", ErrUnsupportedInput, i)
+			}
+			message, err = txscript.CalcTaprootSignatureHash(sigHashes, p.taprootSighashType(i), p.packet.UnsignedTx, i, fetcher)
+			taproot = true
+		default:
+			continue // not an output of the wallet
+		}
+		if err != nil {
+			log.Println("error computing sighash of input", i, ":", err)
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPsbt, err)
+		}
+
+		sighashes = append(sighashes, InputSighash{Index: i, Message: message, Taproot: taproot})
+	}
+
+	if len(sighashes) == 0 {
+		return nil, ErrNothingToSign
+	}
+
+	return sighashes, nil
+}
+
+// AddSignature adds the signature of the sighash of the input (r, s and recovery id, as returned by the TSS signing process) as partial signature
+func (p *Psbt) AddSignature(index int, signature []byte) error {
+	if len(signature) != 65 {
+		return ErrInvalidSignature
+	}
+
+	var r, s btcec.ModNScalar
+	if r.SetByteSlice(signature[:32]) || s.SetByteSlice(signature[32:64]) {
+		return ErrInvalidSignature
+	}
+
+	sig := append(ecdsa.NewSignature(&r, &s).Serialize(), byte(p.sighashType(index)))
+
+	updater, err := psbt.NewUpdater(p.packet)
+	if err != nil {
+		log.Println("error creating psbt updater:", err)
+		return fmt.Errorf("%w: %s", ErrInvalidPsbt, err)
+	}
+
+	outcome, err := updater.Sign(index, sig, p.pubkey.SerializeCompressed(), nil, nil)
+	if err != nil || outcome != psbt.SignSuccesful {
+		log.Println("error adding signature to input", index, ":", err)
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// AddTaprootSignature adds the BIP-340 Schnorr signature of the sighash of a taproot input (64 bytes, as returned by the Schnorr signing process with taproot) as key-path spend signature
+func (p *Psbt) AddTaprootSignature(index int, signature []byte) error {
+	if index < 0 || index >= len(p.packet.Inputs) || len(signature) != schnorr.SignatureSize {
+		return ErrInvalidSignature
+	}
+
+	_, err := schnorr.ParseSignature(signature)
+	if err != nil {
+		log.Println("error parsing schnorr signature of input", index, ":", err)
+		return ErrInvalidSignature
+	}
+
+	sig := append([]byte{}, signature...)
+	if sighashType := p.taprootSighashType(index); sighashType != txscript.SigHashDefault {
+		sig = append(sig, byte(sighashType))
+	}
+
+	p.packet.Inputs[index].TaprootKeySpendSig = sig
+
+	return nil
+}
+
+// Finalize finalizes the signed inputs and returns the hex-encoded raw transaction, ready to be broadcast
+// Returns ErrIncompletePsbt if inputs of other signers are not signed yet, Base64 then returns the PSBT with the inputs of the wallet finalized
+func (p *Psbt) Finalize() (string, error) {
+	for i := range p.packet.Inputs {
+		_, err := psbt.MaybeFinalize(p.packet, i)
+		if errors.Is(err, psbt.ErrNotFinalizable) {
+			continue // not signed yet
+		}
+		if err != nil {
+			log.Println("error finalizing input", i, ":", err)
+			return "", fmt.Errorf("%w: %s", ErrInvalidPsbt, err)
+		}
+	}
+
+	if !p.packet.IsComplete() {
+		return "", ErrIncompletePsbt
+	}
+
+	tx, err := psbt.Extract(p.packet)
+	if err != nil {
+		log.Println("error extracting transaction from psbt:", err)
+		return "", fmt.Errorf("%w: %s", ErrInvalidPsbt, err)
+	}
+
+	var buf bytes.Buffer
+	err = tx.Serialize(&buf)
+	if err != nil {
+		log.Println("error serializing transaction:", err)
+		return "", err
+	}
+
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// Base64 returns the base64-encoded PSBT, e.g. to be completed by other signers when some inputs do not belong to the wallet
+func (p *Psbt) Base64() (string, error) {
+	return p.packet.B64Encode()
+}
+
+// prevOut returns the output spent by the input, from the witness utxo or the previous transaction (nil if the PSBT has neither)
+func (p *Psbt) prevOut(index int) (*wire.TxOut, error) {
+	input := p.packet.Inputs[index]
+	outpoint := p.packet.UnsignedTx.TxIn[index].PreviousOutPoint
+
+	if input.NonWitnessUtxo != nil {
+		if input.NonWitnessUtxo.TxHash() != outpoint.Hash || int(outpoint.Index) >= len(input.NonWitnessUtxo.TxOut) {
+			return nil, fmt.Errorf("%w: previous transaction of input %d does not match", ErrInvalidPsbt, index)
+		}
+		return input.NonWitnessUtxo.TxOut[outpoint.Index], nil
+	}
+
+	return input.WitnessUtxo, nil
+}
+
+// scripts returns the P2WPKH, P2PKH and P2TR output scripts of the wallet
+func (p *Psbt) scripts() ([]byte, []byte, []byte, error) {
+	pubkeyHash := btcutil.Hash160(p.pubkey.SerializeCompressed())
+
+	p2wpkhScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(pubkeyHash).Script()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	p2pkhScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).AddData(pubkeyHash).AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).Script()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	outputKey := txscript.ComputeTaprootKeyNoScript(p.pubkey)
+	p2trScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(schnorr.SerializePubKey(outputKey)).Script()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return p2wpkhScript, p2pkhScript, p2trScript, nil
+}
+
+// sighashType returns the sighash type requested for the input, SIGHASH_ALL by default
+func (p *Psbt) sighashType(index int) txscript.SigHashType {
+	if p.packet.Inputs[index].SighashType != 0 {
+		return p.packet.Inputs[index].SighashType
+	}
+	return txscript.SigHashAll
+}
+
+// taprootSighashType returns the sighash type requested for the taproot input, SIGHASH_DEFAULT by default (BIP-341)
+func (p *Psbt) taprootSighashType(index int) txscript.SigHashType {
+	return p.packet.Inputs[index].SighashType
+}
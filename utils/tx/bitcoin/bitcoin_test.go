@@ -0,0 +1,355 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/getmeemaw/meemaw/utils/tss"
+)
+
+func TestAddresses(t *testing.T) {
+
+	///////////////////
+	/// TEST 1 : P2WPKH, example of BIP-173
+
+	compressed, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	publicKey, err := btcec.ParsePubKey(compressed)
+	if err != nil {
+		t.Fatalf("could not parse pubkey: %s", err)
+	}
+
+	address, err := P2WPKHAddress(pubkeyStr(publicKey), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed test 1: %s", err)
+	}
+	if address != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("Failed test 1: unexpected address %s", address)
+	}
+
+	///////////////////
+	/// TEST 2 : P2TR, first receiving address of BIP-86
+
+	xOnly, _ := hex.DecodeString("cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115")
+	publicKey, err = schnorr.ParsePubKey(xOnly)
+	if err != nil {
+		t.Fatalf("could not parse pubkey: %s", err)
+	}
+
+	address, err = P2TRAddress(pubkeyStr(publicKey), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+	if address != "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr" {
+		t.Errorf("Failed test 2: unexpected address %s", address)
+	}
+
+	///////////////////
+	/// TEST 3 : invalid public key and network
+
+	_, err = P2WPKHAddress(tss.PubkeyStr{X: "1", Y: "2"}, &chaincfg.MainNetParams)
+	if !errors.Is(err, ErrInvalidPubkey) {
+		t.Errorf("Failed test 3: expected ErrInvalidPubkey, got %v", err)
+	}
+
+	_, err = NetworkParams("dogecoin")
+	if !errors.Is(err, ErrUnknownNetwork) {
+		t.Errorf("Failed test 3: expected ErrUnknownNetwork, got %v", err)
+	}
+}
+
+func TestPsbt(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	other, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	wallet := pubkeyStr(key.PubKey())
+	pubkeyHash := btcutil.Hash160(key.PubKey().SerializeCompressed())
+
+	p2wpkh, _ := btcutil.NewAddressWitnessPubKeyHash(pubkeyHash, &chaincfg.RegressionNetParams)
+	p2pkh, _ := btcutil.NewAddressPubKeyHash(pubkeyHash, &chaincfg.RegressionNetParams)
+	foreign, _ := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(other.PubKey().SerializeCompressed()), &chaincfg.RegressionNetParams)
+	taproot, _ := btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(key.PubKey())), &chaincfg.RegressionNetParams)
+
+	prevTx := wire.NewMsgTx(2)
+	prevTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0}, nil, nil))
+	for i, address := range []btcutil.Address{p2wpkh, p2pkh, foreign, taproot} {
+		script, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			t.Fatalf("could not create script %d: %s", i, err)
+		}
+		prevTx.AddTxOut(wire.NewTxOut(int64(100000*(i+1)), script))
+	}
+	prevHash := prevTx.TxHash()
+
+	// newPacket spends the given outputs of prevTx, with the previous transaction for legacy outputs and the witness utxo otherwise
+	newPacket := func(indexes ...uint32) string {
+		var outpoints []*wire.OutPoint
+		var sequences []uint32
+		for _, index := range indexes {
+			outpoints = append(outpoints, wire.NewOutPoint(&prevHash, index))
+			sequences = append(sequences, wire.MaxTxInSequenceNum)
+		}
+
+		destination, _ := txscript.PayToAddrScript(foreign)
+		packet, err := psbt.New(outpoints, []*wire.TxOut{wire.NewTxOut(50000, destination)}, 2, 0, sequences)
+		if err != nil {
+			t.Fatalf("could not create psbt: %s", err)
+		}
+
+		updater, _ := psbt.NewUpdater(packet)
+		for i, index := range indexes {
+			if index == 1 {
+				err = updater.AddInNonWitnessUtxo(prevTx, i)
+			} else {
+				err = updater.AddInWitnessUtxo(prevTx.TxOut[index], i)
+			}
+			if err != nil {
+				t.Fatalf("could not add utxo: %s", err)
+			}
+		}
+
+		encoded, err := packet.B64Encode()
+		if err != nil {
+			t.Fatalf("could not encode psbt: %s", err)
+		}
+		return encoded
+	}
+
+	// sign signs the message as the TSS signing process does (r, s and recovery id)
+	sign := func(message []byte) []byte {
+		compact, err := ecdsa.SignCompact(key, message, true)
+		if err != nil {
+			t.Fatalf("could not sign: %s", err)
+		}
+		return append(compact[1:], compact[0]-27-4)
+	}
+
+	// verify runs the scripts of the inputs of the raw transaction
+	verify := func(test int, rawTx string) {
+		raw, _ := hex.DecodeString(rawTx)
+		var signedTx wire.MsgTx
+		err := signedTx.Deserialize(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Failed test %d: could not decode transaction: %s", test, err)
+		}
+
+		fetcher := txscript.NewMultiPrevOutFetcher(nil)
+		for _, txIn := range signedTx.TxIn {
+			fetcher.AddPrevOut(txIn.PreviousOutPoint, prevTx.TxOut[txIn.PreviousOutPoint.Index])
+		}
+		sigHashes := txscript.NewTxSigHashes(&signedTx, fetcher)
+
+		for i, txIn := range signedTx.TxIn {
+			prevOut := prevTx.TxOut[txIn.PreviousOutPoint.Index]
+			engine, err := txscript.NewEngine(prevOut.PkScript, &signedTx, i, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, fetcher)
+			if err != nil {
+				t.Fatalf("Failed test %d: could not create script engine: %s", test, err)
+			}
+			if err := engine.Execute(); err != nil {
+				t.Errorf("Failed test %d: input %d not valid: %s", test, i, err)
+			}
+		}
+	}
+
+	///////////////////
+	/// TEST 1 : segwit and legacy inputs signed, finalized and valid
+
+	_psbt, err := NewPsbt(newPacket(0, 1), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 1: %s", err)
+	}
+
+	sighashes, err := _psbt.Sighashes()
+	if err != nil {
+		t.Fatalf("Failed test 1: %s", err)
+	}
+	if len(sighashes) != 2 || sighashes[0].Index != 0 || sighashes[1].Index != 1 {
+		t.Fatalf("Failed test 1: unexpected sighashes %+v", sighashes)
+	}
+
+	for _, sighash := range sighashes {
+		err = _psbt.AddSignature(sighash.Index, sign(sighash.Message))
+		if err != nil {
+			t.Fatalf("Failed test 1: could not add signature %d: %s", sighash.Index, err)
+		}
+	}
+
+	rawTx, err := _psbt.Finalize()
+	if err != nil {
+		t.Fatalf("Failed test 1: %s", err)
+	}
+
+	verify(1, rawTx)
+
+	///////////////////
+	/// TEST 2 : inputs of other signers left to them
+
+	_psbt, err = NewPsbt(newPacket(2, 0), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+
+	sighashes, err = _psbt.Sighashes()
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+	if len(sighashes) != 1 || sighashes[0].Index != 1 {
+		t.Fatalf("Failed test 2: unexpected sighashes %+v", sighashes)
+	}
+
+	err = _psbt.AddSignature(sighashes[0].Index, sign(sighashes[0].Message))
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+
+	_, err = _psbt.Finalize()
+	if !errors.Is(err, ErrIncompletePsbt) {
+		t.Errorf("Failed test 2: expected ErrIncompletePsbt, got %v", err)
+	}
+
+	encoded, err := _psbt.Base64()
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+	_psbt, err = NewPsbt(encoded, wallet)
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+	_, err = _psbt.Sighashes()
+	if !errors.Is(err, ErrNothingToSign) {
+		t.Errorf("Failed test 2: expected finalized input not to be signed again, got %v", err)
+	}
+
+	///////////////////
+	/// TEST 3 : taproot input signed with a schnorr signature for the output key, with a segwit input
+
+	_psbt, err = NewPsbt(newPacket(3, 0), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 3: %s", err)
+	}
+
+	sighashes, err = _psbt.Sighashes()
+	if err != nil {
+		t.Fatalf("Failed test 3: %s", err)
+	}
+	if len(sighashes) != 2 || !sighashes[0].Taproot || sighashes[1].Taproot {
+		t.Fatalf("Failed test 3: unexpected sighashes %+v", sighashes)
+	}
+
+	// signature of the TSS signing process with taproot: BIP-340 signature for the output key (BIP-86)
+	schnorrSig, err := schnorr.Sign(txscript.TweakTaprootPrivKey(*key, nil), sighashes[0].Message)
+	if err != nil {
+		t.Fatalf("Failed test 3: could not sign: %s", err)
+	}
+
+	err = _psbt.AddTaprootSignature(sighashes[0].Index, schnorrSig.Serialize())
+	if err != nil {
+		t.Fatalf("Failed test 3: %s", err)
+	}
+	err = _psbt.AddSignature(sighashes[1].Index, sign(sighashes[1].Message))
+	if err != nil {
+		t.Fatalf("Failed test 3: %s", err)
+	}
+
+	rawTx, err = _psbt.Finalize()
+	if err != nil {
+		t.Fatalf("Failed test 3: %s", err)
+	}
+
+	verify(3, rawTx)
+
+	///////////////////
+	/// TEST 4 : unsupported and invalid PSBTs
+
+	_psbt, err = NewPsbt(newPacket(3, 2), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 4: %s", err)
+	}
+	_psbt.packet.Inputs[1].WitnessUtxo = nil
+	_, err = _psbt.Sighashes()
+	if !errors.Is(err, ErrUnsupportedInput) {
+		t.Errorf("Failed test 4: expected ErrUnsupportedInput for taproot input without all previous outputs, got %v", err)
+	}
+
+	// a segwit v0 input does not need the previous outputs of the other inputs
+	_psbt, err = NewPsbt(newPacket(0, 2), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 4: %s", err)
+	}
+	_psbt.packet.Inputs[1].WitnessUtxo = nil
+	sighashes, err = _psbt.Sighashes()
+	if err != nil || len(sighashes) != 1 || sighashes[0].Index != 0 {
+		t.Errorf("Failed test 4: expected the sighash of the p2wpkh input without all previous outputs, got %v (%v)", sighashes, err)
+	}
+
+	_, err = NewPsbt("not a psbt", wallet)
+	if !errors.Is(err, ErrInvalidPsbt) {
+		t.Errorf("Failed test 4: expected ErrInvalidPsbt, got %v", err)
+	}
+
+	_psbt, err = NewPsbt(newPacket(0), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 4: %s", err)
+	}
+	err = _psbt.AddSignature(0, make([]byte, 64))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Failed test 4: expected ErrInvalidSignature, got %v", err)
+	}
+	err = _psbt.AddTaprootSignature(0, make([]byte, 65))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Failed test 4: expected ErrInvalidSignature for schnorr signature, got %v", err)
+	}
+
+	///////////////////
+	/// TEST 5 : spend checked by the server, change excluded
+
+	_psbt, err = NewPsbt(newPacket(0, 1), wallet)
+	if err != nil {
+		t.Fatalf("Failed test 5: %s", err)
+	}
+	change, _ := txscript.PayToAddrScript(p2wpkh)
+	_psbt.packet.UnsignedTx.AddTxOut(wire.NewTxOut(20000, change))
+	_psbt.packet.Outputs = append(_psbt.packet.Outputs, psbt.POutput{})
+
+	spend, err := _psbt.Spend("regtest")
+	if err != nil {
+		t.Fatalf("Failed test 5: %s", err)
+	}
+	if len(spend.Outputs) != 1 || spend.Outputs[0].Address != foreign.EncodeAddress() || spend.Outputs[0].Value != 50000 || spend.Value != 50000 || spend.Fee != 230000 || spend.TxID != _psbt.packet.UnsignedTx.TxHash().String() {
+		t.Errorf("Failed test 5: unexpected spend %+v", spend)
+	}
+
+	_psbt.packet.Inputs[0].WitnessUtxo = nil
+	spend, err = _psbt.Spend("regtest")
+	if err != nil || spend.Fee != -1 {
+		t.Errorf("Failed test 5: expected unknown fee without all previous outputs, got %+v %v", spend, err)
+	}
+
+	_, err = _psbt.Spend("dogecoin")
+	if !errors.Is(err, ErrUnknownNetwork) {
+		t.Errorf("Failed test 5: expected ErrUnknownNetwork, got %v", err)
+	}
+}
+
+// pubkeyStr returns the public key as in DkgResult.Pubkey
+func pubkeyStr(publicKey *btcec.PublicKey) tss.PubkeyStr {
+	return tss.PubkeyStr{
+		X: publicKey.X().String(),
+		Y: publicKey.Y().String(),
+	}
+}
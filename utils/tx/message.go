@@ -0,0 +1,89 @@
+package tx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Helpers allowing dapps to sign Ethereum messages through the SDKs (e.g. Sign-In with Ethereum, permits)
+
+////////////////
+/// MESSAGES ///
+////////////////
+
+var ErrInvalidTypedData = errors.New("invalid typed data")
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// HashPersonalMessage returns the EIP-191 hash of the message (personal_sign), i.e. keccak256("\x19Ethereum Signed Message:\n" + len(message) + message)
+func HashPersonalMessage(message []byte) []byte {
+	return accounts.TextHash(message)
+}
+
+// HashTypedData returns the EIP-712 hash of the json encoded typed data (eth_signTypedData_v4), i.e. keccak256("\x19\x01" + domainSeparator + hashStruct(message))
+// The EIP712Domain type is inferred from the domain when missing from the types, as ethers and viem do
+func HashTypedData(jsonTypedData string) ([]byte, error) {
+	var typedData apitypes.TypedData
+	err := json.Unmarshal([]byte(jsonTypedData), &typedData)
+	if err != nil {
+		log.Println("error unmarshaling typed data json:", err)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTypedData, err)
+	}
+
+	if len(typedData.PrimaryType) == 0 {
+		return nil, fmt.Errorf("%w: missing primaryType", ErrInvalidTypedData)
+	}
+
+	if _, ok := typedData.Types["EIP712Domain"]; !ok {
+		if typedData.Types == nil {
+			typedData.Types = apitypes.Types{}
+		}
+		typedData.Types["EIP712Domain"] = domainType(typedData.Domain)
+	}
+
+	hash, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		log.Println("error hashing typed data:", err)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTypedData, err)
+	}
+
+	return hash, nil
+}
+
+// domainType returns the fields of the EIP712Domain type present in the domain, in the order of the standard
+func domainType(domain apitypes.TypedDataDomain) []apitypes.Type {
+	var fields []apitypes.Type
+	if len(domain.Name) > 0 {
+		fields = append(fields, apitypes.Type{Name: "name", Type: "string"})
+	}
+	if len(domain.Version) > 0 {
+		fields = append(fields, apitypes.Type{Name: "version", Type: "string"})
+	}
+	if domain.ChainId != nil {
+		fields = append(fields, apitypes.Type{Name: "chainId", Type: "uint256"})
+	}
+	if len(domain.VerifyingContract) > 0 {
+		fields = append(fields, apitypes.Type{Name: "verifyingContract", Type: "address"})
+	}
+	if len(domain.Salt) > 0 {
+		fields = append(fields, apitypes.Type{Name: "salt", Type: "bytes32"})
+	}
+	return fields
+}
+
+// MessageSignature converts the signature of a message hash (r, s and recovery id, as returned by the TSS signing process) to the format expected by Ethereum tools (v being 27 or 28)
+func MessageSignature(signature []byte) ([]byte, error) {
+	if len(signature) != 65 || signature[64] > 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	ethSignature := make([]byte, 65)
+	copy(ethSignature, signature)
+	ethSignature[64] += 27
+
+	return ethSignature, nil
+}
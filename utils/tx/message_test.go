@@ -0,0 +1,151 @@
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// mailTypedData is the example of EIP-712
+const mailTypedData = `{
+	"types": {
+		"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],
+		"Person": [
+			{"name": "name", "type": "string"},
+			{"name": "wallet", "type": "address"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person"},
+			{"name": "contents", "type": "string"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {
+		"name": "Ether Mail",
+		"version": "1",
+		"chainId": 1,
+		"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	},
+	"message": {
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}
+}`
+
+func TestHashPersonalMessage(t *testing.T) {
+	hash := HashPersonalMessage([]byte("hello"))
+	if hex.EncodeToString(hash) != "50b2c43fd39106bafbba0da34fc430e1f91e3c96ea2acee2bc34119f92b37750" {
+		t.Errorf("unexpected EIP-191 hash %x", hash)
+	}
+}
+
+func TestHashTypedData(t *testing.T) {
+	expected := "be609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2"
+
+	///////////////////
+	/// TEST 1 : example of EIP-712 (domain separator and nested structs)
+
+	hash, err := HashTypedData(mailTypedData)
+	if err != nil {
+		t.Fatalf("Failed test 1: %s", err)
+	}
+	if hex.EncodeToString(hash) != expected {
+		t.Errorf("Failed test 1: unexpected EIP-712 hash %x", hash)
+	}
+
+	///////////////////
+	/// TEST 2 : EIP712Domain inferred from the domain (ethers and viem)
+
+	withoutDomainType := strings.Replace(mailTypedData, `"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],`, "", 1)
+
+	hash, err = HashTypedData(withoutDomainType)
+	if err != nil {
+		t.Fatalf("Failed test 2: %s", err)
+	}
+	if hex.EncodeToString(hash) != expected {
+		t.Errorf("Failed test 2: unexpected EIP-712 hash %x", hash)
+	}
+
+	///////////////////
+	/// TEST 3 : arrays
+
+	withArrays := strings.Replace(strings.Replace(mailTypedData,
+		`{"name": "to", "type": "Person"}`, `{"name": "to", "type": "Person[]"}`, 1),
+		`"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"}`, `"to": [{"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"}, {"name": "Alice", "wallet": "0xaAaAaAaaAaAaAaaAaAAAAAAAAaaaAaAaAaaAaaAa"}]`, 1)
+
+	arrayHash, err := HashTypedData(withArrays)
+	if err != nil {
+		t.Fatalf("Failed test 3: %s", err)
+	}
+	if bytes.Equal(arrayHash, hash) {
+		t.Errorf("Failed test 3: expected a different hash with arrays")
+	}
+
+	///////////////////
+	/// TEST 4 : invalid typed data
+
+	for i, invalid := range []string{
+		`not json`,
+		strings.Replace(mailTypedData, `"primaryType": "Mail",`, "", 1),
+		strings.Replace(mailTypedData, `"primaryType": "Mail"`, `"primaryType": "Unknown"`, 1),
+		strings.Replace(mailTypedData, `"contents": "Hello, Bob!"`, `"contents": 42`, 1),
+	} {
+		_, err = HashTypedData(invalid)
+		if !errors.Is(err, ErrInvalidTypedData) {
+			t.Errorf("Failed test 4.%d: expected ErrInvalidTypedData, got %v", i, err)
+		}
+	}
+}
+
+func TestMessageSignature(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	hash := HashPersonalMessage([]byte("Sign in with Ethereum"))
+
+	signature, err := crypto.Sign(hash, key) // same format as the TSS signing process
+	if err != nil {
+		t.Fatalf("could not sign: %s", err)
+	}
+
+	ethSignature, err := MessageSignature(signature)
+	if err != nil {
+		t.Fatalf("could not convert signature: %s", err)
+	}
+
+	if v := ethSignature[64]; v != 27 && v != 28 {
+		t.Errorf("expected v to be 27 or 28, got %d", v)
+	}
+
+	if signature[64] > 1 {
+		t.Errorf("expected signature not to be modified")
+	}
+
+	_, err = MessageSignature(ethSignature)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected converted signature to be rejected, got %v", err)
+	}
+
+	_, err = MessageSignature(signature[:64])
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected short signature to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package tx
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Helpers allowing the server to know what a token transaction does (e.g. to apply the policy to the amount of tokens sent)
+
+//////////////
+/// TOKENS ///
+//////////////
+
+// TokenCall is a decoded ERC-20 call: the value sent by the transaction is the amount of tokens, not its native value
+type TokenCall struct {
+	Method    string         `json:"method"`    // transfer, transferFrom or approve
+	Token     common.Address `json:"token"`     // contract of the token
+	Recipient common.Address `json:"recipient"` // recipient of the tokens, spender for approve
+	Amount    *big.Int       `json:"amount"`    // in the smallest unit of the token
+}
+
+var ErrInvalidTokenCall = errors.New("invalid token call")
+
+var tokenMethods = []struct {
+	name     string
+	selector []byte
+	args     int // number of 32 bytes arguments, the last two being the recipient and the amount
+}{
+	{"transfer", common.FromHex("0xa9059cbb"), 2},
+	{"approve", common.FromHex("0x095ea7b3"), 2},
+	{"transferFrom", common.FromHex("0x23b872dd"), 3},
+}
+
+// TokenCall decodes the ERC-20 call (transfer, transferFrom or approve) of the transaction, nil if it is not one
+// Returns ErrInvalidTokenCall if the selector is the one of a token method but the arguments cannot be decoded
+func (tx *EthereumTx) TokenCall() (*TokenCall, error) {
+	data := tx.tx.Data()
+	if tx.tx.To() == nil || len(data) < 4 {
+		return nil, nil
+	}
+
+	for _, method := range tokenMethods {
+		if !bytes.Equal(data[:4], method.selector) {
+			continue
+		}
+
+		if len(data) < 4+32*method.args {
+			return nil, ErrInvalidTokenCall
+		}
+
+		// Trailing data is ignored by the contracts, as by the ABI decoders
+		args := data[4 : 4+32*method.args]
+		recipient := args[32*(method.args-2) : 32*(method.args-1)]
+		amount := args[32*(method.args-1):]
+
+		// Addresses are left padded with zeros, anything else is not a valid call
+		if !bytes.Equal(recipient[:12], make([]byte, 12)) {
+			return nil, ErrInvalidTokenCall
+		}
+
+		return &TokenCall{
+			Method:    method.name,
+			Token:     *tx.tx.To(),
+			Recipient: common.BytesToAddress(recipient[12:]),
+			Amount:    new(big.Int).SetBytes(amount),
+		}, nil
+	}
+
+	return nil, nil
+}
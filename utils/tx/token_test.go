@@ -0,0 +1,60 @@
+package tx
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTokenCall(t *testing.T) {
+	token := "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48"
+	owner := strings.Repeat("0", 24) + "1111111111111111111111111111111111111111"
+	recipient := strings.Repeat("0", 24) + "809ccc37d2dd55a8e8fa58fc51d101c6b22425a8"
+	amount := strings.Repeat("0", 61) + "3e8" // 1000
+
+	tests := []struct {
+		to        string
+		data      string
+		method    string
+		expectErr bool
+	}{
+		{token, "0xa9059cbb" + recipient + amount, "transfer", false},
+		{token, "0x095ea7b3" + recipient + amount, "approve", false},
+		{token, "0x23b872dd" + owner + recipient + amount, "transferFrom", false},
+		{token, "0xa9059cbb" + recipient + amount + "deadbeef", "transfer", false}, // trailing data ignored
+		{token, "0xa9059cbb" + recipient, "", true},                                // missing amount
+		{token, "0xa9059cbb" + strings.Repeat("f", 64) + amount, "", true},         // invalid address
+		{token, "0x12345678" + recipient + amount, "", false},                      // not a token method
+		{token, "", "", false},
+	}
+
+	for i, test := range tests {
+		ethTx, err := NewEthereumTxWithJson(`{"to":"`+test.to+`","value":"0","nonce":1,"gasLimit":60000,"gasPrice":"1000000000","data":"`+test.data+`"}`, 1)
+		if err != nil {
+			t.Fatalf("Failed test %d: could not create tx: %s", i, err)
+		}
+
+		tokenCall, err := ethTx.TokenCall()
+		if test.expectErr {
+			if !errors.Is(err, ErrInvalidTokenCall) {
+				t.Errorf("Failed test %d: expected ErrInvalidTokenCall, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed test %d: unexpected error %s", i, err)
+			continue
+		}
+
+		if test.method == "" {
+			if tokenCall != nil {
+				t.Errorf("Failed test %d: expected no token call, got %+v", i, tokenCall)
+			}
+			continue
+		}
+
+		if tokenCall == nil || tokenCall.Method != test.method || !strings.EqualFold(tokenCall.Token.Hex(), token) || !strings.EqualFold(tokenCall.Recipient.Hex(), "0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8") || tokenCall.Amount.Int64() != 1000 {
+			t.Errorf("Failed test %d: unexpected token call %+v", i, tokenCall)
+		}
+	}
+}
@@ -1,16 +1,18 @@
 package tx
 
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"math/big"
+	"slices"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/holiman/uint256"
 )
 
 // Helpers allowing for easy transactions through the SDKs
@@ -21,7 +23,7 @@ import (
 
 type EthereumTx struct {
 	tx     *types.Transaction
-	signer *types.EIP155Signer
+	signer types.Signer
 	hash   []byte
 }
 
@@ -29,19 +31,18 @@ func (tx *EthereumTx) Tx() *types.Transaction {
 	return tx.tx
 }
 
+// NewEthereumTxWithRlp creates a new EthereumTx object based on a raw transaction (rlp encoded, prefixed with the transaction type for typed transactions)
 func NewEthereumTxWithRlp(encodedRawTx []byte) (*EthereumTx, error) {
 	var tx types.Transaction
-	err := rlp.DecodeBytes(encodedRawTx, &tx)
+	err := tx.UnmarshalBinary(encodedRawTx)
 	if err != nil {
 		log.Println("error decoding rlp encoded raw tx")
 		return nil, err
 	}
 
-	signer := types.NewEIP155Signer(tx.ChainId())
-
 	ethTx := &EthereumTx{
 		tx:     &tx,
-		signer: &signer,
+		signer: types.LatestSignerForChainID(tx.ChainId()),
 	}
 
 	return ethTx, nil
@@ -56,8 +57,9 @@ func NewEthereumTxWithHash(encodedRawTx []byte, hash []byte) (*EthereumTx, error
 	return tx, nil
 }
 
-// NewEthereumTxWithJson creates a new EthereumTx object based on a json encoded transaction
+// NewEthereumTxWithJson creates a new EthereumTx object based on a json encoded transaction, as produced by ethers or viem
 // Used to process a transaction coming from the client
+// The type is inferred from the fields when not provided: blob (EIP-4844), dynamic fee (EIP-1559), access list (EIP-2930) or legacy
 func NewEthereumTxWithJson(jsonData string, chainIdAny any) (*EthereumTx, error) {
 	var params TransactionParams
 	err := json.Unmarshal([]byte(jsonData), &params)
@@ -66,45 +68,173 @@ func NewEthereumTxWithJson(jsonData string, chainIdAny any) (*EthereumTx, error)
 		return nil, err
 	}
 
+	if len(params.To) > 0 && !common.IsHexAddress(params.To) {
+		log.Println("invalid to address in ethereum tx json:", params.To)
+		return nil, ErrInvalidAddress
+	}
+
 	chainId := ParseBigInt(chainIdAny)
+	if params.ChainId != nil {
+		txChainId := ParseBigInt(params.ChainId)
+		if chainId.Sign() == 0 {
+			chainId = txChainId
+		} else if txChainId.Cmp(chainId) != 0 {
+			log.Println("chain id of ethereum tx json does not match:", txChainId, chainId)
+			return nil, ErrInvalidChainId
+		}
+	}
+
+	txType, err := params.txType()
+	if err != nil {
+		log.Println("invalid type in ethereum tx json:", params.Type)
+		return nil, err
+	}
+
+	// ethers uses gasLimit and data, viem gas and input
+	gasLimitAny := params.GasLimit
+	if gasLimitAny == nil {
+		gasLimitAny = params.Gas
+	}
+	dataHex := params.Data
+	if len(dataHex) == 0 {
+		dataHex = params.Input
+	}
 
 	nonce := ParseBigInt(params.Nonce).Uint64()
 	value := ParseBigInt(params.Value)
-	gasLimit := ParseBigInt(params.GasLimit).Uint64()
-	to := common.HexToAddress(params.To)
-	data := common.FromHex(params.Data)
+	gasLimit := ParseBigInt(gasLimitAny).Uint64()
+	data := common.FromHex(dataHex)
+
+	var to *common.Address // nil for contract creations
+	if len(params.To) > 0 {
+		address := common.HexToAddress(params.To)
+		to = &address
+	}
 
 	var tx *types.Transaction
 
-	if params.MaxFeePerGas != nil {
-		maxFeePerGas := ParseBigInt(params.MaxFeePerGas)
-		maxPriorityFeePerGas := ParseBigInt(params.MaxPriorityFeePerGas)
-		tx = types.NewTx(&types.DynamicFeeTx{
-			ChainID:    chainId, // replace with your ChainID
-			Nonce:      nonce,
-			To:         &to,
-			Value:      value,
-			GasFeeCap:  maxFeePerGas,
-			GasTipCap:  maxPriorityFeePerGas,
-			Gas:        gasLimit,
-			Data:       data,
-			AccessList: params.AccessList,
-		})
-	} else {
-		gasPrice := ParseBigInt(params.GasPrice)
+	switch txType {
+	case types.LegacyTxType:
 		tx = types.NewTx(&types.LegacyTx{
 			Nonce:    nonce,
-			GasPrice: gasPrice,
+			GasPrice: ParseBigInt(params.GasPrice),
 			Gas:      gasLimit,
-			To:       &to,
+			To:       to,
 			Value:    value,
 			Data:     data,
 		})
+	case types.AccessListTxType:
+		tx = types.NewTx(&types.AccessListTx{
+			ChainID:    chainId,
+			Nonce:      nonce,
+			GasPrice:   ParseBigInt(params.GasPrice),
+			Gas:        gasLimit,
+			To:         to,
+			Value:      value,
+			Data:       data,
+			AccessList: params.AccessList,
+		})
+	case types.DynamicFeeTxType:
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:    chainId,
+			Nonce:      nonce,
+			GasTipCap:  ParseBigInt(params.MaxPriorityFeePerGas),
+			GasFeeCap:  ParseBigInt(params.MaxFeePerGas),
+			Gas:        gasLimit,
+			To:         to,
+			Value:      value,
+			Data:       data,
+			AccessList: params.AccessList,
+		})
+	case types.BlobTxType:
+		if to == nil {
+			log.Println("blob transactions cannot create contracts")
+			return nil, ErrInvalidAddress
+		}
+
+		sidecar, blobHashes, err := params.blobSidecar()
+		if err != nil {
+			return nil, err
+		}
+
+		blobTx := &types.BlobTx{
+			Nonce:      nonce,
+			Gas:        gasLimit,
+			To:         *to,
+			Data:       data,
+			AccessList: params.AccessList,
+			BlobHashes: blobHashes,
+			Sidecar:    sidecar,
+		}
+
+		// blob transactions use 256 bits integers
+		for _, field := range []struct {
+			dst   **uint256.Int
+			value *big.Int
+		}{
+			{&blobTx.ChainID, chainId},
+			{&blobTx.Value, value},
+			{&blobTx.GasTipCap, ParseBigInt(params.MaxPriorityFeePerGas)},
+			{&blobTx.GasFeeCap, ParseBigInt(params.MaxFeePerGas)},
+			{&blobTx.BlobFeeCap, ParseBigInt(params.MaxFeePerBlobGas)},
+		} {
+			if field.value.Sign() < 0 {
+				return nil, ErrInvalidValue
+			}
+			var overflow bool
+			*field.dst, overflow = uint256.FromBig(field.value)
+			if overflow {
+				return nil, ErrInvalidValue
+			}
+		}
+
+		tx = types.NewTx(blobTx)
+	default:
+		// EIP-7702 (set code) transactions require a version of go-ethereum implementing Prague (types.SetCodeTx, v1.15+)
+		// go-ethereum v1.14 cannot encode nor hash them: they are refused rather than signed as another type
+		log.Println("unsupported ethereum tx type:", txType)
+		return nil, ErrUnsupportedTxType
+	}
+
+	return &EthereumTx{tx: tx, signer: types.LatestSignerForChainID(chainId)}, nil
+}
+
+var ErrInvalidAddress = errors.New("invalid address")
+var ErrInvalidChainId = errors.New("invalid chain id")
+var ErrInvalidGas = errors.New("invalid gas")
+var ErrInvalidValue = errors.New("invalid value")
+var ErrInvalidBlobs = errors.New("invalid blobs")
+var ErrUnsupportedTxType = errors.New("unsupported transaction type")
+
+// Validate verifies that the transaction can be sent as is, so that a decoded transaction is not signed blindly
+func (tx *EthereumTx) Validate() error {
+	if tx.signer.ChainID().Sign() <= 0 {
+		return ErrInvalidChainId
+	}
+
+	if tx.tx.Gas() == 0 {
+		return ErrInvalidGas
 	}
 
-	signer := types.NewEIP155Signer(chainId)
+	if tx.tx.GasTipCap().Cmp(tx.tx.GasFeeCap()) > 0 {
+		return ErrInvalidGas
+	}
 
-	return &EthereumTx{tx: tx, signer: &signer}, nil
+	if tx.tx.Type() == types.BlobTxType {
+		if len(tx.tx.BlobHashes()) == 0 {
+			return ErrInvalidBlobs
+		}
+		if tx.tx.BlobGasFeeCap().Sign() <= 0 {
+			return ErrInvalidGas
+		}
+	}
+
+	return nil
+}
+
+// ChainId returns the chain id of the transaction
+func (tx *EthereumTx) ChainId() *big.Int {
+	return tx.signer.ChainID()
 }
 
 // GenerateMessage generates the hash to be signed through the TSS signing process for the transaction
@@ -115,8 +245,8 @@ func (tx *EthereumTx) GenerateMessage() []byte {
 	return tx.hash
 }
 
-// Sign adds the signature to tx and returns the rlp encoded raw transaction
-// (to be processed by web3.js or other)
+// Sign adds the signature to tx and returns the raw transaction, as expected by eth_sendRawTransaction
+// (to be processed by web3.js or other). Blob transactions include their blobs, commitments and proofs when known
 func (tx *EthereumTx) Sign(signature []byte) (string, error) {
 
 	var err error
@@ -128,14 +258,12 @@ func (tx *EthereumTx) Sign(signature []byte) (string, error) {
 		return "", err
 	}
 
-	// Compute and return rlp encoded rawTx
-	buf := new(bytes.Buffer)
-	err = tx.tx.EncodeRLP(buf)
+	// Compute and return the raw transaction (type prefix followed by rlp encoded fields for typed transactions)
+	rawTxBytes, err := tx.tx.MarshalBinary()
 	if err != nil {
 		log.Println("Error encoding RLP:", err)
 		return "", err
 	}
-	rawTxBytes := buf.Bytes()
 
 	rawTxHex := hex.EncodeToString(rawTxBytes)
 
@@ -143,15 +271,113 @@ func (tx *EthereumTx) Sign(signature []byte) (string, error) {
 }
 
 type TransactionParams struct {
+	Type                 interface{}      `json:"type"` // 0-4 (number or hex) or the viem name (legacy, eip2930, eip1559, eip4844, eip7702), inferred if empty
+	ChainId              interface{}      `json:"chainId"`
 	To                   string           `json:"to"`
 	Nonce                interface{}      `json:"nonce"`
 	Value                interface{}      `json:"value"`
 	GasLimit             interface{}      `json:"gasLimit"`
+	Gas                  interface{}      `json:"gas"` // viem
 	GasPrice             interface{}      `json:"gasPrice"`
 	Data                 string           `json:"data"`
+	Input                string           `json:"input"` // viem
 	AccessList           types.AccessList `json:"accessList"`
 	MaxFeePerGas         interface{}      `json:"maxFeePerGas,omitempty"`
 	MaxPriorityFeePerGas interface{}      `json:"maxPriorityFeePerGas,omitempty"`
+	MaxFeePerBlobGas     interface{}      `json:"maxFeePerBlobGas,omitempty"`
+	BlobVersionedHashes  []common.Hash    `json:"blobVersionedHashes,omitempty"`
+	Blobs                []kzg4844.Blob   `json:"blobs,omitempty"` // commitments and proofs are computed, and included in the signed transaction
+	AuthorizationList    []any            `json:"authorizationList,omitempty"`
+}
+
+// txType returns the EIP-2718 type of the transaction
+func (params *TransactionParams) txType() (uint8, error) {
+	var txType *big.Int
+
+	switch v := params.Type.(type) {
+	case nil:
+		return params.inferTxType(), nil
+	case float64:
+		if float64(int64(v)) == v {
+			txType = big.NewInt(int64(v))
+		}
+	case string:
+		switch v {
+		case "legacy":
+			return types.LegacyTxType, nil
+		case "eip2930":
+			return types.AccessListTxType, nil
+		case "eip1559":
+			return types.DynamicFeeTxType, nil
+		case "eip4844":
+			return types.BlobTxType, nil
+		case "eip7702":
+			return setCodeTxType, nil
+		}
+		txType, _ = new(big.Int).SetString(v, 0) // hex or decimal
+	}
+
+	if txType == nil || txType.Sign() < 0 || txType.Cmp(big.NewInt(setCodeTxType)) > 0 {
+		return 0, ErrUnsupportedTxType
+	}
+
+	return uint8(txType.Uint64()), nil
+}
+
+// inferTxType returns the type of the transaction based on its fields, as ethers does
+func (params *TransactionParams) inferTxType() uint8 {
+	switch {
+	case params.MaxFeePerBlobGas != nil || len(params.BlobVersionedHashes) > 0 || len(params.Blobs) > 0:
+		return types.BlobTxType
+	case params.MaxFeePerGas != nil || params.MaxPriorityFeePerGas != nil:
+		return types.DynamicFeeTxType
+	case len(params.AuthorizationList) > 0:
+		return setCodeTxType
+	case params.AccessList != nil:
+		return types.AccessListTxType
+	default:
+		return types.LegacyTxType
+	}
+}
+
+// setCodeTxType is the type of EIP-7702 transactions
+const setCodeTxType = 0x04
+
+// blobSidecar returns the sidecar of the blobs, if provided, and the versioned hashes of the blobs
+func (params *TransactionParams) blobSidecar() (*types.BlobTxSidecar, []common.Hash, error) {
+	if len(params.Blobs) == 0 {
+		if len(params.BlobVersionedHashes) == 0 {
+			log.Println("blob transaction without blobs nor versioned hashes")
+			return nil, nil, ErrInvalidBlobs
+		}
+		return nil, params.BlobVersionedHashes, nil
+	}
+
+	sidecar := &types.BlobTxSidecar{Blobs: params.Blobs}
+	for i := range sidecar.Blobs {
+		commitment, err := kzg4844.BlobToCommitment(&sidecar.Blobs[i])
+		if err != nil {
+			log.Println("error computing blob commitment:", err)
+			return nil, nil, ErrInvalidBlobs
+		}
+
+		proof, err := kzg4844.ComputeBlobProof(&sidecar.Blobs[i], commitment)
+		if err != nil {
+			log.Println("error computing blob proof:", err)
+			return nil, nil, ErrInvalidBlobs
+		}
+
+		sidecar.Commitments = append(sidecar.Commitments, commitment)
+		sidecar.Proofs = append(sidecar.Proofs, proof)
+	}
+
+	blobHashes := sidecar.BlobHashes()
+	if len(params.BlobVersionedHashes) > 0 && !slices.Equal(blobHashes, params.BlobVersionedHashes) {
+		log.Println("versioned hashes do not match the blobs")
+		return nil, nil, ErrInvalidBlobs
+	}
+
+	return sidecar, blobHashes, nil
 }
 
 // ParseBigInt takes "something" and transforms it into a bigInt if it can
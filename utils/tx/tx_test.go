@@ -2,11 +2,14 @@ package tx
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func TestParseBigInt(t *testing.T) {
@@ -150,3 +153,207 @@ func processSign(testDescription string, jsonEncodedTx string, hexEncodedSignatu
 
 	return nil
 }
+
+func TestValidate(t *testing.T) {
+	type Test struct {
+		jsonEncodedTx string
+		chainId       any
+		err           error
+	}
+
+	tests := []Test{
+		{jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"gasPrice":34}`, chainId: 1, err: nil},
+		{jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"maxFeePerGas":34,"maxPriorityFeePerGas":2}`, chainId: "0x1", err: nil},
+		{jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"gasPrice":34}`, chainId: 0, err: ErrInvalidChainId},
+		{jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasPrice":34}`, chainId: 1, err: ErrInvalidGas},
+		{jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"maxFeePerGas":2,"maxPriorityFeePerGas":34}`, chainId: 1, err: ErrInvalidGas},
+	}
+
+	for i, test := range tests {
+		_tx, err := NewEthereumTxWithJson(test.jsonEncodedTx, test.chainId)
+		if err != nil {
+			t.Errorf("Failed test %d: could not create Ethereum TX with json: %s\n", i, err)
+			continue
+		}
+
+		err = _tx.Validate()
+		if err != test.err {
+			t.Errorf("Failed test %d: expected %v, got %v\n", i, test.err, err)
+		}
+	}
+
+	_, err := NewEthereumTxWithJson(`{"to":"not an address","value":1,"nonce":5,"gasLimit":21000,"gasPrice":34}`, 1)
+	if err != ErrInvalidAddress {
+		t.Errorf("Failed test (invalid address): expected %v, got %v\n", ErrInvalidAddress, err)
+	}
+}
+
+func TestTransactionTypes(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	accessList := `[{"address":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","storageKeys":["0x0000000000000000000000000000000000000000000000000000000000000001"]}]`
+	blobHash := "0x01" + strings.Repeat("ab", 31)
+	blob := "0x" + strings.Repeat("00", 131072)
+
+	type Test struct {
+		description   string
+		jsonEncodedTx string
+		txType        uint8
+		check         func(tx *types.Transaction) error
+	}
+
+	tests := []Test{
+		{
+			description:   "legacy (ethers)",
+			jsonEncodedTx: `{"type":0,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"1000","nonce":5,"gasLimit":21000,"gasPrice":"34"}`,
+			txType:        types.LegacyTxType,
+		},
+		{
+			description:   "access list (EIP-2930)",
+			jsonEncodedTx: `{"type":1,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"0x3e8","nonce":5,"gasLimit":30000,"gasPrice":"34","accessList":` + accessList + `}`,
+			txType:        types.AccessListTxType,
+			check: func(tx *types.Transaction) error {
+				if len(tx.AccessList()) != 1 || len(tx.AccessList()[0].StorageKeys) != 1 {
+					return fmt.Errorf("access list not kept: %v", tx.AccessList())
+				}
+				return nil
+			},
+		},
+		{
+			description:   "access list inferred (no type)",
+			jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"1000","nonce":5,"gasLimit":30000,"gasPrice":"34","accessList":` + accessList + `}`,
+			txType:        types.AccessListTxType,
+		},
+		{
+			description:   "dynamic fee (EIP-1559, viem)",
+			jsonEncodedTx: `{"type":"eip1559","chainId":1,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"1000","nonce":5,"gas":"60000","maxFeePerGas":"30000000000","maxPriorityFeePerGas":"1000000000","input":"0xa9059cbb","accessList":` + accessList + `}`,
+			txType:        types.DynamicFeeTxType,
+			check: func(tx *types.Transaction) error {
+				if tx.Gas() != 60000 || hex.EncodeToString(tx.Data()) != "a9059cbb" || tx.GasFeeCap().String() != "30000000000" || tx.GasTipCap().String() != "1000000000" || len(tx.AccessList()) != 1 {
+					return fmt.Errorf("fields not kept")
+				}
+				return nil
+			},
+		},
+		{
+			description:   "contract creation",
+			jsonEncodedTx: `{"type":"0x2","value":"0","nonce":5,"gasLimit":500000,"maxFeePerGas":"30000000000","maxPriorityFeePerGas":"1000000000","data":"0x6080"}`,
+			txType:        types.DynamicFeeTxType,
+			check: func(tx *types.Transaction) error {
+				if tx.To() != nil {
+					return fmt.Errorf("expected no recipient, got %s", tx.To())
+				}
+				return nil
+			},
+		},
+		{
+			description:   "blob (EIP-4844) with versioned hashes",
+			jsonEncodedTx: `{"type":3,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"0","nonce":5,"gasLimit":21000,"maxFeePerGas":"30000000000","maxPriorityFeePerGas":"1000000000","maxFeePerBlobGas":"1000","blobVersionedHashes":["` + blobHash + `"]}`,
+			txType:        types.BlobTxType,
+			check: func(tx *types.Transaction) error {
+				if len(tx.BlobHashes()) != 1 || tx.BlobHashes()[0].Hex() != blobHash || tx.BlobGasFeeCap().String() != "1000" {
+					return fmt.Errorf("blob fields not kept")
+				}
+				return nil
+			},
+		},
+		{
+			description:   "blob (EIP-4844) with blobs",
+			jsonEncodedTx: `{"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"0","nonce":5,"gasLimit":21000,"maxFeePerGas":"30000000000","maxPriorityFeePerGas":"1000000000","maxFeePerBlobGas":"1000","blobs":["` + blob + `"]}`,
+			txType:        types.BlobTxType,
+			check: func(tx *types.Transaction) error {
+				sidecar := tx.BlobTxSidecar()
+				if sidecar == nil || len(sidecar.Commitments) != 1 || len(sidecar.Proofs) != 1 || len(tx.BlobHashes()) != 1 || sidecar.BlobHashes()[0] != tx.BlobHashes()[0] {
+					return fmt.Errorf("sidecar not included in raw transaction")
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		_tx, err := NewEthereumTxWithJson(test.jsonEncodedTx, 1)
+		if err != nil {
+			t.Errorf("Failed test %s: could not create Ethereum TX with json: %s", test.description, err)
+			continue
+		}
+
+		err = _tx.Validate()
+		if err != nil {
+			t.Errorf("Failed test %s: expected valid tx, got %s", test.description, err)
+		}
+
+		signature, err := crypto.Sign(_tx.GenerateMessage(), key)
+		if err != nil {
+			t.Fatalf("could not sign: %s", err)
+		}
+
+		hexEncodedRawSignedTx, err := _tx.Sign(signature)
+		if err != nil {
+			t.Errorf("Failed test %s: could not sign tx: %s", test.description, err)
+			continue
+		}
+
+		rawSignedTx, err := hex.DecodeString(hexEncodedRawSignedTx)
+		if err != nil {
+			t.Fatalf("could not decode raw tx: %s", err)
+		}
+
+		// decoded as eth_sendRawTransaction would
+		recoveredTx, err := NewEthereumTxWithRlp(rawSignedTx)
+		if err != nil {
+			t.Errorf("Failed test %s: could not decode raw tx: %s", test.description, err)
+			continue
+		}
+
+		if recoveredTx.Tx().Type() != test.txType {
+			t.Errorf("Failed test %s: expected type %d, got %d", test.description, test.txType, recoveredTx.Tx().Type())
+		}
+
+		if recoveredTx.Tx().Hash() != _tx.Tx().Hash() {
+			t.Errorf("Failed test %s: recovered tx does not correspond", test.description)
+		}
+
+		sender, err := types.Sender(types.LatestSignerForChainID(big.NewInt(1)), recoveredTx.Tx())
+		if err != nil || sender != address {
+			t.Errorf("Failed test %s: expected sender %s, got %s (%v)", test.description, address, sender, err)
+		}
+
+		if test.check != nil {
+			if err := test.check(recoveredTx.Tx()); err != nil {
+				t.Errorf("Failed test %s: %s", test.description, err)
+			}
+		}
+	}
+}
+
+func TestTransactionErrors(t *testing.T) {
+	type Test struct {
+		jsonEncodedTx string
+		chainId       any
+		err           error
+	}
+
+	tests := []Test{
+		// chain id of the transaction not matching
+		{jsonEncodedTx: `{"chainId":"0x2105","to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"maxFeePerGas":34,"maxPriorityFeePerGas":2}`, chainId: 1, err: ErrInvalidChainId},
+		// set code transactions (EIP-7702) not supported yet
+		{jsonEncodedTx: `{"type":4,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"maxFeePerGas":34,"maxPriorityFeePerGas":2,"authorizationList":[]}`, chainId: 1, err: ErrUnsupportedTxType},
+		{jsonEncodedTx: `{"type":"0x7e","to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":1,"nonce":5,"gasLimit":21000,"gasPrice":34}`, chainId: 1, err: ErrUnsupportedTxType},
+		// blob transactions cannot create contracts, and need blobs
+		{jsonEncodedTx: `{"type":3,"value":0,"nonce":5,"gasLimit":21000,"maxFeePerGas":34,"maxPriorityFeePerGas":2,"maxFeePerBlobGas":1,"blobVersionedHashes":["0x01ababababababababababababababababababababababababababababababab"]}`, chainId: 1, err: ErrInvalidAddress},
+		{jsonEncodedTx: `{"type":3,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":0,"nonce":5,"gasLimit":21000,"maxFeePerGas":34,"maxPriorityFeePerGas":2,"maxFeePerBlobGas":1}`, chainId: 1, err: ErrInvalidBlobs},
+		{jsonEncodedTx: `{"type":3,"to":"0x809ccc37d2dd55a8e8fa58fc51d101c6b22425a8","value":"-1","nonce":5,"gasLimit":21000,"maxFeePerGas":34,"maxPriorityFeePerGas":2,"maxFeePerBlobGas":1,"blobVersionedHashes":["0x01ababababababababababababababababababababababababababababababab"]}`, chainId: 1, err: ErrInvalidValue},
+	}
+
+	for i, test := range tests {
+		_, err := NewEthereumTxWithJson(test.jsonEncodedTx, test.chainId)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Failed test %d: expected %v, got %v\n", i, test.err, err)
+		}
+	}
+}
@@ -18,6 +18,12 @@ func (err *ErrUnauthorized) Error() string {
 	return "unauthorized"
 }
 
+type ErrForbidden struct{}
+
+func (err *ErrForbidden) Error() string {
+	return "forbidden"
+}
+
 type ErrBadRequest struct{}
 
 func (err *ErrBadRequest) Error() string {
@@ -48,6 +54,117 @@ func (err *ErrTimeOut) Error() string {
 	return "timed out"
 }
 
+type ErrTooManyRequests struct{}
+
+func (err *ErrTooManyRequests) Error() string {
+	return "too many requests"
+}
+
+// ErrPolicyRejected is returned when the server refuses to co-sign because of its policy, Reason explains which rule
+type ErrPolicyRejected struct {
+	Reason string
+}
+
+func (err *ErrPolicyRejected) Error() string {
+	if len(err.Reason) == 0 {
+		return "rejected by policy"
+	}
+	return "rejected by policy: " + err.Reason
+}
+
+// Is matches any ErrPolicyRejected, whatever the reason
+func (err *ErrPolicyRejected) Is(target error) bool {
+	_, ok := target.(*ErrPolicyRejected)
+	return ok
+}
+
+// ErrApprovalPending is returned when the signature needs an approval which has not been given yet: signing again once approved succeeds
+type ErrApprovalPending struct{}
+
+func (err *ErrApprovalPending) Error() string {
+	return "approval pending"
+}
+
+// ErrDevicesMissing is returned when a process requiring every device of the wallet (refresh) cannot run without some of them: lost devices need to be revoked first
+type ErrDevicesMissing struct{}
+
+func (err *ErrDevicesMissing) Error() string {
+	return "devices missing, revoke the lost devices first"
+}
+
+// ErrUnsupportedScheme is returned when the process is not available for the signature scheme of the wallet (adding devices and refresh require an ECDSA wallet)
+type ErrUnsupportedScheme struct{}
+
+func (err *ErrUnsupportedScheme) Error() string {
+	return "not supported for the scheme of the wallet"
+}
+
+// ErrRefreshRequired is returned when the wallet does not have the public shares of its devices (wallets created before they were kept): a refresh of the wallet gives them
+type ErrRefreshRequired struct{}
+
+func (err *ErrRefreshRequired) Error() string {
+	return "public shares of the devices unknown, refresh the wallet first"
+}
+
+// ErrorResponse is the body of the error responses of the server
+type ErrorResponse struct {
+	Code      string `json:"code"`      // stable, see ErrorCode
+	Message   string `json:"message"`   // human readable, can change
+	RequestID string `json:"requestId"` // to find the request in the server logs
+}
+
+// errorCodes are the stable codes of the errors, shared by server and client
+var errorCodes = []struct {
+	code   string
+	status int
+	err    error
+}{
+	{"bad_request", 400, &ErrBadRequest{}},
+	{"unsupported_scheme", 400, &ErrUnsupportedScheme{}},
+	{"unauthorized", 401, &ErrUnauthorized{}},
+	{"forbidden", 403, &ErrForbidden{}},
+	{"policy_rejected", 403, &ErrPolicyRejected{}},
+	{"approval_pending", 403, &ErrApprovalPending{}},
+	{"not_found", 404, &ErrNotFound{}},
+	{"conflict", 409, &ErrConflict{}},
+	{"devices_missing", 409, &ErrDevicesMissing{}},
+	{"refresh_required", 409, &ErrRefreshRequired{}},
+	{"timed_out", 408, &ErrTimeOut{}},
+	{"too_many_requests", 429, &ErrTooManyRequests{}},
+	{"server_error", 500, &ErrServerError{}},
+	{"tss_process_failed", 500, &ErrTssProcessFailed{}},
+}
+
+// ErrorCode returns the code of the error, "server_error" for errors which are not defined here
+func ErrorCode(err error) string {
+	for _, errorCode := range errorCodes {
+		if errors.Is(err, errorCode.err) {
+			return errorCode.code
+		}
+	}
+	return "server_error"
+}
+
+// ErrorFromCode returns the error of the code, nil if the code is unknown
+func ErrorFromCode(code string) error {
+	for _, errorCode := range errorCodes {
+		if errorCode.code == code {
+			return errorCode.err
+		}
+	}
+	return nil
+}
+
+// ErrorFromStatus returns the error matching the http status (ErrServerError for 500), nil if there is none
+func ErrorFromStatus(status int) error {
+	for _, errorCode := range errorCodes {
+		if errorCode.status == status {
+			return errorCode.err
+		}
+	}
+	return nil
+}
+
 // ProcessShouldError compares the result of a test with what it should have been, and reacts accordingly (fail or succeed test)
 func ProcessShouldError(testDescription string, err error, requiredErr error, resultObject any, t *testing.T) {
 	if err != nil {
@@ -25,8 +25,10 @@ var (
 	PubkeyAckMessage              = MessageType{MsgType: "pubkey-ack", MsgStage: 30}   // new device to server (=> start TSS msg management on server registerHandler)
 	MetadataMessage               = MessageType{MsgType: "metadata", MsgStage: 20}     // old device to server (before TSS) ; server to new device (after TSS)
 	MetadataAckMessage            = MessageType{MsgType: "metadata-ack", MsgStage: 30} // server to old device (=> start TSS)
+	PeersMessage                  = MessageType{MsgType: "peers", MsgStage: 30}        // server to devices taking part in dkg or signing (=> start TSS with the given peers)
 	TssMessage                    = MessageType{MsgType: "tss", MsgStage: 40}
 	TssDoneMessage                = MessageType{MsgType: "tss-done", MsgStage: 50}
+	RefreshAckMessage             = MessageType{MsgType: "refresh-ack", MsgStage: 60} // device to server, once it has its refreshed share (=> server stores its own when all devices acked)
 	EverythingStoredClientMessage = MessageType{MsgType: "stored-client", MsgStage: 70}
 	ExistingDeviceDoneMessage     = MessageType{MsgType: "existing-device-done", MsgStage: 80}
 	NewDeviceDoneMessage          = MessageType{MsgType: "new-device-done", MsgStage: 80}
@@ -38,8 +40,57 @@ type Message struct {
 	Msg  string      `json:"payload"`
 }
 
+// Peers is the payload of PeersMessage (json, hex encoded): the threshold and scheme of the wallet and all the client peers taking part in the TSS process
+type Peers struct {
+	Threshold uint32     `json:"threshold"`
+	Scheme    tss.Scheme `json:"scheme"`
+	PeerIDs   []string   `json:"peerIDs"`
+}
+
+// EncodePeers formats a Peers payload for communication
+func EncodePeers(peers Peers) (string, error) {
+	jsonEncodedPeers, err := json.Marshal(peers)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(jsonEncodedPeers), nil
+}
+
+// DecodePeers parses the payload of a PeersMessage
+func DecodePeers(payload string) (*Peers, error) {
+	byteString, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers Peers
+	err = json.Unmarshal(byteString, &peers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peers, nil
+}
+
+// DecodeTssMessage parses the payload of a TssMessage
+func DecodeTssMessage(payload string) (*tss.Message, error) {
+	byteString, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tssMsg := &tss.Message{}
+	err = json.Unmarshal(byteString, tssMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return tssMsg, nil
+}
+
 // TssSend loops through TSS messages to be sent through the websocket connection
-// Note : this is the v2 of tss.Send() used for AddDevice and Dkg (for now, Sign still uses tss.Send())
+// Used for Dkg, Sign and AddDevice: every message contains the target peerID, which allows the server to relay messages between clients
 func TssSend(getNextMessageToSend func() (tss.Message, error), serverDone chan struct{}, errs chan error, ctx context.Context, c *websocket.Conn, functionName string) {
 	for {
 		select {